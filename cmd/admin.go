@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// staff-only operational endpoints, used by the admin command (see admincli.go)
+
+// work directories untouched for this long are considered stale
+const adminDefaultPurgeHours = 24
+
+const adminDefaultJobLimit = 50
+
+type purgeInfo struct {
+	Dir    string `json:"dir"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+/**
+ * List jobs, newest first, optionally filtered by state
+ */
+func adminJobsHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(adminDefaultJobLimit)))
+	if err != nil || limit <= 0 {
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid limit: [%s]", ctx.Query("limit")))
+		return
+	}
+
+	jobs, err := c.jobList(ctx.Query("state"), limit)
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	c.respondJSON(http.StatusOK, jobs)
+}
+
+/**
+ * Cancel a queued or running job
+ */
+func adminCancelHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	job, err := c.jobGet(ctx.Param("reqid"))
+	if err != nil {
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	if ok, err := c.jobCancel(job.ReqID); err != nil || ok == false {
+		c.respondString(http.StatusConflict, fmt.Sprintf("ERROR: Job is not queued or running: [%s]", job.State))
+		return
+	}
+
+	// a running job may already have a workflow underway
+	if job.State == jobStateRunning {
+		if job.WorkflowID != "" && sess != nil {
+			c.awsTerminateWorkflow(job.WorkflowID, "canceled by staff")
+		}
+
+		os.RemoveAll(getWorkDir(job.Pid))
+	}
+
+	c.jobLockRelease(job.ReqID)
+
+	c.audit(auditEntry{Action: auditJobCanceled, Pid: job.Pid, ReqID: job.ReqID, Details: fmt.Sprintf("%s job canceled", job.State)})
+
+	c.jobNotifyCallbacks(job, "fail", "OCR request canceled", nil)
+
+	publishProgress(job.Pid, job.ReqID, eventJobCanceled, progressEvent{Details: "canceled by staff"})
+
+	c.info("[ADMIN] canceled %s job: [%s] (pid: [%s])", job.State, job.ReqID, job.Pid)
+
+	c.respondString(http.StatusOK, "OK")
+}
+
+/**
+ * Queue a new job repeating a finished one; with pages=failed, only pages without results are included
+ */
+func adminRetryHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+	c.respondRetry(ctx.Query("pages") == "failed")
+}
+
+func (c *clientContext) jobNotifyCallbacks(job *jobInfo, status, message string, failed []string) {
+	finished := job.Finished
+	if finished == "" {
+		finished = fmt.Sprintf("%d", time.Now().Unix())
+	}
+
+	callbacks, _ := c.jobGetCallbacks(job.ReqID)
+	for _, cb := range callbacks {
+		if c.tsJobStatusCallback(cb, status, message, tsTimestamp(job.Started), tsTimestamp(finished), failed) == nil {
+			c.audit(auditEntry{Action: auditCallbackDelivered, Pid: job.Pid, ReqID: job.ReqID, Target: cb, Details: status})
+		}
+	}
+}
+
+// sends the failure email and callbacks for a job
+func (c *clientContext) jobNotifyFailure(job *jobInfo, url string, emails []string, message string) {
+	subject, body := ocrFailureEmail(url)
+	for _, e := range emails {
+		if c.emailResults(e, subject, body, "") == nil {
+			c.audit(auditEntry{Action: auditEmailSent, Pid: job.Pid, ReqID: job.ReqID, Target: e, Details: subject})
+		}
+	}
+
+	c.jobNotifyCallbacks(job, "fail", message, nil)
+}
+
+// the pages of a completed job's document.  a retry only ocr's the pages its original job was missing,
+// so its document is assembled from the whole chain of jobs, in the original request's page order
+func (c *clientContext) jobDocumentPages(job *jobInfo) ([]ocrPidInfo, error) {
+	oc, err := newJobContext(c.jobGetRetryOrigin(job))
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := c.jobGetPages(job.ReqID)
+	if err != nil {
+		return nil, err
+	}
+
+	pages = append(pages, c.jobGetRetriedPages(job.ReqID, pages)...)
+
+	results := make(map[string]ocrPidInfo)
+	for _, p := range pages {
+		results[p.pid] = p
+	}
+
+	var doc []ocrPidInfo
+	for _, p := range oc.ocr.ts.Pages {
+		r, ok := results[p.Pid]
+		if ok == false {
+			r = ocrPidInfo{pid: p.Pid, failed: true}
+		}
+		doc = append(doc, r)
+	}
+
+	return doc, nil
+}
+
+/**
+ * Resend the completion (or failure) email and callbacks for a finished job
+ */
+func adminNotifyHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	job, err := c.jobGet(ctx.Param("reqid"))
+	if err != nil {
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	jc, err := newJobContext(job)
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	url := virgoURL(job.Pid, jc.ocr.ts.Pid.CatalogKey)
+	emails, _ := c.jobGetEmails(job.ReqID)
+
+	switch job.State {
+	case jobStateComplete:
+		doc, err := c.jobDocumentPages(job)
+		if err != nil {
+			c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+			return
+		}
+
+		tmpDir, err := os.MkdirTemp(config.storageDir.value, "notify-")
+		if err != nil {
+			c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+			return
+		}
+
+		defer os.RemoveAll(tmpDir)
+
+		ocrFile := filepath.Join(tmpDir, ocrFileName(job.Pid, jc.ocr.ts.Pid.CallNumber))
+		if err := c.writeFileWithContents(ocrFile, ocrFormatDocument(doc)); err != nil {
+			c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+			return
+		}
+
+		failed := ocrFailedPages(doc)
+
+		message := "OCR completed successfully"
+		if len(failed) > 0 {
+			message = fmt.Sprintf("OCR completed with %d page(s) unavailable", len(failed))
+		}
+
+		subject, body := ocrSuccessEmail(url, failed)
+		for _, e := range emails {
+			if c.emailResults(e, subject, body, ocrFile) == nil {
+				c.audit(auditEntry{Action: auditEmailSent, Pid: job.Pid, ReqID: job.ReqID, Target: e, Details: subject})
+			}
+		}
+
+		c.jobNotifyCallbacks(job, "success", message, failed)
+
+	case jobStateFailed:
+		c.jobNotifyFailure(job, url, emails, "OCR generation failed")
+
+	default:
+		c.respondString(http.StatusConflict, fmt.Sprintf("ERROR: Job is not finished: [%s]", job.State))
+		return
+	}
+
+	c.info("[ADMIN] resent notifications for job: [%s] (%d email(s))", job.ReqID, len(emails))
+
+	c.respondString(http.StatusOK, "OK")
+}
+
+/**
+ * Remove per-pid work directories that no active job is using
+ */
+func adminPurgeHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	hours, err := strconv.Atoi(ctx.DefaultQuery("older_than", strconv.Itoa(adminDefaultPurgeHours)))
+	if err != nil || hours < 0 {
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid age: [%s]", ctx.Query("older_than")))
+		return
+	}
+
+	dryrun := isDryRun(ctx.Query("dryrun"))
+
+	purged, err := c.purgeWorkDirs(time.Now().Add(-time.Duration(hours)*time.Hour), dryrun)
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	c.info("[ADMIN] purge: %d stale work dir(s) older than %d hours (dry run: %v)", len(purged), hours, dryrun)
+
+	status := make(map[string]interface{})
+
+	status["dryrun"] = dryrun
+	status["purged"] = purged
+
+	c.respondJSON(http.StatusOK, status)
+}
+
+// removes work directories not modified since the cutoff that no active job is using
+func (c *clientContext) purgeWorkDirs(cutoff time.Time, dryrun bool) ([]purgeInfo, error) {
+	entries, err := os.ReadDir(config.storageDir.value)
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []purgeInfo
+
+	for _, entry := range entries {
+		if entry.IsDir() == false {
+			continue
+		}
+
+		pid := entry.Name()
+		dir := getWorkDir(pid)
+
+		// export packages have their own retention; see exportPurge
+		if pid == exportSubDir {
+			continue
+		}
+
+		if active, _ := c.jobGetActiveForPid(pid); active != nil {
+			continue
+		}
+
+		// requests answered from existing text hold the pid's lock without a job
+		if _, held := c.jobLockHolder(pid); held == true {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		reason := fmt.Sprintf("not modified since %s", info.ModTime().Format(time.RFC3339))
+		if req, err := c.reqGetRequestInfo(dir, ""); err == nil && req.Finished != "" {
+			reason = fmt.Sprintf("finished %s", tsTimestamp(req.Finished))
+		}
+
+		p := purgeInfo{Dir: dir, Reason: reason}
+
+		if dryrun == false {
+			if err := os.RemoveAll(dir); err != nil {
+				p.Error = err.Error()
+			}
+		}
+
+		purged = append(purged, p)
+	}
+
+	return purged, nil
+}
+
+/**
+ * Show the effective configuration, with secrets masked
+ */
+func adminConfigHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+	c.respondJSON(http.StatusOK, configSummary())
+}
+
+/**
+ * Check whether a pid can be ocr'd, using the same checks as a normal request
+ */
+func adminEligibilityHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	ts, tsErr := c.tsGetMetadataPidInfo()
+	if tsErr != nil {
+		status := make(map[string]interface{})
+
+		status["pid"] = c.req.pid
+		status["eligible"] = false
+		status["reason"] = tsErr.Error()
+
+		c.respondJSON(http.StatusOK, status)
+		return
+	}
+
+	reason := "eligible for OCR"
+
+	switch {
+	case ts.Pid.HasOcr == true:
+		reason = "OCR/transcription already exists; requests are answered with existing text unless forced"
+	case ts.isOcrable == false:
+		reason = fmt.Sprintf("not in a format conducive to OCR (ocr hint: [%s]  text source: [%s])", ts.Pid.OcrHint, ts.Pid.TextSource)
+	}
+
+	status := make(map[string]interface{})
+
+	status["pid"] = c.req.pid
+	status["eligible"] = ts.isOcrable
+	status["reason"] = reason
+	status["type"] = ts.Pid.Type
+	status["ocr_hint"] = ts.Pid.OcrHint
+	status["ocr_candidate"] = ts.Pid.OcrCandidate
+	status["ocr_language_hint"] = ts.Pid.OcrLanguageHint
+	status["text_source"] = ts.Pid.TextSource
+	status["has_ocr"] = ts.Pid.HasOcr
+	status["has_transcription"] = ts.Pid.HasTranscription
+	status["pages"] = len(ts.Pages)
+
+	c.respondJSON(http.StatusOK, status)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func adminRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.POST("/admin/jobs/:reqid/cancel", adminCancelHandler)
+	router.POST("/admin/jobs/:reqid/notify", adminNotifyHandler)
+
+	return router
+}
+
+func TestNotifyAfterRetry(t *testing.T) {
+	c := useJobStore(t)
+
+	var status struct {
+		Status      string   `json:"status"`
+		Message     string   `json:"message"`
+		FailedPages []string `json:"failed_pages"`
+	}
+
+	cb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&status)
+	}))
+	defer cb.Close()
+
+	savedClient := client
+	t.Cleanup(func() { client = savedClient })
+
+	client = cb.Client()
+
+	pages := []tsGenericPidInfo{{Pid: "uva:2"}, {Pid: "uva:3"}, {Pid: "uva:4"}}
+
+	// the original job gave up on its last page, which a retry then ocr'd
+	c.jobCreate(&jobInfo{ReqID: "orig", Pid: "uva:1", Priority: jobPriorityPatron}, &tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}, Pages: pages})
+	c.jobSavePages("orig", []ocrPidInfo{{pid: "uva:2", attempts: 1, text: "page two"}, {pid: "uva:3", attempts: 1, text: "page three"}, {pid: "uva:4", attempts: 3, failed: true}})
+	finishTestJob(c, "orig", jobStateFailed)
+
+	c.jobCreate(&jobInfo{ReqID: "retry", Pid: "uva:1", Priority: jobPriorityPatron, RetryOf: "orig"}, &tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}, Pages: pages[2:]})
+	c.jobSavePages("retry", []ocrPidInfo{{pid: "uva:4", attempts: 1, text: "page four"}})
+	finishTestJob(c, "retry", jobStateComplete)
+
+	c.jobAddCallback("retry", cb.URL)
+
+	job, _ := c.jobGet("retry")
+
+	doc, err := c.jobDocumentPages(job)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	var texts []string
+	for _, p := range doc {
+		texts = append(texts, p.text)
+	}
+
+	if got := strings.Join(texts, "|"); got != "page two|page three|page four" || len(ocrFailedPages(doc)) != 0 {
+		t.Errorf("expected every page of the original request, got [%s] (failed: %v)", got, ocrFailedPages(doc))
+	}
+
+	res := httptest.NewRecorder()
+	adminRouter().ServeHTTP(res, httptest.NewRequest("POST", "/admin/jobs/retry/notify", nil))
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+
+	if status.Status != "success" || status.Message != "OCR completed successfully" || len(status.FailedPages) != 0 {
+		t.Errorf("expected a complete document to be reported, got %+v", status)
+	}
+}
+
+func TestAdminCancel(t *testing.T) {
+	c := useJobStore(t)
+
+	var callbacks []string
+
+	cb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var status struct {
+			Status string `json:"status"`
+		}
+		json.NewDecoder(r.Body).Decode(&status)
+		callbacks = append(callbacks, status.Status)
+	}))
+	defer cb.Close()
+
+	savedClient := client
+	t.Cleanup(func() { client = savedClient })
+
+	client = cb.Client()
+
+	tests := []struct {
+		name     string
+		state    string
+		code     int
+		canceled bool
+	}{
+		{"queued job", jobStateQueued, http.StatusOK, true},
+		{"running job", jobStateRunning, http.StatusOK, true},
+		{"finished job", jobStateComplete, http.StatusConflict, false},
+		{"canceled job", jobStateCanceled, http.StatusConflict, false},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			callbacks = nil
+
+			reqid := fmt.Sprintf("r%d", i+1)
+			pid := fmt.Sprintf("uva:%d", i+1)
+
+			c.jobCreate(&jobInfo{ReqID: reqid, Pid: pid, Priority: jobPriorityPatron}, &tsPidInfo{Pid: tsGenericPidInfo{Pid: pid}, Pages: []tsGenericPidInfo{{Pid: pid + "0"}}})
+			c.jobAddCallback(reqid, cb.URL)
+			c.jobLockAcquire(pid, reqid)
+			jobDB.Exec("update jobs set state = ? where req_id = ?;", tc.state, reqid)
+
+			os.MkdirAll(getWorkDir(pid), 0755)
+
+			res := httptest.NewRecorder()
+			adminRouter().ServeHTTP(res, httptest.NewRequest("POST", "/admin/jobs/"+reqid+"/cancel", nil))
+
+			if res.Code != tc.code {
+				t.Fatalf("expected %d, got %d: %s", tc.code, res.Code, res.Body.String())
+			}
+
+			job, _ := c.jobGet(reqid)
+
+			if tc.canceled == false {
+				if job.State != tc.state || len(callbacks) != 0 {
+					t.Errorf("expected the job to be left %s, got %s (callbacks: %v)", tc.state, job.State, callbacks)
+				}
+				return
+			}
+
+			if job.State != jobStateCanceled || job.Finished == "" {
+				t.Errorf("expected a finished, canceled job, got %s (finished: [%s])", job.State, job.Finished)
+			}
+
+			if holder, _ := c.jobLockHolder(pid); holder != "" {
+				t.Errorf("expected the lock to be released, held by [%s]", holder)
+			}
+
+			if strings.Join(callbacks, ",") != "fail" {
+				t.Errorf("expected a single fail callback, got %v", callbacks)
+			}
+
+			// only a running job has work underway to clean up
+			if _, err := os.Stat(getWorkDir(pid)); (err == nil) != (tc.state == jobStateQueued) {
+				t.Errorf("expected the work directory to be removed only for running jobs (stat: %v)", err)
+			}
+
+			entries, _ := c.auditQuery(auditFilter{reqid: reqid, action: auditJobCanceled, limit: 10})
+			if len(entries) != 1 || entries[0].Details != tc.state+" job canceled" {
+				t.Errorf("expected a cancellation audit entry, got %+v", entries)
+			}
+		})
+	}
+
+	res := httptest.NewRecorder()
+	adminRouter().ServeHTTP(res, httptest.NewRequest("POST", "/admin/jobs/unknown/cancel", nil))
+
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown job, got %d", http.StatusNotFound, res.Code)
+	}
+}
+
+func TestAdminCancelThenFinish(t *testing.T) {
+	c := useJobStore(t)
+
+	c.jobCreate(&jobInfo{ReqID: "r1", Pid: "uva:1", Priority: jobPriorityPatron}, &tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}, Pages: []tsGenericPidInfo{{Pid: "uva:2"}}})
+	c.jobClaimNext()
+
+	if job, _ := c.jobGet("r1"); job.State != jobStateRunning {
+		t.Fatalf("expected a running job, got %s", job.State)
+	}
+
+	res := httptest.NewRecorder()
+	adminRouter().ServeHTTP(res, httptest.NewRequest("POST", "/admin/jobs/r1/cancel", nil))
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+
+	canceled, _ := c.jobGet("r1")
+
+	// the job's workflow completing after the cancel must not revive it
+	for _, state := range []string{jobStateComplete, jobStateFailed} {
+		if ok, err := c.jobFinish("r1", state); ok == true || err != nil {
+			t.Errorf("expected finishing as %s to be refused, got %v (%v)", state, ok, err)
+		}
+	}
+
+	job, _ := c.jobGet("r1")
+	if job.State != jobStateCanceled || job.Finished != canceled.Finished {
+		t.Errorf("expected the job to stay canceled, got %s (finished: [%s], was [%s])", job.State, job.Finished, canceled.Finished)
+	}
+
+	if c.jobIsStopped("r1") == false {
+		t.Errorf("expected the job to be stopped")
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// command-line client for the staff endpoints of a running service:
+//
+//	ocr-ws admin [-url URL] [-key KEY] <command> [options] [args]
+
+const adminDefaultURL = "http://localhost:8080"
+
+type adminClient struct {
+	baseURL string
+	key     string
+	user    string
+	http    *http.Client
+}
+
+type adminCommand struct {
+	usage string
+	run   func(a *adminClient, usage string, args []string) error
+}
+
+var adminCommands = map[string]adminCommand{
+	"jobs":        {"jobs [-state STATE] [-limit N]          list jobs, newest first", adminListJobs},
+	"inspect":     {"inspect REQID                          show job details and quality report", adminInspectJob},
+	"cancel":      {"cancel REQID                           cancel a queued or running job", adminCancelJob},
+	"retry":       {"retry [-failed-pages] [-scale N] REQID  queue a failed job again, optionally only its failed pages", adminRetryJob},
+	"notify":      {"notify REQID                           resend email and callback notifications", adminNotifyJob},
+	"purge":       {"purge [-older-than HOURS] [-dry-run]   remove stale work directories under the storage dir", adminPurge},
+	"config":      {"config                                 show the effective service configuration", adminShowConfig},
+	"eligibility": {"eligibility PID                        check whether a pid can be OCR'd", adminEligibility},
+	"audit":       {"audit [-pid PID] [-reqid REQID] [-csv]  show audit log entries, newest first (more filters: audit -h)", adminAudit},
+	"erase":       {"erase EMAIL                            erase an email address from jobs, requests, and the audit log", adminErase},
+	"export":      {"export [-pids PIDS] [-catalog-key KEY]  export OCR text as a BagIt bag or zip (see export -h)", adminExport},
+	"exports":     {"exports [-o FILE] ID                   show an export's progress, or download its package", adminExportStatus},
+	"search":      {"search [-catalog-key KEY] QUERY         search the text of OCR'd pages (more filters: search -h)", adminSearch},
+}
+
+var adminCommandOrder = []string{"jobs", "inspect", "cancel", "retry", "notify", "purge", "config", "eligibility", "audit", "erase", "export", "exports", "search"}
+
+func adminUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "usage: %s admin [options] <command> [command options] [args]\n\noptions:\n", os.Args[0])
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\ncommands:\n")
+		for _, name := range adminCommandOrder {
+			fmt.Fprintf(os.Stderr, "  %s\n", adminCommands[name].usage)
+		}
+	}
+}
+
+// entry point for "ocr-ws admin ..."; returns the process exit code
+func adminMain(args []string) int {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+
+	baseURL := os.Getenv("OCRWS_ADMIN_URL")
+	if baseURL == "" {
+		baseURL = adminDefaultURL
+	}
+
+	a := adminClient{http: &http.Client{Timeout: 5 * time.Minute}}
+
+	fs.StringVar(&a.baseURL, "url", baseURL, "service base url (or OCRWS_ADMIN_URL)")
+	fs.StringVar(&a.key, "key", os.Getenv("OCRWS_STAFF_API_KEY"), "staff api key (or OCRWS_STAFF_API_KEY)")
+	fs.StringVar(&a.user, "user", os.Getenv("USER"), "staff user recorded in the audit log")
+	fs.Usage = adminUsage(fs)
+
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cmd, ok := adminCommands[fs.Arg(0)]
+	if ok == false {
+		fmt.Fprintf(os.Stderr, "unknown command: [%s]\n\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+
+	if err := cmd.run(&a, cmd.usage, fs.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// parses command options, and requires exactly the given number of positional arguments
+func adminParseArgs(fs *flag.FlagSet, args []string, nargs int, usage string) ([]string, error) {
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s\n", usage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() != nargs {
+		fs.Usage()
+		return nil, fmt.Errorf("expected %d argument(s), got %d", nargs, fs.NArg())
+	}
+
+	return fs.Args(), nil
+}
+
+// form values, if any, are sent as the request body
+func (a *adminClient) request(method, path string, params, form url.Values) (*http.Response, error) {
+	u := strings.TrimSuffix(a.baseURL, "/") + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if form != nil {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	if a.key != "" {
+		req.Header.Add("Authorization", "Bearer "+a.key)
+	}
+
+	if a.user != "" {
+		req.Header.Add("X-Staff-User", a.user)
+	}
+
+	return a.http.Do(req)
+}
+
+// calls the service and prints the response, pretty-printing json
+func (a *adminClient) call(method, path string, params url.Values) error {
+	return a.send(method, path, params, nil)
+}
+
+// like call, sending form values in the request body; for values that must not appear in urls
+func (a *adminClient) send(method, path string, params, form url.Values) error {
+	res, err := a.request(method, path, params, form)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(adminFormatJSON(buf))
+
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s %s: %s", method, path, res.Status)
+	}
+
+	return nil
+}
+
+// calls the service and saves the response body to a file
+func (a *adminClient) download(path, file string) error {
+	res, err := a.request("GET", path, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		buf, _ := io.ReadAll(res.Body)
+		fmt.Println(string(buf))
+		return fmt.Errorf("GET %s: %s", path, res.Status)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(f, res.Body)
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("saved %d bytes to %s\n", n, file)
+
+	return nil
+}
+
+// pretty-prints a response body if it is json, and returns it unchanged otherwise
+func adminFormatJSON(buf []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return string(buf)
+	}
+
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return string(buf)
+	}
+
+	return string(out)
+}
+
+func adminListJobs(a *adminClient, usage string, args []string) error {
+	fs := flag.NewFlagSet("jobs", flag.ContinueOnError)
+	state := fs.String("state", "", "only jobs in this state (queued, running, complete, failed, canceled)")
+	limit := fs.Int("limit", adminDefaultJobLimit, "maximum number of jobs")
+
+	if _, err := adminParseArgs(fs, args, 0, usage); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("limit", fmt.Sprintf("%d", *limit))
+	if *state != "" {
+		params.Set("state", *state)
+	}
+
+	return a.call("GET", "/admin/jobs", params)
+}
+
+func adminInspectJob(a *adminClient, usage string, args []string) error {
+	pos, err := adminParseArgs(flag.NewFlagSet("inspect", flag.ContinueOnError), args, 1, usage)
+	if err != nil {
+		return err
+	}
+
+	return a.call("GET", "/jobs/"+url.PathEscape(pos[0]), nil)
+}
+
+func adminCancelJob(a *adminClient, usage string, args []string) error {
+	pos, err := adminParseArgs(flag.NewFlagSet("cancel", flag.ContinueOnError), args, 1, usage)
+	if err != nil {
+		return err
+	}
+
+	return a.call("POST", "/admin/jobs/"+url.PathEscape(pos[0])+"/cancel", nil)
+}
+
+func adminRetryJob(a *adminClient, usage string, args []string) error {
+	fs := flag.NewFlagSet("retry", flag.ContinueOnError)
+	failedPages := fs.Bool("failed-pages", false, "only retry pages without results")
+	scale := fs.Int("scale", 0, "initial image scale percentage (10-100)")
+	engine := fs.String("engine", "", "lambda function to use instead of the configured one")
+
+	pos, err := adminParseArgs(fs, args, 1, usage)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	if *failedPages == true {
+		params.Set("pages", "failed")
+	}
+	if *scale != 0 {
+		params.Set("scale", fmt.Sprintf("%d", *scale))
+	}
+	if *engine != "" {
+		params.Set("engine", *engine)
+	}
+
+	return a.call("POST", "/admin/jobs/"+url.PathEscape(pos[0])+"/retry", params)
+}
+
+func adminNotifyJob(a *adminClient, usage string, args []string) error {
+	pos, err := adminParseArgs(flag.NewFlagSet("notify", flag.ContinueOnError), args, 1, usage)
+	if err != nil {
+		return err
+	}
+
+	return a.call("POST", "/admin/jobs/"+url.PathEscape(pos[0])+"/notify", nil)
+}
+
+func adminPurge(a *adminClient, usage string, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	hours := fs.Int("older-than", adminDefaultPurgeHours, "only directories not modified for this many hours")
+	dryrun := fs.Bool("dry-run", false, "list what would be removed, without removing anything")
+
+	if _, err := adminParseArgs(fs, args, 0, usage); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("older_than", fmt.Sprintf("%d", *hours))
+	params.Set("dryrun", fmt.Sprintf("%t", *dryrun))
+
+	return a.call("POST", "/admin/purge", params)
+}
+
+func adminShowConfig(a *adminClient, usage string, args []string) error {
+	if _, err := adminParseArgs(flag.NewFlagSet("config", flag.ContinueOnError), args, 0, usage); err != nil {
+		return err
+	}
+
+	return a.call("GET", "/admin/config", nil)
+}
+
+func adminEligibility(a *adminClient, usage string, args []string) error {
+	pos, err := adminParseArgs(flag.NewFlagSet("eligibility", flag.ContinueOnError), args, 1, usage)
+	if err != nil {
+		return err
+	}
+
+	return a.call("GET", "/admin/eligibility/"+url.PathEscape(pos[0]), nil)
+}
+
+func adminAudit(a *adminClient, usage string, args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	pid := fs.String("pid", "", "only entries for this pid or page pid")
+	reqid := fs.String("reqid", "", "only entries for this job")
+	action := fs.String("action", "", "only entries for this action (e.g. tracksys_post, email_sent)")
+	actor := fs.String("actor", "", "only entries by this actor")
+	target := fs.String("target", "", "only entries for this email address or callback url")
+	since := fs.String("since", "", "only entries at or after this time (epoch seconds or RFC3339)")
+	until := fs.String("until", "", "only entries at or before this time (epoch seconds or RFC3339)")
+	limit := fs.Int("limit", auditDefaultLimit, "maximum number of entries")
+	csv := fs.Bool("csv", false, "output csv instead of json")
+
+	if _, err := adminParseArgs(fs, args, 0, usage); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("limit", fmt.Sprintf("%d", *limit))
+
+	for name, value := range map[string]string{"pid": *pid, "reqid": *reqid, "action": *action, "actor": *actor, "target": *target, "since": *since, "until": *until} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+
+	if *csv == true {
+		params.Set("format", "csv")
+	}
+
+	return a.call("GET", "/audit", params)
+}
+
+func adminErase(a *adminClient, usage string, args []string) error {
+	pos, err := adminParseArgs(flag.NewFlagSet("erase", flag.ContinueOnError), args, 1, usage)
+	if err != nil {
+		return err
+	}
+
+	// addresses are kept out of the url, which servers and proxies log
+	form := url.Values{}
+	form.Set("email", pos[0])
+
+	return a.send("POST", "/admin/erase", nil, form)
+}
+
+func adminExport(a *adminClient, usage string, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	pids := fs.String("pids", "", "comma-separated metadata pids to export")
+	catalogKey := fs.String("catalog-key", "", "export the items with this catalog key that have been OCR'd")
+	format := fs.String("format", exportFormatBagIt, "package format (bagit or zip)")
+
+	if _, err := adminParseArgs(fs, args, 0, usage); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("format", *format)
+	if *pids != "" {
+		params.Set("pids", *pids)
+	}
+	if *catalogKey != "" {
+		params.Set("catalog_key", *catalogKey)
+	}
+
+	return a.call("POST", "/exports", params)
+}
+
+func adminExportStatus(a *adminClient, usage string, args []string) error {
+	fs := flag.NewFlagSet("exports", flag.ContinueOnError)
+	file := fs.String("o", "", "download the completed export's package to this file")
+
+	pos, err := adminParseArgs(fs, args, 1, usage)
+	if err != nil {
+		return err
+	}
+
+	if *file != "" {
+		return a.download("/exports/"+url.PathEscape(pos[0])+"/download", *file)
+	}
+
+	return a.call("GET", "/exports/"+url.PathEscape(pos[0]), nil)
+}
+
+func adminSearch(a *adminClient, usage string, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	catalogKey := fs.String("catalog-key", "", "only items with this catalog key")
+	callNumber := fs.String("call-number", "", "only items with this call number")
+	lang := fs.String("lang", "", "only items in this language (e.g. eng)")
+	limit := fs.Int("limit", searchDefaultLimit, "maximum number of pages")
+
+	pos, err := adminParseArgs(fs, args, 1, usage)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("q", pos[0])
+	params.Set("limit", fmt.Sprintf("%d", *limit))
+
+	for name, value := range map[string]string{"catalog_key": *catalogKey, "call_number": *callNumber, "lang": *lang} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+
+	return a.call("GET", "/search", params)
+}
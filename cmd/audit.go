@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// an append-only record of who requested and changed what: ocr requests, tracksys posts, emails,
+// callbacks, cancellations, and manual corrections.  entries are only ever inserted, except that
+// patron addresses may be erased from them on request.  patron actors and targets are stored
+// encrypted, like recipients.
+
+const (
+	auditOcrRequested      = "ocr_requested"
+	auditForceOverride     = "force_override"
+	auditTracksysPost      = "tracksys_post"
+	auditEmailSent         = "email_sent"
+	auditCallbackDelivered = "callback_delivered"
+	auditJobCanceled       = "job_canceled"
+	auditPageCorrected     = "page_corrected"
+	auditPageRestored      = "page_restored"
+	auditRecipientErased   = "recipient_erased"
+	auditExportRequested   = "export_requested"
+)
+
+const (
+	auditActorSystem    = "system"
+	auditActorAnonymous = "anonymous"
+	auditDefaultLimit   = 100
+	auditMaxLimit       = 100000
+)
+
+// set on the gin context by staffAuthHandler, with the staff user named in the request, if any
+const staffUserKey = "staffUser"
+
+type auditEntry struct {
+	ID      int64  `json:"id"`
+	Time    string `json:"time"`
+	Action  string `json:"action"`
+	Actor   string `json:"actor"`
+	IP      string `json:"ip,omitempty"`
+	Pid     string `json:"pid,omitempty"`
+	ReqID   string `json:"reqid,omitempty"`
+	Page    string `json:"page,omitempty"`
+	Target  string `json:"target,omitempty"` // email address or callback url
+	Details string `json:"details,omitempty"`
+}
+
+type auditFilter struct {
+	pid    string // matches either the pid or the page
+	reqid  string
+	action string
+	actor  string
+	target string
+	since  int64
+	until  int64
+	limit  int
+}
+
+// who is behind the current request: staff (by name, if given), the requester's email or callback,
+// or the service itself for queued and background work
+func (c *clientContext) auditActor() string {
+	if c.ctx == nil {
+		return auditActorSystem
+	}
+
+	if user, ok := c.ctx.Get(staffUserKey); ok == true {
+		if name, _ := user.(string); name != "" {
+			return fmt.Sprintf("staff:%s", name)
+		}
+		return "staff"
+	}
+
+	switch {
+	case c.req.email != "":
+		return c.req.email
+	case c.req.callback != "":
+		return c.req.callback
+	}
+
+	return auditActorAnonymous
+}
+
+// whether an actor is a patron's email address or callback, rather than staff or the service
+func isPatronActor(actor string) bool {
+	switch {
+	case actor == auditActorSystem, actor == auditActorAnonymous, actor == recipientErased:
+		return false
+	case actor == "staff", strings.HasPrefix(actor, "staff:"):
+		return false
+	}
+
+	return true
+}
+
+// records an entry, filling in the actor and ip from the current request.  failures are logged,
+// but never stop the action being audited
+func (c *clientContext) audit(e auditEntry) {
+	if e.Actor == "" {
+		e.Actor = c.auditActor()
+	}
+
+	if e.IP == "" {
+		e.IP = c.ip
+	}
+
+	if isPatronActor(e.Actor) {
+		e.Actor = sealRecipient(e.Actor)
+	}
+
+	e.Target = sealRecipient(e.Target)
+
+	query := "insert into audit_log (time, action, actor, ip, pid, req_id, page, target, details) values (?, ?, ?, ?, ?, ?, ?, ?, ?);"
+	if _, err := jobDB.Exec(query, fmt.Sprintf("%d", time.Now().Unix()), e.Action, e.Actor, e.IP, e.Pid, e.ReqID, e.Page, e.Target, e.Details); err != nil {
+		c.err("[AUDIT] failed to record %s: [%s]", e.Action, err.Error())
+	}
+}
+
+// records an ocr request for a pid, with its options and what became of it.  the requester's
+// email or callback is the actor; a callback given alongside an email is the target
+func (c *clientContext) auditRequest(reqid, outcome string) {
+	target := ""
+	if c.req.email != "" {
+		target = c.req.callback
+	}
+
+	opts := []struct {
+		name  string
+		value string
+	}{
+		{"unit", c.req.unit},
+		{"priority", c.req.priority},
+		{"force", c.req.force},
+		{"lang", c.req.lang},
+		{"dryrun", c.req.dryrun},
+		{"overwrite_corrected", c.req.overwriteCorrected},
+		{"partial", c.req.partial},
+	}
+
+	var details []string
+	for _, o := range opts {
+		if o.value != "" {
+			details = append(details, fmt.Sprintf("%s=%s", o.name, o.value))
+		}
+	}
+
+	details = append(details, fmt.Sprintf("outcome=%s", outcome))
+
+	c.audit(auditEntry{Action: auditOcrRequested, Pid: c.req.pid, ReqID: reqid, Target: target, Details: strings.Join(details, " ")})
+}
+
+func (c *clientContext) auditQuery(f auditFilter) ([]auditEntry, error) {
+	query := `select id, time, action, actor, ip, pid, req_id, page, target, details from audit_log
+		where (? = '' or pid = ? or page = ?) and (? = '' or req_id = ?) and (? = '' or action = ?) and (? = '' or actor in (?, ?)) and (? = '' or target in (?, ?))
+		and (? = 0 or cast(time as integer) >= ?) and (? = 0 or cast(time as integer) <= ?)
+		order by id desc limit ?;`
+
+	// actors and targets may be stored encrypted or, from before a key was configured, plain
+	actors := recipientStoredValues(f.actor)
+	targets := recipientStoredValues(f.target)
+
+	rows, err := jobDB.Query(query, f.pid, f.pid, f.pid, f.reqid, f.reqid, f.action, f.action, f.actor, actors[0], actors[1], f.target, targets[0], targets[1], f.since, f.since, f.until, f.until, f.limit)
+	if err != nil {
+		c.err("[AUDIT] failed to retrieve audit log: [%s]", err.Error())
+		return nil, errors.New("failed to retrieve audit log")
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+
+	for rows.Next() {
+		var e auditEntry
+
+		if err := rows.Scan(&e.ID, &e.Time, &e.Action, &e.Actor, &e.IP, &e.Pid, &e.ReqID, &e.Page, &e.Target, &e.Details); err != nil {
+			c.err("[AUDIT] failed to scan audit entry: [%s]", err.Error())
+			return nil, errors.New("failed to scan audit entry")
+		}
+
+		if actor, err := openRecipient(e.Actor); err == nil {
+			e.Actor = actor
+		}
+
+		if target, err := openRecipient(e.Target); err == nil {
+			e.Target = target
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// parses a time given as epoch seconds or RFC3339
+func parseAuditTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time (expected epoch seconds or RFC3339): [%s]", s)
+	}
+
+	return t.Unix(), nil
+}
+
+func auditTimeString(epoch string) string {
+	e, err := epochToInt64(epoch)
+	if err != nil {
+		return epoch
+	}
+
+	return time.Unix(e, 0).UTC().Format(time.RFC3339)
+}
+
+/**
+ * List audit entries, newest first, optionally filtered, as json or csv
+ */
+func auditHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	f := auditFilter{
+		pid:    ctx.Query("pid"),
+		reqid:  ctx.Query("reqid"),
+		action: ctx.Query("action"),
+		actor:  ctx.Query("actor"),
+		target: ctx.Query("target"),
+	}
+
+	var err error
+
+	if f.since, err = parseAuditTime(ctx.Query("since")); err != nil {
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	if f.until, err = parseAuditTime(ctx.Query("until")); err != nil {
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	f.limit, err = strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(auditDefaultLimit)))
+	if err != nil || f.limit <= 0 || f.limit > auditMaxLimit {
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid limit (expected 1-%d): [%s]", auditMaxLimit, ctx.Query("limit")))
+		return
+	}
+
+	entries, err := c.auditQuery(f)
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	if ctx.Query("format") != "csv" {
+		c.respondJSON(http.StatusOK, entries)
+		return
+	}
+
+	c.logResponse(http.StatusOK, fmt.Sprintf("%d audit entries as csv", len(entries)))
+
+	ctx.Header("Content-Type", "text/csv; charset=utf-8")
+	ctx.Header("Content-Disposition", "attachment; filename=\"audit.csv\"")
+	ctx.Status(http.StatusOK)
+
+	w := csv.NewWriter(ctx.Writer)
+
+	w.Write([]string{"id", "time", "action", "actor", "ip", "pid", "reqid", "page", "target", "details"})
+
+	for _, e := range entries {
+		w.Write([]string{strconv.FormatInt(e.ID, 10), auditTimeString(e.Time), e.Action, e.Actor, e.IP, e.Pid, e.ReqID, e.Page, e.Target, e.Details})
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAudit(t *testing.T) {
+	useJobStore(t)
+
+	gin.SetMode(gin.TestMode)
+
+	if randomSource == nil {
+		randomSource = rand.New(rand.NewSource(1))
+	}
+
+	config.staffAPIKey.value = "secret"
+
+	router := gin.New()
+	router.GET("/audit", staffAuthHandler, auditHandler)
+
+	// a patron request, a staff correction, and a post by the service on the request's behalf
+	router.GET("/ocr/:pid", func(ctx *gin.Context) {
+		newClientContext(ctx).auditRequest("r1", "queued")
+	})
+	router.PUT("/pages/:pid/text", staffAuthHandler, func(ctx *gin.Context) {
+		c := newClientContext(ctx)
+		c.audit(auditEntry{Action: auditPageCorrected, Page: c.req.pid})
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ocr/uva:1?email=a@example.com&priority=staff", nil))
+
+	req := httptest.NewRequest("PUT", "/pages/uva:2/text", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Staff-User", "jdoe")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	newBackgroundContext().audit(auditEntry{Action: auditTracksysPost, ReqID: "r1", Page: "uva:2"})
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/audit?"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+
+		return res
+	}
+
+	// a page's history includes posts and corrections, newest first
+	res := get("pid=uva:2")
+
+	var entries []auditEntry
+	if err := json.Unmarshal(res.Body.Bytes(), &entries); err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 entries for [uva:2], got %d: %s", len(entries), res.Body.String())
+	}
+
+	if entries[0].Action != auditTracksysPost || entries[0].Actor != auditActorSystem {
+		t.Errorf("unexpected entry: %+v", entries[0])
+	}
+
+	if entries[1].Action != auditPageCorrected || entries[1].Actor != "staff:jdoe" {
+		t.Errorf("unexpected entry: %+v", entries[1])
+	}
+
+	entries = nil
+	json.Unmarshal(get("action=ocr_requested").Body.Bytes(), &entries)
+
+	if len(entries) != 1 || entries[0].Actor != "a@example.com" || entries[0].Details != "priority=staff outcome=queued" {
+		t.Errorf("unexpected request entries: %+v", entries)
+	}
+
+	// csv export
+	res = get("reqid=r1&format=csv")
+
+	if strings.HasPrefix(res.Header().Get("Content-Type"), "text/csv") == false {
+		t.Fatalf("expected csv, got [%s]", res.Header().Get("Content-Type"))
+	}
+
+	rows, err := csv.NewReader(res.Body).ReadAll()
+	if err != nil || len(rows) != 3 || rows[0][2] != "action" || rows[1][2] != auditTracksysPost || rows[2][2] != auditOcrRequested {
+		t.Errorf("unexpected csv: %v (%v)", rows, err)
+	}
+
+	if res := get("since=yesterday"); res.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an invalid time, got %d", http.StatusBadRequest, res.Code)
+	}
+}
@@ -8,11 +8,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"math"
 	"net/http"
-	"os"
-	"runtime"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -20,9 +17,9 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/swf"
-	"github.com/gammazero/workerpool"
 )
 
 // holds information we extract from a decision task
@@ -35,6 +32,10 @@ type decisionInfo struct {
 	allEvents    []*swf.HistoryEvent
 	recentEvents []*swf.HistoryEvent
 	ocrResults   []*swf.HistoryEvent
+	failedPages  []string // pages given up on, when partial success is allowed
+
+	pidToFilename map[string]string
+	concurrency   concurrencyInfo
 }
 
 // json for webservice <-> workflow communication
@@ -44,12 +45,16 @@ type ocrPageInfo struct {
 }
 
 type workflowRequest struct {
-	Pid    string        `json:"pid,omitempty"`
-	Path   string        `json:"path,omitempty"`
-	Lang   string        `json:"lang,omitempty"`
-	ReqID  string        `json:"reqid,omitempty"`
-	Bucket string        `json:"bucket,omitempty"`
-	Pages  []ocrPageInfo `json:"pages,omitempty"`
+	Pid     string        `json:"pid,omitempty"`
+	Path    string        `json:"path,omitempty"`
+	Lang    string        `json:"lang,omitempty"`
+	ReqID   string        `json:"reqid,omitempty"`
+	Bucket  string        `json:"bucket,omitempty"`
+	Sample  bool          `json:"sample,omitempty"`  // language detection sample; full ocr follows
+	Scale   string        `json:"scale,omitempty"`   // initial image scale factor, if not the default
+	Engine  string        `json:"engine,omitempty"`  // lambda function to use, if not the configured one
+	Partial bool          `json:"partial,omitempty"` // complete the workflow even if some pages fail
+	Pages   []ocrPageInfo `json:"pages,omitempty"`
 }
 
 // json for workflow <-> lambda communication
@@ -63,7 +68,9 @@ type lambdaRequest struct {
 }
 
 type lambdaResponse struct {
-	Text string `json:"text,omitempty"`
+	Text       string   `json:"text,omitempty"`
+	Confidence *float64 `json:"confidence,omitempty"` // mean word confidence (0-100), if supported by the lambda
+	Words      int      `json:"words,omitempty"`      // word count, if supported by the lambda
 }
 
 // json for failed lambda error details
@@ -93,8 +100,17 @@ type controlPayload struct {
 	LambdaCount    int                    `json:"lc,omitempty"`
 	LambdaTimedOut bool                   `json:"lt,omitempty"`
 	LambdaFailed   bool                   `json:"lf,omitempty"`
+	Failure        lambdaFailureType      `json:"f,omitempty"`
+	Lang           string                 `json:"ol,omitempty"` // language, when the final attempt overrides the job's
+	Engine         string                 `json:"oe,omitempty"` // lambda function, when the final attempt overrides the job's
 }
 
+// image scale factor for a page's first lambda attempt
+const lambdaDefaultScale = "100"
+
+// marker recorded in the workflow history for each page given up on (partial success)
+const markerPageFailed = "page-failed"
+
 // functions
 
 func awsCompleteWorkflowExecution(result string) *swf.Decision {
@@ -116,26 +132,12 @@ func awsFailWorkflowExecution(reason, details string) *swf.Decision {
 	return decision
 }
 
-func awsScheduleLambdaFunction(input, control string) *swf.Decision {
+func awsRecordMarker(name, details string) *swf.Decision {
 	decision := (&swf.Decision{}).
-		SetDecisionType("ScheduleLambdaFunction").
-		SetScheduleLambdaFunctionDecisionAttributes((&swf.ScheduleLambdaFunctionDecisionAttributes{}).
-			SetControl(control).
-			SetName(config.awsLambdaFunction.value).
-			SetStartToCloseTimeout(config.awsLambdaTimeout.value).
-			SetId(randomID()).
-			SetInput(input))
-
-	return decision
-}
-
-func awsStartTimer(duration int, control string) *swf.Decision {
-	decision := (&swf.Decision{}).
-		SetDecisionType("StartTimer").
-		SetStartTimerDecisionAttributes((&swf.StartTimerDecisionAttributes{}).
-			SetControl(control).
-			SetStartToFireTimeout(strconv.Itoa(duration)).
-			SetTimerId(randomID()))
+		SetDecisionType("RecordMarker").
+		SetRecordMarkerDecisionAttributes((&swf.RecordMarkerDecisionAttributes{}).
+			SetMarkerName(name).
+			SetDetails(details))
 
 	return decision
 }
@@ -153,6 +155,16 @@ func awsEventWithID(events []*swf.HistoryEvent, eventID int64) *swf.HistoryEvent
 	return nil
 }
 
+func awsDecisionWithType(decisions []*swf.Decision, decisionType string) *swf.Decision {
+	for _, d := range decisions {
+		if decisionType == *d.DecisionType {
+			return d
+		}
+	}
+
+	return nil
+}
+
 func awsEventWithType(events []*swf.HistoryEvent, eventType string) *swf.HistoryEvent {
 	for _, e := range events {
 		if eventType == *e.EventType {
@@ -163,13 +175,21 @@ func awsEventWithType(events []*swf.HistoryEvent, eventType string) *swf.History
 	return nil
 }
 
-func (c *clientContext) awsFinalizeSuccess(info decisionInfo) {
-	res := ocrResultsInfo{}
+func (req workflowRequest) lambdaScale() string {
+	return ocrScale(req.Scale)
+}
 
-	res.pid = info.req.Pid
-	res.reqid = info.req.ReqID
-	res.workDir = getWorkDir(info.req.Path)
-	res.overwrite = true
+// the image scale pages are first ocr'd at, given a requested one
+func ocrScale(scale string) string {
+	if scale != "" {
+		return scale
+	}
+	return lambdaDefaultScale
+}
+
+// extracts page results from the completed lambda events of a workflow
+func (c *clientContext) awsCompletedPages(info decisionInfo) []ocrPidInfo {
+	var pages []ocrPidInfo
 
 	for _, e := range info.ocrResults {
 		// lambda result is json embedded within a json string value; must unmarshal twice
@@ -200,503 +220,134 @@ func (c *clientContext) awsFinalizeSuccess(info decisionInfo) {
 			continue
 		}
 
-		res.pages = append(res.pages, ocrPidInfo{pid: lambdaReq.Pid, text: strings.TrimSpace(lambdaRes.Text)})
-	}
+		// get attempt count from the lambda's control payload
+		lambdaPayload := controlPayload{}
 
-	// sort by pid
-	sort.Slice(res.pages, func(i, j int) bool { return res.pages[i].pid < res.pages[j].pid })
+		if o.LambdaFunctionScheduledEventAttributes.Control != nil {
+			if jErr := json.Unmarshal([]byte(*o.LambdaFunctionScheduledEventAttributes.Control), &lambdaPayload); jErr != nil {
+				c.warn("[AWS] Unmarshal() failed [finalize control]: %s", jErr.Error())
+			}
+		}
 
-	go c.processOcrSuccess(res)
+		page := ocrPidInfo{
+			pid:        lambdaReq.Pid,
+			text:       strings.TrimSpace(lambdaRes.Text),
+			confidence: lambdaRes.Confidence,
+			words:      lambdaRes.Words,
+			attempts:   lambdaPayload.LambdaCount,
+			scale:      lambdaReq.Scale,
+			lang:       lambdaPayload.Lang,
+			engine:     lambdaPayload.Engine,
+			duration:   maxOfFloat(0, lambdaDuration(&info, e)),
+		}
 
-	c.awsDeleteImages(info.req.ReqID)
+		pages = append(pages, page)
+	}
+
+	return pages
 }
 
-func (c *clientContext) awsFinalizeFailure(info decisionInfo, details string) {
+func (c *clientContext) awsFinalizeSuccess(info decisionInfo) {
 	res := ocrResultsInfo{}
 
 	res.pid = info.req.Pid
 	res.reqid = info.req.ReqID
-	res.details = fmt.Sprintf("OCR generation process failed (%s)", details)
 	res.workDir = getWorkDir(info.req.Path)
+	res.overwrite = true
+	res.pages = c.awsCompletedPages(info)
 
-	go c.processOcrFailure(res)
-
-	c.awsDeleteImages(info.req.ReqID)
-}
-
-func (c *clientContext) awsHandleDecisionTask(svc *swf.SWF, info decisionInfo) {
-	workflowHalted := false
-
-	pidToFilenameMap := make(map[string]string)
-
-	// loop over all events to take inventory of the overall state so far
-	for _, e := range info.allEvents {
-		t := *e.EventType
-
-		// extract the original input string containing pids that were processed
-		if info.input == "" && t == "WorkflowExecutionStarted" {
-			info.input = c.decodeWorkflowInput(*e.WorkflowExecutionStartedEventAttributes.Input)
-			json.Unmarshal([]byte(info.input), &info.req)
-			pages := []ocrPageInfo{}
-			for _, p := range info.req.Pages {
-				if p.Pid != "" {
-					pages = append(pages, p)
-					pidToFilenameMap[p.Pid] = p.Filename
-				}
-			}
-			info.req.Pages = pages
-			//c.info("[AWS] [%s] input = [%s] (%d pids)", info.workflowID, info.input, len(info.req.Pages))
-			c.info("[AWS] [%s] reqid: [%s]  pages: %d", info.workflowID, info.req.ReqID, len(info.req.Pages))
-		}
-
-		// collect the completed (successful) OCR events, which contain the OCR results
-		if t == "LambdaFunctionCompleted" {
-			//c.info("[AWS] [%s] lambda completed", info.workflowID)
-			info.ocrResults = append(info.ocrResults, e)
-		}
-
-		// set a flag if any workflow execution event failed (start, complete, fail)
-		if strings.Contains(t, "WorkflowExecutionFailed") {
-			workflowHalted = true
-		}
-
-		// from here on out, only consider recent events (events that occurred since
-		// since the last time a decision task for this workflow was processed)
-		if *e.EventId <= info.lastEventID {
-			continue
-		}
-
-		// collect all non-decision recent events
-		if strings.HasPrefix(t, "Decision") {
-			continue
-		}
-
-		info.recentEvents = append(info.recentEvents, e)
+	for _, pid := range info.failedPages {
+		res.pages = append(res.pages, ocrPidInfo{pid: pid, failed: true})
 	}
 
-	c.reqUpdateImagesComplete(getWorkDir(info.req.Path), info.req.ReqID, len(info.ocrResults))
-
-	if workflowHalted {
-		c.info("[AWS] [%s] WORKFLOW WAS PREVIOUSLY HALTED", info.workflowID)
+	// sample results are only used to pick a language for the full run, which reuses the uploaded images
+	if info.req.Sample == true {
+		go c.processLanguageSample(res)
+		return
 	}
 
-	c.info("[AWS] [%s] lambdas completed: %d / %d", info.workflowID, len(info.ocrResults), len(info.req.Pages))
+	c.cacheStoreResults(res.reqid, res.pages)
 
-	recentCounts := make(map[string]int)
-	var lastEventType string
-	for _, e := range info.recentEvents {
-		recentCounts[*e.EventType]++
-		lastEventType = *e.EventType
+	// add any pages that were satisfied by the result cache or corrections, and so were never part of the workflow
+	if satisfied, err := c.jobGetSatisfiedPages(res.reqid); err == nil {
+		res.pages = append(res.pages, satisfied...)
 	}
-	c.info("[AWS] [%s] recent events: %s", info.workflowID, countsToString(recentCounts))
-	c.info("[AWS] [%s] last event type: [%s]", info.workflowID, lastEventType)
-
-	// we can now make decisions about the workflow.  the overview of the process is as follows:
-	//
-	// 1. start workflow
-	//
-	// 2. receive "workflow started" decision task -- at this point, split pages into Q queues,
-	//    using Timer events as the mechanism to start and track each queue.  AWS has a limit
-	//    of 1000 concurrent tasks, so we make sure to keep 1 <= Q <= 999
-	//
-	// 3. for each queue, we begin by receiving a "timer fired" decision task -- at this point,
-	//    kick off the lambda for the first page in this queue's page list
-	//
-	// 4. as each lambda completes (glossing over any lambda retries here), we refer back to
-	//    the associated queue to find the next lambda to kick off, if any
-	//
-	// 5. determine overall completion/failure after all lambdas have run
-
-	var decisions []*swf.Decision
-
-	switch {
-	// completion condition (failure): no pids found in the input string
-	// decision(s): fail the workflow
-	case len(info.req.Pages) == 0:
-		decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "No PIDs to process"))
-		c.awsFinalizeFailure(info, "no pages to process")
-
-	// start of workflow
-	// decision(s): split pages into Q queues, and schedule a timer event to start each queue
-	case recentCounts["WorkflowExecutionStarted"] > 0:
-
-		queues := c.numQueues(len(info.req.Pages))
-
-		timerPayloads := make([]controlPayload, queues)
-
-		for i, page := range info.req.Pages {
-			timerPayloads[i%queues].Pids = append(timerPayloads[i%queues].Pids, page.Pid)
-		}
-
-		// create a timer for each queue
-		for _, timerPayload := range timerPayloads {
-			timerPayload.Type = controlPayloadTypeTimerLambdaQueue
 
-			//c.info("[AWS] lambda queue %d (%d pids) = %v", i + 1, len(timerPayload.Pids), timerPayload)
-
-			control, jsonErr := json.Marshal(timerPayload)
-			if jsonErr != nil {
-				c.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jsonErr.Error())
-				decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "timer-based lambda queue creation failed"))
-				c.awsFinalizeFailure(info, "failed to start page OCR queues")
-				break
-			}
-
-			decisions = append(decisions, awsStartTimer(0, string(control)))
-		}
+	// a retry only ocr's the pages its original job was missing; the rest come from the original
+	res.pages = append(res.pages, c.jobGetRetriedPages(res.reqid, res.pages)...)
 
-	// completion condition (success): number of successful lambda executions = number of pids
-	// decision(s): complete the workflow
-	case len(info.ocrResults) == len(info.req.Pages):
-		// did a previous completion attempt fail?  try, try again
-		if e := awsEventWithType(info.recentEvents, "CompleteWorkflowExecutionFailed"); e != nil {
-			a := e.CompleteWorkflowExecutionFailedEventAttributes
-			c.err("[AWS] [%s] complete workflow execution failed (%s)", info.workflowID, *a.Cause)
-			decisions = append([]*swf.Decision{}, awsCompleteWorkflowExecution("SUCCESS"))
-		} else {
-			decisions = append([]*swf.Decision{}, awsCompleteWorkflowExecution("success"))
-			c.awsFinalizeSuccess(info)
-		}
-
-	// middle of the workflow -- timer and lambda events are handled here
-	// decision(s): see conditions in recent events loop below
-	default:
-
-	RecentEventsProcessingLoop:
-		for _, e := range info.recentEvents {
-			t := *e.EventType
-
-			// attempt to start the workflow failed?
-			// decision(s): fail the workflow
-			if t == "WorkflowExecutionFailed" {
-				a := e.WorkflowExecutionFailedEventAttributes
-				c.err("[AWS] [%s] start workflow execution failed (%s) - (%s)", info.workflowID, *a.Reason, *a.Details)
-				decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "workflow execution failed"))
-				c.awsFinalizeFailure(info, "failed to start OCR workflow")
-				break RecentEventsProcessingLoop
-			}
-
-			// attempt to fail the workflow failed?
-			// decision(s): fail the workflow
-			if t == "FailWorkflowExecutionFailed" {
-				a := e.FailWorkflowExecutionFailedEventAttributes
-				c.err("[AWS] [%s] fail workflow execution failed (%s)", info.workflowID, *a.Cause)
-				decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("FAILURE", "fail workflow execution failed"))
-				break RecentEventsProcessingLoop
-			}
-
-			// attempt to start a timer failed?
-			// decision(s): fail the workflow
-			if t == "StartTimerFailed" {
-				a := e.StartTimerFailedEventAttributes
-				c.err("[AWS] [%s] start timer failed (%s)", info.workflowID, *a.Cause)
-				decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("FAILURE", "start timer failed"))
-				c.awsFinalizeFailure(info, "failed to start timer")
-				break RecentEventsProcessingLoop
-			}
-
-			// signal sent to workflow
-			// decision(s): ignore
-			if t == "WorkflowExecutionSignaled" {
-				a := e.WorkflowExecutionSignaledEventAttributes
-				c.info("[AWS] [%s] workflow execution signaled (%s) - (%s)", info.workflowID, *a.SignalName, c.decodeWorkflowInput(*a.Input))
-				continue RecentEventsProcessingLoop
-			}
-
-			// cancel request sent to workflow
-			// decision(s): fail the workflow
-			if t == "WorkflowExecutionCancelRequested" {
-				//a := e.WorkflowExecutionCancelRequestedEventAttributes
-				c.info("[AWS] [%s] workflow cancellation requested", info.workflowID)
-				decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "workflow execution canceled"))
-				c.awsFinalizeFailure(info, "process was canceled")
-				break RecentEventsProcessingLoop
-			}
-
-			// lambda execution succeeded
-			// decision(s): start the next lambda in the queue, if applicable.  otherwise, no decision
-			if t == "LambdaFunctionCompleted" {
-				a := e.LambdaFunctionCompletedEventAttributes
-				o := awsEventWithID(info.allEvents, *a.ScheduledEventId)
-
-				lambdaPayload := controlPayload{}
+	// sort by pid
+	sort.Slice(res.pages, func(i, j int) bool { return res.pages[i].pid < res.pages[j].pid })
 
-				if jErr := json.Unmarshal([]byte(*o.LambdaFunctionScheduledEventAttributes.Control), &lambdaPayload); jErr != nil {
-					c.err("[AWS] Unmarshal() failed [lambda payload]: %s", jErr.Error())
-					decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda payload unmarshal failed"))
-					c.awsFinalizeFailure(info, "failed to process page OCR")
-					break RecentEventsProcessingLoop
-				}
+	// images are left in place (a language sample's images are reused by the full run); s3 lifecycle
+	// policies, or the reaper's s3 retention, remove them
+	go c.processOcrSuccess(res)
+}
 
-				if len(lambdaPayload.Pids) > 0 {
-					// fire lambda for next pid
-
-					c.info("[AWS] [%s] scheduling next lambda in this queue", info.workflowID)
-
-					pid := lambdaPayload.Pids[0]
-
-					req := lambdaRequest{
-						Lang:      info.req.Lang,
-						Scale:     "100",
-						Bucket:    info.req.Bucket,
-						Key:       getS3Filename(info.req.ReqID, pidToFilenameMap[pid]),
-						ParentPid: info.req.Pid,
-						Pid:       pid,
-					}
-
-					input, jsonErr := json.Marshal(req)
-					if jsonErr != nil {
-						c.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jsonErr.Error())
-						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda creation failed"))
-						c.awsFinalizeFailure(info, "failed to start page OCR")
-						break RecentEventsProcessingLoop
-					}
-
-					lambdaPayload := controlPayload{
-						Type:        controlPayloadTypeLambdaData,
-						Pids:        lambdaPayload.Pids[1:],
-						OrigEventID: fmt.Sprintf("%d", *a.StartedEventId),
-						LambdaCount: 1,
-					}
-
-					control, jsonErr := json.Marshal(lambdaPayload)
-					if jsonErr != nil {
-						c.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jsonErr.Error())
-						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "timer-based lambda creation failed"))
-						c.awsFinalizeFailure(info, "failed to start page OCR")
-						break RecentEventsProcessingLoop
-					}
-
-					c.info("[AWS] [%s] lambda control: [%s]", info.workflowID, control)
-					c.info("[AWS] [%s] lambda input: [%s]", info.workflowID, input)
-
-					decisions = append(decisions, awsScheduleLambdaFunction(string(input), string(control)))
-
-					continue RecentEventsProcessingLoop
-				} else {
-					c.info("[AWS] [%s] lambda queue complete", info.workflowID)
-				}
+func (c *clientContext) awsFinalizeFailure(info decisionInfo, details string) {
+	res := ocrResultsInfo{}
 
-				continue RecentEventsProcessingLoop
-			}
+	res.pid = info.req.Pid
+	res.reqid = info.req.ReqID
+	res.details = fmt.Sprintf("OCR generation process failed (%s)", details)
+	res.workDir = getWorkDir(info.req.Path)
 
-			// timer and lambda retry scenarios from this point on
+	// keep any pages that did succeed, so that a retry only needs to ocr the rest
+	if info.req.Sample == false {
+		if pages := c.awsCompletedPages(info); len(pages) > 0 {
+			c.info("[AWS] [%s] keeping %d of %d page result(s) from failed workflow", info.workflowID, len(pages), len(info.req.Pages))
+			c.jobSavePages(res.reqid, pages)
+			c.cacheStoreResults(res.reqid, pages)
+		}
+	}
 
-			var origLambdaEvent *swf.HistoryEvent
-			timerPayload := controlPayload{}
-			lambdaTimedOut := false
-			lambdaFailed := false
+	go c.processOcrFailure(res)
+}
 
-			// lambda execution failed
-			// decision(s): set up lambda to be retried below
-			if t == "LambdaFunctionFailed" {
-				a := e.LambdaFunctionFailedEventAttributes
-				reason := *a.Reason
+func (c *clientContext) awsHandleDecisionTask(svc *swf.SWF, info decisionInfo) {
+	d := newDecider(c)
 
-				details := lambdaFailureDetails{}
-				json.Unmarshal([]byte(*a.Details), &details)
+	// without the workflow's input, leave the task unanswered; it times out and swf schedules
+	// another one, by which time the input may be readable again
+	if err := d.inventory(&info); err != nil {
+		c.err("[AWS] [%s] not responding to decision task: [%s]", info.workflowID, err.Error())
+		return
+	}
 
-				if details.ErrorType != "" || details.ErrorMessage != "" {
-					c.err("[AWS] [%s] lambda failed: (%s) : [%s] / [%s]", info.workflowID, reason, details.ErrorType, details.ErrorMessage)
-				} else {
-					c.err("[AWS] [%s] lambda failed: (%s)", info.workflowID, reason)
-				}
+	c.reqUpdateImagesComplete(getWorkDir(info.req.Path), info.req.ReqID, len(info.ocrResults))
 
-				origLambdaEvent = awsEventWithID(info.allEvents, *a.ScheduledEventId)
-				lambdaFailed = true
-			}
+	res := d.decide(&info)
 
-			// lambda execution timed out
-			// decision(s): set up lambda to be retried below
-			if t == "LambdaFunctionTimedOut" {
-				a := e.LambdaFunctionTimedOutEventAttributes
+	c.awsRecordDecisionTask(info, res)
 
-				origLambdaEvent = awsEventWithID(info.allEvents, *a.ScheduledEventId)
+	updates := decisionPageUpdates(info, res)
 
-				timeoutStr := ""
-				if origLambdaEvent.LambdaFunctionScheduledEventAttributes.StartToCloseTimeout != nil {
-					timeoutStr = fmt.Sprintf(" after %s seconds", *origLambdaEvent.LambdaFunctionScheduledEventAttributes.StartToCloseTimeout)
-				}
+	c.jobUpdatePageStates(info.req.ReqID, updates)
+	publishDecisionEvents(info, updates)
 
-				c.err("[AWS] [%s] lambda timed out%s (%s)", info.workflowID, timeoutStr, *a.TimeoutType)
-				lambdaTimedOut = true
-			}
+	// the workflow is still making progress, whichever instance is handling it
+	c.jobLockRenew(info.req.ReqID)
 
-			// timer fired
-			// decision(s):
-			// * lambda queue timer: start the first lambda in the queue
-			// * lambda retry timer: set up lambda to be retried below
-			if t == "TimerFired" {
-				a := e.TimerFiredEventAttributes
-				o := awsEventWithID(info.allEvents, *a.StartedEventId)
-
-				c.info("[AWS] [%s] timer fired", info.workflowID)
-
-				if jErr := json.Unmarshal([]byte(*o.TimerStartedEventAttributes.Control), &timerPayload); jErr != nil {
-					c.err("[AWS] Unmarshal() failed [timer payload]: %s", jErr.Error())
-					decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "timer payload unmarshal failed"))
-					c.awsFinalizeFailure(info, "failed to process timer")
-					break RecentEventsProcessingLoop
-				}
+	if res.outcome != "" {
+		workflowManifests.forget(info.workflowID)
 
-				switch timerPayload.Type {
-				case controlPayloadTypeTimerLambdaQueue:
-					c.info("[AWS] handling lambda queue timer payload")
-
-					// fire lambda for first pid
-
-					c.info("[AWS] [%s] scheduling first lambda in this queue", info.workflowID)
-					pid := timerPayload.Pids[0]
-
-					req := lambdaRequest{
-						Lang:      info.req.Lang,
-						Scale:     "100",
-						Bucket:    info.req.Bucket,
-						Key:       getS3Filename(info.req.ReqID, pidToFilenameMap[pid]),
-						ParentPid: info.req.Pid,
-						Pid:       pid,
-					}
-
-					input, jsonErr := json.Marshal(req)
-					if jsonErr != nil {
-						c.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jsonErr.Error())
-						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda creation failed"))
-						c.awsFinalizeFailure(info, "failed to start page OCR")
-						break RecentEventsProcessingLoop
-					}
-
-					lambdaPayload := controlPayload{
-						Type:        controlPayloadTypeLambdaData,
-						Pids:        timerPayload.Pids[1:],
-						OrigEventID: fmt.Sprintf("%d", *a.StartedEventId),
-						LambdaCount: 1,
-					}
-
-					control, jsonErr := json.Marshal(lambdaPayload)
-					if jsonErr != nil {
-						c.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jsonErr.Error())
-						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "timer-based lambda creation failed"))
-						c.awsFinalizeFailure(info, "failed to start page OCR")
-						break RecentEventsProcessingLoop
-					}
-
-					c.info("[AWS] [%s] lambda control: [%s]", info.workflowID, control)
-					c.info("[AWS] [%s] lambda input: [%s]", info.workflowID, input)
-
-					decisions = append(decisions, awsScheduleLambdaFunction(string(input), string(control)))
-
-					continue RecentEventsProcessingLoop
-
-				case controlPayloadTypeTimerLambdaRetry:
-					c.info("[AWS] handling lambda retry timer payload")
-
-					id, _ := strconv.Atoi(timerPayload.OrigEventID)
-					origLambdaEvent = awsEventWithID(info.allEvents, int64(id))
-				}
-			}
+		final := info.concurrency.target
+		if final == 0 {
+			final = info.concurrency.initial
+		}
 
-			// handle lambda retry-related scenarios:
-			// if a retry timer fired, rerun the lambda (reducing image scale for timeouts).
-			// otherwise, start a retry timer to delay lambda retry.
-			if origLambdaEvent != nil {
-				lambdaPayload := controlPayload{}
-
-				if jErr := json.Unmarshal([]byte(*origLambdaEvent.LambdaFunctionScheduledEventAttributes.Control), &lambdaPayload); jErr != nil {
-					c.err("[AWS] Unmarshal() failed [lambda payload]: %s", jErr.Error())
-					decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda payload unmarshal failed"))
-					c.awsFinalizeFailure(info, "failed to process page OCR")
-					break RecentEventsProcessingLoop
-				}
+		c.jobUpdateConcurrency(info.req.ReqID, info.concurrency.initial, info.concurrency.peak, final)
+	}
 
-				// this condition can only be met if a lambda retry timer fired above
-				if timerPayload.Type == controlPayloadTypeTimerLambdaRetry {
-					// rerun the referenced lambda, with reduced scale only if the lambda timed out
-
-					lambdaPayload.LambdaCount++
-
-					newLambdaInput := *origLambdaEvent.LambdaFunctionScheduledEventAttributes.Input
-
-					if timerPayload.LambdaTimedOut == true {
-						req := lambdaRequest{}
-
-						if jErr := json.Unmarshal([]byte(newLambdaInput), &req); jErr != nil {
-							c.err("[AWS] Unmarshal() failed [lambda retry]: %s", jErr.Error())
-							decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda unmarshal failed"))
-							c.awsFinalizeFailure(info, "failed to retry page OCR")
-							break RecentEventsProcessingLoop
-						}
-
-						// reduce scale in steps of 10%, going no lower than 10%
-						scale, _ := strconv.Atoi(req.Scale)
-						newScale := fmt.Sprintf("%d", maxOf(10, scale-10))
-						c.info("[AWS] [%s] scale: %s%% -> %s%%", info.workflowID, req.Scale, newScale)
-						req.Scale = newScale
-
-						input, jErr := json.Marshal(req)
-						if jErr != nil {
-							c.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jErr.Error())
-							decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda re-marshal failed"))
-							c.awsFinalizeFailure(info, "failed to retry page OCR")
-							break RecentEventsProcessingLoop
-						}
-
-						newLambdaInput = string(input)
-
-						c.info("[AWS] [%s] new input: %s", info.workflowID, newLambdaInput)
-					}
-
-					c.info("[AWS] [%s] retrying lambda event %d (attempt %d)", info.workflowID, *origLambdaEvent.EventId, lambdaPayload.LambdaCount)
-
-					control, jsonErr := json.Marshal(lambdaPayload)
-					if jsonErr != nil {
-						c.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jsonErr.Error())
-						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda creation failed"))
-						c.awsFinalizeFailure(info, "failed to retry page OCR")
-						break RecentEventsProcessingLoop
-					}
-
-					decisions = append(decisions, awsScheduleLambdaFunction(newLambdaInput, string(control)))
-				} else {
-					// start a timer referencing the original lambda to be rerun, with exponential backoff based on execution count
-
-					maxAttempts, _ := strconv.Atoi(config.lambdaAttempts.value)
-					if maxAttempts < 1 {
-						maxAttempts = 1
-					}
-
-					// limit number of reruns
-					if lambdaPayload.LambdaCount >= maxAttempts {
-						c.err("[AWS] [%s] maximum lambda attempts reached (%d); failing", info.workflowID, maxAttempts)
-						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "maximum OCR attempts reached for one or more pages"))
-						c.awsFinalizeFailure(info, "maximum OCR attempts reached for one or more pages")
-						break RecentEventsProcessingLoop
-					}
-
-					delay := int(math.Pow(2, float64(lambdaPayload.LambdaCount))) + randpool.Intn(30)
-
-					c.info("[AWS] [%s] scheduling lambda event %d to be retried in %d seconds...", info.workflowID, *origLambdaEvent.EventId, delay)
-
-					payload := controlPayload{
-						Type:           controlPayloadTypeTimerLambdaRetry,
-						OrigEventID:    fmt.Sprintf("%d", *origLambdaEvent.EventId),
-						LambdaTimedOut: lambdaTimedOut,
-						LambdaFailed:   lambdaFailed,
-					}
-
-					control, jsonErr := json.Marshal(payload)
-					if jsonErr != nil {
-						c.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jsonErr.Error())
-						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "timer-based lambda retry creation failed"))
-						c.awsFinalizeFailure(info, "failed to retry page OCR")
-						break RecentEventsProcessingLoop
-					}
-
-					decisions = append(decisions, awsStartTimer(delay, string(control)))
-				}
-			}
-		}
+	switch res.outcome {
+	case deciderOutcomeSuccess:
+		c.awsFinalizeSuccess(info)
+	case deciderOutcomeFailure:
+		c.awsFinalizeFailure(info, res.details)
 	}
 
+	decisions := res.decisions
+
 	// quick check to ensure all decisions made appear valid
 
 	decisionCounts := make(map[string]int)
@@ -854,28 +505,103 @@ func (c *clientContext) awsWorkflowIsClosed(workflowID, runID string) (bool, err
 	return c.awsWorkflowInList(res.ExecutionInfos, workflowID, runID), nil
 }
 
-func (c *clientContext) awsDeleteImages(reqDir string) error {
-	c.info("[AWS] relying on S3 policies to remove original images")
+func (c *clientContext) awsTerminateWorkflow(workflowID, reason string) error {
+	svc := swf.New(sess)
+
+	input := (&swf.TerminateWorkflowExecutionInput{}).
+		SetDomain(config.awsSwfDomain.value).
+		SetWorkflowId(workflowID).
+		SetChildPolicy("TERMINATE").
+		SetReason(reason)
+
+	if _, err := svc.TerminateWorkflowExecution(input); err != nil {
+		c.err("[AWS] terminate workflow error: [%s]", err.Error())
+		return errors.New("failed to terminate workflow")
+	}
+
+	c.info("[AWS] terminated WorkflowId [%s]: [%s]", workflowID, reason)
+
 	return nil
+}
+
+// removes a request's images (and manifest) from s3
+func (c *clientContext) awsDeleteImages(reqID string) error {
+	if sess == nil || reqID == "" {
+		return nil
+	}
 
-	/*
-		svc := s3.New(sess)
+	svc := s3.New(sess)
 
-		c.info("[AWS] deleting: [%s]", reqDir)
+	prefix := path.Join("requests", reqID) + "/"
 
-		iter := s3manager.NewDeleteListIterator(svc, &s3.ListObjectsInput{
-			Bucket: aws.String(config.awsBucketName.value),
-			Prefix: aws.String(fmt.Sprintf("requests/%s", reqDir)),
-		})
+	c.info("[AWS] deleting: [%s]", prefix)
+
+	iter := s3manager.NewDeleteListIterator(svc, &s3.ListObjectsInput{
+		Bucket: aws.String(config.awsBucketName.value),
+		Prefix: aws.String(prefix),
+	})
 
-		err := s3manager.NewBatchDeleteWithClient(svc).Delete(aws.BackgroundContext(), iter)
+	if err := s3manager.NewBatchDeleteWithClient(svc).Delete(aws.BackgroundContext(), iter); err != nil {
+		c.err("[AWS] S3 delete failed: [%s]", err.Error())
+		return errors.New("failed to delete request images")
+	}
 
-		if err != nil {
-			c.err("[AWS] S3 delete failed: [%s]", err.Error())
+	return nil
+}
+
+// removes the s3 prefixes of requests that no active job is using and that have not been written to
+// since the cutoff.  returns the request ids removed
+func (c *clientContext) awsPurgeRequestPrefixes(cutoff time.Time) ([]string, error) {
+	if sess == nil {
+		return nil, nil
+	}
+
+	svc := s3.New(sess)
+
+	// the most recent write to each request prefix
+	latest := make(map[string]time.Time)
+
+	input := s3.ListObjectsV2Input{Bucket: aws.String(config.awsBucketName.value), Prefix: aws.String("requests/")}
+
+	err := svc.ListObjectsV2Pages(&input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			parts := strings.SplitN(strings.TrimPrefix(*obj.Key, "requests/"), "/", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				continue
+			}
+
+			if t := aws.TimeValue(obj.LastModified); t.After(latest[parts[0]]) {
+				latest[parts[0]] = t
+			}
 		}
 
-		return err
-	*/
+		return true
+	})
+
+	if err != nil {
+		c.err("[AWS] S3 list failed: [%s]", err.Error())
+		return nil, errors.New("failed to list request prefixes")
+	}
+
+	var purged []string
+
+	for reqID, t := range latest {
+		if t.After(cutoff) {
+			continue
+		}
+
+		if job, _ := c.jobGet(reqID); job != nil && (job.State == jobStateQueued || job.State == jobStateRunning) {
+			continue
+		}
+
+		if c.awsDeleteImages(reqID) == nil {
+			purged = append(purged, reqID)
+		}
+	}
+
+	sort.Strings(purged)
+
+	return purged, nil
 }
 
 func (c *clientContext) awsSubmitWorkflow(req workflowRequest) error {
@@ -889,6 +615,11 @@ func (c *clientContext) awsSubmitWorkflow(req workflowRequest) error {
 		return errors.New("failed to encode workflow request")
 	}
 
+	workflowInput, err := c.workflowInput(req.ReqID, string(input))
+	if err != nil {
+		return err
+	}
+
 	startParams := (&swf.StartWorkflowExecutionInput{}).
 		SetDomain(config.awsSwfDomain.value).
 		SetWorkflowId(id).
@@ -900,7 +631,7 @@ func (c *clientContext) awsSubmitWorkflow(req workflowRequest) error {
 		SetChildPolicy("TERMINATE").
 		SetExecutionStartToCloseTimeout(config.awsSwfWorkflowTimeout.value).
 		SetTaskStartToCloseTimeout(config.awsSwfDecisionTimeout.value).
-		SetInput(c.encodeWorkflowInput(string(input)))
+		SetInput(workflowInput)
 
 	res, startErr := svc.StartWorkflowExecution(startParams)
 
@@ -913,6 +644,14 @@ func (c *clientContext) awsSubmitWorkflow(req workflowRequest) error {
 
 	c.reqUpdateAwsWorkflowID(getWorkDir(req.Path), req.ReqID, id)
 	c.reqUpdateAwsRunID(getWorkDir(req.Path), req.ReqID, *res.RunId)
+	c.jobUpdateWorkflowID(req.ReqID, id)
+
+	details := ""
+	if req.Sample == true {
+		details = "language detection sample"
+	}
+
+	publishProgress(req.Pid, req.ReqID, eventWorkflowStarted, progressEvent{Total: len(req.Pages), Details: details})
 
 	return nil
 }
@@ -922,7 +661,7 @@ func (c *clientContext) openURL(url string) (io.ReadCloser, error) {
 	backoff := 1
 
 	for i := 1; i <= maxTries; i++ {
-		h, err := http.Get(url)
+		h, err := imageClient.Get(url)
 
 		if err != nil {
 			return nil, err
@@ -950,59 +689,52 @@ func (c *clientContext) openURL(url string) (io.ReadCloser, error) {
 	return nil, fmt.Errorf("max tries reached")
 }
 
-func (c *clientContext) awsUploadImage(uploader *s3manager.Uploader, reqID, imageSource, remoteName string) error {
-	s3File := getS3Filename(reqID, remoteName)
-
-	var imageStream io.ReadCloser
-	var err error
-
-	if strings.HasPrefix(imageSource, "/") {
-		imageStream, err = os.Open(imageSource)
-	} else {
-		imageStream, err = c.openURL(imageSource)
-	}
+func (c *clientContext) awsUploadImage(uploader *s3manager.Uploader, reqID string, page *tsGenericPidInfo, steps []string) error {
+	s3File := getS3Filename(reqID, page.remoteName)
 
+	imageStream, err := c.openPageImage(page)
 	if err != nil {
 		return err
 	}
 
-	if imageStream == nil {
-		return errors.New("failed to upload image")
-	}
-
 	defer imageStream.Close()
 
-	c.info("[AWS] uploading: [%s] => [%s]", imageSource, s3File)
+	var body io.Reader = imageStream
+
+	if len(steps) > 0 {
+		if body, err = c.preprocessImage(imageStream, steps); err != nil {
+			return err
+		}
+	}
+
+	c.info("[AWS] uploading: [%s] %s => [%s]", page.imageSourceName, page.imageSource, s3File)
 
 	_, aerr := uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(config.awsBucketName.value),
 		Key:    aws.String(s3File),
-		Body:   imageStream,
+		Body:   body,
 	})
 
-	return aerr
-}
-
-func (c *clientContext) awsUploadImagesConcurrently() error {
-	uploader := s3manager.NewUploader(sess)
+	if aerr != nil {
+		return aerr
+	}
 
-	workers, err := strconv.Atoi(config.concurrentUploads.value)
-
-	switch {
-	case err != nil:
-		workers = 1
-	case workers == 0:
-		workers = runtime.NumCPU()
-	case workers < 0:
-		workers = 1
-	// failsafe
-	case workers > 100:
-		workers = 100
+	// the uploader may have stopped short of the error reporting a mismatch
+	sum, err := imageStream.checksum()
+	if err != nil {
+		return err
 	}
 
-	c.info("[AWS] concurrent uploads set to [%s]; limiting to %d uploads", config.concurrentUploads.value, workers)
+	c.jobSavePageSource(reqID, page.Pid, page.imageSourceName, sum, imageStream.verified())
 
-	wp := workerpool.New(workers)
+	return nil
+}
+
+func (c *clientContext) awsUploadImagesConcurrently(pages []tsGenericPidInfo) error {
+	uploader := s3manager.NewUploader(sess)
+
+	// uploads are handled by the service-wide upload pool, shared with any other running jobs
+	var wg sync.WaitGroup
 
 	start := time.Now()
 
@@ -1011,24 +743,34 @@ func (c *clientContext) awsUploadImagesConcurrently() error {
 
 	mutex := &sync.Mutex{}
 
-	for i := range c.ocr.ts.Pages {
-		page := &c.ocr.ts.Pages[i]
-		wp.Submit(func() {
-			if err := c.awsUploadImage(uploader, c.ocr.reqID, page.imageSource, page.remoteName); err != nil {
+	steps := preprocessStepsForHint(c.ocr.ts.Pid.OcrHint)
+	if len(steps) > 0 {
+		c.info("[AWS] preprocessing images for ocr hint [%s]: %v", c.ocr.ts.Pid.OcrHint, steps)
+	}
+
+	for i := range pages {
+		page := &pages[i]
+		wg.Add(1)
+		uploadPool.Submit(func() {
+			defer wg.Done()
+			if err := c.awsUploadImage(uploader, c.ocr.reqID, page, steps); err != nil {
+				mutex.Lock()
 				uploadFailed = true
+				mutex.Unlock()
 				c.err("[AWS] Failed to upload image: [%s]", err.Error())
 			} else {
 				mutex.Lock()
 				uploadCount++
 				c.reqUpdateImagesUploaded(c.ocr.workDir, c.ocr.reqID, uploadCount)
+				publishProgress(c.req.pid, c.ocr.reqID, eventImageUploaded, progressEvent{Page: page.Pid, Done: uploadCount, Total: len(pages)})
 				mutex.Unlock()
 			}
 		})
 	}
 
-	c.info("[AWS] Waiting for %d uploads to complete...", len(c.ocr.ts.Pages))
+	c.info("[AWS] Waiting for %d uploads to complete...", len(pages))
 
-	wp.StopWait()
+	wg.Wait()
 
 	if uploadFailed == true {
 		c.err("[AWS] one or more images failed to upload")
@@ -1037,7 +779,31 @@ func (c *clientContext) awsUploadImagesConcurrently() error {
 
 	elapsed := time.Since(start).Seconds()
 
-	c.info("[AWS] %d images uploaded in %0.2f seconds (%0.2f seconds/image)", len(c.ocr.ts.Pages), elapsed, elapsed/float64(len(c.ocr.ts.Pages)))
+	if len(pages) > 0 {
+		c.info("[AWS] %d images uploaded in %0.2f seconds (%0.2f seconds/image)", len(pages), elapsed, elapsed/float64(len(pages)))
+	}
+
+	return nil
+}
+
+func (c *clientContext) awsMapImages() error {
+	// create {image source location} to {s3 key} mapping
+	for i := range c.ocr.ts.Pages {
+		page := &c.ocr.ts.Pages[i]
+
+		if err := c.locatePageImage(page); err != nil {
+			return err
+		}
+
+		extensionSource := page.imageSource
+		if steps := preprocessStepsForHint(c.ocr.ts.Pid.OcrHint); len(steps) > 0 {
+			extensionSource = preprocessExtension(steps)
+		}
+
+		page.remoteName = getRemoteFilename(page.Filename, extensionSource)
+
+		c.info("[AWS] mapping [%s] %s => [%s]", page.imageSourceName, page.imageSource, page.remoteName)
+	}
 
 	return nil
 }
@@ -1047,29 +813,83 @@ func (c *clientContext) awsGenerateOcr() error {
 		return fmt.Errorf("automatically failed: [AWS is disabled]")
 	}
 
-	// create {local tif or iiif url} to {s3 key} mapping
-	for i := range c.ocr.ts.Pages {
-		page := &c.ocr.ts.Pages[i]
+	if err := c.awsMapImages(); err != nil {
+		return fmt.Errorf("image mapping failed: [%s]", err.Error())
+	}
+
+	// pages corrected by hand are not ocr'd again unless requested
+	pages := c.skipCorrectedPages(c.ocr.ts.Pages)
 
-		localFile := getLocalFilename(page.Filename)
+	// without a language hint, ocr a sample of pages first to determine the language.  the language
+	// is needed to check the cache, so only the sample is uploaded now; the rest of the pages are
+	// checked, and the misses uploaded, once it is known
+	if c.ocr.ts.Pid.OcrLanguageHint == "" && config.langDetection.value == true && len(pages) > 0 {
+		sample := languageSamplePages(pages)
 
-		if _, err := os.Stat(localFile); err == nil {
-			page.imageSource = localFile
-		} else {
-			page.imageSource = getIIIFUrl(page.Pid)
+		if err := c.awsUploadPages(sample); err != nil {
+			return err
 		}
 
-		page.remoteName = getRemoteFilename(page.Filename, page.imageSource)
+		return c.awsSubmitOcrWorkflow(sample, true)
+	}
+
+	pages = c.cacheCheckPages(pages, c.ocr.ts.Pid.OcrLanguageHint)
 
-		c.info("[AWS] mapping [%s] => [%s]", page.imageSource, page.remoteName)
+	if err := c.awsUploadPages(pages); err != nil {
+		return err
 	}
 
+	return c.awsSubmitOcrWorkflow(pages, false)
+}
+
+func (c *clientContext) awsUploadPages(pages []tsGenericPidInfo) error {
 	if config.disableUploads.value == true {
 		c.info("[AWS] SKIPPING IMAGE UPLOADS; LAMBDAS WILL FAIL")
-	} else {
-		if err := c.awsUploadImagesConcurrently(); err != nil {
-			return fmt.Errorf("upload failed: [%s]", err.Error())
+		return nil
+	}
+
+	if len(pages) == 0 {
+		return nil
+	}
+
+	c.jobUpdatePhase(c.ocr.reqID, jobPhaseUploading)
+
+	if err := c.awsUploadImagesConcurrently(pages); err != nil {
+		return fmt.Errorf("upload failed: [%s]", err.Error())
+	}
+
+	return nil
+}
+
+func (c *clientContext) awsSubmitOcrWorkflow(pages []tsGenericPidInfo, sample bool) error {
+	// the job may have been canceled, or failed by the reaper, while images were uploading
+	if c.jobIsStopped(c.ocr.reqID) == true {
+		c.info("[AWS] job was stopped; not submitting workflow")
+		return nil
+	}
+
+	// every page was found in the result cache or corrected by hand; no workflow needed
+	if len(pages) == 0 && sample == false {
+		satisfied, err := c.jobGetSatisfiedPages(c.ocr.reqID)
+		if err != nil {
+			return fmt.Errorf("page retrieval failed: [%s]", err.Error())
 		}
+
+		c.info("[AWS] all %d pages found in result cache or corrections; skipping workflow", len(satisfied))
+
+		res := ocrResultsInfo{}
+
+		res.pid = c.req.pid
+		res.reqid = c.ocr.reqID
+		res.workDir = c.ocr.workDir
+		res.overwrite = true
+		res.pages = append(satisfied, c.jobGetRetriedPages(c.ocr.reqID, satisfied)...)
+
+		sort.Slice(res.pages, func(i, j int) bool { return res.pages[i].pid < res.pages[j].pid })
+
+		go c.processOcrSuccess(res)
+
+		return nil
 	}
 
 	req := workflowRequest{}
@@ -1079,8 +899,12 @@ func (c *clientContext) awsGenerateOcr() error {
 	req.Lang = c.ocr.ts.Pid.OcrLanguageHint
 	req.ReqID = c.ocr.reqID
 	req.Bucket = config.awsBucketName.value
+	req.Sample = sample
+	req.Scale = c.req.scale
+	req.Engine = c.req.engine
+	req.Partial = partialSuccessEnabled(c.req.partial)
 
-	for _, page := range c.ocr.ts.Pages {
+	for _, page := range pages {
 		req.Pages = append(req.Pages, ocrPageInfo{Pid: page.Pid, Filename: page.remoteName})
 	}
 
@@ -1089,6 +913,12 @@ func (c *clientContext) awsGenerateOcr() error {
 		return fmt.Errorf("workflow failed: [%s]", err.Error())
 	}
 
+	if sample == true {
+		c.jobUpdatePhase(c.ocr.reqID, jobPhaseLanguage)
+	} else {
+		c.jobUpdatePhase(c.ocr.reqID, jobPhaseOcr)
+	}
+
 	return nil
 }
 
@@ -1119,59 +949,3 @@ func (c *clientContext) encodeWorkflowInput(input string) string {
 
 	return enc
 }
-
-func (c *clientContext) decodeWorkflowInput(input string) string {
-	// attempt to decode input as a base64-encoded gzipped string.
-	// if that fails, just return the original input
-
-	//c.info("decoding (%5d) : [%s]", len(input), input)
-
-	b64, b64Err := base64.StdEncoding.DecodeString(input)
-	if b64Err != nil {
-		c.warn("decode: base64 read error: %s", b64Err.Error())
-		return input
-	}
-
-	gzDec, gzErr := gzip.NewReader(bytes.NewReader([]byte(b64)))
-	if gzErr != nil {
-		c.warn("decode: gzip init error: %s", gzErr.Error())
-		return input
-	}
-
-	dec, decErr := ioutil.ReadAll(gzDec)
-	if decErr != nil {
-		c.warn("decode: gzip read error: %s", decErr.Error())
-		return input
-	}
-
-	//c.info("decoded (%5d) : [%s]", len(dec), dec)
-
-	c.info("decode: decompressed input from %d bytes to %d bytes", len(input), len(dec))
-
-	return string(dec)
-}
-
-func (c *clientContext) numQueues(pages int) int {
-	queueMin := 1
-	queueMax := 999
-	queueDefault := 500
-
-	queues, err := strconv.Atoi(config.lambdaQueues.value)
-
-	switch {
-	case err != nil:
-		queues = queueDefault
-	case queues <= queueMin-1:
-		queues = queueMin
-	case queues >= queueMax+1:
-		queues = queueMax
-	}
-
-	c.info("[AWS] lambda queues set to [%s]; using up to %d queues for %d pages", config.lambdaQueues.value, queues, pages)
-
-	if pages < queues {
-		queues = pages
-	}
-
-	return queues
-}
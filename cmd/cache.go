@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// content-addressed ocr result cache: pages whose images have not changed since they were last
+// ocr'd (with the same language, engine and image scale settings) skip both upload and lambda processing
+
+// identifies everything besides the image and language that affects ocr output.
+// a lambda function override (from a retry) takes the place of the configured engine
+func ocrEngineVersion(override, hint string) string {
+	engine := config.engineVersion.value
+	if engine == "" {
+		engine = config.awsLambdaFunction.value
+	}
+
+	if override != "" {
+		engine = override
+	}
+
+	if steps := preprocessStepsForHint(hint); len(steps) > 0 {
+		engine += "/" + strings.Join(steps, ",")
+	}
+
+	return engine
+}
+
+func cacheKey(md5, lang, engine, scale string) string {
+	return fmt.Sprintf("%s|%s|%s|%s", md5, lang, engine, scale)
+}
+
+// determines the checksum a page's cache key is based on.  sources serving the master file use the
+// checksum from tracksys; derived images (iiif) are identified by the master's checksum and what
+// they are derived with, so that they are not downloaded just to be hashed and then again to be
+// uploaded.  only pages without a checksum in tracksys are read in full
+func (c *clientContext) pageImageChecksum(page *tsGenericPidInfo) (string, error) {
+	if page.MD5 != "" {
+		if src := newImageSource(page.imageSourceName); src != nil {
+			if src.original() == true {
+				return strings.ToLower(page.MD5), nil
+			}
+
+			derived := md5.Sum([]byte(strings.ToLower(page.MD5) + "|" + src.derivation()))
+
+			return hex.EncodeToString(derived[:]), nil
+		}
+	}
+
+	stream, err := c.openPageImage(page)
+	if err != nil {
+		return "", err
+	}
+
+	defer stream.Close()
+
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		return "", err
+	}
+
+	return stream.checksum()
+}
+
+// records cached results for any pages that have them, and returns the pages that still need ocr
+func (c *clientContext) cacheCheckPages(pages []tsGenericPidInfo, lang string) []tsGenericPidInfo {
+	if config.resultCache.value == false {
+		return pages
+	}
+
+	engine := ocrEngineVersion(c.req.engine, c.ocr.ts.Pid.OcrHint)
+	scale := ocrScale(c.req.scale)
+
+	var misses []tsGenericPidInfo
+	var hits []ocrPidInfo
+
+	for i := range pages {
+		page := &pages[i]
+
+		sum, err := c.pageImageChecksum(page)
+		if err != nil {
+			c.warn("[CACHE] [%s] unable to determine image checksum; not cached: [%s]", page.Pid, err.Error())
+			misses = append(misses, *page)
+			continue
+		}
+
+		key := cacheKey(sum, lang, engine, scale)
+
+		c.jobSavePageCacheKey(c.ocr.reqID, page.Pid, page.imageSourceName, sum, key)
+
+		hit, err := c.cacheGet(key)
+		if err != nil || hit == nil {
+			misses = append(misses, *page)
+			continue
+		}
+
+		hit.pid = page.Pid
+		hits = append(hits, *hit)
+	}
+
+	if len(hits) > 0 {
+		c.jobSaveCachedPages(c.ocr.reqID, hits)
+	}
+
+	c.jobUpdateCacheCounts(c.ocr.reqID, len(hits), len(misses))
+
+	c.info("[CACHE] %d cache hit(s), %d miss(es) for %d pages (lang: [%s]  engine: [%s]  scale: [%s])", len(hits), len(misses), len(pages), lang, engine, scale)
+
+	return misses
+}
+
+func (c *clientContext) cacheGet(key string) (*ocrPidInfo, error) {
+	var p ocrPidInfo
+	var confidence sql.NullFloat64
+
+	// entries without text (stored for pages given up on, before those were skipped) are misses
+	err := jobDB.QueryRow("select text, confidence, words from ocr_cache where key = ? and text != '';", key).Scan(&p.text, &confidence, &p.words)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			c.err("[CACHE] failed to retrieve cached result: [%s]", err.Error())
+			return nil, errors.New("failed to retrieve cached result")
+		}
+		return nil, nil
+	}
+
+	if confidence.Valid == true {
+		p.confidence = &confidence.Float64
+	}
+
+	p.cached = true
+
+	jobDB.Exec("update ocr_cache set hits = hits + 1, last_hit = ? where key = ?;", fmt.Sprintf("%d", time.Now().Unix()), key)
+
+	return &p, nil
+}
+
+// adds newly generated page results to the cache, using the keys recorded when the job was submitted
+func (c *clientContext) cacheStoreResults(reqid string, pages []ocrPidInfo) {
+	if config.resultCache.value == false {
+		return
+	}
+
+	keys, err := c.jobGetPageCacheKeys(reqid)
+	if err != nil {
+		return
+	}
+
+	job, err := c.jobGet(reqid)
+	if err != nil {
+		return
+	}
+
+	scale := ocrScale(job.Scale)
+
+	stored := 0
+
+	for _, p := range pages {
+		// pages given up on have no text to reuse, and pages rescued by a retry at a reduced scale, or
+		// by a final attempt with another language or engine, have text the key's settings did not produce
+		key := keys[p.pid]
+		if key == "" || p.cached == true || p.failed == true || p.lang != "" || p.engine != "" || (p.scale != "" && p.scale != scale) {
+			continue
+		}
+
+		var confidence sql.NullFloat64
+		if p.confidence != nil {
+			confidence = sql.NullFloat64{Float64: *p.confidence, Valid: true}
+		}
+
+		query := "insert or replace into ocr_cache (key, text, confidence, words, created, hits, last_hit) values (?, ?, ?, ?, ?, 0, '');"
+		if _, err := jobDB.Exec(query, key, p.text, confidence, p.words, fmt.Sprintf("%d", time.Now().Unix())); err != nil {
+			c.err("[CACHE] failed to store result: [%s]", err.Error())
+			continue
+		}
+
+		stored++
+	}
+
+	c.info("[CACHE] stored %d new result(s)", stored)
+}
+
+// removes the cached results of pages whose text was rejected in review, so that the next request for
+// the same images runs ocr again rather than reusing it
+func (c *clientContext) cacheEvictResults(reqid string, pages []ocrPidInfo) {
+	keys, err := c.jobGetPageCacheKeys(reqid)
+	if err != nil {
+		return
+	}
+
+	evicted := int64(0)
+
+	for _, p := range pages {
+		key := keys[p.pid]
+		if key == "" {
+			continue
+		}
+
+		// the entry may since have been replaced by another job's result
+		res, err := jobDB.Exec("delete from ocr_cache where key = ? and text = ?;", key, p.text)
+		if err != nil {
+			c.err("[CACHE] failed to evict result: [%s]", err.Error())
+			continue
+		}
+
+		n, _ := res.RowsAffected()
+		evicted += n
+	}
+
+	if evicted > 0 {
+		c.info("[CACHE] evicted %d rejected result(s)", evicted)
+	}
+}
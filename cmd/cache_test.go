@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCacheStoreResults(t *testing.T) {
+	c := useJobStore(t)
+
+	config.resultCache.value = true
+
+	c.jobCreate(&jobInfo{ReqID: "r1", Pid: "uva:1", Priority: jobPriorityPatron}, &tsPidInfo{})
+
+	for _, pid := range []string{"uva:2", "uva:3", "uva:4", "uva:5"} {
+		c.jobSavePageCacheKey("r1", pid, "", "md5-"+pid, cacheKey("md5-"+pid, "eng", "v1", "100"))
+	}
+
+	// uva:3 was given up on by the decider, and has no text; uva:4 was rescued by a final attempt
+	// in another language, and uva:5 by a retry at a reduced scale, so their text does not belong
+	// under their keys
+	c.cacheStoreResults("r1", []ocrPidInfo{{pid: "uva:2", text: "text", scale: "100"}, {pid: "uva:3", failed: true}, {pid: "uva:4", text: "text", lang: "eng+lat"}, {pid: "uva:5", text: "text", scale: "75"}})
+
+	if p, err := c.cacheGet(cacheKey("md5-uva:2", "eng", "v1", "100")); err != nil || p == nil || p.text != "text" {
+		t.Errorf("expected a cached result for [uva:2], got %+v (%v)", p, err)
+	}
+
+	if p, _ := c.cacheGet(cacheKey("md5-uva:3", "eng", "v1", "100")); p != nil {
+		t.Errorf("expected no cached result for a failed page, got %+v", p)
+	}
+
+	for _, pid := range []string{"uva:4", "uva:5"} {
+		if p, _ := c.cacheGet(cacheKey("md5-"+pid, "eng", "v1", "100")); p != nil {
+			t.Errorf("expected no cached result for [%s], ocr'd with other settings, got %+v", pid, p)
+		}
+	}
+
+	// nor are empty results stored before failed pages were skipped used
+	jobDB.Exec("insert into ocr_cache (key, text, created, hits, last_hit) values (?, '', '', 0, '');", "empty")
+
+	if p, _ := c.cacheGet("empty"); p != nil {
+		t.Errorf("expected an empty cached result to be a miss, got %+v", p)
+	}
+}
+
+func TestPageImageChecksum(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config.iiifURLTemplate.value = "http://127.0.0.1:1/iiif/{PID}/{REGION}/{SIZE}/0/default.{FORMAT}"
+
+	c := newBackgroundContext()
+
+	checksum := func(source, md5 string) string {
+		t.Helper()
+
+		page := tsGenericPidInfo{Pid: "uva:2", MD5: md5, imageSourceName: source, imageSource: getIIIFUrl("uva:2")}
+
+		sum, err := c.pageImageChecksum(&page)
+		if err != nil {
+			t.Fatalf("unexpected error for [%s] source: %s", source, err.Error())
+		}
+
+		return sum
+	}
+
+	if sum := checksum(imageSourceArchive, "ABC123"); sum != "abc123" {
+		t.Errorf("expected the tracksys checksum for an original, got [%s]", sum)
+	}
+
+	// iiif images are not downloaded (the template points nowhere), and are keyed on the master
+	// and the image request parameters
+	full := checksum(imageSourceIIIF, "abc123")
+
+	if full == "abc123" || full != checksum(imageSourceIIIF, "ABC123") {
+		t.Errorf("expected a stable checksum distinct from the master's, got [%s]", full)
+	}
+
+	if checksum(imageSourceIIIF, "def456") == full {
+		t.Errorf("expected a different master to change the checksum")
+	}
+
+	config.iiifSize.value = "pct:50"
+
+	if checksum(imageSourceIIIF, "abc123") == full {
+		t.Errorf("expected different image parameters to change the checksum")
+	}
+}
+
+func TestCacheScale(t *testing.T) {
+	c := useJobStore(t)
+
+	config.resultCache.value = true
+	config.engineVersion.value = "v1"
+
+	ts := tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}, Pages: []tsGenericPidInfo{{Pid: "uva:2", MD5: "ABC123", imageSourceName: imageSourceArchive}}}
+
+	// ocr's the page at the given scale, returning the pages the cache did not have
+	run := func(reqid, scale string) []tsGenericPidInfo {
+		t.Helper()
+
+		c.jobCreate(&jobInfo{ReqID: reqid, Pid: "uva:1", Priority: jobPriorityPatron, Scale: scale}, &ts)
+
+		c.req.scale = scale
+		c.ocr.reqID = reqid
+		c.ocr.ts = &ts
+
+		misses := c.cacheCheckPages(append([]tsGenericPidInfo{}, ts.Pages...), "eng")
+
+		if len(misses) > 0 {
+			c.cacheStoreResults(reqid, []ocrPidInfo{{pid: "uva:2", text: "text at " + ocrScale(scale), scale: ocrScale(scale)}})
+		}
+
+		return misses
+	}
+
+	if misses := run("r1", ""); len(misses) != 1 {
+		t.Fatalf("expected a miss for a new page, got %d", len(misses))
+	}
+
+	// the default scale is the same whether given or not
+	if misses := run("r2", "100"); len(misses) != 0 {
+		t.Errorf("expected a hit at the default scale, got %d miss(es)", len(misses))
+	}
+
+	// a run at another scale does not reuse the first run's text, and is cached separately
+	if misses := run("r3", "50"); len(misses) != 1 {
+		t.Errorf("expected a miss at another scale, got %d hit(s)", 1-len(misses))
+	}
+
+	if misses := run("r4", "50"); len(misses) != 0 {
+		t.Errorf("expected a hit at the same scale, got %d miss(es)", len(misses))
+	}
+
+	expected := map[string]string{"100": "text at 100", "50": "text at 50"}
+
+	for scale, text := range expected {
+		if p, _ := c.cacheGet(cacheKey("abc123", "eng", "v1", scale)); p == nil || p.text != text {
+			t.Errorf("expected [%s] cached at scale %s, got %+v", text, scale, p)
+		}
+	}
+}
@@ -9,12 +9,19 @@ import (
 )
 
 type ocrRequest struct {
-	pid      string
-	unit     string
-	email    string
-	callback string
-	force    string
-	lang     string
+	pid                string
+	unit               string
+	email              string
+	callback           string
+	force              string
+	lang               string
+	priority           string
+	dryrun             string
+	overwriteCorrected string
+	scale              string // lambda image scale override, for retries
+	engine             string // lambda function override, for retries
+	retryOf            string // request id of the job being retried
+	partial            string // whether to deliver results even if some pages fail (default: service setting)
 }
 
 type ocrInfo struct {
@@ -53,10 +60,18 @@ func (c *clientContext) initClient(ctx *gin.Context) {
 
 	c.req.pid = c.ctx.Param("pid")
 	c.req.unit = c.ctx.Query("unit")
-	c.req.email = c.ctx.Query("email")
+	c.req.email = normalizeEmail(c.ctx.Query("email"))
 	c.req.callback = c.ctx.Query("callback")
 	c.req.force = c.ctx.Query("force")
 	c.req.lang = c.ctx.Query("lang")
+	c.req.priority = c.ctx.DefaultQuery("priority", jobPriorityPatron)
+	c.req.dryrun = c.ctx.Query("dryrun")
+	c.req.partial = c.ctx.Query("partial")
+
+	// hand corrections are only discarded at the request of staff
+	if staffKeyValid(ctx) == true {
+		c.req.overwriteCorrected = c.ctx.Query("overwrite_corrected")
+	}
 
 	// save info generated from the original request
 	c.ocr.subDir = c.req.pid
@@ -78,7 +93,8 @@ func (c *clientContext) log(format string, args ...interface{}) {
 		fmt.Sprintf(format, args...),
 	}
 
-	log.Printf("%s", strings.Join(parts, " "))
+	// patron email addresses are never logged in full
+	log.Printf("%s", redactEmails(strings.Join(parts, " ")))
 }
 
 func (c *clientContext) debug(format string, args ...interface{}) {
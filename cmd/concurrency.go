@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// adaptive lambda concurrency: rather than fixing a set of queues at submission, the decider keeps a
+// concurrency target (recorded as a workflow marker) and schedules pages from the pool of those not
+// yet started whenever fewer lambdas than that are running.  the target grows by one while lambdas
+// complete quickly, and halves when lambda is throttled or times out.
+//
+// workflows started before this was introduced have no target, and keep their original queues.
+
+// marker recorded in the workflow history each time the concurrency target changes
+const markerConcurrency = "concurrency"
+
+const lambdaQueuesLimit = 999
+
+type concurrencyInfo struct {
+	target   int             // current concurrency target; 0 for workflows with fixed queues
+	initial  int             // concurrency the workflow started with
+	active   int             // lambdas and timers currently open
+	peak     int             // most lambdas open at once
+	reserved map[string]bool // pages that have been scheduled, or queued to be
+}
+
+// maximum concurrency target, given the configured initial number of queues
+func lambdaQueuesMax(queues string) int {
+	if config.lambdaQueuesMax.value > 0 {
+		return minOf(config.lambdaQueuesMax.value, lambdaQueuesLimit)
+	}
+
+	n, err := strconv.Atoi(queues)
+	if err != nil || n < 1 {
+		return lambdaQueuesLimit
+	}
+
+	return minOf(2*n, lambdaQueuesLimit)
+}
+
+// lambdas completing in less than this many seconds allow the concurrency target to grow
+func lambdaGrowSeconds(timeout string) int {
+	if config.lambdaGrowSeconds.value != 0 {
+		return config.lambdaGrowSeconds.value
+	}
+
+	secs, _ := strconv.Atoi(timeout)
+
+	return secs / 4
+}
+
+// takes inventory of open lambdas and timers, scheduled pages, and the concurrency target
+func (d *decider) inventoryConcurrency(info *decisionInfo) {
+	ci := concurrencyInfo{reserved: make(map[string]bool)}
+
+	openLambdas := make(map[int64]bool)
+	openTimers := make(map[int64]bool)
+	queueTimers := 0
+
+	reserve := func(control *string) controlPayload {
+		payload := controlPayload{}
+		if control != nil {
+			json.Unmarshal([]byte(*control), &payload)
+		}
+
+		for _, pid := range payload.Pids {
+			ci.reserved[pid] = true
+		}
+
+		return payload
+	}
+
+	for _, e := range info.allEvents {
+		switch *e.EventType {
+		case "MarkerRecorded":
+			a := e.MarkerRecordedEventAttributes
+			if *a.MarkerName == markerConcurrency && a.Details != nil {
+				if n, err := strconv.Atoi(*a.Details); err == nil && n > 0 {
+					if ci.initial == 0 {
+						ci.initial = n
+					}
+					ci.target = n
+				}
+			}
+
+		case "LambdaFunctionScheduled":
+			a := e.LambdaFunctionScheduledEventAttributes
+
+			openLambdas[*e.EventId] = true
+			ci.peak = maxOf(ci.peak, len(openLambdas))
+
+			req := lambdaRequest{}
+			if a.Input != nil && json.Unmarshal([]byte(*a.Input), &req) == nil && req.Pid != "" {
+				ci.reserved[req.Pid] = true
+			}
+
+			reserve(a.Control)
+
+		case "LambdaFunctionCompleted":
+			delete(openLambdas, *e.LambdaFunctionCompletedEventAttributes.ScheduledEventId)
+
+		case "LambdaFunctionFailed":
+			delete(openLambdas, *e.LambdaFunctionFailedEventAttributes.ScheduledEventId)
+
+		case "LambdaFunctionTimedOut":
+			delete(openLambdas, *e.LambdaFunctionTimedOutEventAttributes.ScheduledEventId)
+
+		case "StartLambdaFunctionFailed":
+			if id := e.StartLambdaFunctionFailedEventAttributes.ScheduledEventId; id != nil {
+				delete(openLambdas, *id)
+			}
+
+		case "TimerStarted":
+			openTimers[*e.EventId] = true
+
+			if reserve(e.TimerStartedEventAttributes.Control).Type == controlPayloadTypeTimerLambdaQueue {
+				queueTimers++
+			}
+
+		case "TimerFired":
+			delete(openTimers, *e.TimerFiredEventAttributes.StartedEventId)
+
+		case "TimerCanceled":
+			delete(openTimers, *e.TimerCanceledEventAttributes.StartedEventId)
+		}
+	}
+
+	ci.active = len(openLambdas) + len(openTimers)
+
+	// fixed queues: one per queue timer started with the workflow
+	if ci.initial == 0 {
+		ci.initial = queueTimers
+	}
+
+	info.concurrency = ci
+}
+
+// pages not yet scheduled, in order
+func (ci concurrencyInfo) pool(pages []ocrPageInfo) []string {
+	var pids []string
+
+	for _, p := range pages {
+		if ci.reserved[p.Pid] == false {
+			pids = append(pids, p.Pid)
+		}
+	}
+
+	return pids
+}
+
+// seconds between a completed lambda starting and completing, or -1 if unknown
+func lambdaDuration(info *decisionInfo, e *swf.HistoryEvent) float64 {
+	started := awsEventWithID(info.allEvents, *e.LambdaFunctionCompletedEventAttributes.StartedEventId)
+
+	if started == nil || started.EventTimestamp == nil || e.EventTimestamp == nil {
+		return -1
+	}
+
+	return e.EventTimestamp.Sub(*started.EventTimestamp).Seconds()
+}
+
+// adjusts the concurrency target based on the recent lambda events, returning a marker
+// decision recording the new target if it changed
+func (d *decider) adjustConcurrency(info *decisionInfo) *swf.Decision {
+	ci := &info.concurrency
+
+	if ci.target == 0 {
+		return nil
+	}
+
+	congested := false
+	fast := false
+
+	for _, e := range info.recentEvents {
+		switch *e.EventType {
+		case "LambdaFunctionTimedOut":
+			congested = true
+
+		case "LambdaFunctionFailed":
+			if lambdaFailureFromEvent(e) == lambdaFailureThrottle {
+				congested = true
+			}
+
+		case "LambdaFunctionCompleted":
+			if secs := lambdaDuration(info, e); secs >= 0 && secs < float64(d.growSeconds) {
+				fast = true
+			}
+		}
+	}
+
+	target := ci.target
+
+	switch {
+	case congested == true:
+		target = maxOf(1, target/2)
+
+	case fast == true && len(ci.pool(info.req.Pages)) > 0:
+		target = minOf(d.queuesMax, target+1)
+	}
+
+	if target == ci.target {
+		return nil
+	}
+
+	d.info("[AWS] [%s] lambda concurrency target: %d -> %d (%d running)", info.workflowID, ci.target, target, ci.active)
+
+	ci.target = target
+
+	return awsRecordMarker(markerConcurrency, strconv.Itoa(target))
+}
+
+// schedules lambdas for pages from the pool, up to the concurrency target (counting
+// lambdas and timers from decisions already made for this task)
+func (d *decider) fillConcurrency(info *decisionInfo, decisions []*swf.Decision, origEventID int64) ([]*swf.Decision, error) {
+	ci := &info.concurrency
+
+	active := ci.active
+	for _, decision := range decisions {
+		switch *decision.DecisionType {
+		case "ScheduleLambdaFunction", "StartTimer":
+			active++
+		}
+	}
+
+	pool := ci.pool(info.req.Pages)
+
+	var scheduled []*swf.Decision
+
+	for i := 0; i < ci.target-active && i < len(pool); i++ {
+		next, err := d.scheduleQueueLambda(info, []string{pool[i]}, origEventID)
+		if err != nil {
+			return nil, err
+		}
+
+		ci.reserved[pool[i]] = true
+		scheduled = append(scheduled, next)
+	}
+
+	if len(scheduled) > 0 {
+		d.info("[AWS] [%s] scheduled %d lambda(s) from the pool (%d running, target %d, %d page(s) left)", info.workflowID, len(scheduled), active, ci.target, len(pool)-len(scheduled))
+	}
+
+	return scheduled, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"reflect"
 	"strconv"
 )
 
@@ -35,12 +36,52 @@ type configData struct {
 	archiveDir            configStringItem
 	lambdaAttempts        configStringItem
 	lambdaQueues          configStringItem
+	lambdaQueuesMax       configIntItem
+	lambdaGrowSeconds     configIntItem
+	lambdaMemory          configIntItem
+	lambdaRetryBackoff    configStringItem
+	lambdaRetryJitter     configIntItem
+	lambdaRetryFailures   configStringItem
+	lambdaRetryScales     configStringItem
+	lambdaFinalLang       configStringItem
+	lambdaFinalEngine     configStringItem
+	lambdaEngines         configStringItem
+	decisionRecordDir     configStringItem
+	manifestThreshold     configIntItem
+	manifestDir           configStringItem
 	concurrentUploads     configStringItem
+	maxRunningJobs        configIntItem
+	jobLockLease          configIntItem
+	reaperInterval        configIntItem
+	phaseTimeouts         configStringItem
+	workDirRetention      configIntItem
+	s3Retention           configIntItem
+	resultRetention       configIntItem
 	disableUploads        configBoolItem
+	preprocess            configStringItem
+	preprocessDPI         configIntItem
+	preprocessMegapixels  configIntItem
+	resultCache           configBoolItem
+	engineVersion         configStringItem
+	qualityThreshold      configIntItem
+	qualityReview         configBoolItem
+	langDetection         configBoolItem
+	langSamplePages       configIntItem
+	partialSuccess        configBoolItem
 	iiifURLTemplate       configStringItem
+	iiifRegion            configStringItem
+	iiifSize              configStringItem
+	iiifFormat            configStringItem
+	imageSources          configStringItem
+	imageTimeout          configIntItem
+	s3ImageTemplate       configStringItem
+	httpImageTemplate     configStringItem
 	tsAPIHost             configStringItem
 	tsAPIKey              configStringItem
 	tsReadOnly            configBoolItem
+	staffAPIKey           configStringItem
+	recipientKey          configStringItem
+	recipientRetention    configIntItem
 	emailName             configStringItem
 	emailAddress          configStringItem
 	emailHost             configStringItem
@@ -68,9 +109,46 @@ func init() {
 	config.archiveDir = configStringItem{value: "", configItem: configItem{flag: "a", env: "OCRWS_OCR_ARCHIVE_DIR", desc: "ocr archive directory"}}
 	config.lambdaAttempts = configStringItem{value: "", configItem: configItem{flag: "e", env: "OCRWS_LAMBDA_ATTEMPTS", desc: "max lambda attempts"}}
 	config.lambdaQueues = configStringItem{value: "", configItem: configItem{flag: "q", env: "OCRWS_LAMBDA_QUEUES", desc: "concurrent lambda queues (1 <= # <= 999)"}}
+	config.lambdaQueuesMax = configIntItem{value: 0, configItem: configItem{flag: "lambda-queues-max", env: "OCRWS_LAMBDA_QUEUES_MAX", desc: "maximum concurrent lambdas while adapting to throughput (0 => twice the initial queues)"}}
+	config.lambdaGrowSeconds = configIntItem{value: 0, configItem: configItem{flag: "lambda-grow-seconds", env: "OCRWS_LAMBDA_GROW_SECONDS", desc: "lambdas completing faster than this allow more to run at once (0 => a quarter of the lambda timeout, -1 => never)"}}
+	config.lambdaMemory = configIntItem{value: 0, configItem: configItem{flag: "lambda-memory", env: "OCRWS_LAMBDA_MEMORY", desc: "lambda memory size in MB, for cost estimates (0 => 1024)"}}
+	config.lambdaRetryBackoff = configStringItem{value: "", configItem: configItem{flag: "lambda-retry-backoff", env: "OCRWS_LAMBDA_RETRY_BACKOFF", desc: "lambda retry delay curve: exponential[:base], linear:seconds, or fixed:seconds (default: exponential:1)"}}
+	config.lambdaRetryJitter = configIntItem{value: 0, configItem: configItem{flag: "lambda-retry-jitter", env: "OCRWS_LAMBDA_RETRY_JITTER", desc: "max random seconds added to lambda retry delays (0 => 30, -1 => none)"}}
+	config.lambdaRetryFailures = configStringItem{value: "", configItem: configItem{flag: "lambda-retry-failures", env: "OCRWS_LAMBDA_RETRY_FAILURES", desc: "per failure type lambda retry handling (e.g. \"timeout=5/scale,throttle=8/x4\"; default: max lambda attempts, scaling timeouts)"}}
+	config.lambdaRetryScales = configStringItem{value: "", configItem: configItem{flag: "lambda-retry-scales", env: "OCRWS_LAMBDA_RETRY_SCALES", desc: "descending image scales for reduced-scale lambda retries (e.g. \"75,50,25\"; default: steps of 10)"}}
+	config.lambdaFinalLang = configStringItem{value: "", configItem: configItem{flag: "lambda-retry-final-lang", env: "OCRWS_LAMBDA_RETRY_FINAL_LANG", desc: "language to use for a page's final lambda attempt (default: unchanged)"}}
+	config.lambdaFinalEngine = configStringItem{value: "", configItem: configItem{flag: "lambda-retry-final-engine", env: "OCRWS_LAMBDA_RETRY_FINAL_ENGINE", desc: "lambda function to use for a page's final attempt (default: unchanged)"}}
+	config.lambdaEngines = configStringItem{value: "", configItem: configItem{flag: "lambda-engines", env: "OCRWS_LAMBDA_ENGINES", desc: "comma-separated lambda functions staff may choose when retrying a job (the default and final-attempt functions are always allowed)"}}
+	config.decisionRecordDir = configStringItem{value: "", configItem: configItem{flag: "decision-record-dir", env: "OCRWS_DECISION_RECORD_DIR", desc: "directory to record decision task histories to, for offline replay (default: none)"}}
+	config.manifestThreshold = configIntItem{value: 0, configItem: configItem{flag: "manifest-threshold", env: "OCRWS_MANIFEST_THRESHOLD", desc: "encoded workflow input size above which the request is stored as a manifest in s3 (0 => 30000; swf limit is 32768)"}}
+	config.manifestDir = configStringItem{value: "", configItem: configItem{flag: "manifest-dir", env: "OCRWS_MANIFEST_DIR", desc: "local directory to store workflow manifests in instead of s3 (for testing)"}}
 	config.concurrentUploads = configStringItem{value: "", configItem: configItem{flag: "o", env: "OCRWS_CONCURRENT_UPLOADS", desc: "concurrent uploads (0 => # cpu cores)"}}
+	config.maxRunningJobs = configIntItem{value: 0, configItem: configItem{flag: "max-running-jobs", env: "OCRWS_MAX_RUNNING_JOBS", desc: "max concurrently running jobs (0 => unlimited)"}}
+	config.jobLockLease = configIntItem{value: 300, configItem: configItem{flag: "job-lock-lease", env: "OCRWS_JOB_LOCK_LEASE", desc: "seconds a pid's job lock lasts without a heartbeat from its instance"}}
+	config.reaperInterval = configIntItem{value: 0, configItem: configItem{flag: "reaper-interval", env: "OCRWS_REAPER_INTERVAL", desc: "seconds between stale job reaper runs (0 => 300, -1 => disabled)"}}
+	config.phaseTimeouts = configStringItem{value: "", configItem: configItem{flag: "phase-timeouts", env: "OCRWS_PHASE_TIMEOUTS", desc: "per job phase seconds after which a job is considered stuck (e.g. \"uploading=3600,ocr=43200\"; 0 => never; queued jobs never time out by default)"}}
+	config.workDirRetention = configIntItem{value: 0, configItem: configItem{flag: "work-dir-retention", env: "OCRWS_WORK_DIR_RETENTION", desc: "hours to keep work directories that no active job is using (0 => 72, -1 => forever)"}}
+	config.s3Retention = configIntItem{value: 0, configItem: configItem{flag: "s3-retention", env: "OCRWS_S3_RETENTION", desc: "hours to keep s3 request prefixes that no active job is using (0 => leave to s3 lifecycle policies)"}}
+	config.resultRetention = configIntItem{value: 0, configItem: configItem{flag: "result-retention", env: "OCRWS_RESULT_RETENTION", desc: "days to keep finished jobs' page results and unused cached results (0 => forever)"}}
 	config.disableUploads = configBoolItem{value: false, configItem: configItem{flag: "u", env: "OCRWS_DISABLE_UPLOADS", desc: "disable uploads (for workflow development)"}}
+	config.preprocess = configStringItem{value: "", configItem: configItem{flag: "preprocess", env: "OCRWS_PREPROCESS", desc: "image preprocessing steps by ocr hint (e.g. \"Regular Font=scale,gray;*=scale\")"}}
+	config.preprocessDPI = configIntItem{value: 0, configItem: configItem{flag: "preprocess-dpi", env: "OCRWS_PREPROCESS_DPI", desc: "preprocessing target dpi (0 => 300)"}}
+	config.preprocessMegapixels = configIntItem{value: 0, configItem: configItem{flag: "preprocess-megapixels", env: "OCRWS_PREPROCESS_MEGAPIXELS", desc: "preprocessing pixel budget in megapixels (0 => 25)"}}
+	config.resultCache = configBoolItem{value: false, configItem: configItem{flag: "result-cache", env: "OCRWS_RESULT_CACHE", desc: "reuse ocr results for unchanged page images"}}
+	config.engineVersion = configStringItem{value: "", configItem: configItem{flag: "engine-version", env: "OCRWS_ENGINE_VERSION", desc: "ocr engine version for result cache keys (default: lambda function name)"}}
+	config.qualityThreshold = configIntItem{value: 0, configItem: configItem{flag: "quality-threshold", env: "OCRWS_QUALITY_THRESHOLD", desc: "page confidence threshold (0 => 70)"}}
+	config.qualityReview = configBoolItem{value: false, configItem: configItem{flag: "quality-review", env: "OCRWS_QUALITY_REVIEW", desc: "hold low quality ocr for review instead of posting to tracksys"}}
+	config.langDetection = configBoolItem{value: false, configItem: configItem{flag: "language-detection", env: "OCRWS_LANGUAGE_DETECTION", desc: "detect language from sample pages when there is no language hint"}}
+	config.langSamplePages = configIntItem{value: 0, configItem: configItem{flag: "language-sample-pages", env: "OCRWS_LANGUAGE_SAMPLE_PAGES", desc: "pages to sample for language detection (0 => 3)"}}
+	config.partialSuccess = configBoolItem{value: false, configItem: configItem{flag: "partial-success", env: "OCRWS_PARTIAL_SUCCESS", desc: "deliver results when some pages fail ocr, marking those pages unavailable"}}
 	config.iiifURLTemplate = configStringItem{value: "", configItem: configItem{flag: "i", env: "OCRWS_IIIF_URL_TEMPLATE", desc: "iiif url template"}}
+	config.iiifRegion = configStringItem{value: "", configItem: configItem{flag: "iiif-region", env: "OCRWS_IIIF_REGION", desc: "iiif region for {REGION} in url template (default: full)"}}
+	config.iiifSize = configStringItem{value: "", configItem: configItem{flag: "iiif-size", env: "OCRWS_IIIF_SIZE", desc: "iiif size for {SIZE} in url template (default: full)"}}
+	config.iiifFormat = configStringItem{value: "", configItem: configItem{flag: "iiif-format", env: "OCRWS_IIIF_FORMAT", desc: "iiif format for {FORMAT} in url template (default: jpg)"}}
+	config.imageSources = configStringItem{value: "", configItem: configItem{flag: "image-sources", env: "OCRWS_IMAGE_SOURCES", desc: "image sources to try, in order (archive, iiif, s3, http; default: archive,iiif)"}}
+	config.imageTimeout = configIntItem{value: 0, configItem: configItem{flag: "image-timeout", env: "OCRWS_IMAGE_TIMEOUT", desc: "image download timeout in seconds (0 => 300)"}}
+	config.s3ImageTemplate = configStringItem{value: "", configItem: configItem{flag: "s3-image-template", env: "OCRWS_S3_IMAGE_TEMPLATE", desc: "s3 image location template (e.g. s3://bucket/{DIR}/{FILENAME})"}}
+	config.httpImageTemplate = configStringItem{value: "", configItem: configItem{flag: "http-image-template", env: "OCRWS_HTTP_IMAGE_TEMPLATE", desc: "http image url template (e.g. https://host/{DIR}/{FILENAME})"}}
 	config.tsAPIHost = configStringItem{value: "", configItem: configItem{flag: "h", env: "OCRWS_TRACKSYS_API_HOST", desc: "tracksys host"}}
 	config.tsAPIKey = configStringItem{value: "", configItem: configItem{flag: "k", env: "OCRWS_TRACKSYS_API_KEY", desc: "tracksys write key"}}
 	config.tsReadOnly = configBoolItem{value: false, configItem: configItem{flag: "r", env: "OCRWS_TRACKSYS_READ_ONLY", desc: "tracksys read-only flag"}}
@@ -78,6 +156,9 @@ func init() {
 	config.emailAddress = configStringItem{value: "", configItem: configItem{flag: "d", env: "OCRWS_EMAIL_ADDRESS", desc: "email address"}}
 	config.emailHost = configStringItem{value: "", configItem: configItem{flag: "s", env: "OCRWS_EMAIL_HOST", desc: "smtp host"}}
 	config.emailPort = configIntItem{value: 0, configItem: configItem{flag: "p", env: "OCRWS_EMAIL_PORT", desc: "smtp port"}}
+	config.staffAPIKey = configStringItem{value: "", configItem: configItem{flag: "staff-key", env: "OCRWS_STAFF_API_KEY", desc: "api key for staff endpoints (review, etc.); disabled if empty"}}
+	config.recipientKey = configStringItem{value: "", configItem: configItem{flag: "recipient-key", env: "OCRWS_RECIPIENT_KEY", desc: "256-bit key (hex or base64) for encrypting stored email addresses and callbacks; stored unencrypted if empty"}}
+	config.recipientRetention = configIntItem{value: 0, configItem: configItem{flag: "recipient-retention", env: "OCRWS_RECIPIENT_RETENTION", desc: "hours to keep finished jobs' email addresses and callbacks (0 => 168, -1 => forever)"}}
 	config.awsDisabled = configBoolItem{value: false, configItem: configItem{flag: "L", env: "AWS_DISABLED", desc: "aws disabled flag"}}
 	config.awsAccessKeyID = configStringItem{value: "", configItem: configItem{flag: "A", env: "AWS_ACCESS_KEY_ID", desc: "aws access key id"}}
 	config.awsSecretAccessKey = configStringItem{value: "", configItem: configItem{flag: "S", env: "AWS_SECRET_ACCESS_KEY", desc: "aws secret access key"}}
@@ -133,6 +214,61 @@ func maskValue(value string) string {
 	return fmt.Sprintf("...%s", value[len(value)-4:])
 }
 
+// items whose values are masked wherever the configuration is shown
+var configSecrets = map[string]bool{
+	"tsAPIKey":           true,
+	"staffAPIKey":        true,
+	"recipientKey":       true,
+	"awsAccessKeyID":     true,
+	"awsSecretAccessKey": true,
+}
+
+type configSummaryItem struct {
+	Name  string `json:"name"`
+	Flag  string `json:"flag"`
+	Env   string `json:"env"`
+	Value string `json:"value"`
+}
+
+// returns the effective value of every config item, in declaration order
+func configSummary() []configSummaryItem {
+	var items []configSummaryItem
+
+	v := reflect.ValueOf(config)
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+
+		// every item embeds a configItem alongside its value
+		info := field.FieldByName("configItem")
+		value := field.FieldByName("value")
+
+		item := configSummaryItem{
+			Name: t.Field(i).Name,
+			Flag: info.FieldByName("flag").String(),
+			Env:  info.FieldByName("env").String(),
+		}
+
+		switch value.Kind() {
+		case reflect.String:
+			item.Value = value.String()
+		case reflect.Bool:
+			item.Value = strconv.FormatBool(value.Bool())
+		case reflect.Int:
+			item.Value = strconv.FormatInt(value.Int(), 10)
+		}
+
+		if configSecrets[item.Name] == true {
+			item.Value = maskValue(item.Value)
+		}
+
+		items = append(items, item)
+	}
+
+	return items
+}
+
 func getConfigValues() {
 	// get values from the command line first, falling back to environment variables
 	flagStringVar(&config.listenPort)
@@ -140,12 +276,52 @@ func getConfigValues() {
 	flagStringVar(&config.archiveDir)
 	flagStringVar(&config.lambdaAttempts)
 	flagStringVar(&config.lambdaQueues)
+	flagIntVar(&config.lambdaQueuesMax)
+	flagIntVar(&config.lambdaGrowSeconds)
+	flagIntVar(&config.lambdaMemory)
+	flagStringVar(&config.lambdaRetryBackoff)
+	flagIntVar(&config.lambdaRetryJitter)
+	flagStringVar(&config.lambdaRetryFailures)
+	flagStringVar(&config.lambdaRetryScales)
+	flagStringVar(&config.lambdaFinalLang)
+	flagStringVar(&config.lambdaFinalEngine)
+	flagStringVar(&config.lambdaEngines)
+	flagStringVar(&config.decisionRecordDir)
+	flagIntVar(&config.manifestThreshold)
+	flagStringVar(&config.manifestDir)
 	flagStringVar(&config.concurrentUploads)
+	flagIntVar(&config.maxRunningJobs)
+	flagIntVar(&config.jobLockLease)
+	flagIntVar(&config.reaperInterval)
+	flagStringVar(&config.phaseTimeouts)
+	flagIntVar(&config.workDirRetention)
+	flagIntVar(&config.s3Retention)
+	flagIntVar(&config.resultRetention)
 	flagBoolVar(&config.disableUploads)
+	flagStringVar(&config.preprocess)
+	flagIntVar(&config.preprocessDPI)
+	flagIntVar(&config.preprocessMegapixels)
+	flagBoolVar(&config.resultCache)
+	flagStringVar(&config.engineVersion)
+	flagIntVar(&config.qualityThreshold)
+	flagBoolVar(&config.qualityReview)
+	flagBoolVar(&config.langDetection)
+	flagIntVar(&config.langSamplePages)
+	flagBoolVar(&config.partialSuccess)
 	flagStringVar(&config.iiifURLTemplate)
+	flagStringVar(&config.iiifRegion)
+	flagStringVar(&config.iiifSize)
+	flagStringVar(&config.iiifFormat)
+	flagStringVar(&config.imageSources)
+	flagIntVar(&config.imageTimeout)
+	flagStringVar(&config.s3ImageTemplate)
+	flagStringVar(&config.httpImageTemplate)
 	flagStringVar(&config.tsAPIHost)
 	flagStringVar(&config.tsAPIKey)
 	flagBoolVar(&config.tsReadOnly)
+	flagStringVar(&config.staffAPIKey)
+	flagStringVar(&config.recipientKey)
+	flagIntVar(&config.recipientRetention)
 	flagStringVar(&config.emailName)
 	flagStringVar(&config.emailAddress)
 	flagStringVar(&config.emailHost)
@@ -207,12 +383,52 @@ func getConfigValues() {
 	log.Printf("[CONFIG] archiveDir            = [%s]", config.archiveDir.value)
 	log.Printf("[CONFIG] lambdaAttempts        = [%s]", config.lambdaAttempts.value)
 	log.Printf("[CONFIG] lambdaQueues          = [%s]", config.lambdaQueues.value)
+	log.Printf("[CONFIG] lambdaQueuesMax       = [%d]", config.lambdaQueuesMax.value)
+	log.Printf("[CONFIG] lambdaGrowSeconds     = [%d]", config.lambdaGrowSeconds.value)
+	log.Printf("[CONFIG] lambdaMemory          = [%d]", config.lambdaMemory.value)
+	log.Printf("[CONFIG] lambdaRetryBackoff    = [%s]", config.lambdaRetryBackoff.value)
+	log.Printf("[CONFIG] lambdaRetryJitter     = [%d]", config.lambdaRetryJitter.value)
+	log.Printf("[CONFIG] lambdaRetryFailures   = [%s]", config.lambdaRetryFailures.value)
+	log.Printf("[CONFIG] lambdaRetryScales     = [%s]", config.lambdaRetryScales.value)
+	log.Printf("[CONFIG] lambdaFinalLang       = [%s]", config.lambdaFinalLang.value)
+	log.Printf("[CONFIG] lambdaFinalEngine     = [%s]", config.lambdaFinalEngine.value)
+	log.Printf("[CONFIG] lambdaEngines         = [%s]", config.lambdaEngines.value)
+	log.Printf("[CONFIG] decisionRecordDir     = [%s]", config.decisionRecordDir.value)
+	log.Printf("[CONFIG] manifestThreshold     = [%d]", config.manifestThreshold.value)
+	log.Printf("[CONFIG] manifestDir           = [%s]", config.manifestDir.value)
 	log.Printf("[CONFIG] concurrentUploads     = [%s]", config.concurrentUploads.value)
+	log.Printf("[CONFIG] maxRunningJobs        = [%d]", config.maxRunningJobs.value)
+	log.Printf("[CONFIG] jobLockLease          = [%d]", config.jobLockLease.value)
+	log.Printf("[CONFIG] reaperInterval        = [%d]", config.reaperInterval.value)
+	log.Printf("[CONFIG] phaseTimeouts         = [%s]", config.phaseTimeouts.value)
+	log.Printf("[CONFIG] workDirRetention      = [%d]", config.workDirRetention.value)
+	log.Printf("[CONFIG] s3Retention           = [%d]", config.s3Retention.value)
+	log.Printf("[CONFIG] resultRetention       = [%d]", config.resultRetention.value)
 	log.Printf("[CONFIG] disableUploads        = [%v]", config.disableUploads.value)
+	log.Printf("[CONFIG] preprocess            = [%s]", config.preprocess.value)
+	log.Printf("[CONFIG] preprocessDPI         = [%d]", config.preprocessDPI.value)
+	log.Printf("[CONFIG] preprocessMegapixels  = [%d]", config.preprocessMegapixels.value)
+	log.Printf("[CONFIG] resultCache           = [%v]", config.resultCache.value)
+	log.Printf("[CONFIG] engineVersion         = [%s]", config.engineVersion.value)
+	log.Printf("[CONFIG] qualityThreshold      = [%d]", config.qualityThreshold.value)
+	log.Printf("[CONFIG] qualityReview         = [%v]", config.qualityReview.value)
+	log.Printf("[CONFIG] langDetection         = [%v]", config.langDetection.value)
+	log.Printf("[CONFIG] langSamplePages       = [%d]", config.langSamplePages.value)
+	log.Printf("[CONFIG] partialSuccess        = [%v]", config.partialSuccess.value)
 	log.Printf("[CONFIG] iiifURLTemplate       = [%s]", config.iiifURLTemplate.value)
+	log.Printf("[CONFIG] iiifRegion            = [%s]", config.iiifRegion.value)
+	log.Printf("[CONFIG] iiifSize              = [%s]", config.iiifSize.value)
+	log.Printf("[CONFIG] iiifFormat            = [%s]", config.iiifFormat.value)
+	log.Printf("[CONFIG] imageSources          = [%s]", config.imageSources.value)
+	log.Printf("[CONFIG] imageTimeout          = [%d]", config.imageTimeout.value)
+	log.Printf("[CONFIG] s3ImageTemplate       = [%s]", config.s3ImageTemplate.value)
+	log.Printf("[CONFIG] httpImageTemplate     = [%s]", config.httpImageTemplate.value)
 	log.Printf("[CONFIG] tsAPIHost             = [%s]", config.tsAPIHost.value)
 	log.Printf("[CONFIG] tsAPIKey              = [%s]", maskValue(config.tsAPIKey.value))
 	log.Printf("[CONFIG] tsReadOnly            = [%v]", config.tsReadOnly.value)
+	log.Printf("[CONFIG] staffAPIKey           = [%s]", maskValue(config.staffAPIKey.value))
+	log.Printf("[CONFIG] recipientKey          = [%s]", maskValue(config.recipientKey.value))
+	log.Printf("[CONFIG] recipientRetention    = [%d]", config.recipientRetention.value)
 	log.Printf("[CONFIG] emailName             = [%s]", config.emailName.value)
 	log.Printf("[CONFIG] emailAddress          = [%s]", config.emailAddress.value)
 	log.Printf("[CONFIG] emailHost             = [%s]", config.emailHost.value)
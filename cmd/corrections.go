@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// manual corrections of page text by staff.  corrected pages are left alone by later
+// ocr runs, unless the request explicitly asks to overwrite them.
+
+const versionSourceManual = "manual"
+
+// corrected text formats
+const (
+	correctionFormatPlain = "plain"
+	correctionFormatHOCR  = "hocr"
+	correctionFormatALTO  = "alto"
+)
+
+// upper limit on the size of a correction upload
+const correctionMaxBytes = 10 * 1024 * 1024
+
+func correctionFormat(format, body string) string {
+	if format != "" {
+		return format
+	}
+
+	trimmed := strings.ToLower(strings.TrimSpace(body))
+
+	switch {
+	case strings.HasPrefix(trimmed, "<") == false:
+		return correctionFormatPlain
+	case strings.Contains(trimmed, "<alto"):
+		return correctionFormatALTO
+	case strings.Contains(trimmed, "ocr_page"), strings.Contains(trimmed, "ocrx_word"), strings.Contains(trimmed, "<html"):
+		return correctionFormatHOCR
+	}
+
+	return correctionFormatPlain
+}
+
+// collects words into lines and paragraphs while walking a structured ocr document
+type textFlattener struct {
+	text strings.Builder
+	line []string
+}
+
+func (f *textFlattener) word(w string) {
+	if w = strings.TrimSpace(w); w != "" {
+		f.line = append(f.line, w)
+	}
+}
+
+// appends to the previous word, e.g. an alto hyphen
+func (f *textFlattener) suffix(s string) {
+	if len(f.line) == 0 {
+		f.word(s)
+		return
+	}
+
+	f.line[len(f.line)-1] += s
+}
+
+func (f *textFlattener) endLine() {
+	if len(f.line) > 0 {
+		f.text.WriteString(strings.Join(f.line, " ") + "\n")
+		f.line = nil
+	}
+}
+
+func (f *textFlattener) endParagraph() {
+	f.endLine()
+	f.text.WriteString("\n")
+}
+
+func (f *textFlattener) String() string {
+	f.endLine()
+	return f.text.String()
+}
+
+func newLenientDecoder(body string) *xml.Decoder {
+	d := xml.NewDecoder(strings.NewReader(body))
+
+	// hocr is often html rather than xhtml
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	return d
+}
+
+func xmlAttr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+func hasHOCRClass(classes []string, names ...string) bool {
+	for _, c := range classes {
+		for _, n := range names {
+			if c == n {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// flattens hocr to plain text, one line per ocr_line and a blank line after each paragraph
+func flattenHOCR(body string) (string, error) {
+	d := newLenientDecoder(body)
+
+	var f textFlattener
+	var stack [][]string
+
+	// depth within elements whose text is page content
+	inText := 0
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid hocr: [%s]", err.Error())
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			classes := strings.Fields(xmlAttr(t, "class"))
+			stack = append(stack, classes)
+			if hasHOCRClass(classes, "ocrx_word", "ocr_line", "ocrx_line", "ocr_header", "ocr_caption", "ocr_textfloat") {
+				inText++
+			}
+
+		case xml.EndElement:
+			if len(stack) == 0 {
+				continue
+			}
+
+			classes := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			if hasHOCRClass(classes, "ocrx_word", "ocr_line", "ocrx_line", "ocr_header", "ocr_caption", "ocr_textfloat") {
+				inText--
+			}
+
+			switch {
+			case hasHOCRClass(classes, "ocr_line", "ocrx_line", "ocr_header", "ocr_caption", "ocr_textfloat"):
+				f.endLine()
+			case hasHOCRClass(classes, "ocr_par", "ocr_carea", "ocrx_block"):
+				f.endParagraph()
+			}
+
+		case xml.CharData:
+			if inText > 0 {
+				for _, w := range strings.Fields(string(t)) {
+					f.word(w)
+				}
+			}
+		}
+	}
+
+	return f.String(), nil
+}
+
+// flattens alto to plain text, one line per TextLine and a blank line after each TextBlock
+func flattenALTO(body string) (string, error) {
+	d := xml.NewDecoder(strings.NewReader(body))
+
+	var f textFlattener
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid alto: [%s]", err.Error())
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "String":
+				f.word(xmlAttr(t, "CONTENT"))
+			case "HYP":
+				f.suffix(xmlAttr(t, "CONTENT"))
+			}
+
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "TextLine":
+				f.endLine()
+			case "TextBlock":
+				f.endParagraph()
+			}
+		}
+	}
+
+	return f.String(), nil
+}
+
+func flattenCorrection(format, body string) (string, error) {
+	switch format {
+	case correctionFormatPlain:
+		return body, nil
+	case correctionFormatHOCR:
+		return flattenHOCR(body)
+	case correctionFormatALTO:
+		return flattenALTO(body)
+	}
+
+	return "", fmt.Errorf("unsupported format: [%s]", format)
+}
+
+func (c *clientContext) correctionSave(pid string, versionID int64) error {
+	query := "insert or replace into page_corrections (pid, version_id, created) values (?, ?, ?);"
+	if _, err := jobDB.Exec(query, pid, versionID, fmt.Sprintf("%d", time.Now().Unix())); err != nil {
+		c.err("[CORRECTION] failed to save correction: [%s]", err.Error())
+		return errors.New("failed to save correction")
+	}
+
+	return nil
+}
+
+func (c *clientContext) correctionDelete(pid string) error {
+	if _, err := jobDB.Exec("delete from page_corrections where pid = ?;", pid); err != nil {
+		c.err("[CORRECTION] failed to remove correction: [%s]", err.Error())
+		return errors.New("failed to remove correction")
+	}
+
+	return nil
+}
+
+// returns the corrected text version for a page, if it has one
+func (c *clientContext) correctionGet(pid string) (*textVersion, error) {
+	var id int64
+
+	if err := jobDB.QueryRow("select version_id from page_corrections where pid = ?;", pid).Scan(&id); err != nil {
+		if err != sql.ErrNoRows {
+			c.err("[CORRECTION] failed to retrieve correction: [%s]", err.Error())
+			return nil, errors.New("failed to retrieve correction")
+		}
+		return nil, nil
+	}
+
+	return c.versionGet(pid, id)
+}
+
+// records corrected text for any pages that have it, and returns the pages that still need ocr
+func (c *clientContext) skipCorrectedPages(pages []tsGenericPidInfo) []tsGenericPidInfo {
+	if b, err := strconv.ParseBool(c.req.overwriteCorrected); err == nil && b == true {
+		c.info("[CORRECTION] overwriting any corrected pages")
+		return pages
+	}
+
+	var remaining []tsGenericPidInfo
+	var corrected []ocrPidInfo
+
+	for _, page := range pages {
+		v, err := c.correctionGet(page.Pid)
+		if err != nil || v == nil {
+			remaining = append(remaining, page)
+			continue
+		}
+
+		corrected = append(corrected, ocrPidInfo{pid: page.Pid, text: v.Text, corrected: true})
+	}
+
+	if len(corrected) > 0 {
+		c.jobSaveCorrectedPages(c.ocr.reqID, corrected)
+		c.info("[CORRECTION] skipping %d corrected page(s)", len(corrected))
+	}
+
+	return remaining
+}
+
+/**
+ * Replace the text of a page with a manual correction
+ */
+func pageTextUpdateHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	buf, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, correctionMaxBytes))
+	if err != nil {
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: Could not read corrected text: [%s]", err.Error()))
+		return
+	}
+
+	body := string(buf)
+	format := correctionFormat(ctx.Query("format"), body)
+
+	text, err := flattenCorrection(format, body)
+	if err != nil {
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	text = cleanOcrText(text)
+
+	if text == "" {
+		c.respondString(http.StatusBadRequest, "ERROR: Corrected text is empty")
+		return
+	}
+
+	if config.tsReadOnly.value == true {
+		c.info("[%s] SKIPPING TRACKSYS POST", c.req.pid)
+		c.respondString(http.StatusConflict, "ERROR: Tracksys is read-only")
+		return
+	}
+
+	id, err := c.versionAdd(textVersion{Pid: c.req.pid, Source: versionSourceManual, Text: text})
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	if err := c.versionPost(c.req.pid, id, text); err != nil {
+		c.err("[%s] Tracksys OCR posting failed: [%s]", c.req.pid, err.Error())
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	c.searchUpdatePage(c.req.pid, text)
+
+	if err := c.correctionSave(c.req.pid, id); err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	c.info("[%s] saved manual correction (format: [%s]  version: %d  length: %d)", c.req.pid, format, id, len(text))
+
+	c.audit(auditEntry{Action: auditPageCorrected, Page: c.req.pid, Details: fmt.Sprintf("version %d (format: %s  %d characters)", id, format, len(text))})
+
+	status := make(map[string]interface{})
+
+	status["pid"] = c.req.pid
+	status["format"] = format
+	status["version"] = id
+
+	c.respondJSON(http.StatusOK, status)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testHOCR = `<!DOCTYPE html>
+<html><head><title>page</title><meta name="ocr-system" content="tesseract"></head>
+<body><div class="ocr_page" title="bbox 0 0 2000 3000">
+<div class="ocr_carea"><p class="ocr_par">
+<span class="ocr_line"><span class="ocrx_word">The</span> <span class="ocrx_word">quick</span>
+<span class="ocrx_word">brown</span></span>
+<span class="ocr_line"><span class="ocrx_word">fox</span> <span class="ocrx_word">&amp;</span> <span class="ocrx_word"><strong>hound</strong></span></span>
+</p><p class="ocr_par">
+<span class="ocr_line"><span class="ocrx_word">Second</span> <span class="ocrx_word">paragraph</span></span>
+</p></div>
+<div class="ocr_photo">not page text</div>
+<span class="ocr_caption"><span class="ocrx_word">Figure</span> <span class="ocrx_word">one</span></span>
+</div></body></html>`
+
+const testALTO = `<?xml version="1.0" encoding="UTF-8"?>
+<alto xmlns="http://www.loc.gov/standards/alto/ns-v4#">
+<Layout><Page ID="p1"><PrintSpace>
+<TextBlock ID="b1">
+<TextLine><String CONTENT="The"/><SP/><String CONTENT="quick"/><SP/><String CONTENT="bro"/><HYP CONTENT="-"/></TextLine>
+<TextLine><String CONTENT="wn"/><SP/><String CONTENT="fox &amp; hound"/></TextLine>
+</TextBlock>
+<TextBlock ID="b2">
+<TextLine><String CONTENT="Second"/><SP/><String CONTENT="block"/></TextLine>
+</TextBlock>
+</PrintSpace></Page></Layout>
+</alto>`
+
+func TestCorrectionFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		body     string
+		expected string
+	}{
+		{"plain text", "", "The quick brown fox", correctionFormatPlain},
+		{"hocr", "", testHOCR, correctionFormatHOCR},
+		{"hocr fragment", "", `<div class='ocr_page'><span class='ocrx_word'>word</span></div>`, correctionFormatHOCR},
+		{"alto", "", "  \n" + testALTO, correctionFormatALTO},
+		{"unrecognized markup", "", "<p>markup</p>", correctionFormatPlain},
+		{"format given", correctionFormatPlain, testALTO, correctionFormatPlain},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if format := correctionFormat(tc.format, tc.body); format != tc.expected {
+				t.Errorf("expected [%s], got [%s]", tc.expected, format)
+			}
+		})
+	}
+}
+
+func TestFlattenCorrection(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		body     string
+		expected string // after cleanOcrText(), as saved
+		fails    bool
+	}{
+		{"plain text", correctionFormatPlain, "The quick brown fox\n\njumps", "The quick brown fox\n\njumps", false},
+		{"hocr lines and paragraphs", correctionFormatHOCR, testHOCR, "The quick brown\nfox & hound\n\nSecond paragraph\n\nFigure one\n", false},
+		{"hocr without a text layer", correctionFormatHOCR, `<html><body><div class="ocr_page">page</div></body></html>`, "", false},
+		{"hocr unclosed tags", correctionFormatHOCR, `<div class="ocr_page"><span class="ocr_line"><span class="ocrx_word">one<br><span class="ocrx_word">two</span></span></div>`, "one two\n", false},
+		{"alto lines, blocks, and hyphens", correctionFormatALTO, testALTO, "The quick bro-\nwn fox & hound\n\nSecond block\n\n", false},
+		{"invalid alto", correctionFormatALTO, `<alto><TextBlock><TextLine><String CONTENT="word"></TextLine>`, "", true},
+		{"unsupported format", "pdf", "text", "", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			text, err := flattenCorrection(tc.format, tc.body)
+
+			if tc.fails == true {
+				if err == nil {
+					t.Errorf("expected an error, got [%s]", text)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			if text = cleanOcrText(text); text != tc.expected {
+				t.Errorf("expected [%q], got [%q]", tc.expected, text)
+			}
+		})
+	}
+}
+
+func TestOverwriteCorrectedRequiresStaffKey(t *testing.T) {
+	c := useJobStore(t)
+
+	config.staffAPIKey.value = "secret"
+
+	id, _ := c.versionAdd(textVersion{Pid: "uva:2", Source: versionSourceManual, Text: "corrected text"})
+	c.correctionSave("uva:2", id)
+
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/ocr/:pid", func(ctx *gin.Context) {
+		rc := newClientContext(ctx)
+
+		var pids []string
+		for _, p := range rc.skipCorrectedPages([]tsGenericPidInfo{{Pid: "uva:2"}, {Pid: "uva:3"}}) {
+			pids = append(pids, p.Pid)
+		}
+
+		ctx.String(http.StatusOK, strings.Join(pids, ","))
+	})
+
+	tests := []struct {
+		name     string
+		query    string
+		header   string
+		expected string // pages still needing ocr
+	}{
+		{"no overwrite", "", "", "uva:3"},
+		{"anonymous overwrite", "?overwrite_corrected=true", "", "uva:3"},
+		{"overwrite with the wrong key", "?overwrite_corrected=true", "Bearer other", "uva:3"},
+		{"staff overwrite", "?overwrite_corrected=true", "Bearer secret", "uva:2,uva:3"},
+		{"staff without overwrite", "", "Bearer secret", "uva:3"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ocr/uva:1"+tc.query, nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+
+			if res.Body.String() != tc.expected {
+				t.Errorf("expected pages [%s], got [%s]", tc.expected, res.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// the workflow decider: given a decision task's event history, determines the decisions to respond
+// with and the workflow outcome, if any.  it has no side effects of its own (finalizing results and
+// responding to SWF are left to the caller), so recorded histories can be replayed offline.
+
+const (
+	deciderOutcomeSuccess = "success"
+	deciderOutcomeFailure = "failure"
+)
+
+type decider struct {
+	policy      retryPolicy
+	queues      string        // lambda queue setting
+	function    string        // default lambda function
+	timeout     string        // lambda start-to-close timeout
+	queuesMax   int           // maximum lambda concurrency
+	growSeconds int           // lambda duration below which concurrency may grow
+	newID       func() string // source of lambda/timer ids
+	manifest    func(workflowID, location string) (string, error)
+	info        func(format string, args ...interface{})
+	warn        func(format string, args ...interface{})
+	err         func(format string, args ...interface{})
+}
+
+type deciderResult struct {
+	decisions []*swf.Decision
+	outcome   string // workflow outcome to finalize, if it has ended
+	details   string // reason for a failure outcome
+}
+
+func (r *deciderResult) fail(details string) {
+	r.outcome = deciderOutcomeFailure
+	r.details = details
+}
+
+func newDecider(c *clientContext) *decider {
+	d := decider{
+		policy:   lambdaRetryPolicy,
+		queues:   config.lambdaQueues.value,
+		function: config.awsLambdaFunction.value,
+		timeout:  config.awsLambdaTimeout.value,
+		newID:    randomID,
+
+		queuesMax:   lambdaQueuesMax(config.lambdaQueues.value),
+		growSeconds: lambdaGrowSeconds(config.awsLambdaTimeout.value),
+		manifest:    workflowManifests.get,
+		info:        c.info,
+		warn:        c.warn,
+		err:         c.err,
+	}
+
+	return &d
+}
+
+func (d *decider) scheduleLambda(name, input, control string) *swf.Decision {
+	decision := (&swf.Decision{}).
+		SetDecisionType("ScheduleLambdaFunction").
+		SetScheduleLambdaFunctionDecisionAttributes((&swf.ScheduleLambdaFunctionDecisionAttributes{}).
+			SetControl(control).
+			SetName(name).
+			SetStartToCloseTimeout(d.timeout).
+			SetId(d.newID()).
+			SetInput(input))
+
+	return decision
+}
+
+func (d *decider) startTimer(duration int, control string) *swf.Decision {
+	decision := (&swf.Decision{}).
+		SetDecisionType("StartTimer").
+		SetStartTimerDecisionAttributes((&swf.StartTimerDecisionAttributes{}).
+			SetControl(control).
+			SetStartToFireTimeout(strconv.Itoa(duration)).
+			SetTimerId(d.newID()))
+
+	return decision
+}
+
+func (d *decider) lambdaFunction(req workflowRequest) string {
+	if req.Engine != "" {
+		return req.Engine
+	}
+	return d.function
+}
+
+func (d *decider) numQueues(pages int) int {
+	queueMin := 1
+	queueMax := 999
+	queueDefault := 500
+
+	queues, err := strconv.Atoi(d.queues)
+
+	switch {
+	case err != nil:
+		queues = queueDefault
+	case queues <= queueMin-1:
+		queues = queueMin
+	case queues >= queueMax+1:
+		queues = queueMax
+	}
+
+	d.info("[AWS] lambda queues set to [%s]; using up to %d queues for %d pages", d.queues, queues, pages)
+
+	if pages < queues {
+		queues = pages
+	}
+
+	return queues
+}
+
+func (d *decider) decodeInput(workflowID, input string) (string, error) {
+	dec := d.decompressInput(input)
+
+	// large requests are passed as a reference to a stored manifest
+	ref := manifestReference{}
+	if json.Unmarshal([]byte(dec), &ref) != nil || ref.Manifest == "" {
+		return dec, nil
+	}
+
+	manifest, err := d.manifest(workflowID, ref.Manifest)
+	if err != nil {
+		d.err("decode: failed to read manifest [%s]: %s", ref.Manifest, err.Error())
+		return "", errors.New("failed to read manifest")
+	}
+
+	d.info("decode: read %d byte manifest from [%s]", len(manifest), ref.Manifest)
+
+	return manifest, nil
+}
+
+func (d *decider) decompressInput(input string) string {
+	// attempt to decode input as a base64-encoded gzipped string.
+	// if that fails, just return the original input
+
+	b64, b64Err := base64.StdEncoding.DecodeString(input)
+	if b64Err != nil {
+		d.warn("decode: base64 read error: %s", b64Err.Error())
+		return input
+	}
+
+	gzDec, gzErr := gzip.NewReader(bytes.NewReader([]byte(b64)))
+	if gzErr != nil {
+		d.warn("decode: gzip init error: %s", gzErr.Error())
+		return input
+	}
+
+	dec, decErr := ioutil.ReadAll(gzDec)
+	if decErr != nil {
+		d.warn("decode: gzip read error: %s", decErr.Error())
+		return input
+	}
+
+	d.info("decode: decompressed input from %d bytes to %d bytes", len(input), len(dec))
+
+	return string(dec)
+}
+
+// builds the decision to run the lambda for the first pid in a queue, passing the rest of the queue along
+func (d *decider) scheduleQueueLambda(info *decisionInfo, pids []string, origEventID int64) (*swf.Decision, error) {
+	pid := pids[0]
+
+	req := lambdaRequest{
+		Lang:      info.req.Lang,
+		Scale:     info.req.lambdaScale(),
+		Bucket:    info.req.Bucket,
+		Key:       getS3Filename(info.req.ReqID, info.pidToFilename[pid]),
+		ParentPid: info.req.Pid,
+		Pid:       pid,
+	}
+
+	input, jsonErr := json.Marshal(req)
+	if jsonErr != nil {
+		d.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jsonErr.Error())
+		return nil, errors.New("failed to encode lambda input")
+	}
+
+	lambdaPayload := controlPayload{
+		Type:        controlPayloadTypeLambdaData,
+		Pids:        pids[1:],
+		OrigEventID: fmt.Sprintf("%d", origEventID),
+		LambdaCount: 1,
+	}
+
+	control, jsonErr := json.Marshal(lambdaPayload)
+	if jsonErr != nil {
+		d.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jsonErr.Error())
+		return nil, errors.New("failed to encode lambda control")
+	}
+
+	d.info("[AWS] [%s] lambda control: [%s]", info.workflowID, control)
+	d.info("[AWS] [%s] lambda input: [%s]", info.workflowID, input)
+
+	return d.scheduleLambda(d.lambdaFunction(info.req), string(input), string(control)), nil
+}
+
+// takes inventory of the workflow's history.  fails only if the workflow's input cannot be read
+// (e.g. a stored manifest is temporarily unavailable), in which case no decisions can be made yet
+func (d *decider) inventory(info *decisionInfo) error {
+	workflowHalted := false
+
+	info.pidToFilename = make(map[string]string)
+
+	// loop over all events to take inventory of the overall state so far
+	for _, e := range info.allEvents {
+		t := *e.EventType
+
+		// extract the original input string containing pids that were processed
+		if info.input == "" && t == "WorkflowExecutionStarted" {
+			input, err := d.decodeInput(info.workflowID, *e.WorkflowExecutionStartedEventAttributes.Input)
+			if err != nil {
+				return err
+			}
+
+			info.input = input
+			json.Unmarshal([]byte(info.input), &info.req)
+			pages := []ocrPageInfo{}
+			for _, p := range info.req.Pages {
+				if p.Pid != "" {
+					pages = append(pages, p)
+					info.pidToFilename[p.Pid] = p.Filename
+				}
+			}
+			info.req.Pages = pages
+			//d.info("[AWS] [%s] input = [%s] (%d pids)", info.workflowID, info.input, len(info.req.Pages))
+			d.info("[AWS] [%s] reqid: [%s]  pages: %d", info.workflowID, info.req.ReqID, len(info.req.Pages))
+		}
+
+		// collect the completed (successful) OCR events, which contain the OCR results
+		if t == "LambdaFunctionCompleted" {
+			//d.info("[AWS] [%s] lambda completed", info.workflowID)
+			info.ocrResults = append(info.ocrResults, e)
+		}
+
+		// collect the pages that were given up on
+		if t == "MarkerRecorded" && *e.MarkerRecordedEventAttributes.MarkerName == markerPageFailed {
+			info.failedPages = append(info.failedPages, *e.MarkerRecordedEventAttributes.Details)
+		}
+
+		// set a flag if any workflow execution event failed (start, complete, fail)
+		if strings.Contains(t, "WorkflowExecutionFailed") {
+			workflowHalted = true
+		}
+
+		// from here on out, only consider recent events (events that occurred since
+		// since the last time a decision task for this workflow was processed)
+		if *e.EventId <= info.lastEventID {
+			continue
+		}
+
+		// collect all non-decision recent events
+		if strings.HasPrefix(t, "Decision") {
+			continue
+		}
+
+		info.recentEvents = append(info.recentEvents, e)
+	}
+
+	if workflowHalted {
+		d.info("[AWS] [%s] WORKFLOW WAS PREVIOUSLY HALTED", info.workflowID)
+	}
+
+	d.inventoryConcurrency(info)
+
+	return nil
+}
+
+// determines the decisions to respond to a decision task with, and the resulting workflow outcome, if any
+func (d *decider) decide(info *decisionInfo) deciderResult {
+	res := deciderResult{}
+
+	d.info("[AWS] [%s] lambdas completed: %d / %d", info.workflowID, len(info.ocrResults), len(info.req.Pages))
+
+	if len(info.failedPages) > 0 {
+		d.info("[AWS] [%s] pages given up on: %d", info.workflowID, len(info.failedPages))
+	}
+
+	recentCounts := make(map[string]int)
+	var lastEventType string
+	for _, e := range info.recentEvents {
+		recentCounts[*e.EventType]++
+		lastEventType = *e.EventType
+	}
+	d.info("[AWS] [%s] recent events: %s", info.workflowID, countsToString(recentCounts))
+	d.info("[AWS] [%s] last event type: [%s]", info.workflowID, lastEventType)
+
+	// we can now make decisions about the workflow.  the overview of the process is as follows:
+	//
+	// 1. start workflow
+	//
+	// 2. receive "workflow started" decision task -- at this point, record an initial concurrency
+	//    target Q, and start a Timer event for each of the first Q pages.  AWS has a limit
+	//    of 1000 concurrent tasks, so we make sure to keep 1 <= Q <= 999
+	//
+	// 3. for each of these, we begin by receiving a "timer fired" decision task -- at this point,
+	//    kick off the lambda for the timer's page
+	//
+	// 4. as each lambda completes (glossing over any lambda retries here), adjust the target
+	//    (see concurrency.go) and kick off lambdas for pages not yet started, up to the target.
+	//    (workflows started before adaptive concurrency instead refer back to the completed
+	//    lambda's queue to find the next lambda to kick off, if any)
+	//
+	// 5. determine overall completion/failure after all lambdas have run
+
+	var decisions []*swf.Decision
+
+	switch {
+	// completion condition (failure): no pids found in the input string
+	// decision(s): fail the workflow
+	case len(info.req.Pages) == 0:
+		decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "No PIDs to process"))
+		res.fail("no pages to process")
+
+	// start of workflow
+	// decision(s): record the initial concurrency target Q, and schedule a timer event to start each of the first Q pages
+	case recentCounts["WorkflowExecutionStarted"] > 0:
+
+		queues := d.numQueues(len(info.req.Pages))
+
+		info.concurrency.target = queues
+		decisions = append(decisions, awsRecordMarker(markerConcurrency, strconv.Itoa(queues)))
+
+		timerPayloads := make([]controlPayload, queues)
+
+		for i := range timerPayloads {
+			timerPayloads[i].Pids = []string{info.req.Pages[i].Pid}
+		}
+
+		// create a timer for each page
+		for _, timerPayload := range timerPayloads {
+			timerPayload.Type = controlPayloadTypeTimerLambdaQueue
+
+			//d.info("[AWS] lambda queue %d (%d pids) = %v", i + 1, len(timerPayload.Pids), timerPayload)
+
+			control, jsonErr := json.Marshal(timerPayload)
+			if jsonErr != nil {
+				d.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jsonErr.Error())
+				decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "timer-based lambda queue creation failed"))
+				res.fail("failed to start page OCR queues")
+				break
+			}
+
+			decisions = append(decisions, d.startTimer(0, string(control)))
+		}
+
+	// completion condition (success): number of successful lambda executions (plus any pages
+	// given up on, if allowed) = number of pids
+	// decision(s): complete the workflow
+	case len(info.ocrResults)+len(info.failedPages) == len(info.req.Pages):
+		// did a previous completion attempt fail?  try, try again
+		if e := awsEventWithType(info.recentEvents, "CompleteWorkflowExecutionFailed"); e != nil {
+			a := e.CompleteWorkflowExecutionFailedEventAttributes
+			d.err("[AWS] [%s] complete workflow execution failed (%s)", info.workflowID, *a.Cause)
+			decisions = append([]*swf.Decision{}, awsCompleteWorkflowExecution("SUCCESS"))
+		} else {
+			decisions = append([]*swf.Decision{}, awsCompleteWorkflowExecution("success"))
+			res.outcome = deciderOutcomeSuccess
+		}
+
+	// middle of the workflow -- timer and lambda events are handled here
+	// decision(s): see conditions in recent events loop below
+	default:
+		gaveUp := false
+
+		if marker := d.adjustConcurrency(info); marker != nil {
+			decisions = append(decisions, marker)
+		}
+
+	RecentEventsProcessingLoop:
+		for _, e := range info.recentEvents {
+			t := *e.EventType
+
+			// attempt to start the workflow failed?
+			// decision(s): fail the workflow
+			if t == "WorkflowExecutionFailed" {
+				a := e.WorkflowExecutionFailedEventAttributes
+				d.err("[AWS] [%s] start workflow execution failed (%s) - (%s)", info.workflowID, *a.Reason, *a.Details)
+				decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "workflow execution failed"))
+				res.fail("failed to start OCR workflow")
+				break RecentEventsProcessingLoop
+			}
+
+			// attempt to fail the workflow failed?
+			// decision(s): fail the workflow
+			if t == "FailWorkflowExecutionFailed" {
+				a := e.FailWorkflowExecutionFailedEventAttributes
+				d.err("[AWS] [%s] fail workflow execution failed (%s)", info.workflowID, *a.Cause)
+				decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("FAILURE", "fail workflow execution failed"))
+				break RecentEventsProcessingLoop
+			}
+
+			// attempt to start a timer failed?
+			// decision(s): fail the workflow
+			if t == "StartTimerFailed" {
+				a := e.StartTimerFailedEventAttributes
+				d.err("[AWS] [%s] start timer failed (%s)", info.workflowID, *a.Cause)
+				decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("FAILURE", "start timer failed"))
+				res.fail("failed to start timer")
+				break RecentEventsProcessingLoop
+			}
+
+			// signal sent to workflow
+			// decision(s): ignore
+			if t == "WorkflowExecutionSignaled" {
+				a := e.WorkflowExecutionSignaledEventAttributes
+				d.info("[AWS] [%s] workflow execution signaled (%s) - (%s)", info.workflowID, *a.SignalName, d.decompressInput(*a.Input))
+				continue RecentEventsProcessingLoop
+			}
+
+			// cancel request sent to workflow
+			// decision(s): fail the workflow
+			if t == "WorkflowExecutionCancelRequested" {
+				//a := e.WorkflowExecutionCancelRequestedEventAttributes
+				d.info("[AWS] [%s] workflow cancellation requested", info.workflowID)
+				decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "workflow execution canceled"))
+				res.fail("process was canceled")
+				break RecentEventsProcessingLoop
+			}
+
+			// lambda execution succeeded
+			// decision(s): start the next lambda in the queue, if applicable.  otherwise, no decision
+			if t == "LambdaFunctionCompleted" {
+				a := e.LambdaFunctionCompletedEventAttributes
+				o := awsEventWithID(info.allEvents, *a.ScheduledEventId)
+
+				lambdaPayload := controlPayload{}
+
+				if jErr := json.Unmarshal([]byte(*o.LambdaFunctionScheduledEventAttributes.Control), &lambdaPayload); jErr != nil {
+					d.err("[AWS] Unmarshal() failed [lambda payload]: %s", jErr.Error())
+					decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda payload unmarshal failed"))
+					res.fail("failed to process page OCR")
+					break RecentEventsProcessingLoop
+				}
+
+				if len(lambdaPayload.Pids) > 0 {
+					// fire lambda for next pid
+
+					d.info("[AWS] [%s] scheduling next lambda in this queue", info.workflowID)
+
+					next, err := d.scheduleQueueLambda(info, lambdaPayload.Pids, *a.StartedEventId)
+					if err != nil {
+						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda creation failed"))
+						res.fail("failed to start page OCR")
+						break RecentEventsProcessingLoop
+					}
+
+					decisions = append(decisions, next)
+
+					continue RecentEventsProcessingLoop
+				} else {
+					d.info("[AWS] [%s] lambda queue complete", info.workflowID)
+				}
+
+				continue RecentEventsProcessingLoop
+			}
+
+			// timer and lambda retry scenarios from this point on
+
+			var origLambdaEvent *swf.HistoryEvent
+			timerPayload := controlPayload{}
+			lambdaTimedOut := false
+			lambdaFailed := false
+
+			// lambda execution failed
+			// decision(s): set up lambda to be retried below
+			if t == "LambdaFunctionFailed" {
+				a := e.LambdaFunctionFailedEventAttributes
+				reason := *a.Reason
+
+				details := lambdaFailureDetails{}
+				json.Unmarshal([]byte(*a.Details), &details)
+
+				if details.ErrorType != "" || details.ErrorMessage != "" {
+					d.err("[AWS] [%s] lambda failed: (%s) : [%s] / [%s]", info.workflowID, reason, details.ErrorType, details.ErrorMessage)
+				} else {
+					d.err("[AWS] [%s] lambda failed: (%s)", info.workflowID, reason)
+				}
+
+				origLambdaEvent = awsEventWithID(info.allEvents, *a.ScheduledEventId)
+				lambdaFailed = true
+			}
+
+			// lambda execution timed out
+			// decision(s): set up lambda to be retried below
+			if t == "LambdaFunctionTimedOut" {
+				a := e.LambdaFunctionTimedOutEventAttributes
+
+				origLambdaEvent = awsEventWithID(info.allEvents, *a.ScheduledEventId)
+
+				timeoutStr := ""
+				if origLambdaEvent.LambdaFunctionScheduledEventAttributes.StartToCloseTimeout != nil {
+					timeoutStr = fmt.Sprintf(" after %s seconds", *origLambdaEvent.LambdaFunctionScheduledEventAttributes.StartToCloseTimeout)
+				}
+
+				d.err("[AWS] [%s] lambda timed out%s (%s)", info.workflowID, timeoutStr, *a.TimeoutType)
+				lambdaTimedOut = true
+			}
+
+			// timer fired
+			// decision(s):
+			// * lambda queue timer: start the first lambda in the queue
+			// * lambda retry timer: set up lambda to be retried below
+			if t == "TimerFired" {
+				a := e.TimerFiredEventAttributes
+				o := awsEventWithID(info.allEvents, *a.StartedEventId)
+
+				d.info("[AWS] [%s] timer fired", info.workflowID)
+
+				if jErr := json.Unmarshal([]byte(*o.TimerStartedEventAttributes.Control), &timerPayload); jErr != nil {
+					d.err("[AWS] Unmarshal() failed [timer payload]: %s", jErr.Error())
+					decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "timer payload unmarshal failed"))
+					res.fail("failed to process timer")
+					break RecentEventsProcessingLoop
+				}
+
+				switch timerPayload.Type {
+				case controlPayloadTypeTimerLambdaQueue:
+					d.info("[AWS] handling lambda queue timer payload")
+
+					// fire lambda for first pid
+
+					d.info("[AWS] [%s] scheduling first lambda in this queue", info.workflowID)
+
+					next, err := d.scheduleQueueLambda(info, timerPayload.Pids, *a.StartedEventId)
+					if err != nil {
+						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda creation failed"))
+						res.fail("failed to start page OCR")
+						break RecentEventsProcessingLoop
+					}
+
+					decisions = append(decisions, next)
+
+					continue RecentEventsProcessingLoop
+
+				case controlPayloadTypeTimerLambdaRetry:
+					d.info("[AWS] handling lambda retry timer payload")
+
+					id, _ := strconv.Atoi(timerPayload.OrigEventID)
+					origLambdaEvent = awsEventWithID(info.allEvents, int64(id))
+				}
+			}
+
+			// handle lambda retry-related scenarios:
+			// if a retry timer fired, rerun the lambda (adjusted per the retry policy).
+			// otherwise, start a retry timer to delay lambda retry.
+			if origLambdaEvent != nil {
+				lambdaPayload := controlPayload{}
+
+				if jErr := json.Unmarshal([]byte(*origLambdaEvent.LambdaFunctionScheduledEventAttributes.Control), &lambdaPayload); jErr != nil {
+					d.err("[AWS] Unmarshal() failed [lambda payload]: %s", jErr.Error())
+					decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda payload unmarshal failed"))
+					res.fail("failed to process page OCR")
+					break RecentEventsProcessingLoop
+				}
+
+				// this condition can only be met if a lambda retry timer fired above
+				if timerPayload.Type == controlPayloadTypeTimerLambdaRetry {
+					// rerun the referenced lambda, adjusted as the retry policy sees fit for the failure
+
+					input, control, function, err := retryLambdaInput(d.policy, timerPayload, origLambdaEvent, d.lambdaFunction(info.req))
+					if err != nil {
+						d.err("[AWS] [%s] lambda retry failed: [%s]", info.workflowID, err.Error())
+						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda creation failed"))
+						res.fail("failed to retry page OCR")
+						break RecentEventsProcessingLoop
+					}
+
+					d.info("[AWS] [%s] retrying lambda event %d (attempt %d) after %s", info.workflowID, *origLambdaEvent.EventId, lambdaPayload.LambdaCount+1, timerPayload.failureType())
+					d.info("[AWS] [%s] new input: %s", info.workflowID, input)
+
+					decisions = append(decisions, d.scheduleLambda(function, input, control))
+				} else {
+					// start a timer referencing the original lambda to be rerun, with a delay (and attempt limit) according to the retry policy
+
+					plan, err := planLambdaRetry(d.policy, e, origLambdaEvent)
+					if err != nil {
+						d.err("[AWS] [%s] lambda retry planning failed: [%s]", info.workflowID, err.Error())
+						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda payload unmarshal failed"))
+						res.fail("failed to process page OCR")
+						break RecentEventsProcessingLoop
+					}
+
+					// limit number of reruns; give up on just this page if partial success is allowed
+					if plan.retry == false && info.req.Partial == true {
+						req := lambdaRequest{}
+						json.Unmarshal([]byte(*origLambdaEvent.LambdaFunctionScheduledEventAttributes.Input), &req)
+
+						d.warn("[AWS] [%s] maximum lambda attempts reached (%d, after %s); giving up on page [%s]", info.workflowID, plan.attempt, plan.failure, req.Pid)
+
+						decisions = append(decisions, awsRecordMarker(markerPageFailed, req.Pid))
+						info.failedPages = append(info.failedPages, req.Pid)
+						gaveUp = true
+
+						// carry on with the rest of this page's queue
+						if len(lambdaPayload.Pids) > 0 {
+							next, err := d.scheduleQueueLambda(info, lambdaPayload.Pids, *origLambdaEvent.EventId)
+							if err != nil {
+								decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda creation failed"))
+								res.fail("failed to start page OCR")
+								break RecentEventsProcessingLoop
+							}
+
+							decisions = append(decisions, next)
+						}
+
+						continue RecentEventsProcessingLoop
+					}
+
+					if plan.retry == false {
+						d.err("[AWS] [%s] maximum lambda attempts reached (%d, after %s); failing", info.workflowID, plan.attempt, plan.failure)
+						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "maximum OCR attempts reached for one or more pages"))
+						res.fail("maximum OCR attempts reached for one or more pages")
+						break RecentEventsProcessingLoop
+					}
+
+					d.info("[AWS] [%s] scheduling lambda event %d to be retried in %d seconds (after %s)...", info.workflowID, *origLambdaEvent.EventId, plan.delay, plan.failure)
+
+					payload := controlPayload{
+						Type:           controlPayloadTypeTimerLambdaRetry,
+						OrigEventID:    fmt.Sprintf("%d", *origLambdaEvent.EventId),
+						LambdaTimedOut: lambdaTimedOut,
+						LambdaFailed:   lambdaFailed,
+						Failure:        plan.failure,
+					}
+
+					control, jsonErr := json.Marshal(payload)
+					if jsonErr != nil {
+						d.err("[AWS] [%s] JSON marshal failed: [%s]", info.workflowID, jsonErr.Error())
+						decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "timer-based lambda retry creation failed"))
+						res.fail("failed to retry page OCR")
+						break RecentEventsProcessingLoop
+					}
+
+					decisions = append(decisions, d.startTimer(plan.delay, string(control)))
+				}
+			}
+		}
+
+		// giving up on the last outstanding page(s) leaves nothing else to wait for
+		if gaveUp == true && len(info.ocrResults)+len(info.failedPages) == len(info.req.Pages) && awsDecisionWithType(decisions, "FailWorkflowExecution") == nil {
+			d.info("[AWS] [%s] all remaining pages given up on; completing workflow", info.workflowID)
+			decisions = append(decisions, awsCompleteWorkflowExecution("success"))
+			res.outcome = deciderOutcomeSuccess
+		}
+
+		// keep the target number of lambdas running
+		if info.concurrency.target > 0 && res.outcome == "" && awsDecisionWithType(decisions, "FailWorkflowExecution") == nil {
+			lastEvent := info.recentEvents[len(info.recentEvents)-1]
+
+			scheduled, err := d.fillConcurrency(info, decisions, *lastEvent.EventId)
+			if err != nil {
+				decisions = append([]*swf.Decision{}, awsFailWorkflowExecution("failure", "lambda creation failed"))
+				res.fail("failed to start page OCR")
+			} else {
+				decisions = append(decisions, scheduled...)
+			}
+		}
+	}
+
+	res.decisions = decisions
+
+	return res
+}
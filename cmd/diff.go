@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// line-based unified diffs, for previewing what new ocr text would replace.
+// page texts are small enough that a plain longest-common-subsequence table is fine.
+
+// lines of unchanged context shown around each change
+const diffContext = 3
+
+type diffOp struct {
+	kind byte // ' ' (unchanged), '-' (removed), or '+' (added)
+	a    int  // line index in the original text (or lines consumed so far, for additions)
+	b    int  // line index in the new text (or lines consumed so far, for removals)
+	text string
+}
+
+func diffSplitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+func diffLines(a, b []string) []diffOp {
+	// lcs[i][j] = length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = maxOf(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var ops []diffOp
+
+	i, j := 0, 0
+
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{kind: ' ', a: i, b: j, text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{kind: '-', a: i, b: j, text: a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', a: i, b: j, text: b[j]})
+			j++
+		}
+	}
+
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{kind: '-', a: i, b: j, text: a[i]})
+	}
+
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{kind: '+', a: i, b: j, text: b[j]})
+	}
+
+	return ops
+}
+
+// returns a unified diff between two texts, or an empty string if they are the same
+func unifiedDiff(fromName, toName, from, to string) string {
+	ops := diffLines(diffSplitLines(from), diffSplitLines(to))
+
+	var sb strings.Builder
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// extend the hunk over any changes close enough that their context would overlap
+		last := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			} else if j-last > 2*diffContext {
+				break
+			}
+		}
+
+		start := maxOf(0, i-diffContext)
+		stop := len(ops)
+		if last+diffContext+1 < stop {
+			stop = last + diffContext + 1
+		}
+
+		hunk := ops[start:stop]
+
+		aCount, bCount := 0, 0
+		for _, op := range hunk {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+
+		// line numbers are 1-based, except for an empty range, which names the line before it
+		aStart := hunk[0].a
+		if aCount > 0 {
+			aStart++
+		}
+
+		bStart := hunk[0].b
+		if bCount > 0 {
+			bStart++
+		}
+
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+		}
+
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+
+		for _, op := range hunk {
+			fmt.Fprintf(&sb, "%c%s\n", op.kind, op.text)
+		}
+
+		i = stop
+	}
+
+	return sb.String()
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 
 	"gopkg.in/gomail.v2"
 )
 
-func (c *clientContext) sendEmail(m *gomail.Message) {
+func (c *clientContext) sendEmail(m *gomail.Message) error {
 	d := gomail.Dialer{Host: config.emailHost.value, Port: config.emailPort.value}
 	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
 
@@ -16,15 +17,18 @@ func (c *clientContext) sendEmail(m *gomail.Message) {
 
 	if err := d.DialAndSend(m); err != nil {
 		c.err("failed to send email to %s: [%s]", to, err.Error())
-	} else {
-		c.info("email sent to %s with subject %s", to, subject)
+		return errors.New("failed to send email")
 	}
+
+	c.info("email sent to %s with subject %s", to, subject)
+
+	return nil
 }
 
-func (c *clientContext) emailResults(to, subject, body, attachment string) {
+func (c *clientContext) emailResults(to, subject, body, attachment string) error {
 	if to == "" {
 		c.warn("missing email address")
-		return
+		return errors.New("missing email address")
 	}
 
 	m := gomail.NewMessage()
@@ -38,5 +42,5 @@ func (c *clientContext) emailResults(to, subject, body, attachment string) {
 		m.Attach(attachment)
 	}
 
-	c.sendEmail(m)
+	return c.sendEmail(m)
 }
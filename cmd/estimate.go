@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cost and duration estimates for ocr'ing a pid, for staff deciding whether to run it.
+// page image sizes are sampled from the archive (or the iiif info.json, when the archive
+// does not have the image), and lambda durations come from recently completed jobs.
+
+const (
+	estimateSamplePages       = 20               // most page images to look up sizes for
+	estimateHistoryPages      = 1000             // recent pages to base lambda durations on
+	estimateHistoryJobs       = 100              // recent jobs to base queue wait on
+	estimateDefaultPageSecs   = 30.0             // lambda seconds per page, without history
+	estimateDefaultJobSecs    = 600.0            // job run time, without history
+	estimateDefaultMemory     = 1024             // lambda memory size in MB
+	estimateUploadBytesPerSec = 10 * 1024 * 1024 // per upload worker
+	iiifBytesPerPixel         = 0.3              // typical full-size jpeg
+)
+
+type ocrEstimate struct {
+	Pid             string  `json:"pid"`
+	Pages           int     `json:"pages"`
+	PagesSampled    int     `json:"pages_sampled"`     // pages whose image size was looked up
+	ImageBytes      int64   `json:"image_bytes"`       // estimated total size of the page images
+	PageSeconds     float64 `json:"page_seconds"`      // expected lambda seconds per page, including retries
+	PageHistory     int     `json:"page_history"`      // historical pages the per-page seconds are based on
+	Concurrency     int     `json:"concurrency"`       // lambdas run at once
+	LambdaGBSeconds float64 `json:"lambda_gb_seconds"` // billed lambda compute
+	S3TransferBytes int64   `json:"s3_transfer_bytes"` // uploaded, plus read back by each lambda attempt
+	S3Requests      int     `json:"s3_requests"`
+	JobsAhead       int     `json:"jobs_ahead"` // queued or running jobs
+	QueueSeconds    int     `json:"queue_wait_seconds"`
+	UploadSeconds   int     `json:"upload_seconds"`
+	OcrSeconds      int     `json:"ocr_seconds"`
+	WallSeconds     int     `json:"wall_clock_seconds"` // queue wait, upload, and ocr
+}
+
+// Handle a request for /ocr/:pid/estimate
+func ocrEstimateHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	ts, tsErr := c.tsGetMetadataPidInfo()
+
+	if tsErr != nil {
+		c.err("Tracksys API error: [%s]", tsErr.Error())
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: Could not retrieve PID info: [%s]", tsErr.Error()))
+		return
+	}
+
+	c.respondJSON(http.StatusOK, c.estimateOcr(ts.Pages))
+}
+
+func (c *clientContext) estimateOcr(pages []tsGenericPidInfo) ocrEstimate {
+	est := ocrEstimate{Pid: c.req.pid, Pages: len(pages)}
+
+	// image sizes: sample evenly across the pages and extrapolate
+	var sampled int64
+
+	step := maxOf(1, len(pages)/estimateSamplePages)
+
+	for i := 0; i < len(pages) && est.PagesSampled < estimateSamplePages; i += step {
+		if size, ok := c.estimateImageBytes(&pages[i]); ok == true {
+			sampled += size
+			est.PagesSampled++
+		}
+	}
+
+	if est.PagesSampled > 0 {
+		est.ImageBytes = sampled * int64(len(pages)) / int64(est.PagesSampled)
+	}
+
+	// lambda time per page, from history
+	pageSecs, attempts, history := c.estimatePageSeconds()
+
+	est.PageHistory = history
+	est.PageSeconds = roundTo(pageSecs*attempts, 1)
+
+	memory := config.lambdaMemory.value
+	if memory <= 0 {
+		memory = estimateDefaultMemory
+	}
+
+	est.LambdaGBSeconds = roundTo(float64(len(pages))*est.PageSeconds*float64(memory)/1024, 1)
+
+	est.S3TransferBytes = est.ImageBytes + int64(float64(est.ImageBytes)*attempts)
+	est.S3Requests = len(pages) + int(math.Ceil(float64(len(pages))*attempts))
+
+	// wall clock
+	est.Concurrency = estimateConcurrency(len(pages))
+	est.OcrSeconds = estimateOcrSeconds(len(pages), est.PageSeconds)
+	est.UploadSeconds = int(est.ImageBytes / int64(numUploadWorkers()*estimateUploadBytesPerSec))
+	est.JobsAhead, est.QueueSeconds = c.estimateQueueWait()
+	est.WallSeconds = est.QueueSeconds + est.UploadSeconds + est.OcrSeconds
+
+	c.info("estimate: %d pages, %d bytes, %.1f lambda GB-seconds, %d seconds", est.Pages, est.ImageBytes, est.LambdaGBSeconds, est.WallSeconds)
+
+	return est
+}
+
+// mean lambda seconds per attempt and attempts per page for recently ocr'd pages, and
+// the number of pages these are based on (defaults are used without any history)
+func (c *clientContext) estimatePageSeconds() (float64, float64, int) {
+	pageSecs, attempts, history, err := c.jobPageLambdaStats(estimateHistoryPages)
+	if err != nil || history == 0 {
+		return estimateDefaultPageSecs, 1, 0
+	}
+
+	return pageSecs, attempts, history
+}
+
+// lambdas a workflow for this many pages would run at once
+func estimateConcurrency(pages int) int {
+	return minOf(maxOf(1, pages), maxOf(1, newDecider(newBackgroundContext()).numQueues(pages)))
+}
+
+// seconds to ocr this many pages, given the lambda seconds per page
+func estimateOcrSeconds(pages int, pageSecs float64) int {
+	if pages <= 0 {
+		return 0
+	}
+
+	return int(math.Ceil(float64(pages)/float64(estimateConcurrency(pages))) * pageSecs)
+}
+
+// size of a page image in the archive, or as estimated from its iiif dimensions
+func (c *clientContext) estimateImageBytes(page *tsGenericPidInfo) (int64, bool) {
+	if page.Filename != "" {
+		if fi, err := os.Stat(getLocalFilename(page.Filename)); err == nil {
+			return fi.Size(), true
+		}
+	}
+
+	infoURL := getIIIFInfoURL(page.Pid)
+	if infoURL == "" {
+		return 0, false
+	}
+
+	res, err := client.Get(infoURL)
+	if err != nil {
+		c.warn("estimate: iiif info request failed: [%s]", err.Error())
+		return 0, false
+	}
+
+	defer res.Body.Close()
+
+	info := struct {
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	}{}
+
+	if res.StatusCode != http.StatusOK || json.NewDecoder(res.Body).Decode(&info) != nil || info.Width <= 0 || info.Height <= 0 {
+		c.warn("estimate: no dimensions in iiif info for [%s] (status: %s)", page.Pid, res.Status)
+		return 0, false
+	}
+
+	return int64(float64(info.Width*info.Height) * iiifBytesPerPixel), true
+}
+
+// how many jobs are ahead of a new one, and roughly how long it would wait to start
+func (c *clientContext) estimateQueueWait() (int, int) {
+	queued, _ := c.jobCountByState(jobStateQueued)
+	running, _ := c.jobCountByState(jobStateRunning)
+
+	max := config.maxRunningJobs.value
+	if max <= 0 || running+queued < max {
+		return queued + running, 0
+	}
+
+	jobSecs, history, err := c.jobRunSecondsStats(estimateHistoryJobs)
+	if err != nil || history == 0 {
+		jobSecs = estimateDefaultJobSecs
+	}
+
+	return queued + running, estimateWaitSeconds(queued+running, max, jobSecs)
+}
+
+// seconds until a new job starts, with this many jobs ahead of it and up to max running at once
+func estimateWaitSeconds(ahead, max int, jobSecs float64) int {
+	if max <= 0 || ahead < max {
+		return 0
+	}
+
+	// jobs start in waves as running ones finish
+	waves := (ahead-max)/max + 1
+
+	return int(float64(waves) * jobSecs)
+}
+
+// the iiif info.json url for a pid, based on the image url template
+func getIIIFInfoURL(pid string) string {
+	tmpl := config.iiifURLTemplate.value
+
+	i := strings.Index(tmpl, "{PID}")
+	if i < 0 {
+		return ""
+	}
+
+	return strings.Replace(tmpl[:i+len("{PID}")], "{PID}", pid, 1) + "/info.json"
+}
+
+func roundTo(f float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(f*p) / p
+}
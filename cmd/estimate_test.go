@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEstimateOcrSeconds(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	tests := []struct {
+		name     string
+		queues   string
+		pages    int
+		pageSecs float64
+		expected int
+	}{
+		{"no pages", "10", 0, 30, 0},
+		{"one page", "10", 1, 30, 30},
+		{"fewer pages than queues", "10", 5, 30, 30},
+		{"exactly the queues", "10", 10, 30, 30},
+		{"one more than the queues", "10", 11, 30, 60},
+		{"several rounds", "10", 95, 12.5, 125},
+		{"single queue", "1", 4, 30, 120},
+		{"invalid queue setting uses the default", "x", 1000, 10, 20},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config.lambdaQueues.value = tc.queues
+
+			if secs := estimateOcrSeconds(tc.pages, tc.pageSecs); secs != tc.expected {
+				t.Errorf("expected %d seconds for %d pages at %.1f seconds each, got %d", tc.expected, tc.pages, tc.pageSecs, secs)
+			}
+		})
+	}
+}
+
+func TestEstimateWaitSeconds(t *testing.T) {
+	tests := []struct {
+		name     string
+		ahead    int
+		max      int
+		expected int
+	}{
+		{"no limit", 50, 0, 0},
+		{"no jobs ahead", 0, 4, 0},
+		{"free slot", 3, 4, 0},
+		{"all slots taken", 4, 4, 600},
+		{"last job of the first wave", 7, 4, 600},
+		{"second wave", 8, 4, 1200},
+		{"single slot", 3, 1, 1800},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if secs := estimateWaitSeconds(tc.ahead, tc.max, 600); secs != tc.expected {
+				t.Errorf("expected %d seconds with %d jobs ahead and %d running at once, got %d", tc.expected, tc.ahead, tc.max, secs)
+			}
+		})
+	}
+}
+
+func TestGetIIIFInfoURL(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"image api template", "https://iiif.example.edu/iiif/2/{PID}/full/full/0/default.jpg", "https://iiif.example.edu/iiif/2/uva:2/info.json"},
+		{"pid at the end", "https://iiif.example.edu/{PID}", "https://iiif.example.edu/uva:2/info.json"},
+		{"no pid placeholder", "https://iiif.example.edu/full/full/0/default.jpg", ""},
+		{"no template", "", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config.iiifURLTemplate.value = tc.template
+
+			if url := getIIIFInfoURL("uva:2"); url != tc.expected {
+				t.Errorf("expected [%s], got [%s]", tc.expected, url)
+			}
+		})
+	}
+}
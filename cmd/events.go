@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// job progress events, streamed to clients of /ocr/:pid/events as they are published.
+// each pid keeps the events of its most recent job, so that clients connecting (or reconnecting,
+// with Last-Event-ID) partway through a job see everything that has happened so far.
+//
+// events are only known to the instance that publishes them; decision tasks for a job
+// handled by another instance will not appear in this instance's streams.
+//
+// event ids start from the time the process started, in microseconds, so that they keep increasing
+// across restarts.  a Last-Event-ID this instance did not issue for the pid (from before a restart,
+// or from another instance) is treated as a new connection.
+
+const (
+	eventJobAccepted       = "job_accepted"
+	eventJobStarted        = "job_started"
+	eventImageUploaded     = "image_uploaded"
+	eventWorkflowStarted   = "workflow_started"
+	eventPageComplete      = "page_complete"
+	eventPageRetry         = "page_retry"
+	eventPageFailed        = "page_failed"
+	eventFinalizing        = "finalizing"
+	eventEmailSent         = "email_sent"
+	eventCallbackDelivered = "callback_delivered"
+	eventJobComplete       = "job_complete"
+	eventJobFailed         = "job_failed"
+	eventJobCanceled       = "job_canceled"
+	eventStatus            = "status" // snapshot sent to new clients when there is no history
+)
+
+const (
+	progressHistoryLimit   = 5000             // most events kept per pid
+	progressHistoryExpiry  = time.Hour        // how long a finished job's events are kept
+	progressSubscriberSize = 256              // events buffered per client before it is dropped
+	progressKeepalive      = 30 * time.Second // interval between comments on an idle stream
+	progressRetryMillis    = 5000             // client reconnection delay
+)
+
+type progressEvent struct {
+	ID      int64     `json:"id"`
+	Type    string    `json:"type"`
+	Pid     string    `json:"pid"`
+	ReqID   string    `json:"reqid,omitempty"`
+	Time    time.Time `json:"time"`
+	Page    string    `json:"page,omitempty"`    // page pid, for page events
+	Attempt int       `json:"attempt,omitempty"` // lambda attempt about to be made, for page retries
+	Done    int       `json:"done,omitempty"`    // images uploaded, pages ocr'd, or notifications sent so far
+	Total   int       `json:"total,omitempty"`
+	Details string    `json:"details,omitempty"`
+}
+
+func (e progressEvent) terminal() bool {
+	switch e.Type {
+	case eventJobComplete, eventJobFailed, eventJobCanceled:
+		return true
+	}
+
+	return false
+}
+
+type progressHistory struct {
+	events  []progressEvent
+	updated time.Time
+}
+
+type progressBroker struct {
+	mutex       sync.Mutex
+	lastID      int64
+	pruned      time.Time
+	history     map[string]*progressHistory
+	subscribers map[string]map[chan progressEvent]bool
+}
+
+var progress = newProgressBroker()
+
+func newProgressBroker() *progressBroker {
+	return &progressBroker{
+		lastID:      time.Now().UnixMicro(),
+		history:     make(map[string]*progressHistory),
+		subscribers: make(map[string]map[chan progressEvent]bool),
+	}
+}
+
+func (b *progressBroker) publish(e progressEvent) {
+	if e.Pid == "" {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastID++
+
+	e.ID = b.lastID
+	e.Time = time.Now()
+
+	// a new job starts a new history
+	h := b.history[e.Pid]
+	if h == nil || e.Type == eventJobAccepted {
+		h = &progressHistory{}
+		b.history[e.Pid] = h
+	}
+
+	h.events = append(h.events, e)
+	h.updated = e.Time
+
+	if len(h.events) > progressHistoryLimit {
+		h.events = h.events[len(h.events)-progressHistoryLimit:]
+	}
+
+	// clients that have fallen behind are dropped; they can reconnect and catch up from the history
+	for ch := range b.subscribers[e.Pid] {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subscribers[e.Pid], ch)
+			close(ch)
+		}
+	}
+
+	b.prune(e.Time)
+}
+
+// forgets the histories of pids with no recent events
+func (b *progressBroker) prune(now time.Time) {
+	if now.Sub(b.pruned) < time.Minute {
+		return
+	}
+
+	b.pruned = now
+
+	for pid, h := range b.history {
+		if now.Sub(h.updated) > progressHistoryExpiry && len(b.subscribers[pid]) == 0 {
+			delete(b.history, pid)
+		}
+	}
+}
+
+// registers a client for a pid's events, returning any history after lastID, whether the pid's job
+// already finished before lastID (so the client has seen everything), and the last id the client
+// has seen: lastID if it is one of the pid's events, and 0 otherwise
+func (b *progressBroker) subscribe(pid string, lastID int64) ([]progressEvent, chan progressEvent, bool, int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var backlog []progressEvent
+	finished := false
+
+	h := b.history[pid]
+
+	if lastID != 0 && b.known(h, lastID) == false {
+		lastID = 0
+	}
+
+	if h != nil && len(h.events) > 0 {
+		for _, e := range h.events {
+			if e.ID > lastID {
+				backlog = append(backlog, e)
+			}
+		}
+
+		last := h.events[len(h.events)-1]
+		finished = lastID > 0 && last.ID <= lastID && last.terminal() == true
+	}
+
+	ch := make(chan progressEvent, progressSubscriberSize)
+
+	if b.subscribers[pid] == nil {
+		b.subscribers[pid] = make(map[chan progressEvent]bool)
+	}
+
+	b.subscribers[pid][ch] = true
+
+	return backlog, ch, finished, lastID
+}
+
+// whether an event id was issued by this broker for a pid's current history
+func (b *progressBroker) known(h *progressHistory, id int64) bool {
+	if h == nil || id > b.lastID {
+		return false
+	}
+
+	for _, e := range h.events {
+		if e.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *progressBroker) unsubscribe(pid string, ch chan progressEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.subscribers[pid][ch] == true {
+		delete(b.subscribers[pid], ch)
+		close(ch)
+	}
+
+	if len(b.subscribers[pid]) == 0 {
+		delete(b.subscribers, pid)
+	}
+}
+
+func publishProgress(pid, reqID, eventType string, e progressEvent) {
+	e.Pid = pid
+	e.ReqID = reqID
+	e.Type = eventType
+
+	progress.publish(e)
+}
+
+// publishes page events for the page state changes in a decision task
+func publishDecisionEvents(info decisionInfo, updates []pageUpdate) {
+	pid := info.req.Pid
+	reqID := info.req.ReqID
+	total := len(info.req.Pages)
+
+	for _, u := range updates {
+		switch u.state {
+		case pageStateComplete:
+			publishProgress(pid, reqID, eventPageComplete, progressEvent{Page: u.pid, Done: len(info.ocrResults), Total: total})
+
+		case pageStateRetrying:
+			publishProgress(pid, reqID, eventPageRetry, progressEvent{Page: u.pid, Attempt: u.attempt + 1, Details: u.details})
+
+		case pageStateFailed:
+			publishProgress(pid, reqID, eventPageFailed, progressEvent{Page: u.pid, Total: total})
+		}
+	}
+}
+
+// Handle a request for /ocr/:pid/events
+func ocrEventsHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	lastID, _ := strconv.ParseInt(ctx.GetHeader("Last-Event-ID"), 10, 64)
+
+	backlog, ch, finished, lastID := progress.subscribe(c.req.pid, lastID)
+	defer progress.unsubscribe(c.req.pid, ch)
+
+	// tells EventSource clients to stop reconnecting
+	if finished == true {
+		c.logResponse(http.StatusNoContent, "job finished")
+		ctx.Status(http.StatusNoContent)
+		return
+	}
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+
+	c.logResponse(http.StatusOK, "event stream")
+
+	fmt.Fprintf(ctx.Writer, "retry: %d\n\n", progressRetryMillis)
+
+	if len(backlog) == 0 && lastID == 0 {
+		backlog = append(backlog, c.progressSnapshot())
+	}
+
+	sent := 0
+
+	for _, e := range backlog {
+		if c.writeProgressEvent(e) == false {
+			return
+		}
+
+		sent++
+
+		if e.terminal() == true {
+			c.info("[EVENTS] stream closed after %d event(s); job finished", sent)
+			return
+		}
+	}
+
+	ctx.Writer.Flush()
+
+	keepalive := time.NewTicker(progressKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-ctx.Request.Context().Done():
+			c.info("[EVENTS] stream closed by client after %d event(s)", sent)
+			return
+
+		case e, ok := <-ch:
+			if ok == false {
+				c.warn("[EVENTS] stream dropped after %d event(s); client fell behind", sent)
+				return
+			}
+
+			if c.writeProgressEvent(e) == false {
+				return
+			}
+
+			sent++
+
+			if e.terminal() == true {
+				c.info("[EVENTS] stream closed after %d event(s); job finished", sent)
+				return
+			}
+
+		case <-keepalive.C:
+			fmt.Fprintf(ctx.Writer, ": keepalive\n\n")
+			ctx.Writer.Flush()
+		}
+	}
+}
+
+// the current state of a pid's job, for clients connecting when there is no event history
+// (e.g. after a restart, or before any job has been requested)
+func (c *clientContext) progressSnapshot() progressEvent {
+	e := progressEvent{Type: eventStatus, Pid: c.req.pid, Time: time.Now(), Details: "idle"}
+
+	job, _ := c.jobGetActiveForPid(c.req.pid)
+	if job == nil {
+		return e
+	}
+
+	details := c.jobProgressDetails(job)
+
+	e.ReqID = job.ReqID
+	e.Details = job.Phase
+	e.Done = details.Pages.Complete
+	e.Total = details.Pages.Total
+
+	return e
+}
+
+func (c *clientContext) writeProgressEvent(e progressEvent) bool {
+	data, err := json.Marshal(e)
+	if err != nil {
+		c.err("[EVENTS] failed to serialize event: [%s]", err.Error())
+		return true
+	}
+
+	if e.ID > 0 {
+		fmt.Fprintf(c.ctx.Writer, "id: %d\n", e.ID)
+	}
+
+	if _, err := fmt.Fprintf(c.ctx.Writer, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+		c.info("[EVENTS] stream write failed: [%s]", err.Error())
+		return false
+	}
+
+	c.ctx.Writer.Flush()
+
+	return true
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useProgressBroker(t *testing.T) *progressBroker {
+	t.Helper()
+
+	saved := progress
+	t.Cleanup(func() { progress = saved })
+
+	progress = newProgressBroker()
+
+	return progress
+}
+
+func eventTypes(events []progressEvent) string {
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+
+	return strings.Join(types, ",")
+}
+
+func TestProgressBrokerHistory(t *testing.T) {
+	b := useProgressBroker(t)
+
+	publishProgress("uva:1", "r1", eventJobAccepted, progressEvent{})
+	publishProgress("uva:1", "r1", eventImageUploaded, progressEvent{Done: 1, Total: 2})
+	publishProgress("uva:2", "r2", eventJobAccepted, progressEvent{})
+
+	backlog, ch, finished, _ := b.subscribe("uva:1", 0)
+	b.unsubscribe("uva:1", ch)
+
+	if got := eventTypes(backlog); got != "job_accepted,image_uploaded" || finished == true {
+		t.Errorf("unexpected history: [%s] (finished: %v)", got, finished)
+	}
+
+	// a new job replaces the history
+	publishProgress("uva:1", "r3", eventJobAccepted, progressEvent{})
+
+	backlog, ch, _, _ = b.subscribe("uva:1", 0)
+	b.unsubscribe("uva:1", ch)
+
+	if len(backlog) != 1 || backlog[0].ReqID != "r3" {
+		t.Errorf("expected only the new job's event, got [%s]", eventTypes(backlog))
+	}
+
+	// reconnecting clients only get events they have not seen
+	publishProgress("uva:1", "r3", eventJobComplete, progressEvent{})
+
+	backlog, ch, finished, _ = b.subscribe("uva:1", backlog[0].ID)
+	b.unsubscribe("uva:1", ch)
+
+	if got := eventTypes(backlog); got != "job_complete" || finished == true {
+		t.Errorf("unexpected backlog after last id: [%s] (finished: %v)", got, finished)
+	}
+
+	backlog, ch, finished, _ = b.subscribe("uva:1", backlog[0].ID)
+	b.unsubscribe("uva:1", ch)
+
+	if len(backlog) != 0 || finished == false {
+		t.Errorf("expected a finished job with no backlog, got [%s] (finished: %v)", eventTypes(backlog), finished)
+	}
+}
+
+func TestProgressBrokerSubscribers(t *testing.T) {
+	b := useProgressBroker(t)
+
+	_, ch, _, _ := b.subscribe("uva:1", 0)
+
+	publishProgress("uva:1", "r1", eventJobStarted, progressEvent{})
+	publishProgress("uva:2", "r2", eventJobStarted, progressEvent{})
+
+	if e := <-ch; e.Pid != "uva:1" || e.Type != eventJobStarted {
+		t.Errorf("unexpected event: %+v", e)
+	}
+
+	// a client that falls behind is dropped
+	for i := 0; i <= progressSubscriberSize; i++ {
+		publishProgress("uva:1", "r1", eventImageUploaded, progressEvent{Done: i})
+	}
+
+	n := 0
+	for range ch {
+		n++
+	}
+
+	if n != progressSubscriberSize {
+		t.Errorf("expected %d buffered events before the client was dropped, got %d", progressSubscriberSize, n)
+	}
+
+	// unsubscribing a dropped client is harmless
+	b.unsubscribe("uva:1", ch)
+}
+
+func TestOcrEventsHandler(t *testing.T) {
+	useProgressBroker(t)
+
+	gin.SetMode(gin.TestMode)
+
+	if randomSource == nil {
+		randomSource = rand.New(rand.NewSource(1))
+	}
+
+	router := gin.New()
+	router.GET("/ocr/:pid/events", ocrEventsHandler)
+
+	publishProgress("uva:1", "r1", eventJobAccepted, progressEvent{})
+	publishProgress("uva:1", "r1", eventPageComplete, progressEvent{Page: "uva:2", Done: 1, Total: 1})
+	publishProgress("uva:1", "r1", eventJobComplete, progressEvent{Done: 1, Total: 1})
+
+	// the stream replays the job's history, and ends with it
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest("GET", "/ocr/uva:1/events", nil))
+
+	body := res.Body.String()
+
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response: %d [%s]", res.Code, res.Header().Get("Content-Type"))
+	}
+
+	history := progress.history["uva:1"].events
+
+	for _, want := range []string{fmt.Sprintf("id: %d\nevent: page_complete\n", history[1].ID), `"page":"uva:2"`, "event: job_complete\n"} {
+		if strings.Contains(body, want) == false {
+			t.Errorf("stream missing [%s]:\n%s", want, body)
+		}
+	}
+
+	// reconnecting after the job finished tells the client to stop
+	req := httptest.NewRequest("GET", "/ocr/uva:1/events", nil)
+	req.Header.Set("Last-Event-ID", fmt.Sprintf("%d", history[2].ID))
+
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusNoContent {
+		t.Errorf("expected %d after the job finished, got %d", http.StatusNoContent, res.Code)
+	}
+
+	// an id from a previous run of the service gets the history again
+	req = httptest.NewRequest("GET", "/ocr/uva:1/events", nil)
+	req.Header.Set("Last-Event-ID", fmt.Sprintf("%d", history[2].ID+1000000))
+
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK || strings.Contains(res.Body.String(), "event: job_accepted\n") == false {
+		t.Errorf("expected the job's history for an unknown id, got %d:\n%s", res.Code, res.Body.String())
+	}
+}
+
+func TestProgressBrokerRestart(t *testing.T) {
+	before := useProgressBroker(t)
+
+	for i := 0; i < 100; i++ {
+		publishProgress("uva:1", "r1", eventImageUploaded, progressEvent{Done: i})
+	}
+
+	seen := before.lastID
+
+	// a restarted instance issues ids above those of the one before it
+	time.Sleep(time.Millisecond)
+
+	b := useProgressBroker(t)
+
+	publishProgress("uva:1", "r2", eventJobAccepted, progressEvent{})
+	publishProgress("uva:1", "r2", eventJobStarted, progressEvent{})
+
+	backlog, ch, finished, lastID := b.subscribe("uva:1", 0)
+	b.unsubscribe("uva:1", ch)
+
+	if len(backlog) != 2 || backlog[0].ID <= seen {
+		t.Fatalf("expected new ids above [%d], got %+v", seen, backlog)
+	}
+
+	// a client reconnecting with an id from before the restart, one never issued, or another pid's
+	// gets the whole history, as a new connection would
+	publishProgress("uva:2", "r3", eventJobAccepted, progressEvent{})
+
+	for _, id := range []int64{seen, backlog[1].ID + 1000, b.history["uva:2"].events[0].ID, -1} {
+		got, ch, done, last := b.subscribe("uva:1", id)
+		b.unsubscribe("uva:1", ch)
+
+		if eventTypes(got) != "job_accepted,job_started" || done == true || last != 0 {
+			t.Errorf("last id %d: expected the whole history, got [%s] (finished: %v  last id: %d)", id, eventTypes(got), done, last)
+		}
+	}
+
+	// a known id picks up where the client left off
+	backlog, ch, finished, lastID = b.subscribe("uva:1", backlog[0].ID)
+	b.unsubscribe("uva:1", ch)
+
+	if eventTypes(backlog) != "job_started" || finished == true || lastID != b.history["uva:1"].events[0].ID {
+		t.Errorf("expected the rest of the history, got [%s] (finished: %v  last id: %d)", eventTypes(backlog), finished, lastID)
+	}
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bulk export of ocr text for preservation.  an export collects the current text of every page of
+// the requested items, as per-page files and a combined document per item, and packages them as a
+// BagIt bag (serialized as a zip) or a plain zip, for download.  exports run in the background on
+// the instance that accepted them, and their packages are kept under the storage dir.
+
+// export formats
+const (
+	exportFormatBagIt = "bagit"
+	exportFormatZip   = "zip"
+)
+
+// exports are running, complete, or failed like jobs; expired exports have had their package removed
+const exportStateExpired = "expired"
+
+// subdirectory of the storage dir holding export packages (alongside the per-pid work directories)
+const exportSubDir = "exports"
+
+type exportInfo struct {
+	ID         string   `json:"id"`
+	Format     string   `json:"format"`
+	State      string   `json:"state"`
+	Created    string   `json:"created"`
+	Finished   string   `json:"finished,omitempty"`
+	CatalogKey string   `json:"catalog_key,omitempty"`
+	Pids       []string `json:"pids"`
+	Items      int      `json:"items"`             // items packaged
+	Pages      int      `json:"pages"`             // pages packaged
+	Missing    int      `json:"missing_pages"`     // pages whose text could not be retrieved
+	Skipped    []string `json:"skipped,omitempty"` // items that could not be retrieved, and why
+	Size       int64    `json:"size,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+type exportPage struct {
+	pid    string
+	file   string // per-page file name, after the page's master file
+	text   string
+	failed bool
+}
+
+type exportItem struct {
+	ts    *tsPidInfo
+	pages []exportPage
+}
+
+type exportFile struct {
+	name string
+	data []byte
+}
+
+// a file written to a package, as listed in a bag's manifests
+type exportEntry struct {
+	name string
+	sum  [sha256.Size]byte
+	size int64
+}
+
+// writes an export's package as its items are collected: each item's files go straight into the
+// zip, and only their checksums and sizes are kept, for a bag's manifests
+type exportPackage struct {
+	e       *exportInfo
+	zw      *zip.Writer
+	now     time.Time
+	payload []exportEntry
+	items   []tsGenericPidInfo // item metadata, for bag-info
+}
+
+const exportColumns = "id, format, state, created, finished, catalog_key, pids, items, pages, missing, skipped, size, error"
+
+func exportDir() string {
+	return getWorkDir(exportSubDir)
+}
+
+func exportFileName(id string) string {
+	return fmt.Sprintf("%s/%s.zip", exportDir(), id)
+}
+
+func scanExport(row interface{ Scan(...interface{}) error }) (*exportInfo, error) {
+	var e exportInfo
+	var pids, skipped string
+
+	if err := row.Scan(&e.ID, &e.Format, &e.State, &e.Created, &e.Finished, &e.CatalogKey, &pids, &e.Items, &e.Pages, &e.Missing, &skipped, &e.Size, &e.Error); err != nil {
+		return nil, err
+	}
+
+	json.Unmarshal([]byte(pids), &e.Pids)
+	json.Unmarshal([]byte(skipped), &e.Skipped)
+
+	return &e, nil
+}
+
+func (c *clientContext) exportCreate(e *exportInfo) error {
+	pids, _ := json.Marshal(e.Pids)
+
+	e.State = jobStateRunning
+	e.Created = fmt.Sprintf("%d", time.Now().Unix())
+
+	query := "insert into exports (id, format, state, created, finished, catalog_key, pids, items, pages, missing, skipped, size, error, heartbeat) values (?, ?, ?, ?, '', ?, ?, 0, 0, 0, '', 0, '', ?);"
+	if _, err := jobDB.Exec(query, e.ID, e.Format, e.State, e.Created, e.CatalogKey, string(pids), time.Now().Unix()); err != nil {
+		c.err("[EXPORT] failed to create export: [%s]", err.Error())
+		return errors.New("failed to create export")
+	}
+
+	return nil
+}
+
+func (c *clientContext) exportGet(id string) (*exportInfo, error) {
+	row := jobDB.QueryRow(fmt.Sprintf("select %s from exports where id = ?;", exportColumns), id)
+
+	e, err := scanExport(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			c.err("[EXPORT] failed to retrieve export: [%s]", err.Error())
+		}
+		return nil, fmt.Errorf("failed to retrieve export: [%s]", id)
+	}
+
+	return e, nil
+}
+
+// records a finished export's outcome
+func (c *clientContext) exportFinish(e *exportInfo) error {
+	skipped, _ := json.Marshal(e.Skipped)
+
+	e.Finished = fmt.Sprintf("%d", time.Now().Unix())
+
+	query := "update exports set state = ?, finished = ?, items = ?, pages = ?, missing = ?, skipped = ?, size = ?, error = ? where id = ?;"
+	if _, err := jobDB.Exec(query, e.State, e.Finished, e.Items, e.Pages, e.Missing, string(skipped), e.Size, e.Error, e.ID); err != nil {
+		c.err("[EXPORT] failed to update export: [%s]", err.Error())
+		return errors.New("failed to update export")
+	}
+
+	return nil
+}
+
+// shows that a running export is still being worked on; see exportFailAbandoned
+func (c *clientContext) exportHeartbeat(id string) {
+	jobDB.Exec("update exports set heartbeat = ? where id = ?;", time.Now().Unix(), id)
+}
+
+// fails running exports whose instance has stopped working on them (restarted, or went away)
+func (c *clientContext) exportFailAbandoned(now time.Time) (int64, error) {
+	cutoff := now.Add(-2 * jobLockLease()).Unix()
+
+	res, err := jobDB.Exec("update exports set state = ?, finished = ?, error = ? where state = ? and heartbeat < ?;", jobStateFailed, fmt.Sprintf("%d", now.Unix()), "export abandoned (instance stopped working on it)", jobStateRunning, cutoff)
+	if err != nil {
+		c.err("[EXPORT] failed to fail abandoned exports: [%s]", err.Error())
+		return 0, errors.New("failed to fail abandoned exports")
+	}
+
+	return res.RowsAffected()
+}
+
+// removes the packages of exports that finished before the cutoff
+func (c *clientContext) exportPurge(cutoff time.Time) (int, error) {
+	rows, err := jobDB.Query("select id from exports where state = ? and cast(finished as integer) < ?;", jobStateComplete, cutoff.Unix())
+	if err != nil {
+		c.err("[EXPORT] failed to retrieve expired exports: [%s]", err.Error())
+		return 0, errors.New("failed to retrieve expired exports")
+	}
+
+	var ids []string
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	rows.Close()
+
+	for _, id := range ids {
+		os.Remove(exportFileName(id))
+		jobDB.Exec("update exports set state = ? where id = ?;", exportStateExpired, id)
+	}
+
+	return len(ids), nil
+}
+
+// the pids of items with the given catalog key that the service has seen
+func (c *clientContext) exportPidsForCatalogKey(key string) ([]string, error) {
+	rows, err := jobDB.Query("select distinct pid from jobs where json_extract(ts_info, '$.Pid.catalog_key') = ? order by pid;", key)
+	if err != nil {
+		c.err("[EXPORT] failed to find pids for catalog key: [%s]", err.Error())
+		return nil, errors.New("failed to find pids for catalog key")
+	}
+	defer rows.Close()
+
+	var pids []string
+
+	for rows.Next() {
+		var pid string
+		if err := rows.Scan(&pid); err != nil {
+			c.err("[EXPORT] failed to scan pid: [%s]", err.Error())
+			return nil, errors.New("failed to scan pid")
+		}
+
+		pids = append(pids, pid)
+	}
+
+	return pids, nil
+}
+
+// the current text of a page: whatever tracksys has now (which may have been edited outside this
+// service), or else the text last posted to tracksys by this service
+func (c *clientContext) exportPageText(pid string) (string, error) {
+	text, err := c.tsGetText(pid)
+	if err == nil {
+		c.versionRecordFetched(pid, text, "")
+		return text, nil
+	}
+
+	if v, vErr := c.versionGetPosted(pid); vErr == nil {
+		c.warn("[EXPORT] using last posted text for page [%s]: [%s]", pid, err.Error())
+		return v.Text, nil
+	}
+
+	return "", err
+}
+
+// retrieves an item's metadata and the text of each of its pages
+func (c *clientContext) exportCollect(id, pid string) (*exportItem, error) {
+	c.req.pid = pid
+
+	ts, err := c.tsGetMetadataPidInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	item := exportItem{ts: ts}
+
+	for _, p := range ts.Pages {
+		page := exportPage{pid: p.Pid, file: exportPageFileName(p)}
+
+		text, err := c.exportPageText(p.Pid)
+		if err != nil {
+			c.warn("[EXPORT] [%s] no text for page [%s]: [%s]", pid, p.Pid, err.Error())
+			page.failed = true
+		}
+
+		page.text = text
+
+		item.pages = append(item.pages, page)
+
+		c.exportHeartbeat(id)
+	}
+
+	return &item, nil
+}
+
+// runs an export to completion, recording the outcome
+func (c *clientContext) exportRun(e *exportInfo) {
+	if err := c.exportWrite(e); err != nil {
+		c.err("[EXPORT] export [%s] failed: [%s]", e.ID, err.Error())
+		e.State = jobStateFailed
+		e.Error = err.Error()
+		c.exportFinish(e)
+		return
+	}
+
+	c.info("[EXPORT] export [%s] complete: %d item(s), %d page(s) (%d missing), %d skipped, %d bytes", e.ID, e.Items, e.Pages, e.Missing, len(e.Skipped), e.Size)
+
+	e.State = jobStateComplete
+	c.exportFinish(e)
+}
+
+// collects an export's items into its package, replacing any partial package from an earlier attempt
+func (c *clientContext) exportWrite(e *exportInfo) error {
+	if err := os.MkdirAll(exportDir(), 0775); err != nil {
+		return fmt.Errorf("failed to create export directory: [%s]", err.Error())
+	}
+
+	file := exportFileName(e.ID)
+	tmp := file + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create export package: [%s]", err.Error())
+	}
+
+	pkg := newExportPackage(f, e, time.Now())
+
+	err = c.exportItems(e, pkg)
+	if err == nil {
+		err = pkg.close()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil && e.Items == 0 {
+		os.Remove(tmp)
+		return errors.New("no items could be exported")
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write export package: [%s]", err.Error())
+	}
+
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save export package: [%s]", err.Error())
+	}
+
+	if info, err := os.Stat(file); err == nil {
+		e.Size = info.Size()
+	}
+
+	return nil
+}
+
+// collects each item in turn, adding it to the package before moving on to the next
+func (c *clientContext) exportItems(e *exportInfo, pkg *exportPackage) error {
+	for _, pid := range e.Pids {
+		item, err := c.exportCollect(e.ID, pid)
+		if err != nil {
+			c.warn("[EXPORT] skipping [%s]: [%s]", pid, err.Error())
+			e.Skipped = append(e.Skipped, fmt.Sprintf("%s: %s", pid, err.Error()))
+			continue
+		}
+
+		if err := pkg.addItem(item); err != nil {
+			return err
+		}
+
+		e.Items++
+		e.Pages += len(item.pages)
+
+		for _, p := range item.pages {
+			if p.failed == true {
+				e.Missing++
+			}
+		}
+	}
+
+	return nil
+}
+
+// item directories are named after their pids, made safe for any file system
+func exportItemDir(pid string) string {
+	return strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(pid)
+}
+
+// "000012345_0001.tif" => "000012345_0001.txt"
+func exportPageFileName(p tsGenericPidInfo) string {
+	if p.Filename == "" {
+		return exportItemDir(p.Pid) + ".txt"
+	}
+
+	return getRemoteFilename(p.Filename, "page.txt")
+}
+
+// an item's per-page files, and its combined document
+func exportItemFiles(item *exportItem) []exportFile {
+	dir := exportItemDir(item.ts.Pid.Pid)
+
+	var files []exportFile
+	var pages []ocrPidInfo
+
+	for _, p := range item.pages {
+		pages = append(pages, ocrPidInfo{pid: p.pid, text: p.text, failed: p.failed})
+
+		if p.failed == false {
+			files = append(files, exportFile{name: path.Join(dir, p.file), data: []byte(cleanOcrText(p.text))})
+		}
+	}
+
+	doc := ocrFileName(item.ts.Pid.Pid, item.ts.Pid.CallNumber)
+
+	files = append(files, exportFile{name: path.Join(dir, doc), data: []byte(ocrFormatDocument(pages))})
+
+	return files
+}
+
+// BagIt tag values are single lines
+func bagInfoValue(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// BagIt manifests percent-encode line breaks and percent signs in file paths
+func bagManifestPath(name string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(name)
+}
+
+func newExportEntry(f exportFile) exportEntry {
+	return exportEntry{name: f.name, sum: sha256.Sum256(f.data), size: int64(len(f.data))}
+}
+
+func bagManifest(entries []exportEntry, prefix string) []byte {
+	var b strings.Builder
+
+	for _, f := range entries {
+		fmt.Fprintf(&b, "%x  %s\n", f.sum, bagManifestPath(path.Join(prefix, f.name)))
+	}
+
+	return []byte(b.String())
+}
+
+func bagInfo(e *exportInfo, items []tsGenericPidInfo, payload []exportEntry, now time.Time) []byte {
+	var bytes int64
+	for _, f := range payload {
+		bytes += f.size
+	}
+
+	agent := "ocr-ws"
+	if versionDetails != nil {
+		agent = fmt.Sprintf("ocr-ws %s", versionDetails.BuildVersion)
+	}
+
+	lines := []string{
+		"Source-Organization: University of Virginia Library",
+		fmt.Sprintf("Bagging-Date: %s", now.Format("2006-01-02")),
+		fmt.Sprintf("Bag-Software-Agent: %s", agent),
+		fmt.Sprintf("External-Identifier: %s", e.ID),
+		fmt.Sprintf("Payload-Oxum: %d.%d", bytes, len(payload)),
+	}
+
+	// one group of labels per item, in payload order
+	for _, pid := range items {
+		lines = append(lines, fmt.Sprintf("Item-Pid: %s", pid.Pid))
+		lines = append(lines, fmt.Sprintf("Title: %s", bagInfoValue(pid.Title)))
+		lines = append(lines, fmt.Sprintf("Call-Number: %s", bagInfoValue(pid.CallNumber)))
+		lines = append(lines, fmt.Sprintf("Catalog-Key: %s", bagInfoValue(pid.CatalogKey)))
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// a package for an export: its items' files under a directory named after the export, either as
+// is (zip) or as the payload of a bag (bagit)
+func newExportPackage(w io.Writer, e *exportInfo, now time.Time) *exportPackage {
+	return &exportPackage{e: e, zw: zip.NewWriter(w), now: now}
+}
+
+func (p *exportPackage) write(f exportFile) error {
+	fw, err := p.zw.CreateHeader(&zip.FileHeader{Name: path.Join(p.e.ID, f.name), Method: zip.Deflate, Modified: p.now})
+	if err != nil {
+		return err
+	}
+
+	_, err = fw.Write(f.data)
+
+	return err
+}
+
+func (p *exportPackage) addItem(item *exportItem) error {
+	for _, f := range exportItemFiles(item) {
+		name := f.name
+		if p.e.Format == exportFormatBagIt {
+			name = path.Join("data", f.name)
+		}
+
+		if err := p.write(exportFile{name: name, data: f.data}); err != nil {
+			return err
+		}
+
+		p.payload = append(p.payload, newExportEntry(f))
+	}
+
+	p.items = append(p.items, item.ts.Pid)
+
+	return nil
+}
+
+// writes a bag's tag files, then finishes the zip
+func (p *exportPackage) close() error {
+	if p.e.Format == exportFormatBagIt {
+		tags := []exportFile{
+			{name: "bagit.txt", data: []byte("BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n")},
+			{name: "bag-info.txt", data: bagInfo(p.e, p.items, p.payload, p.now)},
+			{name: "manifest-sha256.txt", data: bagManifest(p.payload, "data")},
+		}
+
+		var entries []exportEntry
+		for _, f := range tags {
+			entries = append(entries, newExportEntry(f))
+		}
+
+		tags = append(tags, exportFile{name: "tagmanifest-sha256.txt", data: bagManifest(entries, "")})
+
+		for _, f := range tags {
+			if err := p.write(f); err != nil {
+				return err
+			}
+		}
+	}
+
+	return p.zw.Close()
+}
+
+/**
+ * Start an export of the text of the given pids, or of the items with a catalog key
+ */
+func exportCreateHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	e := exportInfo{
+		ID:         fmt.Sprintf("export-%s", randomID()),
+		Format:     ctx.DefaultQuery("format", exportFormatBagIt),
+		CatalogKey: ctx.Query("catalog_key"),
+	}
+
+	if e.Format != exportFormatBagIt && e.Format != exportFormatZip {
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid format (expected %s or %s): [%s]", exportFormatBagIt, exportFormatZip, e.Format))
+		return
+	}
+
+	for _, pid := range strings.FieldsFunc(ctx.Query("pids"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		e.Pids = appendStringIfMissing(e.Pids, pid)
+	}
+
+	if e.CatalogKey != "" {
+		pids, err := c.exportPidsForCatalogKey(e.CatalogKey)
+		if err != nil {
+			c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+			return
+		}
+
+		for _, pid := range pids {
+			e.Pids = appendStringIfMissing(e.Pids, pid)
+		}
+	}
+
+	if len(e.Pids) == 0 {
+		c.respondString(http.StatusBadRequest, "ERROR: No pids given, or none found for the catalog key")
+		return
+	}
+
+	if err := c.exportCreate(&e); err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	c.audit(auditEntry{Action: auditExportRequested, ReqID: e.ID, Details: fmt.Sprintf("format=%s items=%d catalog_key=%s", e.Format, len(e.Pids), e.CatalogKey)})
+
+	c.info("[EXPORT] starting export [%s] of %d item(s) as %s", e.ID, len(e.Pids), e.Format)
+
+	// the request's context does not outlive the request
+	bc := newBackgroundContext()
+	bc.reqID = e.ID
+
+	run := e
+	go bc.exportRun(&run)
+
+	c.respondJSON(http.StatusAccepted, e)
+}
+
+/**
+ * Show the progress or outcome of an export
+ */
+func exportStatusHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	e, err := c.exportGet(ctx.Param("id"))
+	if err != nil {
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	c.respondJSON(http.StatusOK, e)
+}
+
+/**
+ * Download a completed export's package
+ */
+func exportDownloadHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	e, err := c.exportGet(ctx.Param("id"))
+	if err != nil {
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	switch e.State {
+	case jobStateComplete:
+	case exportStateExpired:
+		c.respondString(http.StatusGone, fmt.Sprintf("ERROR: Export [%s] has expired", e.ID))
+		return
+	default:
+		c.respondString(http.StatusConflict, fmt.Sprintf("ERROR: Export [%s] is %s", e.ID, e.State))
+		return
+	}
+
+	file := exportFileName(e.ID)
+
+	if _, err := os.Stat(file); err != nil {
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: Package for export [%s] not found", e.ID))
+		return
+	}
+
+	c.logResponse(http.StatusOK, fmt.Sprintf("export package (%d bytes)", e.Size))
+
+	ctx.FileAttachment(file, fmt.Sprintf("%s.zip", e.ID))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	c := useJobStore(t)
+
+	// tracksys has one item with two pages, and text for the second.  the service has posted text
+	// for both, but the second has since been edited in tracksys
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/pid/uva:1":
+			fmt.Fprint(w, `{"pid": "uva:1", "type": "sirsi_metadata", "title": "A Title", "call_number": "MSS 1/2", "catalog_key": "u123"}`)
+		case "/api/manifest/uva:1":
+			fmt.Fprint(w, `[{"pid": "uva:2", "filename": "000012345_0001.tif"}, {"pid": "uva:3", "filename": "000012345_0002.tif"}]`)
+		case "/api/pid/uva:3/text":
+			fmt.Fprint(w, "tracksys text")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	savedClient := client
+	t.Cleanup(func() { client = savedClient })
+
+	client = ts.Client()
+	config.tsAPIHost.value = ts.URL
+
+	for pid, text := range map[string]string{"uva:2": "posted text", "uva:3": "stale posted text"} {
+		id, _ := c.versionAdd(textVersion{Pid: pid, Source: versionSourceLambda, Text: text})
+		jobDB.Exec("update text_versions set posted = '1' where id = ?;", id)
+	}
+
+	c.jobCreate(&jobInfo{ReqID: "r1", Pid: "uva:1", Priority: jobPriorityPatron}, &tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1", CatalogKey: "u123"}})
+
+	pids, err := c.exportPidsForCatalogKey("u123")
+	if err != nil || len(pids) != 1 || pids[0] != "uva:1" {
+		t.Fatalf("expected [uva:1] for catalog key [u123], got %v (%v)", pids, err)
+	}
+
+	e := exportInfo{ID: "export-1", Format: exportFormatBagIt, Pids: []string{"uva:1", "uva:9"}}
+	c.exportCreate(&e)
+	c.exportRun(&e)
+
+	e2, _ := c.exportGet("export-1")
+	if e2.State != jobStateComplete || e2.Items != 1 || e2.Pages != 2 || e2.Missing != 0 || len(e2.Skipped) != 1 {
+		t.Fatalf("unexpected export: %+v", e2)
+	}
+
+	buf, err := os.ReadFile(exportFileName("export-1"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		data, _ := io.ReadAll(r)
+		r.Close()
+		files[strings.TrimPrefix(f.Name, "export-1/")] = string(data)
+	}
+
+	expected := map[string]string{
+		"data/uva_1/000012345_0001.txt": "posted text",
+		"data/uva_1/000012345_0002.txt": "tracksys text",
+	}
+
+	for name, text := range expected {
+		if files[name] != text {
+			t.Errorf("expected [%s] to contain [%s], got [%s]", name, text, files[name])
+		}
+	}
+
+	if doc := files["data/uva_1/MSS 1∕2.txt"]; strings.Contains(doc, "Page 2 of 2") == false {
+		t.Errorf("expected a combined document, got [%s]", doc)
+	}
+
+	// every payload file is in the manifest, with its checksum
+	manifest := files["manifest-sha256.txt"]
+	for name, data := range files {
+		if strings.HasPrefix(name, "data/") == false {
+			continue
+		}
+
+		if line := fmt.Sprintf("%x  %s\n", sha256.Sum256([]byte(data)), name); strings.Contains(manifest, line) == false {
+			t.Errorf("expected manifest line [%s], got:\n%s", strings.TrimSpace(line), manifest)
+		}
+	}
+
+	for _, line := range []string{"Title: A Title", "Call-Number: MSS 1/2", "Catalog-Key: u123", "Payload-Oxum: "} {
+		if strings.Contains(files["bag-info.txt"], line) == false {
+			t.Errorf("expected bag-info to contain [%s], got:\n%s", line, files["bag-info.txt"])
+		}
+	}
+
+	if _, ok := files["tagmanifest-sha256.txt"]; ok == false {
+		t.Errorf("expected a tag manifest")
+	}
+}
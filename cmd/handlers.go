@@ -15,8 +15,15 @@ import (
 func ocrGenerateHandler(ctx *gin.Context) {
 	c := newClientContext(ctx)
 
+	if isValidJobPriority(c.req.priority) == false {
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid priority: [%s]", c.req.priority))
+		return
+	}
+
 	// check if forcing ocr... bypasses all checks except pid existence (e.g. allows individual master_file ocr)
 	if b, err := strconv.ParseBool(c.req.force); err == nil && b == true {
+		c.audit(auditEntry{Action: auditForceOverride, Pid: c.req.pid, ReqID: c.ocr.reqID, Details: "eligibility checks bypassed"})
+
 		ts, tsErr := c.tsGetPidInfo()
 
 		if tsErr != nil {
@@ -27,22 +34,17 @@ func ocrGenerateHandler(ctx *gin.Context) {
 
 		c.ocr.ts = ts
 
-		c.respondString(http.StatusOK, "OK")
-
-		go c.generateOcr()
+		c.startOcr()
 
 		return
 	}
 
 	// normal request:
 
-	// see if request is already in progress
-	inProgress, _ := c.reqInProgress(c.ocr.workDir)
-	if inProgress == true {
-		// request is in progress; don't start another request, just add email/callback to completion notification list
-		c.info("Request already in progress; adding email/callback to completion notification list")
-		c.reqAddEmail(c.ocr.workDir, c.req.email)
-		c.reqAddCallback(c.ocr.workDir, c.req.callback)
+	// see if request is already queued or in progress
+	if job, _ := c.jobGetActiveForPid(c.req.pid); job != nil {
+		// request is queued or in progress; don't start another request, just add email/callback to completion notification list
+		c.jobAttachRecipients(job)
 		c.respondString(http.StatusOK, "OK")
 		return
 	}
@@ -62,6 +64,16 @@ func ocrGenerateHandler(ctx *gin.Context) {
 	if ts.Pid.HasOcr == true {
 		c.info("OCR/transcription already exists; emailing now")
 
+		// the pid's lock covers the request directory while the text is gathered and sent
+		if err := c.jobLockForNewJob(c.req.pid, c.ocr.reqID); err != nil {
+			c.respondLocked(err)
+			return
+		}
+
+		c.auditRequest(c.ocr.reqID, "existing text")
+
+		publishProgress(c.req.pid, c.ocr.reqID, eventJobAccepted, progressEvent{Total: len(ts.Pages), Details: "existing OCR"})
+
 		c.reqInitialize(c.ocr.workDir, c.ocr.reqID)
 		c.reqUpdateCatalogKey(c.ocr.workDir, c.ocr.reqID, c.ocr.ts.Pid.CatalogKey)
 		c.reqUpdateCallNumber(c.ocr.workDir, c.ocr.reqID, c.ocr.ts.Pid.CallNumber)
@@ -85,6 +97,8 @@ func ocrGenerateHandler(ctx *gin.Context) {
 				return
 			}
 
+			c.versionRecordFetched(p.Pid, txt, c.ocr.reqID)
+
 			res.pages = append(res.pages, ocrPidInfo{pid: p.Pid, text: txt})
 		}
 
@@ -104,13 +118,36 @@ func ocrGenerateHandler(ctx *gin.Context) {
 
 	// perform ocr
 
+	c.startOcr()
+}
+
+func (c *clientContext) startOcr() {
+	if err := c.queueOcr(); err != nil {
+		c.respondLocked(err)
+		return
+	}
+
+	c.auditRequest(c.ocr.reqID, "queued")
+
 	c.respondString(http.StatusOK, "OK")
+}
+
+// responds to a request that could not take its pid's lock: if another request holds it, this one
+// joins that request's notification list
+func (c *clientContext) respondLocked(err error) {
+	var lErr jobLockedError
+	if errors.As(err, &lErr) {
+		c.attachToLockHolder(lErr.reqid)
+		c.respondString(http.StatusOK, "OK")
+		return
+	}
 
-	go c.generateOcr()
+	c.err("queueOcr() failed: [%s]", err.Error())
+	c.respondString(http.StatusInternalServerError, "ERROR: Could not queue OCR request")
 }
 
 func (c *clientContext) getTextForMetadataPid() (string, error) {
-	var pages []string
+	var pages []ocrPidInfo
 
 	for _, p := range c.ocr.ts.Pages {
 		pageText, txtErr := c.tsGetText(p.Pid)
@@ -119,9 +156,13 @@ func (c *clientContext) getTextForMetadataPid() (string, error) {
 			return "", errors.New("could not retrieve page text")
 		}
 
-		pages = append(pages, pageText)
+		c.versionRecordFetched(p.Pid, pageText, "")
+
+		pages = append(pages, ocrPidInfo{pid: p.Pid, text: pageText})
 	}
 
+	c.searchIndexItem(c.ocr.ts, c.ocr.ts.Pid.OcrLanguageHint, pages)
+
 	ocrText := ocrFormatDocument(pages)
 
 	return ocrText, nil
@@ -150,33 +191,6 @@ func ocrTextHandler(ctx *gin.Context) {
 	c.respondString(http.StatusOK, ocrText)
 }
 
-func ocrStatusHandler(ctx *gin.Context) {
-	c := newClientContext(ctx)
-
-	ts, tsErr := c.tsGetMetadataPidInfo()
-
-	if tsErr != nil {
-		c.err("Tracksys API error: [%s]", tsErr.Error())
-		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: Could not retrieve PID info: [%s]", tsErr.Error()))
-		return
-	}
-
-	status := make(map[string]interface{})
-
-	status["has_ocr"] = ts.Pid.HasOcr
-	status["has_transcription"] = ts.Pid.HasTranscription
-	status["is_ocr_candidate"] = ts.isOcrable
-
-	if inProgress, pct := c.reqInProgress(c.ocr.workDir); inProgress == true {
-		c.info("request in progress: %s", pct)
-		status["ocr_progress"] = pct
-	} else {
-		c.info("no request in progress")
-	}
-
-	c.respondJSON(http.StatusOK, status)
-}
-
 func (c *clientContext) generateOcr() {
 	// check for language override
 	if c.req.lang != "" {
@@ -191,6 +205,19 @@ func (c *clientContext) generateOcr() {
 	c.reqAddEmail(c.ocr.workDir, c.req.email)
 	c.reqAddCallback(c.ocr.workDir, c.req.callback)
 
+	// carry over anyone who asked to be notified while this job was queued
+	if emails, err := c.jobGetEmails(c.ocr.reqID); err == nil {
+		for _, e := range emails {
+			c.reqAddEmail(c.ocr.workDir, e)
+		}
+	}
+
+	if callbacks, err := c.jobGetCallbacks(c.ocr.reqID); err == nil {
+		for _, cb := range callbacks {
+			c.reqAddCallback(c.ocr.workDir, cb)
+		}
+	}
+
 	if err := c.awsGenerateOcr(); err != nil {
 		c.err("generateOcr() failed: [%s]", err.Error())
 
@@ -204,3 +231,53 @@ func (c *clientContext) generateOcr() {
 		c.processOcrFailure(res)
 	}
 }
+
+func jobStatusHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	job, err := c.jobGet(ctx.Param("reqid"))
+	if err != nil {
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	status := make(map[string]interface{})
+
+	status["job"] = job
+
+	if pages, err := c.jobGetPages(job.ReqID); err == nil && len(pages) > 0 {
+		sources := make(map[string]int)
+		verified := 0
+
+		var results []ocrPidInfo
+		var failed []string
+
+		for _, p := range pages {
+			if p.source != "" {
+				sources[p.source]++
+			}
+			if p.failed == true {
+				failed = append(failed, p.pid)
+			}
+			if p.verified == true {
+				verified++
+			}
+			if p.attempts > 0 || p.cached == true {
+				results = append(results, p)
+			}
+		}
+
+		status["image_sources"] = sources
+		status["images_verified"] = verified
+
+		if len(failed) > 0 {
+			status["failed_pages"] = failed
+		}
+
+		if len(results) > 0 {
+			status["quality"] = newQualityReport(results)
+		}
+	}
+
+	c.respondJSON(http.StatusOK, status)
+}
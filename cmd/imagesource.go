@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// where page images are read from before being uploaded for ocr
+
+type imageSource interface {
+	// short name recorded against each page
+	name() string
+	// returns the location of the page image, if this source has it
+	locate(c *clientContext, page *tsGenericPidInfo) (string, bool)
+	// opens a previously located page image
+	open(c *clientContext, location string) (io.ReadCloser, error)
+	// whether this source serves the master file itself, so that checksums apply
+	original() bool
+	// for sources serving images derived from the master, what they are derived with
+	derivation() string
+}
+
+const (
+	imageSourceArchive = "archive"
+	imageSourceIIIF    = "iiif"
+	imageSourceS3      = "s3"
+	imageSourceHTTP    = "http"
+)
+
+// matches the original behavior: archive file if present, otherwise iiif
+const imageSourceDefaultOrder = "archive,iiif"
+
+const imageDefaultTimeout = 300
+
+// used for all image downloads; separate from the tracksys client since images can take a while
+var imageClient *http.Client
+
+func initImageSources() {
+	timeout := config.imageTimeout.value
+	if timeout <= 0 {
+		timeout = imageDefaultTimeout
+	}
+
+	imageClient = &http.Client{Timeout: time.Duration(timeout) * time.Second}
+}
+
+func newImageSource(name string) imageSource {
+	switch name {
+	case imageSourceArchive:
+		return archiveImageSource{}
+	case imageSourceIIIF:
+		return iiifImageSource{}
+	case imageSourceS3:
+		return s3ImageSource{}
+	case imageSourceHTTP:
+		return httpImageSource{}
+	}
+
+	return nil
+}
+
+func imageSources() []imageSource {
+	order := config.imageSources.value
+	if order == "" {
+		order = imageSourceDefaultOrder
+	}
+
+	var sources []imageSource
+	for _, name := range strings.Split(order, ",") {
+		if src := newImageSource(strings.TrimSpace(name)); src != nil {
+			sources = append(sources, src)
+		}
+	}
+
+	return sources
+}
+
+// fills in {PID}, {FILENAME}, and {DIR} (the unit directory, e.g. "000012345" for "000012345_0123.tif")
+func expandImageTemplate(tmpl string, page *tsGenericPidInfo) string {
+	dir := strings.Split(page.Filename, "_")[0]
+
+	r := strings.NewReplacer("{PID}", page.Pid, "{FILENAME}", page.Filename, "{DIR}", dir)
+
+	return r.Replace(tmpl)
+}
+
+// picks the first configured source that has the page image
+func (c *clientContext) locatePageImage(page *tsGenericPidInfo) error {
+	for _, src := range imageSources() {
+		if location, ok := src.locate(c, page); ok == true {
+			page.imageSource = location
+			page.imageSourceName = src.name()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no image source found for page: [%s]", page.Pid)
+}
+
+func (c *clientContext) openPageImage(page *tsGenericPidInfo) (*checksumReader, error) {
+	src := newImageSource(page.imageSourceName)
+	if src == nil {
+		return nil, fmt.Errorf("unknown image source: [%s]", page.imageSourceName)
+	}
+
+	stream, err := src.open(c, page.imageSource)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := ""
+	if src.original() == true {
+		expected = strings.ToLower(page.MD5)
+	}
+
+	return newChecksumReader(stream, expected), nil
+}
+
+// archive filesystem
+
+type archiveImageSource struct{}
+
+func (s archiveImageSource) name() string {
+	return imageSourceArchive
+}
+
+func (s archiveImageSource) locate(c *clientContext, page *tsGenericPidInfo) (string, bool) {
+	localFile := getLocalFilename(page.Filename)
+
+	if _, err := os.Stat(localFile); err != nil {
+		return "", false
+	}
+
+	return localFile, true
+}
+
+func (s archiveImageSource) open(c *clientContext, location string) (io.ReadCloser, error) {
+	return os.Open(location)
+}
+
+func (s archiveImageSource) original() bool {
+	return true
+}
+
+func (s archiveImageSource) derivation() string {
+	return ""
+}
+
+// iiif image api; always assumed available
+
+type iiifImageSource struct{}
+
+func (s iiifImageSource) name() string {
+	return imageSourceIIIF
+}
+
+func (s iiifImageSource) locate(c *clientContext, page *tsGenericPidInfo) (string, bool) {
+	return getIIIFUrl(page.Pid), true
+}
+
+func (s iiifImageSource) open(c *clientContext, location string) (io.ReadCloser, error) {
+	return c.openURL(location)
+}
+
+func (s iiifImageSource) original() bool {
+	return false
+}
+
+// the image request parameters (region, size, format, and the rest of the template)
+func (s iiifImageSource) derivation() string {
+	return getIIIFUrl("{PID}")
+}
+
+// s3 bucket, e.g. "s3://bucket/masters/{DIR}/{FILENAME}"
+
+type s3ImageSource struct{}
+
+func (s s3ImageSource) name() string {
+	return imageSourceS3
+}
+
+func parseS3Location(location string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid s3 location: [%s]", location)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func (s s3ImageSource) locate(c *clientContext, page *tsGenericPidInfo) (string, bool) {
+	if config.s3ImageTemplate.value == "" || sess == nil {
+		return "", false
+	}
+
+	location := expandImageTemplate(config.s3ImageTemplate.value, page)
+
+	bucket, key, err := parseS3Location(location)
+	if err != nil {
+		c.warn("[IMAGE] %s", err.Error())
+		return "", false
+	}
+
+	svc := s3.New(sess)
+	if _, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}); err != nil {
+		return "", false
+	}
+
+	return location, true
+}
+
+func (s s3ImageSource) open(c *clientContext, location string) (io.ReadCloser, error) {
+	bucket, key, err := parseS3Location(location)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := s3.New(sess)
+
+	res, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (s s3ImageSource) original() bool {
+	return true
+}
+
+func (s s3ImageSource) derivation() string {
+	return ""
+}
+
+// plain http(s), e.g. "https://images.example.edu/{DIR}/{FILENAME}"
+
+type httpImageSource struct{}
+
+func (s httpImageSource) name() string {
+	return imageSourceHTTP
+}
+
+func (s httpImageSource) locate(c *clientContext, page *tsGenericPidInfo) (string, bool) {
+	if config.httpImageTemplate.value == "" {
+		return "", false
+	}
+
+	location := expandImageTemplate(config.httpImageTemplate.value, page)
+
+	res, err := imageClient.Head(location)
+	if err != nil {
+		return "", false
+	}
+
+	res.Body.Close()
+
+	return location, res.StatusCode == http.StatusOK
+}
+
+func (s httpImageSource) open(c *clientContext, location string) (io.ReadCloser, error) {
+	return c.openURL(location)
+}
+
+func (s httpImageSource) original() bool {
+	return true
+}
+
+func (s httpImageSource) derivation() string {
+	return ""
+}
+
+// computes an md5 checksum of everything read.  once the stream ends, a checksum that does not match
+// the expected value fails that read and every read after it, so that readers which stop at the
+// first error, or which discard an error that arrives with the last of the data (io.ReadFull),
+// still see it
+
+type checksumReader struct {
+	stream   io.ReadCloser
+	hash     hash.Hash
+	expected string
+	sum      string
+	err      error // mismatch, once the stream has ended
+}
+
+func newChecksumReader(stream io.ReadCloser, expected string) *checksumReader {
+	return &checksumReader{stream: stream, hash: md5.New(), expected: expected}
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if r.sum != "" {
+		return 0, io.EOF
+	}
+
+	n, err := r.stream.Read(p)
+	r.hash.Write(p[:n])
+
+	if err == io.EOF {
+		r.sum = hex.EncodeToString(r.hash.Sum(nil))
+
+		if r.expected != "" && r.sum != r.expected {
+			r.err = fmt.Errorf("checksum mismatch: expected [%s], got [%s]", r.expected, r.sum)
+			return n, r.err
+		}
+	}
+
+	return n, err
+}
+
+func (r *checksumReader) Close() error {
+	return r.stream.Close()
+}
+
+// the md5 of the full stream, once it has been read to the end and found to match any expected value
+func (r *checksumReader) checksum() (string, error) {
+	if r.err != nil {
+		return "", r.err
+	}
+
+	if r.sum == "" {
+		return "", errors.New("stream not fully read")
+	}
+
+	return r.sum, nil
+}
+
+// whether the checksum was compared against a known value
+func (r *checksumReader) verified() bool {
+	return r.expected != "" && r.sum == r.expected
+}
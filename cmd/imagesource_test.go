@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func md5Hex(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestChecksumReader(t *testing.T) {
+	data := strings.Repeat("page image data ", 1000)
+
+	tests := []struct {
+		name     string
+		stream   io.Reader
+		expected string
+		sum      string // empty => no checksum is available
+		verified bool
+		fails    bool // reading to the end returns an error
+	}{
+		{"matching", strings.NewReader(data), md5Hex(data), md5Hex(data), true, false},
+		{"matching, one byte at a time", iotest.OneByteReader(strings.NewReader(data)), md5Hex(data), md5Hex(data), true, false},
+		{"matching, eof with the last data", iotest.DataErrReader(strings.NewReader(data)), md5Hex(data), md5Hex(data), true, false},
+		{"nothing expected", strings.NewReader(data), "", md5Hex(data), false, false},
+		{"mismatched", strings.NewReader(data), md5Hex("other data"), "", false, true},
+		{"truncated, ending cleanly", strings.NewReader(data[:len(data)/2]), md5Hex(data), "", false, true},
+		{"truncated, ending in an error", io.MultiReader(strings.NewReader(data[:len(data)/2]), iotest.ErrReader(io.ErrUnexpectedEOF)), md5Hex(data), "", false, true},
+		{"truncated, nothing expected", io.MultiReader(strings.NewReader(data[:len(data)/2]), iotest.ErrReader(io.ErrUnexpectedEOF)), "", "", false, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newChecksumReader(io.NopCloser(tc.stream), tc.expected)
+
+			_, err := io.ReadAll(r)
+			if (err != nil) != tc.fails {
+				t.Errorf("expected failure: %v, got error: %v", tc.fails, err)
+			}
+
+			sum, sumErr := r.checksum()
+			if sum != tc.sum || (sumErr != nil) != (tc.sum == "") {
+				t.Errorf("expected checksum [%s], got [%s] (%v)", tc.sum, sum, sumErr)
+			}
+
+			if r.verified() != tc.verified {
+				t.Errorf("expected verified: %v, got %v", tc.verified, r.verified())
+			}
+		})
+	}
+}
+
+func TestChecksumReaderMismatchPersists(t *testing.T) {
+	data := "page image data"
+
+	r := newChecksumReader(io.NopCloser(iotest.DataErrReader(strings.NewReader(data))), md5Hex("other data"))
+
+	// io.ReadFull discards an error that arrives with the last of the data it asked for
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("unexpected error filling the buffer: %s", err.Error())
+	}
+
+	for i := 0; i < 2; i++ {
+		if n, err := r.Read(buf); n != 0 || err == nil || errors.Is(err, io.EOF) {
+			t.Errorf("expected the mismatch on every later read, got %d bytes (%v)", n, err)
+		}
+	}
+
+	if _, err := r.checksum(); err == nil || strings.Contains(err.Error(), "mismatch") == false {
+		t.Errorf("expected the mismatch from checksum(), got %v", err)
+	}
+}
+
+func TestExpandImageTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		page     tsGenericPidInfo
+		expected string
+	}{
+		{"all placeholders", "s3://masters/{DIR}/{FILENAME}?pid={PID}", tsGenericPidInfo{Pid: "uva:2", Filename: "000012345_0001.tif"}, "s3://masters/000012345/000012345_0001.tif?pid=uva:2"},
+		{"repeated placeholders", "https://images/{DIR}/{DIR}_{PID}", tsGenericPidInfo{Pid: "uva:2", Filename: "000012345_0001.tif"}, "https://images/000012345/000012345_uva:2"},
+		{"filename without a unit", "https://images/{DIR}/{FILENAME}", tsGenericPidInfo{Pid: "uva:2", Filename: "cover.tif"}, "https://images/cover.tif/cover.tif"},
+		{"no filename", "https://images/{DIR}/{FILENAME}", tsGenericPidInfo{Pid: "uva:2"}, "https://images//"},
+		{"no placeholders", "https://images/fixed.tif", tsGenericPidInfo{Pid: "uva:2", Filename: "000012345_0001.tif"}, "https://images/fixed.tif"},
+		{"unknown placeholders kept", "https://images/{UNIT}/{FILENAME}", tsGenericPidInfo{Pid: "uva:2", Filename: "000012345_0001.tif"}, "https://images/{UNIT}/000012345_0001.tif"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if location := expandImageTemplate(tc.template, &tc.page); location != tc.expected {
+				t.Errorf("expected [%s], got [%s]", tc.expected, location)
+			}
+		})
+	}
+}
+
+func TestParseS3Location(t *testing.T) {
+	tests := []struct {
+		location string
+		bucket   string
+		key      string
+	}{
+		{"s3://masters/000012345/000012345_0001.tif", "masters", "000012345/000012345_0001.tif"},
+		{"s3://masters/file.tif", "masters", "file.tif"},
+		{"masters/file.tif", "masters", "file.tif"},
+		{"s3://masters/", "", ""},
+		{"s3://masters", "", ""},
+		{"s3:///file.tif", "", ""},
+		{"", "", ""},
+	}
+
+	for _, tc := range tests {
+		bucket, key, err := parseS3Location(tc.location)
+
+		if tc.bucket == "" {
+			if err == nil {
+				t.Errorf("[%s]: expected an error, got [%s] [%s]", tc.location, bucket, key)
+			}
+			continue
+		}
+
+		if err != nil || bucket != tc.bucket || key != tc.key {
+			t.Errorf("[%s]: expected [%s] [%s], got [%s] [%s] (%v)", tc.location, tc.bucket, tc.key, bucket, key, err)
+		}
+	}
+}
+
+func TestOpenPageImageVerification(t *testing.T) {
+	data := "page image data"
+
+	file := filepath.Join(t.TempDir(), "000012345_0001.tif")
+	os.WriteFile(file, []byte(data), 0644)
+
+	c := newBackgroundContext()
+
+	// tracksys checksums are upper case
+	tests := []struct {
+		name     string
+		md5      string
+		verified bool
+		fails    bool
+	}{
+		{"matching checksum", strings.ToUpper(md5Hex(data)), true, false},
+		{"no checksum", "", false, false},
+		{"changed image", strings.ToUpper(md5Hex("other data")), false, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			page := tsGenericPidInfo{Pid: "uva:2", MD5: tc.md5, imageSourceName: imageSourceArchive, imageSource: file}
+
+			r, err := c.openPageImage(&page)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			defer r.Close()
+
+			if _, err := io.ReadAll(r); (err != nil) != tc.fails {
+				t.Errorf("expected failure: %v, got error: %v", tc.fails, err)
+			}
+
+			if r.verified() != tc.verified {
+				t.Errorf("expected verified: %v, got %v", tc.verified, r.verified())
+			}
+		})
+	}
+}
@@ -0,0 +1,946 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// service-wide job store, shared by all requests (as opposed to the per-pid request databases)
+
+type jobInfo struct {
+	ReqID              string `json:"reqid,omitempty"`
+	Pid                string `json:"pid,omitempty"`
+	Unit               string `json:"unit,omitempty"`
+	Priority           string `json:"priority,omitempty"`
+	State              string `json:"state,omitempty"`
+	Phase              string `json:"phase,omitempty"`
+	PhaseStarted       string `json:"phase_started,omitempty"`
+	Created            string `json:"created,omitempty"`
+	Started            string `json:"started,omitempty"`
+	Finished           string `json:"finished,omitempty"`
+	Force              string `json:"force,omitempty"`
+	Lang               string `json:"lang,omitempty"`
+	WorkflowID         string `json:"workflow_id,omitempty"`
+	Quality            string `json:"quality,omitempty"`
+	DetectedLang       string `json:"detected_lang,omitempty"`
+	LangConfidence     string `json:"detected_lang_confidence,omitempty"`
+	CacheHits          int    `json:"cache_hits"`
+	CacheMisses        int    `json:"cache_misses"`
+	ConcurrencyInitial int    `json:"concurrency_initial"` // lambda concurrency the workflow started with
+	ConcurrencyPeak    int    `json:"concurrency_peak"`    // most page lambdas running at once
+	ConcurrencyFinal   int    `json:"concurrency_final"`   // concurrency target when the workflow ended
+	RetryOf            string `json:"retry_of,omitempty"`
+	Scale              string `json:"scale,omitempty"`
+	Engine             string `json:"engine,omitempty"`
+	Partial            string `json:"partial,omitempty"`
+	DryRun             string `json:"dryrun,omitempty"`
+	Review             string `json:"review,omitempty"`
+	OverwriteCorrected string `json:"overwrite_corrected,omitempty"`
+	tsInfo             string
+}
+
+// job states
+const (
+	jobStateQueued   = "queued"
+	jobStateRunning  = "running"
+	jobStateComplete = "complete"
+	jobStateFailed   = "failed"
+	jobStateCanceled = "canceled"
+)
+
+// job phases, within the queued and running states; finished jobs take their state as their phase
+const (
+	jobPhaseQueued     = "queued"
+	jobPhaseStarting   = "starting" // locating images, checking the result cache and corrections
+	jobPhaseUploading  = "uploading"
+	jobPhaseLanguage   = "language_detection"
+	jobPhaseOcr        = "ocr"
+	jobPhaseFinalizing = "finalizing"
+)
+
+// page states, as a job progresses
+const (
+	pageStatePending   = "pending"
+	pageStateUploaded  = "uploaded"
+	pageStateRunning   = "running" // lambda scheduled
+	pageStateRetrying  = "retrying"
+	pageStateComplete  = "complete"
+	pageStateFailed    = "failed"
+	pageStateCached    = "cached"
+	pageStateCorrected = "corrected"
+)
+
+// recipient types; these mirror the types used in the per-pid request databases
+const (
+	recipientTypeEmail    = 1
+	recipientTypeCallback = 2
+)
+
+var jobDB *sql.DB
+
+const jobColumns = "req_id, pid, unit, priority, state, phase, phase_started, created, started, finished, force, lang, workflow_id, quality, detected_lang, lang_confidence, cache_hits, cache_misses, concurrency_initial, concurrency_peak, concurrency_final, dryrun, review, overwrite_corrected, retry_of, scale, engine, partial, ts_info"
+
+func jobFileName() string {
+	return fmt.Sprintf("%s/jobs.db", config.storageDir.value)
+}
+
+func initJobStore() {
+	dbFile := jobFileName()
+
+	log.Printf("[JOB] using job store: [%s]", dbFile)
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=10000&_journal_mode=WAL", dbFile))
+	if err != nil {
+		log.Fatalf("ERROR: [JOB] failed to open job store: [%s]", err.Error())
+	}
+
+	// serialize access within this process; sqlite only supports one writer anyway
+	db.SetMaxOpenConns(1)
+
+	queries := []string{
+		`create table if not exists jobs (id integer not null primary key autoincrement, req_id text unique, pid text, unit text, priority text, priority_rank integer, state text, created text, started text, finished text, force text, lang text, workflow_id text, ts_info text);`,
+		`create index if not exists jobs_state on jobs (state, priority_rank, id);`,
+		`create index if not exists jobs_pid on jobs (pid);`,
+		`create table if not exists job_recipients (id integer not null primary key, req_id text, type integer, value text, unique (req_id, type, value));`,
+		`create table if not exists job_pages (id integer not null primary key, req_id text, pid text, attempts integer, scale text, confidence real, words integer, text text, unique (req_id, pid));`,
+		`create table if not exists text_versions (id integer not null primary key autoincrement, pid text, req_id text, source text, engine text, lang text, created text, posted text, text text);`,
+		`create index if not exists text_versions_pid on text_versions (pid, id);`,
+		`create table if not exists page_corrections (pid text not null primary key, version_id integer, created text);`,
+		`create table if not exists ocr_cache (key text not null primary key, text text, confidence real, words integer, created text, hits integer, last_hit text);`,
+		`create table if not exists job_locks (pid text not null primary key, req_id text, owner text, acquired integer, heartbeat integer, expires integer);`,
+		`create index if not exists job_locks_req_id on job_locks (req_id);`,
+		`create table if not exists audit_log (id integer not null primary key autoincrement, time text, action text, actor text, ip text, pid text, req_id text, page text, target text, details text);`,
+		`create index if not exists audit_log_pid on audit_log (pid);`,
+		`create index if not exists audit_log_page on audit_log (page);`,
+		`create index if not exists audit_log_req_id on audit_log (req_id);`,
+		`create table if not exists search_items (pid text not null primary key, title text, catalog_key text, call_number text, lang text, updated text);`,
+		`create table if not exists search_pages (id integer not null primary key, page text unique, pid text, position integer);`,
+		`create index if not exists search_pages_pid on search_pages (pid);`,
+		`create virtual table if not exists search_text using fts4 (text, tokenize=unicode61);`,
+		`create table if not exists exports (id text not null primary key, format text, state text, created text, finished text, catalog_key text, pids text, items integer, pages integer, missing integer, skipped text, size integer, error text, heartbeat integer);`,
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			log.Fatalf("ERROR: [JOB] failed to initialize job store: [%s]", err.Error())
+		}
+	}
+
+	// columns added after the initial schema; existing job stores are upgraded in place
+	columns := []struct {
+		table  string
+		column string
+	}{
+		{"jobs", "quality text not null default ''"},
+		{"jobs", "detected_lang text not null default ''"},
+		{"jobs", "lang_confidence text not null default ''"},
+		{"job_pages", "source text not null default ''"},
+		{"job_pages", "md5 text not null default ''"},
+		{"job_pages", "md5_verified integer not null default 0"},
+		{"job_pages", "cache_key text not null default ''"},
+		{"job_pages", "cached integer not null default 0"},
+		{"jobs", "cache_hits integer not null default 0"},
+		{"jobs", "cache_misses integer not null default 0"},
+		{"jobs", "dryrun text not null default ''"},
+		{"jobs", "review text not null default ''"},
+		{"job_pages", "review text not null default ''"},
+		{"job_pages", "posted integer not null default 0"},
+		{"job_pages", "corrected integer not null default 0"},
+		{"jobs", "overwrite_corrected text not null default ''"},
+		{"jobs", "retry_of text not null default ''"},
+		{"jobs", "scale text not null default ''"},
+		{"jobs", "engine text not null default ''"},
+		{"jobs", "partial text not null default ''"},
+		{"job_pages", "failed integer not null default 0"},
+		{"jobs", "concurrency_initial integer not null default 0"},
+		{"jobs", "concurrency_peak integer not null default 0"},
+		{"jobs", "concurrency_final integer not null default 0"},
+		{"job_pages", "duration real not null default 0"},
+		{"jobs", "phase text not null default ''"},
+		{"jobs", "phase_started text not null default ''"},
+		{"job_pages", "state text not null default ''"},
+		{"job_pages", "attempt integer not null default 0"},
+	}
+
+	for _, col := range columns {
+		if err := jobAddColumn(db, col.table, col.column); err != nil {
+			log.Fatalf("ERROR: [JOB] failed to upgrade job store: [%s]", err.Error())
+		}
+	}
+
+	jobDB = db
+}
+
+func jobAddColumn(db *sql.DB, table, column string) error {
+	_, err := db.Exec(fmt.Sprintf("alter table %s add column %s;", table, column))
+	if err != nil && strings.Contains(err.Error(), "duplicate column") == false {
+		return err
+	}
+
+	return nil
+}
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*jobInfo, error) {
+	var job jobInfo
+
+	err := row.Scan(&job.ReqID, &job.Pid, &job.Unit, &job.Priority, &job.State, &job.Phase, &job.PhaseStarted, &job.Created, &job.Started, &job.Finished, &job.Force, &job.Lang, &job.WorkflowID, &job.Quality, &job.DetectedLang, &job.LangConfidence, &job.CacheHits, &job.CacheMisses, &job.ConcurrencyInitial, &job.ConcurrencyPeak, &job.ConcurrencyFinal, &job.DryRun, &job.Review, &job.OverwriteCorrected, &job.RetryOf, &job.Scale, &job.Engine, &job.Partial, &job.tsInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func (c *clientContext) jobCreate(job *jobInfo, ts *tsPidInfo) error {
+	tsInfo, jsonErr := json.Marshal(ts)
+	if jsonErr != nil {
+		c.err("[JOB] failed to serialize pid info: [%s]", jsonErr.Error())
+		return errors.New("failed to serialize pid info")
+	}
+
+	job.State = jobStateQueued
+	job.Phase = jobPhaseQueued
+	job.Created = fmt.Sprintf("%d", time.Now().Unix())
+	job.PhaseStarted = job.Created
+	job.tsInfo = string(tsInfo)
+
+	query := "insert into jobs (req_id, pid, unit, priority, priority_rank, state, phase, phase_started, created, started, finished, force, lang, workflow_id, dryrun, overwrite_corrected, scale, engine, retry_of, partial, ts_info) values (?, ?, ?, ?, ?, ?, ?, ?, ?, '', '', ?, ?, '', ?, ?, ?, ?, ?, ?, ?);"
+	_, err := jobDB.Exec(query, job.ReqID, job.Pid, job.Unit, job.Priority, jobPriorityRank(job.Priority), job.State, job.Phase, job.PhaseStarted, job.Created, job.Force, job.Lang, job.DryRun, job.OverwriteCorrected, job.Scale, job.Engine, job.RetryOf, job.Partial, job.tsInfo)
+	if err != nil {
+		c.err("[JOB] failed to create job: [%s]", err.Error())
+		return errors.New("failed to create job")
+	}
+
+	return nil
+}
+
+func (c *clientContext) jobGet(reqid string) (*jobInfo, error) {
+	row := jobDB.QueryRow(fmt.Sprintf("select %s from jobs where req_id = ?;", jobColumns), reqid)
+
+	job, err := scanJob(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			c.err("[JOB] failed to retrieve job: [%s]", err.Error())
+		}
+		return nil, fmt.Errorf("failed to retrieve job: [%s]", reqid)
+	}
+
+	return job, nil
+}
+
+// returns the most recent queued or running job for the given pid, if any
+func (c *clientContext) jobGetActiveForPid(pid string) (*jobInfo, error) {
+	query := fmt.Sprintf("select %s from jobs where pid = ? and state in (?, ?) order by id desc limit 1;", jobColumns)
+	row := jobDB.QueryRow(query, pid, jobStateQueued, jobStateRunning)
+
+	job, err := scanJob(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			c.err("[JOB] failed to retrieve active job: [%s]", err.Error())
+			return nil, errors.New("failed to retrieve active job")
+		}
+		return nil, nil
+	}
+
+	return job, nil
+}
+
+// returns the most recent job for the given pid in any state, if any
+func (c *clientContext) jobGetLatestForPid(pid string) (*jobInfo, error) {
+	query := fmt.Sprintf("select %s from jobs where pid = ? order by id desc limit 1;", jobColumns)
+	row := jobDB.QueryRow(query, pid)
+
+	job, err := scanJob(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			c.err("[JOB] failed to retrieve latest job: [%s]", err.Error())
+			return nil, errors.New("failed to retrieve latest job")
+		}
+		return nil, nil
+	}
+
+	return job, nil
+}
+
+// atomically claims the next queued job, in priority order, marking it as running
+func (c *clientContext) jobClaimNext() (*jobInfo, error) {
+	query := fmt.Sprintf("select %s from jobs where state = ? order by priority_rank, id limit 1;", jobColumns)
+	row := jobDB.QueryRow(query, jobStateQueued)
+
+	job, err := scanJob(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			c.err("[JOB] failed to retrieve next queued job: [%s]", err.Error())
+			return nil, errors.New("failed to retrieve next queued job")
+		}
+		return nil, nil
+	}
+
+	job.State = jobStateRunning
+	job.Phase = jobPhaseStarting
+	job.Started = fmt.Sprintf("%d", time.Now().Unix())
+	job.PhaseStarted = job.Started
+
+	res, err := jobDB.Exec("update jobs set state = ?, phase = ?, phase_started = ?, started = ? where req_id = ? and state = ?;", job.State, job.Phase, job.PhaseStarted, job.Started, job.ReqID, jobStateQueued)
+	if err != nil {
+		c.err("[JOB] failed to claim job: [%s]", err.Error())
+		return nil, errors.New("failed to claim job")
+	}
+
+	// someone else got to it first
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+
+	return job, nil
+}
+
+// returns the most recent jobs, optionally limited to those in the given state
+func (c *clientContext) jobList(state string, limit int) ([]jobInfo, error) {
+	query := fmt.Sprintf("select %s from jobs where (? = '' or state = ?) order by id desc limit ?;", jobColumns)
+	rows, err := jobDB.Query(query, state, state, limit)
+	if err != nil {
+		c.err("[JOB] failed to retrieve jobs: [%s]", err.Error())
+		return nil, errors.New("failed to retrieve jobs")
+	}
+	defer rows.Close()
+
+	jobs := []jobInfo{}
+
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			c.err("[JOB] failed to scan job: [%s]", err.Error())
+			return nil, errors.New("failed to scan job")
+		}
+
+		jobs = append(jobs, *job)
+	}
+
+	if err := rows.Err(); err != nil {
+		c.err("[JOB] select query failed: [%s]", err.Error())
+		return nil, errors.New("failed to select jobs")
+	}
+
+	return jobs, nil
+}
+
+// cancels a job if it has not already finished; returns whether it was canceled
+func (c *clientContext) jobCancel(reqid string) (bool, error) {
+	now := fmt.Sprintf("%d", time.Now().Unix())
+
+	query := "update jobs set state = ?, phase = ?, phase_started = ?, finished = ? where req_id = ? and state in (?, ?);"
+	res, err := jobDB.Exec(query, jobStateCanceled, jobStateCanceled, now, now, reqid, jobStateQueued, jobStateRunning)
+	if err != nil {
+		c.err("[JOB] failed to cancel job: [%s]", err.Error())
+		return false, errors.New("failed to cancel job")
+	}
+
+	jobQueueSignal()
+
+	n, _ := res.RowsAffected()
+
+	return n > 0, nil
+}
+
+// whether a job was stopped (canceled by staff, or failed by the reaper) while it was running
+func (c *clientContext) jobIsStopped(reqid string) bool {
+	job, err := c.jobGet(reqid)
+	return err == nil && (job.State == jobStateCanceled || job.State == jobStateFailed)
+}
+
+// fails a job stuck in a phase, provided it has not moved on since it was found
+func (c *clientContext) jobFailStuck(reqid, phase, phaseStarted string) (bool, error) {
+	now := fmt.Sprintf("%d", time.Now().Unix())
+
+	query := "update jobs set state = ?, phase = ?, phase_started = ?, finished = ? where req_id = ? and state in (?, ?) and phase = ? and phase_started = ?;"
+	res, err := jobDB.Exec(query, jobStateFailed, jobStateFailed, now, now, reqid, jobStateQueued, jobStateRunning, phase, phaseStarted)
+	if err != nil {
+		c.err("[JOB] failed to fail stuck job: [%s]", err.Error())
+		return false, errors.New("failed to fail stuck job")
+	}
+
+	jobQueueSignal()
+
+	n, _ := res.RowsAffected()
+
+	return n > 0, nil
+}
+
+// returns all queued and running jobs, oldest first
+func (c *clientContext) jobListActive() ([]jobInfo, error) {
+	query := fmt.Sprintf("select %s from jobs where state in (?, ?) order by id;", jobColumns)
+	rows, err := jobDB.Query(query, jobStateQueued, jobStateRunning)
+	if err != nil {
+		c.err("[JOB] failed to retrieve active jobs: [%s]", err.Error())
+		return nil, errors.New("failed to retrieve active jobs")
+	}
+	defer rows.Close()
+
+	jobs := []jobInfo{}
+
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			c.err("[JOB] failed to scan job: [%s]", err.Error())
+			return nil, errors.New("failed to scan job")
+		}
+
+		jobs = append(jobs, *job)
+	}
+
+	return jobs, nil
+}
+
+// removes the page results of jobs finished before the cutoff (other than pages still held for review),
+// and cached results not used since.  returns the number of pages and cache entries removed
+func (c *clientContext) jobPurgeResults(cutoff time.Time) (int64, int64, error) {
+	before := cutoff.Unix()
+
+	res, err := jobDB.Exec("delete from job_pages where review != ? and req_id in (select req_id from jobs where state not in (?, ?) and finished != '' and cast(finished as integer) < ?);", reviewPending, jobStateQueued, jobStateRunning, before)
+	if err != nil {
+		c.err("[JOB] failed to purge page results: [%s]", err.Error())
+		return 0, 0, errors.New("failed to purge page results")
+	}
+
+	pages, _ := res.RowsAffected()
+
+	res, err = jobDB.Exec("delete from ocr_cache where cast(case when last_hit != '' then last_hit else created end as integer) < ?;", before)
+	if err != nil {
+		c.err("[JOB] failed to purge cached results: [%s]", err.Error())
+		return pages, 0, errors.New("failed to purge cached results")
+	}
+
+	cached, _ := res.RowsAffected()
+
+	return pages, cached, nil
+}
+
+func (c *clientContext) jobCountByState(state string) (int, error) {
+	var count int
+
+	if err := jobDB.QueryRow("select count(*) from jobs where state = ?;", state).Scan(&count); err != nil {
+		c.err("[JOB] failed to count %s jobs: [%s]", state, err.Error())
+		return 0, fmt.Errorf("failed to count %s jobs", state)
+	}
+
+	return count, nil
+}
+
+// returns the 1-based position of a queued job, counting higher priority and older jobs ahead of it
+func (c *clientContext) jobQueuePosition(reqid string) (int, error) {
+	var pos int
+
+	query := `select count(*) from jobs q, jobs j where j.req_id = ? and j.state = ? and q.state = ? and (q.priority_rank < j.priority_rank or (q.priority_rank = j.priority_rank and q.id <= j.id));`
+	if err := jobDB.QueryRow(query, reqid, jobStateQueued, jobStateQueued).Scan(&pos); err != nil {
+		c.err("[JOB] failed to determine queue position: [%s]", err.Error())
+		return 0, errors.New("failed to determine queue position")
+	}
+
+	return pos, nil
+}
+
+func (c *clientContext) jobUpdateColumn(reqid, column, value string) error {
+	query := fmt.Sprintf("update jobs set %s = ? where req_id = ?;", column)
+	if _, err := jobDB.Exec(query, value, reqid); err != nil {
+		c.err("[JOB] failed to update %s: [%s]", column, err.Error())
+		return fmt.Errorf("failed to update %s", column)
+	}
+
+	return nil
+}
+
+func (c *clientContext) jobUpdateWorkflowID(reqid, value string) error {
+	return c.jobUpdateColumn(reqid, "workflow_id", value)
+}
+
+func (c *clientContext) jobUpdateQuality(reqid, value string) error {
+	return c.jobUpdateColumn(reqid, "quality", value)
+}
+
+func (c *clientContext) jobUpdateDetectedLanguage(reqid, lang, confidence string) error {
+	if err := c.jobUpdateColumn(reqid, "detected_lang", lang); err != nil {
+		return err
+	}
+
+	return c.jobUpdateColumn(reqid, "lang_confidence", confidence)
+}
+
+func (c *clientContext) jobUpdateCacheCounts(reqid string, hits, misses int) error {
+	if _, err := jobDB.Exec("update jobs set cache_hits = ?, cache_misses = ? where req_id = ?;", hits, misses, reqid); err != nil {
+		c.err("[JOB] failed to update cache counts: [%s]", err.Error())
+		return errors.New("failed to update cache counts")
+	}
+
+	return nil
+}
+
+func (c *clientContext) jobUpdateConcurrency(reqid string, initial, peak, final int) error {
+	if _, err := jobDB.Exec("update jobs set concurrency_initial = ?, concurrency_peak = ?, concurrency_final = ? where req_id = ?;", initial, peak, final, reqid); err != nil {
+		c.err("[JOB] failed to update concurrency: [%s]", err.Error())
+		return errors.New("failed to update concurrency")
+	}
+
+	return nil
+}
+
+// moves a queued or running job to a new phase
+func (c *clientContext) jobUpdatePhase(reqid, phase string) error {
+	query := "update jobs set phase = ?, phase_started = ? where req_id = ? and state in (?, ?) and phase != ?;"
+	if _, err := jobDB.Exec(query, phase, fmt.Sprintf("%d", time.Now().Unix()), reqid, jobStateQueued, jobStateRunning, phase); err != nil {
+		c.err("[JOB] failed to update phase: [%s]", err.Error())
+		return errors.New("failed to update phase")
+	}
+
+	return nil
+}
+
+// lambda statistics for the most recent ocr'd pages: mean duration of the successful attempt,
+// mean attempts, and the number of pages these are based on
+func (c *clientContext) jobPageLambdaStats(limit int) (float64, float64, int, error) {
+	var seconds, attempts float64
+	var count int
+
+	query := "select coalesce(avg(duration), 0), coalesce(avg(attempts), 0), count(*) from (select duration, attempts from job_pages where duration > 0 and attempts > 0 order by id desc limit ?);"
+	if err := jobDB.QueryRow(query, limit).Scan(&seconds, &attempts, &count); err != nil {
+		c.err("[JOB] failed to retrieve page lambda stats: [%s]", err.Error())
+		return 0, 0, 0, errors.New("failed to retrieve page lambda stats")
+	}
+
+	return seconds, attempts, count, nil
+}
+
+// mean run time in seconds of the most recent completed jobs, and the number of jobs it is based on
+func (c *clientContext) jobRunSecondsStats(limit int) (float64, int, error) {
+	var seconds float64
+	var count int
+
+	query := "select coalesce(avg(cast(finished as integer) - cast(started as integer)), 0), count(*) from (select started, finished from jobs where state = ? and started != '' and finished != '' order by id desc limit ?);"
+	if err := jobDB.QueryRow(query, jobStateComplete, limit).Scan(&seconds, &count); err != nil {
+		c.err("[JOB] failed to retrieve job run stats: [%s]", err.Error())
+		return 0, 0, errors.New("failed to retrieve job run stats")
+	}
+
+	return seconds, count, nil
+}
+
+// finishes a running job, returning false if it was stopped (canceled by staff, or failed by the
+// reaper) before it could be.  requests answered from existing text have no job to finish
+func (c *clientContext) jobFinish(reqid, state string) (bool, error) {
+	now := fmt.Sprintf("%d", time.Now().Unix())
+
+	res, err := jobDB.Exec("update jobs set state = ?, phase = ?, phase_started = ?, finished = ? where req_id = ? and state = ?;", state, state, now, now, reqid, jobStateRunning)
+	if err != nil {
+		c.err("[JOB] failed to finish job: [%s]", err.Error())
+		return false, errors.New("failed to finish job")
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := c.jobGet(reqid); err == nil {
+			return false, nil
+		}
+	}
+
+	// a running slot may have opened up
+	jobQueueSignal()
+
+	return true, nil
+}
+
+// requeues jobs that were running when the service went down, but never got as far as submitting a workflow.
+// jobs whose lock is still live under another instance are being worked on there, and are left alone
+func (c *clientContext) jobRequeueInterrupted() error {
+	now := time.Now()
+
+	query := `update jobs set state = ?, phase = ?, phase_started = ?, started = '' where state = ? and workflow_id = ''
+		and not exists (select 1 from job_locks where job_locks.req_id = jobs.req_id and job_locks.owner != ? and job_locks.expires >= ?);`
+
+	res, err := jobDB.Exec(query, jobStateQueued, jobPhaseQueued, fmt.Sprintf("%d", now.Unix()), jobStateRunning, instanceID, now.Unix())
+	if err != nil {
+		c.err("[JOB] failed to requeue interrupted jobs: [%s]", err.Error())
+		return errors.New("failed to requeue interrupted jobs")
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		c.info("[JOB] requeued %d interrupted job(s)", n)
+	}
+
+	return nil
+}
+
+func (c *clientContext) jobAddRecipientByType(reqid string, rtype int, rvalue string) error {
+	if rvalue == "" {
+		return nil
+	}
+
+	if _, err := jobDB.Exec("insert or ignore into job_recipients (req_id, type, value) values (?, ?, ?);", reqid, rtype, sealRecipient(rvalue)); err != nil {
+		c.err("[JOB] failed to add recipient: [%s]", err.Error())
+		return errors.New("failed to add recipient")
+	}
+
+	return nil
+}
+
+func (c *clientContext) jobAddEmail(reqid, value string) error {
+	return c.jobAddRecipientByType(reqid, recipientTypeEmail, value)
+}
+
+func (c *clientContext) jobAddCallback(reqid, value string) error {
+	return c.jobAddRecipientByType(reqid, recipientTypeCallback, value)
+}
+
+func (c *clientContext) jobGetRecipientsByType(reqid string, rtype int) ([]string, error) {
+	rows, err := jobDB.Query("select value from job_recipients where req_id = ? and type = ? order by id;", reqid, rtype)
+	if err != nil {
+		c.err("[JOB] failed to retrieve recipients: [%s]", err.Error())
+		return nil, errors.New("failed to retrieve recipients")
+	}
+	defer rows.Close()
+
+	var values []string
+
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			c.err("[JOB] failed to scan recipient: [%s]", err.Error())
+			return nil, errors.New("failed to scan recipient")
+		}
+
+		values = appendStringIfMissing(values, value)
+	}
+
+	if err := rows.Err(); err != nil {
+		c.err("[JOB] select query failed: [%s]", err.Error())
+		return nil, errors.New("failed to select recipients")
+	}
+
+	return c.openRecipients(values), nil
+}
+
+func (c *clientContext) jobGetEmails(reqid string) ([]string, error) {
+	return c.jobGetRecipientsByType(reqid, recipientTypeEmail)
+}
+
+func (c *clientContext) jobGetCallbacks(reqid string) ([]string, error) {
+	return c.jobGetRecipientsByType(reqid, recipientTypeCallback)
+}
+
+func (c *clientContext) jobSavePages(reqid string, pages []ocrPidInfo) error {
+	tx, err := jobDB.Begin()
+	if err != nil {
+		c.err("[JOB] failed to create page results transaction: [%s]", err.Error())
+		return errors.New("failed to create page results transaction")
+	}
+	defer tx.Rollback()
+
+	// page rows may already exist from when the image was uploaded
+	stmt, err := tx.Prepare("insert into job_pages (req_id, pid, attempts, scale, confidence, words, text, failed, duration, state) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict (req_id, pid) do update set attempts = excluded.attempts, scale = excluded.scale, confidence = excluded.confidence, words = excluded.words, text = excluded.text, failed = excluded.failed, duration = excluded.duration, state = excluded.state;")
+	if err != nil {
+		c.err("[JOB] failed to prepare page results transaction: [%s]", err.Error())
+		return errors.New("failed to prepare page results transaction")
+	}
+	defer stmt.Close()
+
+	for _, p := range pages {
+		var confidence sql.NullFloat64
+		if p.confidence != nil {
+			confidence = sql.NullFloat64{Float64: *p.confidence, Valid: true}
+		}
+
+		if _, err := stmt.Exec(reqid, p.pid, p.attempts, p.scale, confidence, p.words, p.text, p.failed, p.duration, p.resultState()); err != nil {
+			c.err("[JOB] failed to save page result: [%s]", err.Error())
+			return errors.New("failed to save page result")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.err("[JOB] failed to commit page results: [%s]", err.Error())
+		return errors.New("failed to commit page results")
+	}
+
+	return nil
+}
+
+func (c *clientContext) jobGetPages(reqid string) ([]ocrPidInfo, error) {
+	rows, err := jobDB.Query("select pid, coalesce(attempts, 0), coalesce(scale, ''), confidence, coalesce(words, 0), coalesce(text, ''), source, md5, md5_verified, cached, corrected, review, posted, failed, state, attempt from job_pages where req_id = ? order by pid;", reqid)
+	if err != nil {
+		c.err("[JOB] failed to retrieve page results: [%s]", err.Error())
+		return nil, errors.New("failed to retrieve page results")
+	}
+	defer rows.Close()
+
+	var pages []ocrPidInfo
+
+	for rows.Next() {
+		var p ocrPidInfo
+		var confidence sql.NullFloat64
+
+		if err := rows.Scan(&p.pid, &p.attempts, &p.scale, &confidence, &p.words, &p.text, &p.source, &p.md5, &p.verified, &p.cached, &p.corrected, &p.review, &p.posted, &p.failed, &p.state, &p.attempt); err != nil {
+			c.err("[JOB] failed to scan page result: [%s]", err.Error())
+			return nil, errors.New("failed to scan page result")
+		}
+
+		if confidence.Valid == true {
+			p.confidence = &confidence.Float64
+		}
+
+		pages = append(pages, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		c.err("[JOB] select query failed: [%s]", err.Error())
+		return nil, errors.New("failed to select page results")
+	}
+
+	return pages, nil
+}
+
+// records the progress of pages through a workflow, as seen in a decision task
+func (c *clientContext) jobUpdatePageStates(reqid string, updates []pageUpdate) error {
+	for _, u := range updates {
+		query := "insert into job_pages (req_id, pid, state, attempt) values (?, ?, ?, ?) on conflict (req_id, pid) do update set state = excluded.state, attempt = max(attempt, excluded.attempt);"
+		if _, err := jobDB.Exec(query, reqid, u.pid, u.state, u.attempt); err != nil {
+			c.err("[JOB] failed to update page state: [%s]", err.Error())
+			return errors.New("failed to update page state")
+		}
+	}
+
+	return nil
+}
+
+func (c *clientContext) jobSavePageSource(reqid, pid, source, md5 string, verified bool) error {
+	query := "insert into job_pages (req_id, pid, source, md5, md5_verified, state) values (?, ?, ?, ?, ?, ?) on conflict (req_id, pid) do update set source = excluded.source, md5 = excluded.md5, md5_verified = excluded.md5_verified, state = excluded.state;"
+	if _, err := jobDB.Exec(query, reqid, pid, source, md5, verified, pageStateUploaded); err != nil {
+		c.err("[JOB] failed to save page source: [%s]", err.Error())
+		return errors.New("failed to save page source")
+	}
+
+	return nil
+}
+
+func (c *clientContext) jobSavePageCacheKey(reqid, pid, source, md5, key string) error {
+	query := "insert into job_pages (req_id, pid, source, md5, cache_key) values (?, ?, ?, ?, ?) on conflict (req_id, pid) do update set source = excluded.source, md5 = excluded.md5, cache_key = excluded.cache_key;"
+	if _, err := jobDB.Exec(query, reqid, pid, source, md5, key); err != nil {
+		c.err("[JOB] failed to save page cache key: [%s]", err.Error())
+		return errors.New("failed to save page cache key")
+	}
+
+	return nil
+}
+
+func (c *clientContext) jobSaveCachedPages(reqid string, pages []ocrPidInfo) error {
+	for _, p := range pages {
+		var confidence sql.NullFloat64
+		if p.confidence != nil {
+			confidence = sql.NullFloat64{Float64: *p.confidence, Valid: true}
+		}
+
+		query := "update job_pages set attempts = 0, scale = '', confidence = ?, words = ?, text = ?, cached = 1, state = ? where req_id = ? and pid = ?;"
+		if _, err := jobDB.Exec(query, confidence, p.words, p.text, pageStateCached, reqid, p.pid); err != nil {
+			c.err("[JOB] failed to save cached page: [%s]", err.Error())
+			return errors.New("failed to save cached page")
+		}
+	}
+
+	return nil
+}
+
+func (c *clientContext) jobSaveCorrectedPages(reqid string, pages []ocrPidInfo) error {
+	for _, p := range pages {
+		query := "insert into job_pages (req_id, pid, text, corrected, state) values (?, ?, ?, 1, ?) on conflict (req_id, pid) do update set text = excluded.text, corrected = 1, state = excluded.state;"
+		if _, err := jobDB.Exec(query, reqid, p.pid, p.text, pageStateCorrected); err != nil {
+			c.err("[JOB] failed to save corrected page: [%s]", err.Error())
+			return errors.New("failed to save corrected page")
+		}
+	}
+
+	return nil
+}
+
+// returns pages whose text did not need ocr: result cache hits and manual corrections
+func (c *clientContext) jobGetSatisfiedPages(reqid string) ([]ocrPidInfo, error) {
+	pages, err := c.jobGetPages(reqid)
+	if err != nil {
+		return nil, err
+	}
+
+	var satisfied []ocrPidInfo
+	for _, p := range pages {
+		if p.cached == true || p.corrected == true {
+			satisfied = append(satisfied, p)
+		}
+	}
+
+	return satisfied, nil
+}
+
+// returns pages with usable text: ocr results, result cache hits and manual corrections
+func (c *clientContext) jobGetCompletedPages(reqid string) ([]ocrPidInfo, error) {
+	pages, err := c.jobGetPages(reqid)
+	if err != nil {
+		return nil, err
+	}
+
+	var completed []ocrPidInfo
+	for _, p := range pages {
+		if p.failed == false && (p.attempts > 0 || p.cached == true || p.corrected == true) {
+			completed = append(completed, p)
+		}
+	}
+
+	return completed, nil
+}
+
+// for a retry job, returns the completed pages of the job(s) it retried that are not among the given pages
+func (c *clientContext) jobGetRetriedPages(reqid string, have []ocrPidInfo) []ocrPidInfo {
+	seen := make(map[string]bool)
+	for _, p := range have {
+		seen[p.pid] = true
+	}
+
+	var pages []ocrPidInfo
+
+	visited := map[string]bool{reqid: true}
+
+	job, err := c.jobGet(reqid)
+
+	for err == nil && job.RetryOf != "" && visited[job.RetryOf] == false {
+		visited[job.RetryOf] = true
+
+		completed, cErr := c.jobGetCompletedPages(job.RetryOf)
+		if cErr != nil {
+			break
+		}
+
+		for _, p := range completed {
+			if seen[p.pid] == false {
+				seen[p.pid] = true
+				pages = append(pages, p)
+			}
+		}
+
+		job, err = c.jobGet(job.RetryOf)
+	}
+
+	if len(pages) > 0 {
+		c.info("[JOB] [%s] carrying over %d page result(s) from retried job(s)", reqid, len(pages))
+	}
+
+	return pages
+}
+
+// the job a chain of retries started from, which has the full list of the request's pages
+func (c *clientContext) jobGetRetryOrigin(job *jobInfo) *jobInfo {
+	visited := map[string]bool{job.ReqID: true}
+
+	for job.RetryOf != "" && visited[job.RetryOf] == false {
+		visited[job.RetryOf] = true
+
+		orig, err := c.jobGet(job.RetryOf)
+		if err != nil {
+			break
+		}
+
+		job = orig
+	}
+
+	return job
+}
+
+// pid => cache key
+func (c *clientContext) jobGetPageCacheKeys(reqid string) (map[string]string, error) {
+	rows, err := jobDB.Query("select pid, cache_key from job_pages where req_id = ? and cache_key != '';", reqid)
+	if err != nil {
+		c.err("[JOB] failed to retrieve page cache keys: [%s]", err.Error())
+		return nil, errors.New("failed to retrieve page cache keys")
+	}
+	defer rows.Close()
+
+	keys := make(map[string]string)
+
+	for rows.Next() {
+		var pid, key string
+		if err := rows.Scan(&pid, &key); err != nil {
+			c.err("[JOB] failed to scan page cache key: [%s]", err.Error())
+			return nil, errors.New("failed to scan page cache key")
+		}
+
+		keys[pid] = key
+	}
+
+	if err := rows.Err(); err != nil {
+		c.err("[JOB] select query failed: [%s]", err.Error())
+		return nil, errors.New("failed to select page cache keys")
+	}
+
+	return keys, nil
+}
+
+// holds all pages with results for review, instead of posting them to tracksys
+func (c *clientContext) jobHoldForReview(reqid string) error {
+	if _, err := jobDB.Exec("update job_pages set review = ?, posted = 0 where req_id = ? and (attempts > 0 or cached = 1);", reviewPending, reqid); err != nil {
+		c.err("[JOB] failed to hold pages for review: [%s]", err.Error())
+		return errors.New("failed to hold pages for review")
+	}
+
+	return c.jobUpdateColumn(reqid, "review", reviewPending)
+}
+
+func (c *clientContext) jobUpdatePageReview(reqid, pid, review string, posted bool) error {
+	if _, err := jobDB.Exec("update job_pages set review = ?, posted = ? where req_id = ? and pid = ?;", review, posted, reqid, pid); err != nil {
+		c.err("[JOB] failed to update page review: [%s]", err.Error())
+		return errors.New("failed to update page review")
+	}
+
+	return nil
+}
+
+// derives the job review state from its pages, and saves it
+func (c *clientContext) jobUpdateReviewState(reqid string) (string, error) {
+	rows, err := jobDB.Query("select review, count(*) from job_pages where req_id = ? and review != '' group by review;", reqid)
+	if err != nil {
+		c.err("[JOB] failed to retrieve page reviews: [%s]", err.Error())
+		return "", errors.New("failed to retrieve page reviews")
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+
+	for rows.Next() {
+		var review string
+		var count int
+		if err := rows.Scan(&review, &count); err != nil {
+			c.err("[JOB] failed to scan page review: [%s]", err.Error())
+			return "", errors.New("failed to scan page review")
+		}
+
+		counts[review] = count
+	}
+
+	if err := rows.Err(); err != nil {
+		c.err("[JOB] select query failed: [%s]", err.Error())
+		return "", errors.New("failed to select page reviews")
+	}
+
+	var review string
+
+	switch {
+	case counts[reviewPending] > 0:
+		review = reviewPending
+	case counts[reviewApproved] > 0 && counts[reviewRejected] > 0:
+		review = reviewPartial
+	case counts[reviewApproved] > 0:
+		review = reviewApproved
+	default:
+		review = reviewRejected
+	}
+
+	return review, c.jobUpdateColumn(reqid, "review", review)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// language identification using character n-gram profiles (Cavnar & Trenkle, 1994).
+// profiles are built at startup from the embedded sample texts below, so no network access is needed.
+
+// number of ranked n-grams kept per profile
+const langProfileSize = 300
+
+// longest n-gram considered
+const langMaxNgram = 3
+
+// pages with fewer letters than this are not considered for detection
+const langMinPageLetters = 50
+
+// a language must be detected on at least this percentage of sampled pages to be included in the result
+const langMinPagePct = 25
+
+// default number of pages to ocr for language detection
+const langDefaultSamplePages = 3
+
+// keyed by tesseract language code
+var langSamples = map[string]string{
+	"eng": `All human beings are born free and equal in dignity and rights. They are endowed with reason and conscience and should act towards one another in a spirit of brotherhood. Everyone is entitled to all the rights and freedoms set forth in this Declaration, without distinction of any kind, such as race, colour, sex, language, religion, political or other opinion, national or social origin, property, birth or other status. Everyone has the right to life, liberty and security of person. No one shall be held in slavery or servitude; the slave trade shall be prohibited in all their forms. It was the best of times, it was the worst of times, it was the age of wisdom, it was the age of foolishness, it was the epoch of belief, it was the epoch of incredulity, it was the season of light, it was the season of darkness. The history of the county is that of the people who settled there, and of the church, the school and the courthouse which they built with their own hands.`,
+	"fra": `Tous les êtres humains naissent libres et égaux en dignité et en droits. Ils sont doués de raison et de conscience et doivent agir les uns envers les autres dans un esprit de fraternité. Chacun peut se prévaloir de tous les droits et de toutes les libertés proclamés dans la présente Déclaration, sans distinction aucune, notamment de race, de couleur, de sexe, de langue, de religion, d'opinion politique ou de toute autre opinion, d'origine nationale ou sociale, de fortune, de naissance ou de toute autre situation. Tout individu a droit à la vie, à la liberté et à la sûreté de sa personne. Nul ne sera tenu en esclavage ni en servitude; l'esclavage et la traite des esclaves sont interdits sous toutes leurs formes. Longtemps, je me suis couché de bonne heure. Parfois, à peine ma bougie éteinte, mes yeux se fermaient si vite que je n'avais pas le temps de me dire que je m'endormais.`,
+	"deu": `Alle Menschen sind frei und gleich an Würde und Rechten geboren. Sie sind mit Vernunft und Gewissen begabt und sollen einander im Geist der Brüderlichkeit begegnen. Jeder hat Anspruch auf die in dieser Erklärung verkündeten Rechte und Freiheiten ohne irgendeinen Unterschied, etwa nach Rasse, Hautfarbe, Geschlecht, Sprache, Religion, politischer oder sonstiger Überzeugung, nationaler oder sozialer Herkunft, Vermögen, Geburt oder sonstigem Stand. Jeder hat das Recht auf Leben, Freiheit und Sicherheit der Person. Niemand darf in Sklaverei oder Leibeigenschaft gehalten werden; Sklaverei und Sklavenhandel sind in allen ihren Formen verboten. Als Gregor Samsa eines Morgens aus unruhigen Träumen erwachte, fand er sich in seinem Bett zu einem ungeheueren Ungeziefer verwandelt. Er lag auf seinem panzerartig harten Rücken und sah, wenn er den Kopf ein wenig hob, seinen gewölbten, braunen Bauch.`,
+	"spa": `Todos los seres humanos nacen libres e iguales en dignidad y derechos y, dotados como están de razón y conciencia, deben comportarse fraternalmente los unos con los otros. Toda persona tiene los derechos y libertades proclamados en esta Declaración, sin distinción alguna de raza, color, sexo, idioma, religión, opinión política o de cualquier otra índole, origen nacional o social, posición económica, nacimiento o cualquier otra condición. Todo individuo tiene derecho a la vida, a la libertad y a la seguridad de su persona. Nadie estará sometido a esclavitud ni a servidumbre; la esclavitud y la trata de esclavos están prohibidas en todas sus formas. En un lugar de la Mancha, de cuyo nombre no quiero acordarme, no ha mucho tiempo que vivía un hidalgo de los de lanza en astillero, adarga antigua, rocín flaco y galgo corredor.`,
+	"ita": `Tutti gli esseri umani nascono liberi ed eguali in dignità e diritti. Essi sono dotati di ragione e di coscienza e devono agire gli uni verso gli altri in spirito di fratellanza. Ad ogni individuo spettano tutti i diritti e tutte le libertà enunciate nella presente Dichiarazione, senza distinzione alcuna, per ragioni di razza, di colore, di sesso, di lingua, di religione, di opinione politica o di altro genere, di origine nazionale o sociale, di ricchezza, di nascita o di altra condizione. Ogni individuo ha diritto alla vita, alla libertà ed alla sicurezza della propria persona. Nessun individuo potrà essere tenuto in stato di schiavitù o di servitù; la schiavitù e la tratta degli schiavi saranno proibite sotto qualsiasi forma. Nel mezzo del cammin di nostra vita mi ritrovai per una selva oscura, ché la diritta via era smarrita. Quel ramo del lago di Como, che volge a mezzogiorno, tra due catene non interrotte di monti.`,
+	"por": `Todos os seres humanos nascem livres e iguais em dignidade e em direitos. Dotados de razão e de consciência, devem agir uns para com os outros em espírito de fraternidade. Todos os seres humanos podem invocar os direitos e as liberdades proclamados na presente Declaração, sem distinção alguma, nomeadamente de raça, de cor, de sexo, de língua, de religião, de opinião política ou outra, de origem nacional ou social, de fortuna, de nascimento ou de qualquer outra situação. Todo o indivíduo tem direito à vida, à liberdade e à segurança pessoal. Ninguém será mantido em escravatura ou em servidão; a escravatura e o trato dos escravos, sob todas as formas, são proibidos. Uma noite destas, vindo da cidade para o Engenho Novo, encontrei no trem da Central um rapaz aqui do bairro, que eu conheço de vista e de chapéu.`,
+	"lat": `Omnes homines liberi aequique dignitate atque iuribus nascuntur. Ratione conscientiaque praediti sunt et alii erga alios cum fraternitate se gerere debent. Gallia est omnis divisa in partes tres, quarum unam incolunt Belgae, aliam Aquitani, tertiam qui ipsorum lingua Celtae, nostra Galli appellantur. Hi omnes lingua, institutis, legibus inter se differunt. Gallos ab Aquitanis Garumna flumen, a Belgis Matrona et Sequana dividit. Horum omnium fortissimi sunt Belgae, propterea quod a cultu atque humanitate provinciae longissime absunt, minimeque ad eos mercatores saepe commeant atque ea quae ad effeminandos animos pertinent important. Arma virumque cano, Troiae qui primus ab oris Italiam fato profugus Laviniaque venit litora. Quo usque tandem abutere, Catilina, patientia nostra? Quam diu etiam furor iste tuus nos eludet?`,
+	"nld": `Alle mensen worden vrij en gelijk in waardigheid en rechten geboren. Zij zijn begiftigd met verstand en geweten, en behoren zich jegens elkander in een geest van broederschap te gedragen. Een ieder heeft aanspraak op alle rechten en vrijheden, uiteengezet in deze Verklaring, zonder enig onderscheid van welke aard ook, zoals ras, kleur, geslacht, taal, godsdienst, politieke of andere overtuiging, nationale of maatschappelijke afkomst, eigendom, geboorte of andere status. Een ieder heeft het recht op leven, vrijheid en onschendbaarheid van zijn persoon. Niemand zal in slavernij of dienstbaarheid gehouden worden; slavernij en slavenhandel in iedere vorm zijn verboden. Ik ben makelaar in koffie, en woon op de Lauriergracht, No. 37. Het is mijn gewoonte niet, romans te schrijven, of zulke dingen.`,
+}
+
+// n-gram => rank
+type langProfile map[string]int
+
+var langProfiles map[string]langProfile
+
+type langDetection struct {
+	Codes      string  // tesseract language code(s), e.g. "eng" or "eng+lat"
+	Primary    string  // most likely language
+	Confidence float64 // fraction of sampled pages that agree with the primary language
+}
+
+func langNgramCounts(text string) (map[string]int, int) {
+	counts := make(map[string]int)
+	letters := 0
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return unicode.IsLetter(r) == false
+	})
+
+	for _, word := range words {
+		runes := []rune(" " + word + " ")
+		letters += len(runes) - 2
+
+		for n := 1; n <= langMaxNgram; n++ {
+			for i := 0; i+n <= len(runes); i++ {
+				counts[string(runes[i:i+n])]++
+			}
+		}
+	}
+
+	return counts, letters
+}
+
+func newLangProfile(text string) langProfile {
+	counts, _ := langNgramCounts(text)
+
+	var ngrams []string
+	for ngram := range counts {
+		ngrams = append(ngrams, ngram)
+	}
+
+	// sort by frequency, then alphabetically so that profiles are stable
+	sort.Slice(ngrams, func(i, j int) bool {
+		if counts[ngrams[i]] != counts[ngrams[j]] {
+			return counts[ngrams[i]] > counts[ngrams[j]]
+		}
+		return ngrams[i] < ngrams[j]
+	})
+
+	if len(ngrams) > langProfileSize {
+		ngrams = ngrams[:langProfileSize]
+	}
+
+	profile := make(langProfile)
+	for i, ngram := range ngrams {
+		profile[ngram] = i
+	}
+
+	return profile
+}
+
+// "out-of-place" measure: sum of rank differences, with a maximum penalty for n-grams missing from the reference
+func (p langProfile) distance(doc langProfile) int {
+	dist := 0
+
+	for ngram, rank := range doc {
+		if ref, ok := p[ngram]; ok == true {
+			if ref > rank {
+				dist += ref - rank
+			} else {
+				dist += rank - ref
+			}
+		} else {
+			dist += langProfileSize
+		}
+	}
+
+	return dist
+}
+
+// returns the closest language for the given text, or an empty string if there is not enough text
+func detectLanguage(text string) string {
+	if _, letters := langNgramCounts(text); letters < langMinPageLetters {
+		return ""
+	}
+
+	doc := newLangProfile(text)
+
+	best := ""
+	bestDist := 0
+
+	for lang, profile := range langProfiles {
+		dist := profile.distance(doc)
+		if best == "" || dist < bestDist || (dist == bestDist && lang < best) {
+			best = lang
+			bestDist = dist
+		}
+	}
+
+	return best
+}
+
+func detectDocumentLanguage(pages []string) langDetection {
+	var detection langDetection
+
+	counts := make(map[string]int)
+	total := 0
+
+	for _, page := range pages {
+		if lang := detectLanguage(page); lang != "" {
+			counts[lang]++
+			total++
+		}
+	}
+
+	if total == 0 {
+		return detection
+	}
+
+	detection.Primary = detectLanguage(strings.Join(pages, "\n"))
+	detection.Confidence = float64(counts[detection.Primary]) / float64(total)
+
+	// include any other languages that show up on a significant share of pages, most common first
+	var others []string
+	for lang, count := range counts {
+		if lang != detection.Primary && 100*count >= langMinPagePct*total {
+			others = append(others, lang)
+		}
+	}
+
+	sort.Slice(others, func(i, j int) bool {
+		if counts[others[i]] != counts[others[j]] {
+			return counts[others[i]] > counts[others[j]]
+		}
+		return others[i] < others[j]
+	})
+
+	detection.Codes = strings.Join(append([]string{detection.Primary}, others...), "+")
+
+	return detection
+}
+
+// picks evenly spaced pages, which tends to avoid covers and front matter
+func languageSamplePages(pages []tsGenericPidInfo) []tsGenericPidInfo {
+	n := config.langSamplePages.value
+	if n <= 0 {
+		n = langDefaultSamplePages
+	}
+
+	if len(pages) <= n {
+		return pages
+	}
+
+	var sample []tsGenericPidInfo
+	for i := 1; i <= n; i++ {
+		sample = append(sample, pages[i*len(pages)/(n+1)])
+	}
+
+	return sample
+}
+
+// the pages whose images were not uploaded for the language sample
+func pagesNotSampled(pages []tsGenericPidInfo, sampled []ocrPidInfo) []tsGenericPidInfo {
+	uploaded := make(map[string]bool)
+	for _, p := range sampled {
+		uploaded[p.pid] = true
+	}
+
+	var rest []tsGenericPidInfo
+	for _, p := range pages {
+		if uploaded[p.Pid] == false {
+			rest = append(rest, p)
+		}
+	}
+
+	return rest
+}
+
+func (c *clientContext) processLanguageSample(res ocrResultsInfo) {
+	c.info("[%s] processing language detection sample", res.pid)
+
+	var texts []string
+	for _, p := range res.pages {
+		texts = append(texts, p.text)
+	}
+
+	detection := detectDocumentLanguage(texts)
+
+	if detection.Codes == "" {
+		c.info("[%s] language could not be detected from %d sample page(s); using default", res.pid, len(texts))
+	} else {
+		c.info("[%s] detected language: [%s] (confidence: %0.2f)", res.pid, detection.Codes, detection.Confidence)
+	}
+
+	c.jobUpdateDetectedLanguage(res.reqid, detection.Codes, fmt.Sprintf("%0.2f", detection.Confidence))
+
+	job, err := c.jobGet(res.reqid)
+	if err == nil {
+		var jc *clientContext
+		if jc, err = newJobContext(job); err == nil {
+			jc.ocr.ts.Pid.OcrLanguageHint = detection.Codes
+
+			// the sample's images are reused; the pages not found in the cache are uploaded
+			if err = jc.awsMapImages(); err == nil {
+				pages := jc.cacheCheckPages(jc.skipCorrectedPages(jc.ocr.ts.Pages), detection.Codes)
+
+				if err = jc.awsUploadPages(pagesNotSampled(pages, res.pages)); err == nil {
+					err = jc.awsSubmitOcrWorkflow(pages, false)
+				}
+			}
+		}
+	}
+
+	if err != nil {
+		c.err("[%s] failed to start full OCR after language detection: [%s]", res.pid, err.Error())
+		res.details = "Error encountered while starting the OCR process"
+		c.processOcrFailure(res)
+	}
+}
+
+func init() {
+	langProfiles = make(map[string]langProfile)
+
+	for lang, text := range langSamples {
+		langProfiles[lang] = newLangProfile(text)
+	}
+}
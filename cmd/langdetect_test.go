@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// passages that are not part of the profiles' sample texts
+var langTestPages = map[string]string{
+	"eng": "The committee met in the library on Tuesday evening to discuss the plans for the new building, which the members agreed should be finished before the winter.",
+	"fra": "Le conseil municipal s'est réuni mardi soir dans la bibliothèque pour discuter des plans du nouveau bâtiment, que les membres voulaient voir achevé avant l'hiver.",
+	"deu": "Der Ausschuss traf sich am Dienstagabend in der Bibliothek, um die Pläne für das neue Gebäude zu besprechen, das nach dem Willen der Mitglieder vor dem Winter fertig sein sollte.",
+	"spa": "El comité se reunió el martes por la noche en la biblioteca para discutir los planes del nuevo edificio, que los miembros querían ver terminado antes del invierno.",
+	"ita": "Il comitato si è riunito martedì sera nella biblioteca per discutere i progetti del nuovo edificio, che i membri volevano vedere finito prima dell'inverno.",
+	"por": "O comitê reuniu-se na terça-feira à noite na biblioteca para discutir os planos do novo edifício, que os membros queriam ver terminado antes do inverno.",
+	"lat": "Senatus populusque Romanus in foro convenerunt ut de novo templo deliberarent, quod omnes ante hiemem perfici volebant propter magnam deorum reverentiam.",
+	"nld": "De commissie kwam dinsdagavond bijeen in de bibliotheek om de plannen voor het nieuwe gebouw te bespreken, dat volgens de leden voor de winter klaar moest zijn.",
+}
+
+func TestDetectLanguage(t *testing.T) {
+	for lang, text := range langTestPages {
+		if got := detectLanguage(text); got != lang {
+			t.Errorf("expected [%s], got [%s] for: %s", lang, got, text)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{"empty", "", ""},
+		{"too few letters", "Chapter IV. The end.", ""},
+		{"numbers and punctuation only", strings.Repeat("1234, 5678; -- 90! ", 20), ""},
+		{"just over the minimum", "the house of the people who lived in the town by the river and the", "eng"},
+		{"mostly one language", langTestPages["deu"] + " the end", "deu"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := detectLanguage(tc.text); got != tc.expected {
+				t.Errorf("expected [%s], got [%s]", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDetectDocumentLanguage(t *testing.T) {
+	eng, fra, deu, lat := langTestPages["eng"], langTestPages["fra"], langTestPages["deu"], langTestPages["lat"]
+
+	tests := []struct {
+		name       string
+		pages      []string
+		codes      string
+		primary    string
+		confidence float64
+	}{
+		{"no pages", nil, "", "", 0},
+		{"only short pages", []string{"Plate 1", "", "Index"}, "", "", 0},
+		{"single language", []string{eng, eng, eng}, "eng", "eng", 1},
+		{"short pages are not counted", []string{eng, "Plate 1", eng, ""}, "eng", "eng", 1},
+		{"second language at the threshold", []string{eng, eng, eng, lat}, "eng+lat", "eng", 0.75},
+		{"second language below the threshold", []string{eng, eng, eng, eng, fra}, "eng", "eng", 0.8},
+		{"others ordered by pages, then code", []string{eng, eng, fra, deu}, "eng+deu+fra", "eng", 0.5},
+		{"others ordered by pages", []string{fra, fra, fra, fra, fra, eng, eng, eng, eng, deu, deu, deu}, "fra+eng+deu", "fra", 5.0 / 12},
+		{"third language below the threshold", []string{fra, fra, fra, deu, eng, eng}, "fra+eng", "fra", 0.5},
+		{"primary from all the text, not the most pages", []string{eng + " " + eng + " " + eng, fra, fra}, "eng+fra", "eng", 1.0 / 3},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := detectDocumentLanguage(tc.pages)
+
+			if d.Codes != tc.codes || d.Primary != tc.primary || d.Confidence < tc.confidence-0.001 || d.Confidence > tc.confidence+0.001 {
+				t.Errorf("expected [%s] (primary: [%s]  confidence: %0.2f), got [%s] (primary: [%s]  confidence: %0.2f)", tc.codes, tc.primary, tc.confidence, d.Codes, d.Primary, d.Confidence)
+			}
+
+			// the codes become the full run's language hint: tesseract codes joined with "+",
+			// the primary language first, each with a profile and none repeated
+			if d.Codes == "" {
+				return
+			}
+
+			codes := strings.Split(d.Codes, "+")
+			if codes[0] != d.Primary {
+				t.Errorf("expected [%s] first, got [%s]", d.Primary, d.Codes)
+			}
+
+			seen := make(map[string]bool)
+			for _, code := range codes {
+				if _, ok := langProfiles[code]; ok == false || seen[code] == true {
+					t.Errorf("unexpected code [%s] in [%s]", code, d.Codes)
+				}
+				seen[code] = true
+			}
+		})
+	}
+}
+
+func TestLanguageSamplePages(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	var pages []tsGenericPidInfo
+	for _, pid := range []string{"p1", "p2", "p3", "p4", "p5", "p6", "p7", "p8", "p9"} {
+		pages = append(pages, tsGenericPidInfo{Pid: pid})
+	}
+
+	tests := []struct {
+		samples  int
+		pages    int
+		expected string
+	}{
+		{0, 9, "p3,p5,p7"},
+		{3, 9, "p3,p5,p7"},
+		{1, 9, "p5"},
+		{4, 9, "p2,p4,p6,p8"},
+		{3, 3, "p1,p2,p3"},
+		{5, 2, "p1,p2"},
+	}
+
+	for _, tc := range tests {
+		config.langSamplePages.value = tc.samples
+
+		var got []string
+		for _, p := range languageSamplePages(pages[:tc.pages]) {
+			got = append(got, p.Pid)
+		}
+
+		if strings.Join(got, ",") != tc.expected {
+			t.Errorf("%d of %d pages: expected [%s], got [%s]", tc.samples, tc.pages, tc.expected, strings.Join(got, ","))
+		}
+	}
+}
+
+func TestPagesNotSampled(t *testing.T) {
+	pages := []tsGenericPidInfo{{Pid: "p1"}, {Pid: "p2"}, {Pid: "p3"}, {Pid: "p4"}}
+
+	// sampled pages are uploaded already, including those the sample gave up on
+	sampled := []ocrPidInfo{{pid: "p2", text: "text"}, {pid: "p4", failed: true}, {pid: "p9"}}
+
+	var got []string
+	for _, p := range pagesNotSampled(pages, sampled) {
+		got = append(got, p.Pid)
+	}
+
+	if strings.Join(got, ",") != "p1,p3" {
+		t.Errorf("expected [p1,p3], got [%s]", strings.Join(got, ","))
+	}
+}
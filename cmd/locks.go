@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// per-pid job locks.  only one job at a time may work in a pid's request directory, so a job takes the
+// pid's lock in the job store when it is queued, and gives it up once it has finished with the directory.
+// requests for a pid that is locked attach their recipients to the job holding the lock instead.
+//
+// locks are leases: each names the instance that last renewed it, and expires unless renewed within
+// the lease (by its instance's heartbeat, or by decision tasks for the job's workflow), so that a lock
+// held by an instance that went away does not block the pid forever.
+
+// identifies this service instance in the locks it holds
+var instanceID string
+
+type jobLockedError struct {
+	reqid string // job holding the lock
+}
+
+func (e jobLockedError) Error() string {
+	return fmt.Sprintf("a job for this pid is already queued or running: [%s]", e.reqid)
+}
+
+func jobLockLease() time.Duration {
+	secs := config.jobLockLease.value
+	if secs <= 0 {
+		secs = 300
+	}
+
+	return time.Duration(secs) * time.Second
+}
+
+func initJobLocks() {
+	c := newBackgroundContext()
+
+	host, _ := os.Hostname()
+	instanceID = fmt.Sprintf("%s-%d-%08x", host, os.Getpid(), randomSource.Uint32())
+
+	c.info("[LOCK] instance: [%s]  lease: %s", instanceID, jobLockLease())
+
+	go c.jobLockHeartbeats()
+}
+
+// renews this instance's locks well within their lease
+func (c *clientContext) jobLockHeartbeats() {
+	for {
+		time.Sleep(jobLockLease() / 3)
+
+		now := time.Now()
+
+		if _, err := jobDB.Exec("update job_locks set heartbeat = ?, expires = ? where owner = ?;", now.Unix(), now.Add(jobLockLease()).Unix(), instanceID); err != nil {
+			c.err("[LOCK] heartbeat failed: [%s]", err.Error())
+		}
+	}
+}
+
+// takes the lock on a pid for a job if it is free, expired, or already held by that job on this instance.
+// returns whether it was taken, and if not, the job holding it
+func (c *clientContext) jobLockAcquire(pid, reqid string) (bool, string, error) {
+	now := time.Now()
+
+	query := `insert into job_locks (pid, req_id, owner, acquired, heartbeat, expires) values (?, ?, ?, ?, ?, ?)
+		on conflict (pid) do update set req_id = excluded.req_id, owner = excluded.owner, heartbeat = excluded.heartbeat, expires = excluded.expires,
+			acquired = case when job_locks.req_id = excluded.req_id then job_locks.acquired else excluded.acquired end
+		where (job_locks.req_id = excluded.req_id and job_locks.owner = excluded.owner) or job_locks.expires < excluded.heartbeat;`
+
+	res, err := jobDB.Exec(query, pid, reqid, instanceID, now.Unix(), now.Unix(), now.Add(jobLockLease()).Unix())
+	if err != nil {
+		c.err("[LOCK] failed to acquire lock: [%s]", err.Error())
+		return false, "", errors.New("failed to acquire job lock")
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true, "", nil
+	}
+
+	var holder string
+
+	if err := jobDB.QueryRow("select req_id from job_locks where pid = ?;", pid).Scan(&holder); err != nil {
+		c.err("[LOCK] failed to retrieve lock holder: [%s]", err.Error())
+		return false, "", errors.New("failed to retrieve job lock")
+	}
+
+	return false, holder, nil
+}
+
+// moves a queued job's lock to this instance, which has claimed the job from the queue.  the lock names
+// the instance that queued the job, which is not working on it
+func (c *clientContext) jobLockClaim(pid, reqid string) (bool, error) {
+	now := time.Now()
+
+	res, err := jobDB.Exec("update job_locks set owner = ?, heartbeat = ?, expires = ? where pid = ? and req_id = ?;", instanceID, now.Unix(), now.Add(jobLockLease()).Unix(), pid, reqid)
+	if err != nil {
+		c.err("[LOCK] failed to claim lock: [%s]", err.Error())
+		return false, errors.New("failed to claim job lock")
+	}
+
+	n, _ := res.RowsAffected()
+
+	return n > 0, nil
+}
+
+// hands a lock to another job, if it is still held by the given one
+func (c *clientContext) jobLockTransfer(pid, from, to string) error {
+	if _, err := jobDB.Exec("update job_locks set req_id = ? where pid = ? and req_id = ?;", to, pid, from); err != nil {
+		c.err("[LOCK] failed to transfer lock: [%s]", err.Error())
+		return errors.New("failed to transfer job lock")
+	}
+
+	return nil
+}
+
+// extends a job's lock, regardless of which instance holds it
+func (c *clientContext) jobLockRenew(reqid string) error {
+	now := time.Now()
+
+	if _, err := jobDB.Exec("update job_locks set heartbeat = ?, expires = ? where req_id = ?;", now.Unix(), now.Add(jobLockLease()).Unix(), reqid); err != nil {
+		c.err("[LOCK] failed to renew lock: [%s]", err.Error())
+		return errors.New("failed to renew job lock")
+	}
+
+	return nil
+}
+
+func (c *clientContext) jobLockRelease(reqid string) error {
+	if _, err := jobDB.Exec("delete from job_locks where req_id = ?;", reqid); err != nil {
+		c.err("[LOCK] failed to release lock: [%s]", err.Error())
+		return errors.New("failed to release job lock")
+	}
+
+	return nil
+}
+
+// the request holding a pid's lock, and whether its lease is still live
+func (c *clientContext) jobLockHolder(pid string) (string, bool) {
+	var holder string
+	var expires int64
+
+	if err := jobDB.QueryRow("select req_id, expires from job_locks where pid = ?;", pid).Scan(&holder, &expires); err != nil {
+		return "", false
+	}
+
+	return holder, expires >= time.Now().Unix()
+}
+
+// when a job's lock expires, or 0 if the job holds no lock
+func (c *clientContext) jobLockExpires(reqid string) int64 {
+	var expires int64
+
+	jobDB.QueryRow("select expires from job_locks where req_id = ?;", reqid).Scan(&expires)
+
+	return expires
+}
+
+// takes the pid's lock for a new job.  if another job holds it, or an active job for the pid outlived
+// its lock, returns a jobLockedError naming that job
+func (c *clientContext) jobLockForNewJob(pid, reqid string) error {
+	acquired, holder, err := c.jobLockAcquire(pid, reqid)
+	if err != nil {
+		return err
+	}
+
+	if acquired == false {
+		return jobLockedError{reqid: holder}
+	}
+
+	if active, _ := c.jobGetActiveForPid(pid); active != nil && active.ReqID != reqid {
+		c.warn("[LOCK] job [%s] for [%s] outlived its lock; handing the lock back to it", active.ReqID, pid)
+		c.jobLockTransfer(pid, reqid, active.ReqID)
+		return jobLockedError{reqid: active.ReqID}
+	}
+
+	return nil
+}
+
+// adds the current request's recipients to an active job's notification list, rather than starting another
+func (c *clientContext) jobAttachRecipients(job *jobInfo) {
+	c.info("Request already %s as [%s]; adding email/callback to completion notification list", job.State, job.ReqID)
+
+	c.auditRequest(job.ReqID, "attached")
+
+	c.jobAddEmail(job.ReqID, c.req.email)
+	c.jobAddCallback(job.ReqID, c.req.callback)
+
+	if job.State == jobStateRunning {
+		c.reqAddEmail(c.ocr.workDir, c.req.email)
+		c.reqAddCallback(c.ocr.workDir, c.req.callback)
+	}
+}
+
+// adds the current request's recipients to the request holding a pid's lock.  requests for pids that
+// already have ocr hold the lock without a job, and are tracked only in the request directory
+func (c *clientContext) attachToLockHolder(holder string) {
+	if job, _ := c.jobGet(holder); job != nil {
+		c.jobAttachRecipients(job)
+		return
+	}
+
+	c.info("Request already in progress as [%s]; adding email/callback to completion notification list", holder)
+
+	c.auditRequest(holder, "attached")
+
+	c.reqAddEmail(c.ocr.workDir, c.req.email)
+	c.reqAddCallback(c.ocr.workDir, c.req.callback)
+}
+
+// cancels a queued job that lost its pid's lock, handing its recipients to the job that holds it
+func (c *clientContext) jobSupersede(job *jobInfo, holder string) {
+	workDir := getWorkDir(job.Pid)
+
+	hj, _ := c.jobGet(holder)
+
+	emails, _ := c.jobGetEmails(job.ReqID)
+	for _, e := range emails {
+		c.jobAddEmail(holder, e)
+		if hj == nil || hj.State == jobStateRunning {
+			c.reqAddEmail(workDir, e)
+		}
+	}
+
+	callbacks, _ := c.jobGetCallbacks(job.ReqID)
+	for _, cb := range callbacks {
+		c.jobAddCallback(holder, cb)
+		if hj == nil || hj.State == jobStateRunning {
+			c.reqAddCallback(workDir, cb)
+		}
+	}
+
+	c.jobFinish(job.ReqID, jobStateCanceled)
+
+	c.audit(auditEntry{Action: auditJobCanceled, Pid: job.Pid, ReqID: job.ReqID, Details: fmt.Sprintf("superseded by job %s", holder)})
+
+	publishProgress(job.Pid, job.ReqID, eventJobCanceled, progressEvent{Details: fmt.Sprintf("superseded by job %s", holder)})
+}
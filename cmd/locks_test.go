@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestJobLocks(t *testing.T) {
+	c := useJobStore(t)
+
+	instanceID = "test"
+
+	if ok, _, err := c.jobLockAcquire("uva:1", "r1"); err != nil || ok == false {
+		t.Fatalf("expected to acquire a free lock")
+	}
+
+	// the same job may take its lock again, e.g. when dispatched from the queue
+	if ok, _, _ := c.jobLockAcquire("uva:1", "r1"); ok == false {
+		t.Errorf("expected a job to reacquire its own lock")
+	}
+
+	if ok, holder, _ := c.jobLockAcquire("uva:1", "r2"); ok == true || holder != "r1" {
+		t.Errorf("expected the lock to be held by [r1], got %v [%s]", ok, holder)
+	}
+
+	var lErr jobLockedError
+	if err := c.jobLockForNewJob("uva:1", "r2"); errors.As(err, &lErr) == false || lErr.reqid != "r1" {
+		t.Errorf("expected a locked error naming [r1], got %v", err)
+	}
+
+	// other pids are unaffected
+	if ok, _, _ := c.jobLockAcquire("uva:2", "r3"); ok == false {
+		t.Errorf("expected to acquire another pid's lock")
+	}
+
+	// an expired lease can be taken over
+	jobDB.Exec("update job_locks set expires = ? where pid = ?;", time.Now().Add(-time.Minute).Unix(), "uva:1")
+
+	if ok, _, _ := c.jobLockAcquire("uva:1", "r2"); ok == false {
+		t.Errorf("expected to take over an expired lock")
+	}
+
+	c.jobLockRelease("r2")
+
+	if ok, _, _ := c.jobLockAcquire("uva:1", "r4"); ok == false {
+		t.Errorf("expected to acquire a released lock")
+	}
+}
+
+func TestJobLockOutlivedByJob(t *testing.T) {
+	c := useJobStore(t)
+
+	instanceID = "test"
+
+	ts := tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}, Pages: []tsGenericPidInfo{{Pid: "uva:2"}}}
+
+	c.req.pid = "uva:1"
+	c.req.email = "a@example.com"
+	c.ocr.reqID = "r1"
+	c.ocr.ts = &ts
+
+	if err := c.queueOcr(); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// a second request for the pid is refused in favour of the queued job
+	c.ocr.reqID = "r2"
+	c.req.email = "b@example.com"
+
+	var lErr jobLockedError
+	if err := c.queueOcr(); errors.As(err, &lErr) == false || lErr.reqid != "r1" {
+		t.Fatalf("expected a locked error naming [r1], got %v", err)
+	}
+
+	c.attachToLockHolder(lErr.reqid)
+
+	if emails, _ := c.jobGetEmails("r1"); len(emails) != 2 {
+		t.Errorf("expected both recipients on [r1], got %v", emails)
+	}
+
+	// a lapsed lock is handed back to the active job rather than to a new request
+	c.jobLockRelease("r1")
+
+	if err := c.jobLockForNewJob("uva:1", "r3"); errors.As(err, &lErr) == false || lErr.reqid != "r1" {
+		t.Errorf("expected a locked error naming [r1], got %v", err)
+	}
+
+	if ok, _, _ := c.jobLockAcquire("uva:1", "r1"); ok == false {
+		t.Errorf("expected the lock to be held by [r1]")
+	}
+}
+
+func TestJobLockOwners(t *testing.T) {
+	c := useJobStore(t)
+
+	ts := tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}, Pages: []tsGenericPidInfo{{Pid: "uva:2"}}}
+
+	for i, reqid := range []string{"r1", "r2", "r3"} {
+		c.jobCreate(&jobInfo{ReqID: reqid, Pid: fmt.Sprintf("uva:%d", i+1), Priority: jobPriorityPatron}, &ts)
+	}
+
+	// instance a is uploading r1's images; b holds r2's lock, and r3's lock has gone
+	instanceID = "a"
+	c.jobLockAcquire("uva:1", "r1")
+
+	instanceID = "b"
+	c.jobLockAcquire("uva:2", "r2")
+
+	for i := 0; i < 3; i++ {
+		c.jobClaimNext()
+	}
+
+	// another instance cannot take a live lock, even for the same job
+	if ok, holder, _ := c.jobLockAcquire("uva:1", "r1"); ok == true || holder != "r1" {
+		t.Errorf("expected [r1]'s lock to stay with instance a, got %v [%s]", ok, holder)
+	}
+
+	// b starting up leaves a's running job alone, and requeues its own and the unlocked one
+	c.jobRequeueInterrupted()
+
+	expected := map[string]string{"r1": jobStateRunning, "r2": jobStateQueued, "r3": jobStateQueued}
+
+	for reqid, state := range expected {
+		if job, _ := c.jobGet(reqid); job == nil || job.State != state {
+			t.Errorf("expected [%s] to be %s, got %+v", reqid, state, job)
+		}
+	}
+
+	var owner string
+	jobDB.QueryRow("select owner from job_locks where req_id = ?;", "r1").Scan(&owner)
+
+	if owner != "a" {
+		t.Errorf("expected [r1]'s lock to be owned by instance a, got [%s]", owner)
+	}
+
+	// once a's lease lapses, its job is b's to requeue and take
+	jobDB.Exec("update job_locks set expires = ? where req_id = ?;", time.Now().Add(-time.Minute).Unix(), "r1")
+
+	c.jobRequeueInterrupted()
+
+	if job, _ := c.jobGet("r1"); job == nil || job.State != jobStateQueued {
+		t.Errorf("expected [r1] to be requeued, got %+v", job)
+	}
+
+	if ok, _, _ := c.jobLockAcquire("uva:1", "r1"); ok == false {
+		t.Errorf("expected to take over [r1]'s expired lock")
+	}
+
+	// a job queued by one instance is claimed by the instance that dispatches it
+	instanceID = "a"
+
+	if ok, _ := c.jobLockClaim("uva:2", "r2"); ok == false {
+		t.Errorf("expected to claim [r2]'s lock")
+	}
+
+	if ok, _, _ := c.jobLockAcquire("uva:2", "r2"); ok == false {
+		t.Errorf("expected [r2]'s lock to belong to instance a")
+	}
+
+	if ok, _ := c.jobLockClaim("uva:2", "r9"); ok == true {
+		t.Errorf("expected no claim on a lock held by another job")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -23,6 +24,16 @@ var randomSource *rand.Rand
  * Main entry point for the web service
  */
 func main() {
+	// operational commands talk to a running service, and do not need its configuration
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(adminMain(os.Args[2:]))
+	}
+
+	// offline replay of recorded decision tasks
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
+
 	// Load cfg
 	log.Printf("===> ocr-ws starting up <===")
 	log.Printf("Load configuration...")
@@ -34,6 +45,13 @@ func main() {
 	// initialize http client and random source
 	client = &http.Client{Timeout: 10 * time.Second}
 	randomSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+	initImageSources()
+	initRetryPolicy()
+	initRecipientKey()
+
+	// initialize job store
+	initJobStore()
+	initJobLocks()
 
 	// initialize AWS session
 	if config.awsDisabled.value == false {
@@ -42,11 +60,19 @@ func main() {
 		go c.awsPollForDecisionTasks()
 	}
 
+	// start processing queued jobs
+	initJobQueue()
+
+	// fail stale jobs and enforce retention
+	initReaper()
+
 	// Set routes and start server
 	gin.SetMode(gin.ReleaseMode)
 	gin.DisableConsoleColor()
 
-	router := gin.Default()
+	// gin's default logger writes request urls verbatim, including patron email addresses
+	router := gin.New()
+	router.Use(gin.LoggerWithFormatter(redactedLogFormatter), gin.Recovery())
 
 	corsCfg := cors.DefaultConfig()
 	corsCfg.AllowAllOrigins = true
@@ -63,6 +89,43 @@ func main() {
 	router.GET("/ocr/:pid", ocrGenerateHandler)
 	router.GET("/ocr/:pid/status", ocrStatusHandler)
 	router.GET("/ocr/:pid/text", ocrTextHandler)
+	router.GET("/ocr/:pid/estimate", staffAuthHandler, ocrEstimateHandler)
+	router.GET("/ocr/:pid/events", ocrEventsHandler)
+
+	router.GET("/jobs/:reqid", jobStatusHandler)
+
+	staff := router.Group("/jobs/:reqid", staffAuthHandler)
+	{
+		staff.GET("/diff", jobDiffHandler)
+		staff.POST("/approve", jobApproveHandler)
+		staff.POST("/reject", jobRejectHandler)
+		staff.POST("/retry", jobRetryHandler)
+	}
+
+	router.PUT("/pages/:pid/text", staffAuthHandler, pageTextUpdateHandler)
+	router.GET("/pages/:pid/versions", staffAuthHandler, pageVersionsHandler)
+	router.GET("/pages/:pid/versions/:id", staffAuthHandler, pageVersionHandler)
+	router.POST("/pages/:pid/versions/:id/restore", staffAuthHandler, pageVersionRestoreHandler)
+
+	router.GET("/audit", staffAuthHandler, auditHandler)
+
+	router.GET("/search", staffAuthHandler, searchHandler)
+
+	router.POST("/exports", staffAuthHandler, exportCreateHandler)
+	router.GET("/exports/:id", staffAuthHandler, exportStatusHandler)
+	router.GET("/exports/:id/download", staffAuthHandler, exportDownloadHandler)
+
+	admin := router.Group("/admin", staffAuthHandler)
+	{
+		admin.GET("/jobs", adminJobsHandler)
+		admin.POST("/jobs/:reqid/cancel", adminCancelHandler)
+		admin.POST("/jobs/:reqid/retry", adminRetryHandler)
+		admin.POST("/jobs/:reqid/notify", adminNotifyHandler)
+		admin.POST("/purge", adminPurgeHandler)
+		admin.POST("/erase", adminEraseHandler)
+		admin.GET("/config", adminConfigHandler)
+		admin.GET("/eligibility/:pid", adminEligibilityHandler)
+	}
 
 	portStr := fmt.Sprintf(":%s", config.listenPort.value)
 	log.Printf("Start service on %s", portStr)
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// SWF caps workflow input at 32K characters.  when an encoded workflow request would exceed a
+// threshold, the request (its manifest) is stored as an object in the request's s3 prefix, or a
+// local directory when testing, and the workflow input only carries a reference to it
+
+const (
+	swfInputLimit            = 32768
+	manifestDefaultThreshold = 30000
+	manifestFilename         = "manifest.json.gz"
+	manifestCacheMax         = 100
+)
+
+// workflow input in place of a stored manifest
+type manifestReference struct {
+	Manifest string `json:"manifest"`
+}
+
+type manifestStore interface {
+	// stores a request's gzipped manifest, returning its location
+	put(reqID string, data []byte) (string, error)
+	// reads a gzipped manifest from a location returned by put()
+	get(location string) ([]byte, error)
+}
+
+func newManifestStore() manifestStore {
+	if config.manifestDir.value != "" {
+		return localManifestStore{dir: config.manifestDir.value}
+	}
+
+	return s3ManifestStore{bucket: config.awsBucketName.value}
+}
+
+// the store a manifest location belongs to, regardless of current configuration
+func manifestStoreFor(location string) (manifestStore, error) {
+	switch {
+	case strings.HasPrefix(location, "s3://"):
+		return s3ManifestStore{}, nil
+	case strings.HasPrefix(location, "file://"):
+		return localManifestStore{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown manifest location: [%s]", location)
+}
+
+// reads and decompresses the manifest at a location
+func readManifest(location string) (string, error) {
+	store, err := manifestStoreFor(location)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := store.get(location)
+	if err != nil {
+		return "", err
+	}
+
+	gzDec, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("invalid manifest: [%s]", err.Error())
+	}
+
+	manifest, err := ioutil.ReadAll(gzDec)
+	if err != nil {
+		return "", fmt.Errorf("invalid manifest: [%s]", err.Error())
+	}
+
+	return string(manifest), nil
+}
+
+// manifests read by the decider, by workflow id, so that a workflow's manifest is read once rather
+// than on every one of its decision tasks.  entries are removed when their workflow ends; the cache
+// is bounded in case a workflow ends without the decider seeing it (e.g. it times out)
+type manifestCache struct {
+	mu        sync.Mutex
+	read      func(location string) (string, error)
+	manifests map[string]cachedManifest
+}
+
+type cachedManifest struct {
+	location string
+	manifest string
+}
+
+var workflowManifests = manifestCache{read: readManifest}
+
+func (m *manifestCache) get(workflowID, location string) (string, error) {
+	m.mu.Lock()
+	cached, ok := m.manifests[workflowID]
+	m.mu.Unlock()
+
+	if ok == true && cached.location == location {
+		return cached.manifest, nil
+	}
+
+	manifest, err := m.read(location)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.manifests == nil {
+		m.manifests = make(map[string]cachedManifest)
+	}
+
+	if len(m.manifests) >= manifestCacheMax {
+		for id := range m.manifests {
+			delete(m.manifests, id)
+			break
+		}
+	}
+
+	m.manifests[workflowID] = cachedManifest{location: location, manifest: manifest}
+
+	return manifest, nil
+}
+
+func (m *manifestCache) forget(workflowID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.manifests, workflowID)
+}
+
+func manifestThreshold() int {
+	if config.manifestThreshold.value <= 0 {
+		return manifestDefaultThreshold
+	}
+
+	return config.manifestThreshold.value
+}
+
+// encodes a workflow request for SWF, storing it as a manifest instead if it is too large
+func (c *clientContext) workflowInput(reqID, input string) (string, error) {
+	encoded := c.encodeWorkflowInput(input)
+
+	if len(encoded) <= manifestThreshold() {
+		return encoded, nil
+	}
+
+	var buf bytes.Buffer
+
+	gzEnc := gzip.NewWriter(&buf)
+	gzEnc.Write([]byte(input))
+	if err := gzEnc.Close(); err != nil {
+		c.err("[AWS] manifest gzip error: [%s]", err.Error())
+		return "", errors.New("failed to compress workflow manifest")
+	}
+
+	location, err := newManifestStore().put(reqID, buf.Bytes())
+	if err != nil {
+		c.err("[AWS] manifest store error: [%s]", err.Error())
+		return "", errors.New("failed to store workflow manifest")
+	}
+
+	c.info("[AWS] encoded workflow input is %d characters (limit %d); stored manifest at [%s]", len(encoded), manifestThreshold(), location)
+
+	ref, _ := json.Marshal(manifestReference{Manifest: location})
+
+	return c.encodeWorkflowInput(string(ref)), nil
+}
+
+// manifests stored alongside the request's images in s3
+
+type s3ManifestStore struct {
+	bucket string
+}
+
+func (s s3ManifestStore) put(reqID string, data []byte) (string, error) {
+	key := getS3Filename(reqID, manifestFilename)
+
+	svc := s3.New(sess)
+
+	if _, err := svc.PutObject(&s3.PutObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key), Body: bytes.NewReader(data)}); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("s3://%s/%s", s.bucket, key), nil
+}
+
+func (s s3ManifestStore) get(location string) ([]byte, error) {
+	bucket, key, err := parseS3Location(location)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := s3.New(sess)
+
+	res, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(res.Body)
+}
+
+// manifests stored in a local directory, standing in for s3
+
+type localManifestStore struct {
+	dir string
+}
+
+func (s localManifestStore) put(reqID string, data []byte) (string, error) {
+	dir, err := filepath.Abs(filepath.Join(s.dir, reqID))
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	file := filepath.Join(dir, manifestFilename)
+
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return "", err
+	}
+
+	return "file://" + file, nil
+}
+
+func (s localManifestStore) get(location string) ([]byte, error) {
+	return ioutil.ReadFile(strings.TrimPrefix(location, "file://"))
+}
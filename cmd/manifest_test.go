@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+func useManifestSettings(t *testing.T, threshold int) string {
+	t.Helper()
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config.manifestDir.value = t.TempDir()
+	config.manifestThreshold.value = threshold
+
+	return config.manifestDir.value
+}
+
+func manifestTestRequest(pages int) string {
+	req := workflowRequest{Pid: "uva:1", ReqID: "r1", Lang: "eng", Bucket: "ocr-bucket"}
+
+	for i := 0; i < pages; i++ {
+		req.Pages = append(req.Pages, ocrPageInfo{Pid: fmt.Sprintf("uva:%d", i+2), Filename: fmt.Sprintf("%05d.tif", i+2)})
+	}
+
+	input, _ := json.Marshal(req)
+
+	return string(input)
+}
+
+func manifestTestDecider(t *testing.T) *decider {
+	return &decider{
+		manifest: (&manifestCache{read: readManifest}).get,
+		info:     t.Logf,
+		warn:     t.Logf,
+		err:      t.Errorf,
+	}
+}
+
+func TestWorkflowInputManifest(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		pages     int
+		stored    bool
+	}{
+		{"small request inline", 0, 10, false},
+		{"large request stored", 0, 5000, true},
+		{"lowered threshold", 100, 10, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := useManifestSettings(t, tc.threshold)
+
+			c := newBackgroundContext()
+			input := manifestTestRequest(tc.pages)
+
+			encoded, err := c.workflowInput("r1", input)
+			if err != nil {
+				t.Fatalf("workflowInput() failed: %s", err.Error())
+			}
+
+			if len(encoded) > swfInputLimit {
+				t.Errorf("encoded input is %d characters, over the swf limit", len(encoded))
+			}
+
+			d := manifestTestDecider(t)
+
+			ref := manifestReference{}
+			json.Unmarshal([]byte(d.decompressInput(encoded)), &ref)
+
+			if stored := ref.Manifest != ""; stored != tc.stored {
+				t.Errorf("expected stored manifest: %v, got reference [%s]", tc.stored, ref.Manifest)
+			}
+
+			if tc.stored == true && strings.HasPrefix(ref.Manifest, "file://"+dir) == false {
+				t.Errorf("manifest stored outside [%s]: [%s]", dir, ref.Manifest)
+			}
+
+			if decoded, err := d.decodeInput("wf1", encoded); err != nil || decoded != input {
+				t.Errorf("decoded input differs from original (%d vs %d bytes) (%v)", len(decoded), len(input), err)
+			}
+		})
+	}
+}
+
+func TestReadManifestErrors(t *testing.T) {
+	useManifestSettings(t, 0)
+
+	if _, err := readManifest("ftp://example/manifest"); err == nil {
+		t.Errorf("expected an error for an unknown location")
+	}
+
+	if _, err := readManifest("file:///nonexistent/manifest.json.gz"); err == nil {
+		t.Errorf("expected an error for a missing manifest")
+	}
+
+	location, _ := localManifestStore{dir: config.manifestDir.value}.put("r1", []byte("not gzipped"))
+
+	if _, err := readManifest(location); err == nil {
+		t.Errorf("expected an error for an invalid manifest")
+	}
+}
+
+func TestManifestUnavailable(t *testing.T) {
+	useManifestSettings(t, 100)
+
+	c := newBackgroundContext()
+	input := manifestTestRequest(10)
+
+	encoded, _ := c.workflowInput("r1", input)
+
+	reads := 0
+	failing := true
+
+	cache := manifestCache{read: func(location string) (string, error) {
+		reads++
+		if failing == true {
+			return "", errors.New("service unavailable")
+		}
+		return readManifest(location)
+	}}
+
+	d := manifestTestDecider(t)
+	d.manifest = cache.get
+	d.err = t.Logf
+
+	events := []*swf.HistoryEvent{{
+		EventId:                                 aws.Int64(1),
+		EventType:                               aws.String("WorkflowExecutionStarted"),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{Input: aws.String(encoded)},
+	}}
+
+	// an unreadable manifest is an error, rather than a request with no pages
+	info := decisionInfo{workflowID: "wf1", allEvents: events}
+	if err := d.inventory(&info); err == nil {
+		t.Fatalf("expected an error while the manifest is unavailable, got %d pages", len(info.req.Pages))
+	}
+
+	failing = false
+
+	// once readable, the manifest is read once per workflow
+	for i := 0; i < 3; i++ {
+		info = decisionInfo{workflowID: "wf1", allEvents: events}
+		if err := d.inventory(&info); err != nil || len(info.req.Pages) != 10 {
+			t.Fatalf("expected 10 pages, got %d (%v)", len(info.req.Pages), err)
+		}
+	}
+
+	if reads != 2 {
+		t.Errorf("expected 2 manifest reads (one failed), got %d", reads)
+	}
+
+	cache.forget("wf1")
+	d.decodeInput("wf1", encoded)
+
+	if reads != 3 {
+		t.Errorf("expected the manifest to be read again once forgotten, got %d reads", reads)
+	}
+}
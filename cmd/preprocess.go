@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+	_ "golang.org/x/image/tiff"
+)
+
+// optional image preprocessing performed locally before upload, to cut down on upload size and lambda time
+
+// preprocessing steps, in the order they are applied
+const (
+	preprocessStepScale    = "scale"
+	preprocessStepGray     = "gray"
+	preprocessStepDeskew   = "deskew"
+	preprocessStepBinarize = "binarize"
+)
+
+var preprocessStepOrder = []string{preprocessStepScale, preprocessStepGray, preprocessStepDeskew, preprocessStepBinarize}
+
+// ocr hint wildcard in the preprocessing configuration
+const preprocessAnyHint = "*"
+
+const preprocessDefaultDPI = 300
+
+const preprocessDefaultMegapixels = 25
+
+// deskew search range and resolution, in degrees
+const (
+	deskewMaxAngle  = 5.0
+	deskewAngleStep = 0.25
+)
+
+// images are reduced to roughly this width when searching for the skew angle
+const deskewSearchWidth = 1000
+
+// parses the configured steps for the given ocr hint.  the configuration
+// looks like: "Regular Font=scale,gray;Modern Font=scale,gray,binarize;*=scale"
+func preprocessStepsForHint(hint string) []string {
+	var steps, fallback []string
+
+	for _, entry := range strings.Split(config.preprocess.value, ";") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		var entrySteps []string
+		for _, step := range strings.Split(parts[1], ",") {
+			if step = strings.TrimSpace(step); step != "" {
+				entrySteps = append(entrySteps, step)
+			}
+		}
+
+		switch strings.TrimSpace(parts[0]) {
+		case hint:
+			steps = entrySteps
+		case preprocessAnyHint:
+			fallback = entrySteps
+		}
+	}
+
+	if steps == nil {
+		steps = fallback
+	}
+
+	// keep known steps only, in application order
+	var ordered []string
+	for _, step := range preprocessStepOrder {
+		for _, s := range steps {
+			if s == step {
+				ordered = append(ordered, step)
+				break
+			}
+		}
+	}
+
+	return ordered
+}
+
+func hasPreprocessStep(steps []string, step string) bool {
+	for _, s := range steps {
+		if s == step {
+			return true
+		}
+	}
+
+	return false
+}
+
+// grayscale and bilevel images compress well as png; anything else is re-encoded as jpeg
+func preprocessExtension(steps []string) string {
+	if hasPreprocessStep(steps, preprocessStepGray) || hasPreprocessStep(steps, preprocessStepBinarize) {
+		return ".png"
+	}
+
+	return ".jpg"
+}
+
+func (c *clientContext) preprocessImage(r io.Reader, steps []string) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: [%s]", err.Error())
+	}
+
+	bounds := img.Bounds()
+	c.info("[PRE] decoded %s image: %dx%d (%d bytes); steps: %v", format, bounds.Dx(), bounds.Dy(), len(data), steps)
+
+	if hasPreprocessStep(steps, preprocessStepScale) {
+		img = downscaleImage(img, preprocessScaleFactor(data, format, bounds))
+	}
+
+	if hasPreprocessStep(steps, preprocessStepGray) || hasPreprocessStep(steps, preprocessStepBinarize) {
+		img = grayscaleImage(img)
+	}
+
+	if hasPreprocessStep(steps, preprocessStepDeskew) {
+		gray := grayscaleImage(img)
+		angle := detectSkew(gray)
+		if math.Abs(angle) >= deskewAngleStep {
+			c.info("[PRE] deskewing by %0.2f degrees", angle)
+			img = rotateImage(gray, -angle)
+		}
+	}
+
+	if hasPreprocessStep(steps, preprocessStepBinarize) {
+		img = binarizeImage(grayscaleImage(img))
+	}
+
+	var buf bytes.Buffer
+
+	switch preprocessExtension(steps) {
+	case ".png":
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		err = enc.Encode(&buf, img)
+	default:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image: [%s]", err.Error())
+	}
+
+	bounds = img.Bounds()
+	c.info("[PRE] encoded image: %dx%d (%d bytes)", bounds.Dx(), bounds.Dy(), buf.Len())
+
+	return &buf, nil
+}
+
+// determines how much to shrink an image to meet the target dpi (if known) and pixel budget
+func preprocessScaleFactor(data []byte, format string, bounds image.Rectangle) float64 {
+	factor := 1.0
+
+	targetDPI := config.preprocessDPI.value
+	if targetDPI <= 0 {
+		targetDPI = preprocessDefaultDPI
+	}
+
+	if dpi, err := imageResolution(data, format); err == nil && dpi > float64(targetDPI) {
+		factor = float64(targetDPI) / dpi
+	}
+
+	megapixels := config.preprocessMegapixels.value
+	if megapixels <= 0 {
+		megapixels = preprocessDefaultMegapixels
+	}
+
+	pixels := factor * factor * float64(bounds.Dx()) * float64(bounds.Dy())
+	if budget := float64(megapixels) * 1000000; pixels > budget {
+		factor *= math.Sqrt(budget / pixels)
+	}
+
+	return factor
+}
+
+func downscaleImage(img image.Image, factor float64) image.Image {
+	if factor >= 1.0 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w := maxOf(1, int(float64(bounds.Dx())*factor))
+	h := maxOf(1, int(float64(bounds.Dy())*factor))
+
+	var dst draw.Image
+	if _, ok := img.(*image.Gray); ok == true {
+		dst = image.NewGray(image.Rect(0, 0, w, h))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+
+	return dst
+}
+
+func grayscaleImage(img image.Image) *image.Gray {
+	if gray, ok := img.(*image.Gray); ok == true {
+		return gray
+	}
+
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, bounds.Min, draw.Src)
+
+	return gray
+}
+
+// otsu's method: picks the threshold that maximizes the variance between foreground and background
+func otsuThreshold(gray *image.Gray) uint8 {
+	var hist [256]int
+	for _, p := range gray.Pix {
+		hist[p]++
+	}
+
+	total := len(gray.Pix)
+
+	sum := 0.0
+	for i, n := range hist {
+		sum += float64(i * n)
+	}
+
+	sumB := 0.0
+	wB := 0
+	best := 0.0
+	threshold := uint8(127)
+
+	for i, n := range hist {
+		wB += n
+		if wB == 0 {
+			continue
+		}
+
+		wF := total - wB
+		if wF == 0 {
+			break
+		}
+
+		sumB += float64(i * n)
+		mB := sumB / float64(wB)
+		mF := (sum - sumB) / float64(wF)
+
+		between := float64(wB) * float64(wF) * (mB - mF) * (mB - mF)
+		if between > best {
+			best = between
+			threshold = uint8(i)
+		}
+	}
+
+	return threshold
+}
+
+// produces a 1-bit paletted image, which the png encoder stores very compactly
+func binarizeImage(gray *image.Gray) *image.Paletted {
+	threshold := otsuThreshold(gray)
+
+	bounds := gray.Bounds()
+	bw := image.NewPaletted(bounds, color.Palette{color.Black, color.White})
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if gray.GrayAt(x, y).Y > threshold {
+				bw.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+
+	return bw
+}
+
+// finds the rotation (in degrees) that produces the sharpest horizontal projection profile of dark pixels
+func detectSkew(gray *image.Gray) float64 {
+	small := grayscaleImage(downscaleImage(gray, float64(deskewSearchWidth)/float64(gray.Bounds().Dx())))
+	threshold := otsuThreshold(small)
+
+	bounds := small.Bounds()
+
+	type point struct{ x, y float64 }
+	var dark []point
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if small.GrayAt(x, y).Y <= threshold {
+				dark = append(dark, point{float64(x), float64(y)})
+			}
+		}
+	}
+
+	if len(dark) == 0 {
+		return 0
+	}
+
+	diag := int(math.Hypot(float64(bounds.Dx()), float64(bounds.Dy()))) + 1
+
+	bestAngle := 0.0
+	bestScore := -1.0
+
+	for angle := -deskewMaxAngle; angle <= deskewMaxAngle; angle += deskewAngleStep {
+		rad := angle * math.Pi / 180
+		sin, cos := math.Sin(rad), math.Cos(rad)
+
+		rows := make([]float64, 2*diag)
+		for _, p := range dark {
+			row := int(p.y*cos-p.x*sin) + diag
+			if row >= 0 && row < len(rows) {
+				rows[row]++
+			}
+		}
+
+		// text lines line up best where the row counts vary the most
+		score := 0.0
+		for i := 1; i < len(rows); i++ {
+			d := rows[i] - rows[i-1]
+			score += d * d
+		}
+
+		if score > bestScore {
+			bestScore = score
+			bestAngle = angle
+		}
+	}
+
+	return bestAngle
+}
+
+// rotates about the image center, filling uncovered areas with white
+func rotateImage(gray *image.Gray, degrees float64) *image.Gray {
+	bounds := gray.Bounds()
+	dst := image.NewGray(bounds)
+	draw.Draw(dst, bounds, image.White, image.Point{}, draw.Src)
+
+	rad := degrees * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+	cx := float64(bounds.Min.X+bounds.Max.X) / 2
+	cy := float64(bounds.Min.Y+bounds.Max.Y) / 2
+
+	// maps source coordinates to destination coordinates
+	m := f64.Aff3{
+		cos, -sin, cx - cos*cx + sin*cy,
+		sin, cos, cy - sin*cx - cos*cy,
+	}
+
+	draw.BiLinear.Transform(dst, m, gray, bounds, draw.Over, nil)
+
+	return dst
+}
+
+// returns the horizontal resolution of the image, in dots per inch, if it can be determined
+func imageResolution(data []byte, format string) (float64, error) {
+	switch format {
+	case "tiff":
+		return tiffResolution(data)
+	case "jpeg":
+		return jfifResolution(data)
+	}
+
+	return 0, errors.New("resolution not available")
+}
+
+func tiffResolution(data []byte) (float64, error) {
+	if len(data) < 8 {
+		return 0, errors.New("short tiff header")
+	}
+
+	var order binary.ByteOrder
+	switch string(data[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, errors.New("invalid tiff byte order")
+	}
+
+	ifd := int(order.Uint32(data[4:8]))
+	if ifd+2 > len(data) {
+		return 0, errors.New("invalid tiff ifd offset")
+	}
+
+	entries := int(order.Uint16(data[ifd : ifd+2]))
+
+	xres := 0.0
+	unit := uint16(2) // tiff default: inches
+
+	for i := 0; i < entries; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(data) {
+			break
+		}
+
+		tag := order.Uint16(data[e : e+2])
+		value := data[e+8 : e+12]
+
+		switch tag {
+		case 282: // XResolution (rational)
+			off := int(order.Uint32(value))
+			if off+8 <= len(data) {
+				num := order.Uint32(data[off : off+4])
+				den := order.Uint32(data[off+4 : off+8])
+				if den != 0 {
+					xres = float64(num) / float64(den)
+				}
+			}
+		case 296: // ResolutionUnit (short)
+			unit = order.Uint16(value[0:2])
+		}
+	}
+
+	switch {
+	case xres <= 0:
+		return 0, errors.New("tiff resolution not set")
+	case unit == 3:
+		return xres * 2.54, nil
+	case unit == 2:
+		return xres, nil
+	}
+
+	return 0, errors.New("tiff resolution has no unit")
+}
+
+func jfifResolution(data []byte) (float64, error) {
+	// SOI, followed by an APP0 segment: "JFIF\0", version (2), units (1), xdensity (2), ydensity (2)
+	if len(data) < 18 || data[0] != 0xff || data[1] != 0xd8 || data[2] != 0xff || data[3] != 0xe0 || string(data[6:11]) != "JFIF\x00" {
+		return 0, errors.New("jfif header not found")
+	}
+
+	units := data[13]
+	xdensity := float64(binary.BigEndian.Uint16(data[14:16]))
+
+	switch units {
+	case 1:
+		return xdensity, nil
+	case 2:
+		return xdensity * 2.54, nil
+	}
+
+	return 0, errors.New("jfif resolution has no unit")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+// a page of white with dark horizontal bars, like lines of text
+func textLinesImage(w, h int) *image.Gray {
+	gray := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(gray, gray.Bounds(), image.White, image.Point{}, draw.Src)
+
+	for y := h / 10; y < h-h/10; y += 20 {
+		draw.Draw(gray, image.Rect(w/10, y, w-w/10, y+4), image.Black, image.Point{}, draw.Src)
+	}
+
+	return gray
+}
+
+func grayLevelsImage(levels ...uint8) *image.Gray {
+	gray := image.NewGray(image.Rect(0, 0, len(levels), 1))
+	copy(gray.Pix, levels)
+
+	return gray
+}
+
+func TestOtsuThreshold(t *testing.T) {
+	tests := []struct {
+		name   string
+		levels []uint8
+		min    uint8 // threshold must be at least this
+		max    uint8 // and below this
+	}{
+		{"two levels", []uint8{40, 40, 40, 200, 200, 200}, 40, 200},
+		{"mostly background", []uint8{20, 230, 230, 230, 230, 230, 230, 230}, 20, 230},
+		{"noisy levels", []uint8{10, 20, 30, 25, 15, 180, 190, 200, 210, 220}, 30, 180},
+		{"uniform white", []uint8{255, 255, 255, 255}, 0, 255},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if threshold := otsuThreshold(grayLevelsImage(tc.levels...)); threshold < tc.min || threshold >= tc.max {
+				t.Errorf("expected a threshold in [%d, %d), got %d", tc.min, tc.max, threshold)
+			}
+		})
+	}
+}
+
+func TestBinarizeImage(t *testing.T) {
+	bw := binarizeImage(grayLevelsImage(10, 30, 50, 200, 220, 240))
+
+	expected := []uint8{0, 0, 0, 1, 1, 1}
+
+	for x, index := range expected {
+		if got := bw.ColorIndexAt(x, 0); got != index {
+			t.Errorf("pixel %d: expected color index %d, got %d", x, index, got)
+		}
+	}
+}
+
+func TestDetectSkew(t *testing.T) {
+	page := textLinesImage(600, 400)
+
+	tests := []float64{0, 1.5, -2, 3.25, -4.5}
+
+	for _, angle := range tests {
+		skewed := rotateImage(page, angle)
+
+		detected := detectSkew(skewed)
+		if math.Abs(detected-angle) > deskewAngleStep {
+			t.Errorf("expected a skew of about %0.2f degrees, got %0.2f", angle, detected)
+			continue
+		}
+
+		// the correction preprocessing applies straightens the page
+		if straightened := detectSkew(rotateImage(skewed, -detected)); math.Abs(straightened) > deskewAngleStep {
+			t.Errorf("expected no skew after correcting %0.2f degrees, got %0.2f", angle, straightened)
+		}
+	}
+
+	blank := image.NewGray(image.Rect(0, 0, 100, 100))
+	draw.Draw(blank, blank.Bounds(), image.White, image.Point{}, draw.Src)
+
+	if angle := detectSkew(blank); angle != 0 {
+		t.Errorf("expected no skew for a blank page, got %0.2f", angle)
+	}
+}
+
+func TestRotateImage(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 21, 21))
+	draw.Draw(gray, gray.Bounds(), image.White, image.Point{}, draw.Src)
+	gray.SetGray(10, 2, color.Gray{Y: 0})
+
+	if same := rotateImage(gray, 0); bytes.Equal(same.Pix, gray.Pix) == false {
+		t.Errorf("expected no change rotating by 0 degrees")
+	}
+
+	// positive angles turn clockwise: the top center moves to the right center, and the
+	// corners uncovered by the rotation are white
+	rotated := rotateImage(gray, 90)
+
+	if y := rotated.GrayAt(18, 10).Y; y > 64 {
+		t.Errorf("expected the dark pixel at (18, 10), got level %d", y)
+	}
+
+	if y := rotated.GrayAt(10, 2).Y; y < 192 {
+		t.Errorf("expected the original position to be light, got level %d", y)
+	}
+
+	if y := rotateImage(gray, 45).GrayAt(0, 0).Y; y != 255 {
+		t.Errorf("expected uncovered corners to be white, got level %d", y)
+	}
+}
+
+// a tiff header with a single ifd holding the given resolution entries
+func tiffHeader(order binary.ByteOrder, num, den uint32, unit uint16, withUnit bool) []byte {
+	var b bytes.Buffer
+
+	entries := uint16(1)
+	if withUnit == true {
+		entries = 2
+	}
+
+	rational := uint32(8 + 2 + 12*int(entries) + 4)
+
+	if order == binary.LittleEndian {
+		b.WriteString("II")
+	} else {
+		b.WriteString("MM")
+	}
+
+	binary.Write(&b, order, uint16(42))
+	binary.Write(&b, order, uint32(8))
+	binary.Write(&b, order, entries)
+
+	// XResolution: rational, stored at an offset
+	for _, v := range []interface{}{uint16(282), uint16(5), uint32(1), rational} {
+		binary.Write(&b, order, v)
+	}
+
+	if withUnit == true {
+		// ResolutionUnit: short, stored in the value itself
+		for _, v := range []interface{}{uint16(296), uint16(3), uint32(1), unit, uint16(0)} {
+			binary.Write(&b, order, v)
+		}
+	}
+
+	binary.Write(&b, order, uint32(0))
+	binary.Write(&b, order, num)
+	binary.Write(&b, order, den)
+
+	return b.Bytes()
+}
+
+func jfifHeader(units uint8, density uint16) []byte {
+	b := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00, 0x01, 0x01, units}
+	b = binary.BigEndian.AppendUint16(b, density)
+	b = binary.BigEndian.AppendUint16(b, density)
+
+	return append(b, 0x00, 0x00)
+}
+
+func TestImageResolution(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   []byte
+		dpi    float64 // 0 => an error is expected
+	}{
+		{"tiff inches, little endian", "tiff", tiffHeader(binary.LittleEndian, 600, 1, 2, true), 600},
+		{"tiff inches, big endian", "tiff", tiffHeader(binary.BigEndian, 1200, 2, 2, true), 600},
+		{"tiff centimeters", "tiff", tiffHeader(binary.LittleEndian, 118, 1, 3, true), 299.72},
+		{"tiff default unit is inches", "tiff", tiffHeader(binary.BigEndian, 400, 1, 0, false), 400},
+		{"tiff without a unit", "tiff", tiffHeader(binary.LittleEndian, 300, 1, 1, true), 0},
+		{"tiff zero denominator", "tiff", tiffHeader(binary.LittleEndian, 300, 0, 2, true), 0},
+		{"tiff short header", "tiff", []byte("II*\x00"), 0},
+		{"tiff bad byte order", "tiff", append([]byte("XX"), tiffHeader(binary.LittleEndian, 300, 1, 2, true)[2:]...), 0},
+		{"tiff ifd past the end", "tiff", []byte{'I', 'I', 42, 0, 0xff, 0, 0, 0}, 0},
+		{"tiff truncated entries", "tiff", tiffHeader(binary.LittleEndian, 300, 1, 2, true)[:14], 0},
+		{"jfif dots per inch", "jpeg", jfifHeader(1, 300), 300},
+		{"jfif dots per centimeter", "jpeg", jfifHeader(2, 118), 299.72},
+		{"jfif aspect ratio only", "jpeg", jfifHeader(0, 1), 0},
+		{"jpeg without jfif", "jpeg", append([]byte{0xff, 0xd8, 0xff, 0xe1}, jfifHeader(1, 300)[4:]...), 0},
+		{"jfif short header", "jpeg", jfifHeader(1, 300)[:12], 0},
+		{"other formats", "png", jfifHeader(1, 300), 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dpi, err := imageResolution(tc.data, tc.format)
+
+			if tc.dpi == 0 {
+				if err == nil {
+					t.Errorf("expected an error, got %0.2f dpi", dpi)
+				}
+				return
+			}
+
+			if err != nil || math.Abs(dpi-tc.dpi) > 0.01 {
+				t.Errorf("expected %0.2f dpi, got %0.2f (%v)", tc.dpi, dpi, err)
+			}
+		})
+	}
+}
+
+func TestPreprocessScaleFactor(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config.preprocessDPI.value = 300
+	config.preprocessMegapixels.value = 25
+
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+		w, h   int
+		factor float64
+	}{
+		{"at the target dpi", jfifHeader(1, 300), "jpeg", 2500, 3300, 1},
+		{"over the target dpi", tiffHeader(binary.LittleEndian, 600, 1, 2, true), "tiff", 5000, 6600, 0.5},
+		{"unknown dpi, within budget", nil, "png", 4000, 6000, 1},
+		{"unknown dpi, over budget", nil, "png", 10000, 10000, 0.5},
+		{"over the target dpi and budget", tiffHeader(binary.LittleEndian, 600, 1, 2, true), "tiff", 20000, 20000, 0.25},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if factor := preprocessScaleFactor(tc.data, tc.format, image.Rect(0, 0, tc.w, tc.h)); math.Abs(factor-tc.factor) > 0.001 {
+				t.Errorf("expected a factor of %0.3f, got %0.3f", tc.factor, factor)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// privacy of patron email addresses (and callback urls, which are stored alongside them).
+// recipients are encrypted at rest with AES-256-GCM when a key is configured.  the nonce is derived
+// from the value itself, so a given address always encrypts the same way and can still be found
+// (to avoid duplicates, to erase it, or to filter the audit log) without decrypting everything.
+// addresses are redacted wherever they are logged, and finished jobs' recipients are purged once
+// their notifications have gone out.
+
+const (
+	recipientSealedPrefix          = "enc:v1:"
+	recipientErased                = "[erased]"
+	recipientDefaultRetentionHours = 168
+)
+
+var recipientCipher cipher.AEAD
+var recipientNonceKey []byte
+
+// matches plain and url-encoded email addresses, keeping the first character and the domain
+var emailPattern = regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*(@|%40)([A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,})`)
+
+func initRecipientKey() {
+	if config.recipientKey.value == "" {
+		log.Printf("[PRIVACY] no recipient key configured; email addresses and callbacks are stored unencrypted")
+		return
+	}
+
+	aead, nonceKey, err := newRecipientCipher(config.recipientKey.value)
+	if err != nil {
+		log.Fatalf("ERROR: [PRIVACY] invalid recipient key: [%s]", err.Error())
+	}
+
+	recipientCipher = aead
+	recipientNonceKey = nonceKey
+}
+
+func newRecipientCipher(key string) (cipher.AEAD, []byte, error) {
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		raw, err = base64.StdEncoding.DecodeString(key)
+	}
+
+	if err != nil || len(raw) != 32 {
+		return nil, nil, errors.New("expected 32 bytes, hex or base64 encoded")
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// nonces come from a separate key derived from the configured one
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte("ocr-ws recipient nonce"))
+
+	return aead, mac.Sum(nil), nil
+}
+
+func redactEmails(s string) string {
+	return emailPattern.ReplaceAllString(s, "${1}***${2}${3}")
+}
+
+// gin's default access log line, with email addresses in the path and query redacted
+func redactedLogFormatter(param gin.LogFormatterParams) string {
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		redactEmails(param.Path),
+		redactEmails(param.ErrorMessage),
+	)
+}
+
+// normalizes an email address, so that it is stored (and found) the same way however it was typed
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// encrypts a recipient for storage, if a key is configured
+func sealRecipient(value string) string {
+	if recipientCipher == nil || value == "" || strings.HasPrefix(value, recipientSealedPrefix) {
+		return value
+	}
+
+	mac := hmac.New(sha256.New, recipientNonceKey)
+	mac.Write([]byte(value))
+
+	nonce := mac.Sum(nil)[:recipientCipher.NonceSize()]
+
+	sealed := recipientCipher.Seal(append([]byte{}, nonce...), nonce, []byte(value), nil)
+
+	return recipientSealedPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// decrypts a stored recipient; values stored before a key was configured are returned as is
+func openRecipient(value string) (string, error) {
+	if strings.HasPrefix(value, recipientSealedPrefix) == false {
+		return value, nil
+	}
+
+	if recipientCipher == nil {
+		return "", errors.New("recipient is encrypted, but no recipient key is configured")
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, recipientSealedPrefix))
+	if err != nil || len(raw) < recipientCipher.NonceSize() {
+		return "", errors.New("malformed encrypted recipient")
+	}
+
+	n := recipientCipher.NonceSize()
+
+	plain, err := recipientCipher.Open(nil, raw[:n], raw[n:], nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt recipient")
+	}
+
+	return string(plain), nil
+}
+
+// the forms a recipient may be stored in: encrypted, and plain (from before a key was configured)
+func recipientStoredValues(value string) []string {
+	if sealed := sealRecipient(value); sealed != value {
+		return []string{sealed, value}
+	}
+
+	return []string{value, value}
+}
+
+// decrypts stored recipients, leaving out any that cannot be decrypted
+func (c *clientContext) openRecipients(values []string) []string {
+	var opened []string
+
+	for _, v := range values {
+		plain, err := openRecipient(v)
+		if err != nil {
+			c.err("[PRIVACY] skipping recipient: [%s]", err.Error())
+			continue
+		}
+
+		opened = appendStringIfMissing(opened, plain)
+	}
+
+	return opened
+}
+
+// removes the recipients of jobs that finished before the cutoff; their notifications have been sent
+func (c *clientContext) recipientPurge(cutoff time.Time) (int64, error) {
+	res, err := jobDB.Exec("delete from job_recipients where req_id in (select req_id from jobs where state not in (?, ?) and finished != '' and cast(finished as integer) < ?);", jobStateQueued, jobStateRunning, cutoff.Unix())
+	if err != nil {
+		c.err("[PRIVACY] failed to purge recipients: [%s]", err.Error())
+		return 0, errors.New("failed to purge recipients")
+	}
+
+	return res.RowsAffected()
+}
+
+type eraseInfo struct {
+	Jobs         int64 `json:"jobs"`          // job recipient lists the address was removed from
+	Requests     int64 `json:"requests"`      // in-progress request directories it was removed from
+	AuditEntries int64 `json:"audit_entries"` // audit entries it was erased from
+}
+
+// the values among those stored that are the given (normalized) email address, whether encrypted or
+// not, and however the address was typed when it was stored
+func matchingRecipients(stored []string, email string) []string {
+	var matches []string
+
+	for _, v := range stored {
+		plain, err := openRecipient(v)
+		if err != nil {
+			continue
+		}
+
+		if normalizeEmail(plain) == email {
+			matches = appendStringIfMissing(matches, v)
+		}
+	}
+
+	return matches
+}
+
+func (c *clientContext) selectStoredValues(query string, args ...interface{}) ([]string, error) {
+	rows, err := jobDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
+
+// erases an email address from job recipients, in-progress requests, and the audit log
+func (c *clientContext) recipientErase(email string) (eraseInfo, error) {
+	var info eraseInfo
+
+	email = normalizeEmail(email)
+
+	stored, err := c.selectStoredValues("select distinct value from job_recipients where type = ?;", recipientTypeEmail)
+	if err != nil {
+		c.err("[PRIVACY] failed to retrieve job recipients: [%s]", err.Error())
+		return info, errors.New("failed to retrieve job recipients")
+	}
+
+	for _, value := range matchingRecipients(stored, email) {
+		res, err := jobDB.Exec("delete from job_recipients where type = ? and value = ?;", recipientTypeEmail, value)
+		if err != nil {
+			c.err("[PRIVACY] failed to erase job recipients: [%s]", err.Error())
+			return info, errors.New("failed to erase job recipients")
+		}
+
+		n, _ := res.RowsAffected()
+		info.Jobs += n
+	}
+
+	// requests being worked on keep their own recipient lists in their work directories
+	entries, _ := os.ReadDir(config.storageDir.value)
+	for _, entry := range entries {
+		if entry.IsDir() == false {
+			continue
+		}
+
+		dir := getWorkDir(entry.Name())
+
+		if _, err := os.Stat(c.reqFileName(dir)); err != nil {
+			continue
+		}
+
+		stored, err := c.reqGetStoredRecipientsByType(dir, recipientTypeEmail)
+		if err != nil {
+			continue
+		}
+
+		if values := matchingRecipients(stored, email); len(values) > 0 {
+			n, _ := c.reqRemoveRecipient(dir, recipientTypeEmail, values)
+			info.Requests += n
+		}
+	}
+
+	for _, column := range []string{"actor", "target"} {
+		stored, err := c.selectStoredValues(fmt.Sprintf("select distinct %s from audit_log where %s != '' and %s != ?;", column, column, column), recipientErased)
+		if err != nil {
+			c.err("[PRIVACY] failed to retrieve audit entries: [%s]", err.Error())
+			return info, errors.New("failed to retrieve audit entries")
+		}
+
+		for _, value := range matchingRecipients(stored, email) {
+			res, err := jobDB.Exec(fmt.Sprintf("update audit_log set %s = ? where %s = ?;", column, column), recipientErased, value)
+			if err != nil {
+				c.err("[PRIVACY] failed to erase audit entries: [%s]", err.Error())
+				return info, errors.New("failed to erase audit entries")
+			}
+
+			n, _ := res.RowsAffected()
+			info.AuditEntries += n
+		}
+	}
+
+	return info, nil
+}
+
+/**
+ * Erase everything tied to an email address
+ */
+func adminEraseHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	// taken from the request body only; urls end up in access logs
+	email := normalizeEmail(ctx.PostForm("email"))
+	if strings.Contains(email, "@") == false {
+		c.respondString(http.StatusBadRequest, "ERROR: Missing or invalid email address")
+		return
+	}
+
+	info, err := c.recipientErase(email)
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	// the address itself is not recorded
+	c.audit(auditEntry{Action: auditRecipientErased, Details: fmt.Sprintf("jobs=%d requests=%d audit_entries=%d", info.Jobs, info.Requests, info.AuditEntries)})
+
+	c.info("[ADMIN] erased email address (jobs: %d  requests: %d  audit entries: %d)", info.Jobs, info.Requests, info.AuditEntries)
+
+	c.respondJSON(http.StatusOK, info)
+}
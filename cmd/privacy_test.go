@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useRecipientKey(t *testing.T) {
+	t.Helper()
+
+	savedCipher, savedNonceKey := recipientCipher, recipientNonceKey
+	t.Cleanup(func() { recipientCipher, recipientNonceKey = savedCipher, savedNonceKey })
+
+	aead, nonceKey, err := newRecipientCipher(strings.Repeat("0123456789abcdef", 4))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	recipientCipher, recipientNonceKey = aead, nonceKey
+}
+
+func TestSealRecipient(t *testing.T) {
+	useRecipientKey(t)
+
+	sealed := sealRecipient("a@example.com")
+
+	if strings.HasPrefix(sealed, recipientSealedPrefix) == false || strings.Contains(sealed, "example") {
+		t.Fatalf("expected an encrypted value, got [%s]", sealed)
+	}
+
+	if again := sealRecipient("a@example.com"); again != sealed {
+		t.Errorf("expected the same address to encrypt the same way, got [%s] and [%s]", sealed, again)
+	}
+
+	if other := sealRecipient("b@example.com"); other == sealed {
+		t.Errorf("expected different addresses to encrypt differently")
+	}
+
+	if plain, err := openRecipient(sealed); err != nil || plain != "a@example.com" {
+		t.Errorf("expected [a@example.com], got [%s] (%v)", plain, err)
+	}
+
+	if plain, err := openRecipient("legacy@example.com"); err != nil || plain != "legacy@example.com" {
+		t.Errorf("expected unencrypted values to be returned as is, got [%s] (%v)", plain, err)
+	}
+
+	if _, err := openRecipient(sealed[:len(sealed)-4]); err == nil {
+		t.Errorf("expected an error for a truncated value")
+	}
+
+	for _, key := range []string{"", "abcd", strings.Repeat("zz", 32)} {
+		if _, _, err := newRecipientCipher(key); err == nil {
+			t.Errorf("expected an error for key [%s]", key)
+		}
+	}
+}
+
+func TestRedactEmails(t *testing.T) {
+	tests := map[string]string{
+		"email sent to [jdoe@virginia.edu]":               "email sent to [j***@virginia.edu]",
+		"GET /ocr/uva:1?email=jdoe%40virginia.edu&unit=2": "GET /ocr/uva:1?email=j***%40virginia.edu&unit=2",
+		"pid uva:lib:123 has no address":                  "pid uva:lib:123 has no address",
+	}
+
+	for in, expected := range tests {
+		if out := redactEmails(in); out != expected {
+			t.Errorf("expected [%s], got [%s]", expected, out)
+		}
+	}
+}
+
+func TestRecipientPurgeAndErase(t *testing.T) {
+	c := useJobStore(t)
+
+	useRecipientKey(t)
+
+	ts := tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}}
+
+	for _, reqid := range []string{"done", "active"} {
+		c.jobCreate(&jobInfo{ReqID: reqid, Pid: "uva:1", Priority: jobPriorityPatron}, &ts)
+		c.jobAddEmail(reqid, "a@example.com")
+		c.jobAddEmail(reqid, "b@example.com")
+	}
+
+	finishTestJob(c, "done", jobStateComplete)
+
+	var stored string
+	jobDB.QueryRow("select value from job_recipients limit 1;").Scan(&stored)
+
+	if strings.Contains(stored, "example") {
+		t.Errorf("expected recipients to be stored encrypted, got [%s]", stored)
+	}
+
+	if emails, _ := c.jobGetEmails("active"); len(emails) != 2 || emails[0] != "a@example.com" {
+		t.Errorf("expected both addresses, got %v", emails)
+	}
+
+	// recipients of finished jobs are kept until the retention period passes
+	now := time.Now()
+
+	if n, _ := c.recipientPurge(now.Add(-time.Hour)); n != 0 {
+		t.Errorf("expected nothing to purge yet, got %d", n)
+	}
+
+	jobDB.Exec("update jobs set finished = ? where req_id = ?;", fmt.Sprintf("%d", now.Add(-2*time.Hour).Unix()), "done")
+
+	if n, _ := c.recipientPurge(now.Add(-time.Hour)); n != 2 {
+		t.Errorf("expected to purge 2 recipients, got %d", n)
+	}
+
+	// an in-progress request keeps its own recipients in its work directory
+	dir := getWorkDir("uva:1")
+	c.reqInitialize(dir, "active")
+	c.reqAddEmail(dir, "a@example.com")
+
+	c.audit(auditEntry{Action: auditEmailSent, ReqID: "active", Target: "a@example.com"})
+
+	info, err := c.recipientErase("a@example.com")
+	if err != nil || info.Jobs != 1 || info.Requests != 1 || info.AuditEntries != 1 {
+		t.Fatalf("unexpected erase result: %+v (%v)", info, err)
+	}
+
+	if emails, _ := c.jobGetEmails("active"); len(emails) != 1 || emails[0] != "b@example.com" {
+		t.Errorf("expected only [b@example.com] to remain, got %v", emails)
+	}
+
+	if emails, _ := c.reqGetEmails(dir); len(emails) != 0 {
+		t.Errorf("expected no request recipients to remain, got %v", emails)
+	}
+
+	if entries, _ := c.auditQuery(auditFilter{target: recipientErased, limit: 10}); len(entries) != 1 {
+		t.Errorf("expected the audit entry's target to be erased, got %+v", entries)
+	}
+}
+
+func TestRedactedAccessLog(t *testing.T) {
+	c := useJobStore(t)
+
+	gin.SetMode(gin.TestMode)
+
+	if randomSource == nil {
+		randomSource = rand.New(rand.NewSource(1))
+	}
+
+	var logged bytes.Buffer
+
+	router := gin.New()
+	router.Use(gin.LoggerWithConfig(gin.LoggerConfig{Formatter: redactedLogFormatter, Output: &logged}))
+	router.POST("/admin/erase", adminEraseHandler)
+
+	c.jobCreate(&jobInfo{ReqID: "r1", Pid: "uva:1", Priority: jobPriorityPatron}, &tsPidInfo{})
+	c.jobAddEmail("r1", "jdoe@example.com")
+
+	// addresses in the query string are not accepted, and are not logged
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest("POST", "/admin/erase?email=jdoe%40example.com", nil))
+
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an address in the query string, got %d", http.StatusBadRequest, res.Code)
+	}
+
+	if strings.Contains(logged.String(), "jdoe") || strings.Contains(logged.String(), "j***%40example.com") == false {
+		t.Errorf("expected a redacted access log line, got [%s]", logged.String())
+	}
+
+	req := httptest.NewRequest("POST", "/admin/erase", strings.NewReader(url.Values{"email": {"JDoe@example.com "}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+
+	var info eraseInfo
+	if err := json.Unmarshal(res.Body.Bytes(), &info); err != nil || info.Jobs != 1 {
+		t.Errorf("expected 1 job recipient erased, got [%s]", res.Body.String())
+	}
+
+	if emails, _ := c.jobGetEmails("r1"); len(emails) != 0 {
+		t.Errorf("expected the address to be erased, got %v", emails)
+	}
+}
+
+func TestRecipientEraseNormalizes(t *testing.T) {
+	c := useJobStore(t)
+
+	ts := tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}}
+
+	for _, reqid := range []string{"r1", "r2", "r3"} {
+		c.jobCreate(&jobInfo{ReqID: reqid, Pid: "uva:1", Priority: jobPriorityPatron}, &ts)
+	}
+
+	// stored before addresses were normalized, and before a key was configured
+	c.jobAddEmail("r1", " JDoe@Example.com")
+	c.jobAddEmail("r3", "other@example.com")
+
+	useRecipientKey(t)
+
+	c.jobAddEmail("r2", "JDOE@example.com")
+	c.jobAddEmail("r3", "jdoe@example.com")
+
+	dir := getWorkDir("uva:1")
+	c.reqInitialize(dir, "r3")
+	c.reqAddEmail(dir, "Jdoe@Example.com")
+	c.reqAddEmail(dir, "other@example.com")
+
+	c.audit(auditEntry{Action: auditEmailSent, ReqID: "r2", Target: "JDoe@example.com "})
+	c.audit(auditEntry{Action: auditEmailSent, ReqID: "r3", Target: "other@example.com"})
+
+	info, err := c.recipientErase("jdoe@example.com")
+	if err != nil || info.Jobs != 3 || info.Requests != 1 || info.AuditEntries != 1 {
+		t.Fatalf("unexpected erase result: %+v (%v)", info, err)
+	}
+
+	for reqid, expected := range map[string]int{"r1": 0, "r2": 0, "r3": 1} {
+		if emails, _ := c.jobGetEmails(reqid); len(emails) != expected {
+			t.Errorf("expected %d address(es) left for [%s], got %v", expected, reqid, emails)
+		}
+	}
+
+	if emails, _ := c.reqGetEmails(dir); len(emails) != 1 || emails[0] != "other@example.com" {
+		t.Errorf("expected only [other@example.com] to remain in the request, got %v", emails)
+	}
+
+	if entries, _ := c.auditQuery(auditFilter{target: "other@example.com", limit: 10}); len(entries) != 1 {
+		t.Errorf("expected other addresses' audit entries to be kept, got %+v", entries)
+	}
+}
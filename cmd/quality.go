@@ -0,0 +1,110 @@
+package main
+
+// percentage of pages that may fall below the confidence threshold before a job is considered low quality
+const qualityLowPagesPct = 10
+
+// default mean word confidence below which a page is flagged
+const qualityDefaultThreshold = 70
+
+// job quality values
+const (
+	jobQualityOK  = "ok"
+	jobQualityLow = "low"
+)
+
+type qualityPage struct {
+	Pid        string   `json:"pid"`
+	Confidence *float64 `json:"confidence,omitempty"`
+	Words      int      `json:"words,omitempty"`
+	Attempts   int      `json:"attempts,omitempty"`
+	Scale      string   `json:"scale,omitempty"`
+}
+
+type qualityReport struct {
+	Threshold      int           `json:"threshold"`
+	Pages          int           `json:"pages"`
+	Words          int           `json:"words"`
+	MeanConfidence *float64      `json:"mean_confidence,omitempty"`
+	LowConfidence  []qualityPage `json:"low_confidence_pages,omitempty"`
+	Empty          []qualityPage `json:"empty_pages,omitempty"`
+	Retried        []qualityPage `json:"retried_pages,omitempty"`
+	Rescaled       []qualityPage `json:"rescaled_pages,omitempty"`
+	LowQuality     bool          `json:"low_quality"`
+}
+
+func qualityThreshold() int {
+	if config.qualityThreshold.value <= 0 {
+		return qualityDefaultThreshold
+	}
+
+	return config.qualityThreshold.value
+}
+
+// failed pages have no results to judge, and are reported separately
+func newQualityReport(pages []ocrPidInfo) *qualityReport {
+	report := qualityReport{
+		Threshold: qualityThreshold(),
+	}
+
+	confidenceSum := 0.0
+	confidenceCount := 0
+
+	for _, p := range pages {
+		if p.failed == true {
+			continue
+		}
+
+		report.Pages++
+
+		qp := qualityPage{
+			Pid:        p.pid,
+			Confidence: p.confidence,
+			Words:      p.words,
+			Attempts:   p.attempts,
+			Scale:      p.scale,
+		}
+
+		report.Words += p.words
+
+		if p.confidence != nil {
+			confidenceSum += *p.confidence
+			confidenceCount++
+
+			if *p.confidence < float64(report.Threshold) {
+				report.LowConfidence = append(report.LowConfidence, qp)
+			}
+		}
+
+		if cleanOcrText(p.text) == "" {
+			report.Empty = append(report.Empty, qp)
+		}
+
+		if p.attempts > 1 {
+			report.Retried = append(report.Retried, qp)
+		}
+
+		if p.scale != "" && p.scale != "100" {
+			report.Rescaled = append(report.Rescaled, qp)
+		}
+	}
+
+	if confidenceCount > 0 {
+		mean := confidenceSum / float64(confidenceCount)
+		report.MeanConfidence = &mean
+	}
+
+	// empty pages are common enough (covers, blank leaves) that they do not count against a job by themselves
+	if report.Pages > 0 && 100*len(report.LowConfidence) > qualityLowPagesPct*report.Pages {
+		report.LowQuality = true
+	}
+
+	return &report
+}
+
+func (r *qualityReport) quality() string {
+	if r.LowQuality == true {
+		return jobQualityLow
+	}
+
+	return jobQualityOK
+}
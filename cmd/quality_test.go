@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func confidence(v float64) *float64 {
+	return &v
+}
+
+func qualityPids(pages []qualityPage) string {
+	var pids []string
+	for _, p := range pages {
+		pids = append(pids, p.Pid)
+	}
+
+	return strings.Join(pids, ",")
+}
+
+// good pages at a confidence of 95, followed by low pages at 50
+func qualityPages(good, low int) []ocrPidInfo {
+	var pages []ocrPidInfo
+
+	for i := 0; i < good+low; i++ {
+		conf := 95.0
+		if i >= good {
+			conf = 50
+		}
+
+		pages = append(pages, ocrPidInfo{pid: fmt.Sprintf("p%d", i+1), text: "page text", confidence: confidence(conf), words: 2, attempts: 1, scale: "100"})
+	}
+
+	return pages
+}
+
+func TestQualityThreshold(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	tests := []struct {
+		configured int
+		expected   int
+	}{
+		{0, qualityDefaultThreshold},
+		{-5, qualityDefaultThreshold},
+		{85, 85},
+	}
+
+	for _, tc := range tests {
+		config.qualityThreshold.value = tc.configured
+
+		if threshold := qualityThreshold(); threshold != tc.expected {
+			t.Errorf("configured %d: expected a threshold of %d, got %d", tc.configured, tc.expected, threshold)
+		}
+	}
+}
+
+func TestNewQualityReport(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config.qualityThreshold.value = 0
+
+	tests := []struct {
+		name       string
+		pages      []ocrPidInfo
+		count      int
+		mean       float64 // -1 => no mean confidence
+		low        string  // low confidence pids
+		empty      string
+		retried    string
+		rescaled   string
+		lowQuality bool
+	}{
+		{"no pages", nil, 0, -1, "", "", "", "", false},
+		{"good pages", qualityPages(4, 0), 4, 95, "", "", "", "", false},
+		{"at the threshold", []ocrPidInfo{{pid: "p1", text: "page text", confidence: confidence(qualityDefaultThreshold)}}, 1, qualityDefaultThreshold, "", "", "", "", false},
+		{"just below the threshold", []ocrPidInfo{{pid: "p1", text: "page text", confidence: confidence(qualityDefaultThreshold - 0.1)}}, 1, qualityDefaultThreshold - 0.1, "p1", "", "", "", true},
+		{"low pages at the limit", qualityPages(9, 1), 10, 90.5, "p10", "", "", "", false},
+		{"low pages over the limit", qualityPages(8, 2), 10, 86, "p9,p10", "", "", "", true},
+		{"no confidence reported", []ocrPidInfo{{pid: "p1", text: "page text"}, {pid: "p2", text: "more text"}}, 2, -1, "", "", "", "", false},
+		{"mean of reporting pages only", []ocrPidInfo{{pid: "p1", text: "page text", confidence: confidence(80)}, {pid: "p2", text: "more text"}}, 2, 80, "", "", "", "", false},
+		{"empty pages", []ocrPidInfo{{pid: "p1", text: "", confidence: confidence(90)}, {pid: "p2", text: "~ .\n-", confidence: confidence(90)}, {pid: "p3", text: "page text", confidence: confidence(90)}}, 3, 90, "", "p1,p2", "", "", false},
+		{"empty pages are not low quality", []ocrPidInfo{{pid: "p1"}, {pid: "p2"}}, 2, -1, "", "p1,p2", "", "", false},
+		{"retried and rescaled pages", []ocrPidInfo{{pid: "p1", text: "page text", attempts: 1, scale: "100"}, {pid: "p2", text: "page text", attempts: 3, scale: "50"}, {pid: "p3", text: "page text", attempts: 2}}, 3, -1, "", "", "p2,p3", "p2", false},
+		{"failed pages", []ocrPidInfo{{pid: "p1", text: "page text", confidence: confidence(95)}, {pid: "p2", failed: true, attempts: 3, scale: "50"}}, 1, 95, "", "", "", "", false},
+		{"only failed pages", []ocrPidInfo{{pid: "p1", failed: true, attempts: 2}}, 0, -1, "", "", "", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			report := newQualityReport(tc.pages)
+
+			if report.Threshold != qualityDefaultThreshold {
+				t.Errorf("expected a threshold of %d, got %d", qualityDefaultThreshold, report.Threshold)
+			}
+
+			if report.Pages != tc.count {
+				t.Errorf("expected %d pages, got %d", tc.count, report.Pages)
+			}
+
+			switch {
+			case tc.mean < 0 && report.MeanConfidence != nil:
+				t.Errorf("expected no mean confidence, got %0.2f", *report.MeanConfidence)
+			case tc.mean >= 0 && report.MeanConfidence == nil:
+				t.Errorf("expected a mean confidence of %0.2f, got none", tc.mean)
+			case tc.mean >= 0 && math.Abs(*report.MeanConfidence-tc.mean) > 0.001:
+				t.Errorf("expected a mean confidence of %0.2f, got %0.2f", tc.mean, *report.MeanConfidence)
+			}
+
+			for _, list := range []struct {
+				name     string
+				pages    []qualityPage
+				expected string
+			}{
+				{"low confidence", report.LowConfidence, tc.low},
+				{"empty", report.Empty, tc.empty},
+				{"retried", report.Retried, tc.retried},
+				{"rescaled", report.Rescaled, tc.rescaled},
+			} {
+				if pids := qualityPids(list.pages); pids != list.expected {
+					t.Errorf("expected %s pages [%s], got [%s]", list.name, list.expected, pids)
+				}
+			}
+
+			if report.LowQuality != tc.lowQuality {
+				t.Errorf("expected low quality: %v, got %v", tc.lowQuality, report.LowQuality)
+			}
+
+			expected := jobQualityOK
+			if tc.lowQuality == true {
+				expected = jobQualityLow
+			}
+
+			if quality := report.quality(); quality != expected {
+				t.Errorf("expected quality [%s], got [%s]", expected, quality)
+			}
+		})
+	}
+}
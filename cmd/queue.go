@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/gammazero/workerpool"
+)
+
+// job priority classes, highest first
+const (
+	jobPriorityPatron = "patron"
+	jobPriorityStaff  = "staff"
+	jobPriorityBulk   = "bulk"
+)
+
+var jobPriorities = []string{jobPriorityPatron, jobPriorityStaff, jobPriorityBulk}
+
+// shared across all running jobs so that concurrent requests do not compete with independent pools
+var uploadPool *workerpool.WorkerPool
+
+// wakes the dispatcher when a job is queued or a running slot opens up
+var jobQueueWakeup = make(chan bool, 1)
+
+func isValidJobPriority(priority string) bool {
+	for _, p := range jobPriorities {
+		if p == priority {
+			return true
+		}
+	}
+
+	return false
+}
+
+func jobPriorityRank(priority string) int {
+	for i, p := range jobPriorities {
+		if p == priority {
+			return i
+		}
+	}
+
+	return len(jobPriorities)
+}
+
+func numUploadWorkers() int {
+	workers, err := strconv.Atoi(config.concurrentUploads.value)
+
+	switch {
+	case err != nil:
+		workers = 1
+	case workers == 0:
+		workers = runtime.NumCPU()
+	case workers < 0:
+		workers = 1
+	// failsafe
+	case workers > 100:
+		workers = 100
+	}
+
+	return workers
+}
+
+func jobQueueSignal() {
+	select {
+	case jobQueueWakeup <- true:
+	default:
+	}
+}
+
+func initJobQueue() {
+	c := newBackgroundContext()
+
+	workers := numUploadWorkers()
+	c.info("[QUEUE] concurrent uploads set to [%s]; limiting to %d uploads across all jobs", config.concurrentUploads.value, workers)
+	uploadPool = workerpool.New(workers)
+
+	c.jobRequeueInterrupted()
+
+	go c.jobDispatcher()
+}
+
+func (c *clientContext) jobDispatcher() {
+	for {
+		c.jobDispatch()
+
+		// check periodically as well, in case a signal was missed
+		select {
+		case <-jobQueueWakeup:
+		case <-time.After(60 * time.Second):
+		}
+	}
+}
+
+// starts as many queued jobs as the running job cap allows
+func (c *clientContext) jobDispatch() {
+	for {
+		if max := config.maxRunningJobs.value; max > 0 {
+			running, err := c.jobCountByState(jobStateRunning)
+			if err != nil || running >= max {
+				return
+			}
+		}
+
+		job, err := c.jobClaimNext()
+		if err != nil || job == nil {
+			return
+		}
+
+		// the job's lock normally survives queueing, possibly under the instance that queued it; if it
+		// lapsed and another job took the pid, that job notifies this one's recipients instead
+		acquired, holder, lockErr := c.jobLockAcquire(job.Pid, job.ReqID)
+		if lockErr == nil && acquired == false && holder == job.ReqID {
+			if acquired, lockErr = c.jobLockClaim(job.Pid, job.ReqID); lockErr == nil && acquired == false {
+				acquired, holder, lockErr = c.jobLockAcquire(job.Pid, job.ReqID)
+			}
+		}
+
+		if lockErr == nil && acquired == false {
+			c.warn("[QUEUE] job [%s] superseded by job [%s] for pid [%s]", job.ReqID, holder, job.Pid)
+			c.jobSupersede(job, holder)
+			continue
+		}
+
+		c.info("[QUEUE] starting job: [%s] (pid: [%s]  priority: [%s])", job.ReqID, job.Pid, job.Priority)
+
+		jc, jcErr := newJobContext(job)
+		if jcErr != nil {
+			c.err("[QUEUE] failed to restore job: [%s]", jcErr.Error())
+			c.jobFinish(job.ReqID, jobStateFailed)
+			c.jobLockRelease(job.ReqID)
+			continue
+		}
+
+		publishProgress(job.Pid, job.ReqID, eventJobStarted, progressEvent{})
+
+		go jc.generateOcr()
+	}
+}
+
+// recreates the context of the original request for a job pulled from the queue
+func newJobContext(job *jobInfo) (*clientContext, error) {
+	c := clientContext{}
+
+	c.reqID = job.ReqID
+	c.ip = "queue"
+
+	c.req.pid = job.Pid
+	c.req.unit = job.Unit
+	c.req.force = job.Force
+	c.req.lang = job.Lang
+	c.req.priority = job.Priority
+	c.req.dryrun = job.DryRun
+	c.req.overwriteCorrected = job.OverwriteCorrected
+	c.req.scale = job.Scale
+	c.req.engine = job.Engine
+	c.req.retryOf = job.RetryOf
+	c.req.partial = job.Partial
+
+	c.ocr.subDir = job.Pid
+	c.ocr.workDir = getWorkDir(c.ocr.subDir)
+	c.ocr.reqID = job.ReqID
+
+	var ts tsPidInfo
+	if err := json.Unmarshal([]byte(job.tsInfo), &ts); err != nil {
+		return nil, err
+	}
+
+	c.ocr.ts = &ts
+
+	return &c, nil
+}
+
+// queues a new job for the current request
+func (c *clientContext) queueOcr() error {
+	job := jobInfo{
+		ReqID:              c.ocr.reqID,
+		Pid:                c.req.pid,
+		Unit:               c.req.unit,
+		Priority:           c.req.priority,
+		Force:              c.req.force,
+		Lang:               c.req.lang,
+		DryRun:             c.req.dryrun,
+		OverwriteCorrected: c.req.overwriteCorrected,
+		Scale:              c.req.scale,
+		Engine:             c.req.engine,
+		RetryOf:            c.req.retryOf,
+		Partial:            c.req.partial,
+	}
+
+	if err := c.jobLockForNewJob(job.Pid, job.ReqID); err != nil {
+		return err
+	}
+
+	if err := c.jobCreate(&job, c.ocr.ts); err != nil {
+		c.jobLockRelease(job.ReqID)
+		return err
+	}
+
+	c.jobAddEmail(job.ReqID, c.req.email)
+	c.jobAddCallback(job.ReqID, c.req.callback)
+
+	// a retry notifies everyone the original job would have
+	if job.RetryOf != "" {
+		emails, _ := c.jobGetEmails(job.RetryOf)
+		for _, e := range emails {
+			c.jobAddEmail(job.ReqID, e)
+		}
+
+		callbacks, _ := c.jobGetCallbacks(job.RetryOf)
+		for _, cb := range callbacks {
+			c.jobAddCallback(job.ReqID, cb)
+		}
+	}
+
+	pos, err := c.jobQueuePosition(job.ReqID)
+	if err == nil {
+		c.info("[QUEUE] queued job: [%s] (priority: [%s]  position: %d)", job.ReqID, job.Priority, pos)
+	}
+
+	publishProgress(job.Pid, job.ReqID, eventJobAccepted, progressEvent{Done: pos, Total: len(c.ocr.ts.Pages), Details: job.Priority})
+
+	jobQueueSignal()
+
+	return nil
+}
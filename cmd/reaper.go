@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the stale job reaper.  jobs stuck in a phase for longer than its timeout, and jobs abandoned by an
+// instance that went away before starting their workflow, are failed: their workflows are terminated,
+// their s3 images and work directories removed, and their recipients notified.  each run also enforces
+// the retention settings for work directories (and export packages), s3 request prefixes, stored
+// results, and recipients.  exports abandoned by their instance are failed.
+
+const (
+	reaperDefaultInterval     = 300
+	reaperDefaultWorkDirHours = 72
+)
+
+// queued jobs wait for their turn however long it takes, unless configured otherwise
+var reaperDefaultTimeouts = map[string]int{
+	jobPhaseStarting:   900,
+	jobPhaseUploading:  7200,
+	jobPhaseLanguage:   7200,
+	jobPhaseOcr:        86400,
+	jobPhaseFinalizing: 3600,
+}
+
+var reaperPhaseTimeouts map[string]time.Duration
+
+type reapInfo struct {
+	ReqID  string `json:"reqid"`
+	Pid    string `json:"pid"`
+	Phase  string `json:"phase"`
+	Reason string `json:"reason"`
+}
+
+func initReaper() {
+	timeouts, err := parsePhaseTimeouts(config.phaseTimeouts.value)
+	if err != nil {
+		log.Fatalf("ERROR: [REAPER] invalid phase timeouts: [%s]", err.Error())
+	}
+
+	reaperPhaseTimeouts = timeouts
+
+	interval := config.reaperInterval.value
+	if interval < 0 {
+		log.Printf("[REAPER] disabled")
+		return
+	}
+
+	if interval == 0 {
+		interval = reaperDefaultInterval
+	}
+
+	c := newBackgroundContext()
+
+	go func() {
+		for {
+			time.Sleep(time.Duration(interval) * time.Second)
+			c.reap(time.Now())
+		}
+	}()
+}
+
+// parses "phase=seconds,...", e.g. "uploading=3600,ocr=43200", over the defaults
+func parsePhaseTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+
+	for phase, secs := range reaperDefaultTimeouts {
+		timeouts[phase] = time.Duration(secs) * time.Second
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid phase timeout: [%s]", entry)
+		}
+
+		phase := strings.TrimSpace(parts[0])
+
+		switch phase {
+		case jobPhaseQueued, jobPhaseStarting, jobPhaseUploading, jobPhaseLanguage, jobPhaseOcr, jobPhaseFinalizing:
+		default:
+			return nil, fmt.Errorf("unknown phase: [%s]", phase)
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid timeout for %s: [%s]", phase, parts[1])
+		}
+
+		timeouts[phase] = time.Duration(n) * time.Second
+	}
+
+	return timeouts, nil
+}
+
+func (c *clientContext) reap(now time.Time) {
+	reaped := c.reapStaleJobs(now)
+
+	if n, _ := c.exportFailAbandoned(now); n > 0 {
+		c.warn("[REAPER] failed %d abandoned export(s)", n)
+	}
+
+	c.enforceRetention(now)
+
+	if len(reaped) > 0 {
+		c.warn("[REAPER] failed %d stale job(s)", len(reaped))
+	}
+}
+
+// why a job should be reaped, if it should
+func (c *clientContext) reapReason(job *jobInfo, now time.Time) string {
+	elapsed := time.Duration(epochSecondsSince(job.PhaseStarted, now)) * time.Second
+
+	if timeout := reaperPhaseTimeouts[job.Phase]; timeout > 0 && elapsed > timeout {
+		return fmt.Sprintf("stuck in %s phase for %s", job.Phase, elapsed)
+	}
+
+	// a running job without a workflow is driven entirely by its instance, which renews its lock;
+	// once the lock has lapsed for a full lease, that instance is gone
+	if job.State == jobStateRunning && job.WorkflowID == "" {
+		if expires := c.jobLockExpires(job.ReqID); expires < now.Add(-jobLockLease()).Unix() {
+			return fmt.Sprintf("abandoned in %s phase (job lock lapsed)", job.Phase)
+		}
+	}
+
+	return ""
+}
+
+// fails stale jobs, returning those reaped
+func (c *clientContext) reapStaleJobs(now time.Time) []reapInfo {
+	jobs, err := c.jobListActive()
+	if err != nil {
+		return nil
+	}
+
+	var reaped []reapInfo
+
+	for i := range jobs {
+		job := &jobs[i]
+
+		reason := c.reapReason(job, now)
+		if reason == "" {
+			continue
+		}
+
+		// another instance's reaper may have got there first, or the job may have just moved on
+		if ok, _ := c.jobFailStuck(job.ReqID, job.Phase, job.PhaseStarted); ok == false {
+			continue
+		}
+
+		c.warn("[REAPER] failing job [%s] (pid: [%s]): %s", job.ReqID, job.Pid, reason)
+
+		c.reapJob(job, reason)
+
+		reaped = append(reaped, reapInfo{ReqID: job.ReqID, Pid: job.Pid, Phase: job.Phase, Reason: reason})
+	}
+
+	return reaped
+}
+
+// cleans up after a job that has been failed by the reaper, and notifies its recipients
+func (c *clientContext) reapJob(job *jobInfo, reason string) {
+	if job.WorkflowID != "" && sess != nil {
+		c.awsTerminateWorkflow(job.WorkflowID, reason)
+	}
+
+	if job.State == jobStateRunning {
+		c.awsDeleteImages(job.ReqID)
+
+		// the work directory belongs to whichever request holds the pid's lock
+		if holder, _ := c.jobLockHolder(job.Pid); holder == "" || holder == job.ReqID {
+			os.RemoveAll(getWorkDir(job.Pid))
+		}
+	}
+
+	c.jobLockRelease(job.ReqID)
+
+	url := ""
+	if jc, err := newJobContext(job); err == nil {
+		url = virgoURL(job.Pid, jc.ocr.ts.Pid.CatalogKey)
+	}
+
+	emails, _ := c.jobGetEmails(job.ReqID)
+
+	c.jobNotifyFailure(job, url, emails, fmt.Sprintf("OCR request timed out (%s)", reason))
+
+	publishProgress(job.Pid, job.ReqID, eventJobFailed, progressEvent{Details: reason})
+}
+
+// removes work directories, export packages, s3 request prefixes, stored results, and recipients past their retention
+func (c *clientContext) enforceRetention(now time.Time) {
+	if hours := config.workDirRetention.value; hours >= 0 {
+		if hours == 0 {
+			hours = reaperDefaultWorkDirHours
+		}
+
+		purged, err := c.purgeWorkDirs(now.Add(-time.Duration(hours)*time.Hour), false)
+		if err != nil {
+			c.err("[REAPER] work dir purge failed: [%s]", err.Error())
+		}
+
+		for _, p := range purged {
+			c.info("[REAPER] removed work dir [%s] (%s)", p.Dir, p.Reason)
+		}
+
+		if n, _ := c.exportPurge(now.Add(-time.Duration(hours) * time.Hour)); n > 0 {
+			c.info("[REAPER] removed %d expired export package(s)", n)
+		}
+	}
+
+	if hours := config.s3Retention.value; hours > 0 {
+		purged, _ := c.awsPurgeRequestPrefixes(now.Add(-time.Duration(hours) * time.Hour))
+
+		if len(purged) > 0 {
+			c.info("[REAPER] removed %d abandoned s3 request prefix(es)", len(purged))
+		}
+	}
+
+	if days := config.resultRetention.value; days > 0 {
+		pages, cached, _ := c.jobPurgeResults(now.AddDate(0, 0, -days))
+
+		if pages > 0 || cached > 0 {
+			c.info("[REAPER] removed %d page result(s) and %d cached result(s) older than %d days", pages, cached, days)
+		}
+	}
+
+	if hours := config.recipientRetention.value; hours >= 0 {
+		if hours == 0 {
+			hours = recipientDefaultRetentionHours
+		}
+
+		if n, _ := c.recipientPurge(now.Add(-time.Duration(hours) * time.Hour)); n > 0 {
+			c.info("[REAPER] removed %d recipient(s) of jobs finished more than %d hours ago", n, hours)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParsePhaseTimeouts(t *testing.T) {
+	timeouts, err := parsePhaseTimeouts("uploading=60, queued=3600,ocr=0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	expected := map[string]time.Duration{
+		jobPhaseQueued:     time.Hour,
+		jobPhaseStarting:   900 * time.Second,
+		jobPhaseUploading:  time.Minute,
+		jobPhaseOcr:        0,
+		jobPhaseFinalizing: time.Hour,
+	}
+
+	for phase, d := range expected {
+		if timeouts[phase] != d {
+			t.Errorf("expected %s timeout %s, got %s", phase, d, timeouts[phase])
+		}
+	}
+
+	for _, s := range []string{"uploading", "uploading=x", "uploading=-1", "sleeping=60"} {
+		if _, err := parsePhaseTimeouts(s); err == nil {
+			t.Errorf("expected an error for [%s]", s)
+		}
+	}
+}
+
+func TestReapStaleJobs(t *testing.T) {
+	c := useJobStore(t)
+
+	instanceID = "test"
+
+	saved := reaperPhaseTimeouts
+	t.Cleanup(func() { reaperPhaseTimeouts = saved })
+
+	reaperPhaseTimeouts, _ = parsePhaseTimeouts("uploading=600")
+
+	ts := tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}, Pages: []tsGenericPidInfo{{Pid: "uva:2"}}}
+
+	for i := 1; i <= 3; i++ {
+		reqid := fmt.Sprintf("r%d", i)
+		c.jobCreate(&jobInfo{ReqID: reqid, Pid: fmt.Sprintf("uva:%d", i), Priority: jobPriorityPatron}, &ts)
+		c.jobLockAcquire(fmt.Sprintf("uva:%d", i), reqid)
+	}
+
+	for i := 1; i <= 2; i++ {
+		c.jobClaimNext()
+	}
+
+	now := time.Now()
+
+	// r1 has been uploading for an hour; r2 has only just started; r3 is still queued
+	c.jobUpdatePhase("r1", jobPhaseUploading)
+	c.jobUpdatePhase("r2", jobPhaseUploading)
+	jobDB.Exec("update jobs set phase_started = ? where req_id = ?;", fmt.Sprintf("%d", now.Add(-time.Hour).Unix()), "r1")
+
+	reaped := c.reapStaleJobs(now)
+	if len(reaped) != 1 || reaped[0].ReqID != "r1" {
+		t.Fatalf("expected to reap [r1], got %+v", reaped)
+	}
+
+	if job, _ := c.jobGet("r1"); job.State != jobStateFailed {
+		t.Errorf("expected [r1] to have failed, got %s", job.State)
+	}
+
+	if _, held := c.jobLockHolder("uva:1"); held == true {
+		t.Errorf("expected the lock on [uva:1] to be released")
+	}
+
+	// r2's instance went away: its lock lapsed more than a lease ago
+	jobDB.Exec("update job_locks set expires = ? where req_id = ?;", now.Add(-2*jobLockLease()).Unix(), "r2")
+
+	reaped = c.reapStaleJobs(now)
+	if len(reaped) != 1 || reaped[0].ReqID != "r2" {
+		t.Fatalf("expected to reap [r2], got %+v", reaped)
+	}
+
+	// nothing else is stale, and reaped jobs are not reaped again
+	if reaped = c.reapStaleJobs(now); len(reaped) != 0 {
+		t.Errorf("expected nothing to reap, got %+v", reaped)
+	}
+
+	if job, _ := c.jobGet("r3"); job.State != jobStateQueued {
+		t.Errorf("expected [r3] to still be queued, got %s", job.State)
+	}
+}
+
+func TestJobPurgeResults(t *testing.T) {
+	c := useJobStore(t)
+
+	ts := tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}}
+
+	for _, reqid := range []string{"old", "new"} {
+		c.jobCreate(&jobInfo{ReqID: reqid, Pid: "uva:1", Priority: jobPriorityPatron}, &ts)
+		c.jobSavePages(reqid, []ocrPidInfo{{pid: "uva:2", attempts: 1, text: "text"}})
+		finishTestJob(c, reqid, jobStateComplete)
+	}
+
+	now := time.Now()
+
+	jobDB.Exec("update jobs set finished = ? where req_id = ?;", fmt.Sprintf("%d", now.AddDate(0, 0, -10).Unix()), "old")
+
+	pages, _, err := c.jobPurgeResults(now.AddDate(0, 0, -7))
+	if err != nil || pages != 1 {
+		t.Fatalf("expected to purge 1 page, got %d (%v)", pages, err)
+	}
+
+	if p, _ := c.jobGetPages("old"); len(p) != 0 {
+		t.Errorf("expected no pages left for [old], got %d", len(p))
+	}
+
+	if p, _ := c.jobGetPages("new"); len(p) != 1 {
+		t.Errorf("expected the page for [new] to be kept, got %d", len(p))
+	}
+}
+
+func TestEnforceRecipientRetention(t *testing.T) {
+	c := useJobStore(t)
+
+	useRecipientKey(t)
+
+	ts := tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}}
+
+	now := time.Now()
+
+	for _, reqid := range []string{"old", "recent", "active"} {
+		c.jobCreate(&jobInfo{ReqID: reqid, Pid: "uva:1", Priority: jobPriorityPatron}, &ts)
+		c.jobAddEmail(reqid, "a@example.com")
+	}
+
+	finishTestJob(c, "old", jobStateComplete)
+	finishTestJob(c, "recent", jobStateComplete)
+
+	jobDB.Exec("update jobs set finished = ? where req_id = ?;", fmt.Sprintf("%d", now.Add(-200*time.Hour).Unix()), "old")
+	jobDB.Exec("update jobs set finished = ? where req_id = ?;", fmt.Sprintf("%d", now.Add(-time.Hour).Unix()), "recent")
+
+	// negative keeps recipients forever
+	config.recipientRetention.value = -1
+	c.enforceRetention(now)
+
+	if emails, _ := c.jobGetEmails("old"); len(emails) != 1 {
+		t.Errorf("expected recipients to be kept with retention off, got %v", emails)
+	}
+
+	// zero uses the default retention
+	config.recipientRetention.value = 0
+	c.enforceRetention(now)
+
+	expected := map[string]int{"old": 0, "recent": 1, "active": 1}
+
+	for reqid, count := range expected {
+		if emails, _ := c.jobGetEmails(reqid); len(emails) != count {
+			t.Errorf("expected %d recipient(s) for [%s], got %v", count, reqid, emails)
+		}
+	}
+
+	config.recipientRetention.value = 1
+	c.enforceRetention(now.Add(time.Hour))
+
+	if emails, _ := c.jobGetEmails("recent"); len(emails) != 0 {
+		t.Errorf("expected the recipients of [recent] to be purged, got %v", emails)
+	}
+
+	if emails, _ := c.jobGetEmails("active"); len(emails) != 1 {
+		t.Errorf("expected the recipients of a running job to be kept, got %v", emails)
+	}
+}
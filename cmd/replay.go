@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// recording and offline replay of decision tasks:
+//
+//	ocr-ws replay [-v] [-update] <file|dir> ...
+//
+// a record holds the event history of a decision task (as returned by PollForDecisionTask), the
+// decider settings in effect, and optionally the decisions and outcome expected from it.  field
+// names are matched case-insensitively, so histories saved with the aws cli can be replayed too.
+
+type decisionRecord struct {
+	WorkflowExecution      *swf.WorkflowExecution `json:"workflowExecution,omitempty"`
+	PreviousStartedEventID int64                  `json:"previousStartedEventId"`
+	Settings               deciderSettings        `json:"settings"`
+	Events                 json.RawMessage        `json:"events"`
+	Expect                 *decisionExpectation   `json:"expect,omitempty"`
+}
+
+type decisionExpectation struct {
+	Outcome   string          `json:"outcome"`
+	Details   string          `json:"details,omitempty"`
+	Decisions []*swf.Decision `json:"decisions"`
+}
+
+// the configuration that the decider depends on
+type deciderSettings struct {
+	LambdaFunction string `json:"lambda_function,omitempty"`
+	LambdaTimeout  string `json:"lambda_timeout,omitempty"`
+	LambdaQueues   string `json:"lambda_queues,omitempty"`
+	QueuesMax      int    `json:"lambda_queues_max,omitempty"`
+	GrowSeconds    int    `json:"lambda_grow_seconds,omitempty"`
+	LambdaAttempts string `json:"lambda_attempts,omitempty"`
+	RetryBackoff   string `json:"retry_backoff,omitempty"`
+	RetryJitter    int    `json:"retry_jitter,omitempty"`
+	RetryFailures  string `json:"retry_failures,omitempty"`
+	RetryScales    string `json:"retry_scales,omitempty"`
+	FinalLang      string `json:"final_lang,omitempty"`
+	FinalEngine    string `json:"final_engine,omitempty"`
+}
+
+func currentDeciderSettings() deciderSettings {
+	return deciderSettings{
+		LambdaFunction: config.awsLambdaFunction.value,
+		LambdaTimeout:  config.awsLambdaTimeout.value,
+		LambdaQueues:   config.lambdaQueues.value,
+		QueuesMax:      config.lambdaQueuesMax.value,
+		GrowSeconds:    config.lambdaGrowSeconds.value,
+		LambdaAttempts: config.lambdaAttempts.value,
+		RetryBackoff:   config.lambdaRetryBackoff.value,
+		RetryJitter:    config.lambdaRetryJitter.value,
+		RetryFailures:  config.lambdaRetryFailures.value,
+		RetryScales:    config.lambdaRetryScales.value,
+		FinalLang:      config.lambdaFinalLang.value,
+		FinalEngine:    config.lambdaFinalEngine.value,
+	}
+}
+
+func (s deciderSettings) apply() {
+	config.awsLambdaFunction.value = s.LambdaFunction
+	config.awsLambdaTimeout.value = s.LambdaTimeout
+	config.lambdaQueues.value = s.LambdaQueues
+	config.lambdaQueuesMax.value = s.QueuesMax
+	config.lambdaGrowSeconds.value = s.GrowSeconds
+	config.lambdaAttempts.value = s.LambdaAttempts
+	config.lambdaRetryBackoff.value = s.RetryBackoff
+	config.lambdaRetryJitter.value = s.RetryJitter
+	config.lambdaRetryFailures.value = s.RetryFailures
+	config.lambdaRetryScales.value = s.RetryScales
+	config.lambdaFinalLang.value = s.FinalLang
+	config.lambdaFinalEngine.value = s.FinalEngine
+}
+
+// writes the decision task just handled to the record directory, if configured
+func (c *clientContext) awsRecordDecisionTask(info decisionInfo, res deciderResult) {
+	if config.decisionRecordDir.value == "" {
+		return
+	}
+
+	events, err := json.Marshal(info.allEvents)
+	if err != nil {
+		c.warn("[AWS] [%s] failed to encode decision task events: [%s]", info.workflowID, err.Error())
+		return
+	}
+
+	rec := decisionRecord{
+		WorkflowExecution:      (&swf.WorkflowExecution{}).SetWorkflowId(info.workflowID),
+		PreviousStartedEventID: info.lastEventID,
+		Settings:               currentDeciderSettings(),
+		Events:                 events,
+		Expect:                 &decisionExpectation{Outcome: res.outcome, Details: res.details, Decisions: res.decisions},
+	}
+
+	file := filepath.Join(config.decisionRecordDir.value, fmt.Sprintf("%s-%d.json", info.workflowID, info.lastEventID))
+
+	if err := writeDecisionRecord(file, rec); err != nil {
+		c.warn("[AWS] [%s] failed to record decision task: [%s]", info.workflowID, err.Error())
+		return
+	}
+
+	c.info("[AWS] [%s] recorded decision task to [%s]", info.workflowID, file)
+}
+
+// leaves out the many unset attribute groups of each decision, to keep records readable
+func (e decisionExpectation) MarshalJSON() ([]byte, error) {
+	var decisions []interface{}
+
+	for _, d := range e.Decisions {
+		buf, err := json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+
+		var v interface{}
+		json.Unmarshal(buf, &v)
+
+		decisions = append(decisions, withoutNulls(v))
+	}
+
+	type expectation decisionExpectation
+
+	return json.Marshal(struct {
+		expectation
+		Decisions []interface{} `json:"decisions"`
+	}{expectation(e), decisions})
+}
+
+func withoutNulls(v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if ok == false {
+		return v
+	}
+
+	for k, val := range m {
+		if val == nil {
+			delete(m, k)
+			continue
+		}
+
+		m[k] = withoutNulls(val)
+	}
+
+	return m
+}
+
+func readDecisionRecord(file string) (*decisionRecord, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := decisionRecord{}
+	if err := json.Unmarshal(buf, &rec); err != nil {
+		return nil, fmt.Errorf("failed to decode record: %s", err.Error())
+	}
+
+	return &rec, nil
+}
+
+func writeDecisionRecord(file string, rec decisionRecord) error {
+	buf, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return errors.New("failed to encode record")
+	}
+
+	return ioutil.WriteFile(file, append(buf, '\n'), 0644)
+}
+
+// decodes recorded history events.  the aws cli may have written timestamps as epoch seconds,
+// which time.Time does not accept, so these are converted first
+func decodeHistoryEvents(raw json.RawMessage) ([]*swf.HistoryEvent, error) {
+	var fields []map[string]json.RawMessage
+
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, errors.New("failed to decode events")
+	}
+
+	var events []*swf.HistoryEvent
+
+	for i, f := range fields {
+		for k, v := range f {
+			if strings.EqualFold(k, "eventTimestamp") {
+				if secs, err := strconv.ParseFloat(string(v), 64); err == nil {
+					ts := time.Unix(0, int64(secs*float64(time.Second))).UTC()
+					f[k], _ = json.Marshal(ts)
+				}
+			}
+		}
+
+		buf, _ := json.Marshal(f)
+
+		e := swf.HistoryEvent{}
+		if err := json.Unmarshal(buf, &e); err != nil {
+			return nil, fmt.Errorf("failed to decode event %d: %s", i+1, err.Error())
+		}
+
+		if e.EventId == nil || e.EventType == nil {
+			return nil, fmt.Errorf("event %d is missing an id or type", i+1)
+		}
+
+		events = append(events, &e)
+	}
+
+	return events, nil
+}
+
+// runs the decider over a recorded decision task, with the recorded settings and no retry jitter.
+// returns the result, along with the jitter the recording was made with
+func replayDecisionRecord(rec *decisionRecord, logf func(format string, args ...interface{})) (decisionInfo, deciderResult, int, error) {
+	events, err := decodeHistoryEvents(rec.Events)
+	if err != nil {
+		return decisionInfo{}, deciderResult{}, 0, err
+	}
+
+	saved := config
+	defer func() { config = saved }()
+
+	rec.Settings.apply()
+
+	policy, err := newConfigRetryPolicy()
+	if err != nil {
+		return decisionInfo{}, deciderResult{}, 0, fmt.Errorf("invalid retry settings: %s", err.Error())
+	}
+
+	jitter := policy.jitter
+	policy.jitter = 0
+
+	d := decider{
+		policy:   policy,
+		queues:   config.lambdaQueues.value,
+		function: config.awsLambdaFunction.value,
+		timeout:  config.awsLambdaTimeout.value,
+		newID:    func() string { return "" },
+		manifest: (&manifestCache{read: readManifest}).get,
+
+		queuesMax:   lambdaQueuesMax(config.lambdaQueues.value),
+		growSeconds: lambdaGrowSeconds(config.awsLambdaTimeout.value),
+		info:        func(format string, args ...interface{}) { logf("INFO: "+format, args...) },
+		warn:        func(format string, args ...interface{}) { logf("WARNING: "+format, args...) },
+		err:         func(format string, args ...interface{}) { logf("ERROR: "+format, args...) },
+	}
+
+	info := decisionInfo{
+		lastEventID: rec.PreviousStartedEventID,
+		allEvents:   events,
+	}
+
+	if rec.WorkflowExecution != nil && rec.WorkflowExecution.WorkflowId != nil {
+		info.workflowID = *rec.WorkflowExecution.WorkflowId
+	}
+
+	if err := d.inventory(&info); err != nil {
+		return info, deciderResult{}, jitter, err
+	}
+
+	res := d.decide(&info)
+
+	return info, res, jitter, nil
+}
+
+// a comparable form of a decision: ids are random, so are left out
+func normalizeDecision(decision *swf.Decision) *swf.Decision {
+	buf, _ := json.Marshal(decision)
+
+	n := swf.Decision{}
+	json.Unmarshal(buf, &n)
+
+	if a := n.ScheduleLambdaFunctionDecisionAttributes; a != nil {
+		a.Id = nil
+	}
+
+	if a := n.StartTimerDecisionAttributes; a != nil {
+		a.TimerId = nil
+	}
+
+	return &n
+}
+
+// compares replayed decisions to expected ones.  retry timers were recorded with up to
+// jitter random seconds added to the delay, which replay leaves out
+func compareDecisions(expected, actual []*swf.Decision, jitter int) error {
+	if len(expected) != len(actual) {
+		return fmt.Errorf("expected %d decision(s), got %d: %s", len(expected), len(actual), decisionsString(actual))
+	}
+
+	for i := range expected {
+		e := normalizeDecision(expected[i])
+		a := normalizeDecision(actual[i])
+
+		et := e.StartTimerDecisionAttributes
+		at := a.StartTimerDecisionAttributes
+
+		if et != nil && at != nil && et.StartToFireTimeout != nil && at.StartToFireTimeout != nil {
+			ed, eErr := strconv.Atoi(*et.StartToFireTimeout)
+			ad, aErr := strconv.Atoi(*at.StartToFireTimeout)
+
+			if eErr == nil && aErr == nil && ed >= ad && ed < ad+maxOf(jitter, 1) {
+				at.StartToFireTimeout = et.StartToFireTimeout
+			}
+		}
+
+		eBuf, _ := json.Marshal(e)
+		aBuf, _ := json.Marshal(a)
+
+		if string(eBuf) != string(aBuf) {
+			return fmt.Errorf("decision %d differs:\n  expected: %s\n  got:      %s", i+1, eBuf, aBuf)
+		}
+	}
+
+	return nil
+}
+
+func decisionsString(decisions []*swf.Decision) string {
+	var normalized []*swf.Decision
+	for _, d := range decisions {
+		normalized = append(normalized, normalizeDecision(d))
+	}
+
+	buf, _ := json.Marshal(decisionExpectation{Decisions: normalized})
+
+	var v struct {
+		Decisions json.RawMessage `json:"decisions"`
+	}
+	json.Unmarshal(buf, &v)
+
+	return string(v.Decisions)
+}
+
+// replays a recorded decision task and checks the result against its expectation, if any.
+// with update set, the expectation is (re)written from the replayed result instead
+func replayFile(file string, update bool, logf func(format string, args ...interface{})) (*deciderResult, error) {
+	rec, err := readDecisionRecord(file)
+	if err != nil {
+		return nil, err
+	}
+
+	_, res, jitter, err := replayDecisionRecord(rec, logf)
+	if err != nil {
+		return nil, err
+	}
+
+	if update == true {
+		var decisions []*swf.Decision
+		for _, d := range res.decisions {
+			decisions = append(decisions, normalizeDecision(d))
+		}
+
+		rec.Expect = &decisionExpectation{Outcome: res.outcome, Details: res.details, Decisions: decisions}
+
+		return &res, writeDecisionRecord(file, *rec)
+	}
+
+	if rec.Expect == nil {
+		return &res, nil
+	}
+
+	if res.outcome != rec.Expect.Outcome || res.details != rec.Expect.Details {
+		return &res, fmt.Errorf("expected outcome [%s] (%s), got [%s] (%s)", rec.Expect.Outcome, rec.Expect.Details, res.outcome, res.details)
+	}
+
+	if err := compareDecisions(rec.Expect.Decisions, res.decisions, jitter); err != nil {
+		return &res, err
+	}
+
+	return &res, nil
+}
+
+// expands directories into the record files they contain
+func replayFiles(args []string) ([]string, error) {
+	var files []string
+
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		if fi.IsDir() == false {
+			files = append(files, arg)
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(arg, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// entry point for "ocr-ws replay ..."; returns the process exit code
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+
+	verbose := fs.Bool("v", false, "show decider logging")
+	update := fs.Bool("update", false, "write each record's expectation from the replayed result")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s replay [options] <file|dir> ...\n\noptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	files, err := replayFiles(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 2
+	}
+
+	logf := func(format string, args ...interface{}) {}
+	if *verbose == true {
+		logf = log.Printf
+	}
+
+	failed := 0
+
+	for _, file := range files {
+		res, err := replayFile(file, *update, logf)
+
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("FAIL  %s: %s\n", file, err.Error())
+
+		case *update == true:
+			fmt.Printf("WROTE %s\n", file)
+
+		default:
+			fmt.Printf("ok    %s\n", file)
+		}
+
+		if res != nil && (*verbose == true || err != nil) {
+			fmt.Printf("      outcome: [%s] %s\n", res.outcome, res.details)
+			fmt.Printf("      decisions: %s\n", decisionsString(res.decisions))
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d replay(s) failed\n", failed, len(files))
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+const replayTestdata = "testdata/replay"
+
+// every recorded decision task under testdata must replay to its expected decisions
+func TestReplay(t *testing.T) {
+	files, err := replayFiles([]string{replayTestdata})
+	if err != nil {
+		t.Fatalf("replayFiles() failed: %s", err.Error())
+	}
+
+	if len(files) == 0 {
+		t.Fatalf("no records found in %s", replayTestdata)
+	}
+
+	for _, file := range files {
+		file := file
+
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			if _, err := replayFile(file, false, t.Logf); err != nil {
+				t.Errorf("replay failed: %s", err.Error())
+			}
+		})
+	}
+}
+
+// replaying must not change the service configuration
+func TestReplayRestoresConfig(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config.lambdaQueues.value = "42"
+	config.awsLambdaFunction.value = "configured"
+
+	if _, err := replayFile(filepath.Join(replayTestdata, "01-workflow-started.json"), false, t.Logf); err != nil {
+		t.Fatalf("replay failed: %s", err.Error())
+	}
+
+	if config.lambdaQueues.value != "42" || config.awsLambdaFunction.value != "configured" {
+		t.Errorf("config changed by replay: queues [%s], function [%s]", config.lambdaQueues.value, config.awsLambdaFunction.value)
+	}
+}
+
+func timerDecision(id, delay string) *swf.Decision {
+	return (&swf.Decision{}).
+		SetDecisionType("StartTimer").
+		SetStartTimerDecisionAttributes((&swf.StartTimerDecisionAttributes{}).
+			SetControl(`{"t":2,"o":"11"}`).
+			SetStartToFireTimeout(delay).
+			SetTimerId(id))
+}
+
+func TestCompareDecisions(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected []*swf.Decision
+		actual   []*swf.Decision
+		jitter   int
+		mismatch string
+	}{
+		{"ids ignored", []*swf.Decision{timerDecision("a", "2")}, []*swf.Decision{timerDecision("", "2")}, 0, ""},
+		{"within jitter", []*swf.Decision{timerDecision("a", "11")}, []*swf.Decision{timerDecision("", "2")}, 10, ""},
+		{"beyond jitter", []*swf.Decision{timerDecision("a", "12")}, []*swf.Decision{timerDecision("", "2")}, 10, "decision 1 differs"},
+		{"shorter than replayed", []*swf.Decision{timerDecision("a", "1")}, []*swf.Decision{timerDecision("", "2")}, 10, "decision 1 differs"},
+		{"count", []*swf.Decision{timerDecision("a", "2")}, nil, 0, "expected 1 decision(s), got 0"},
+		{"type", []*swf.Decision{timerDecision("a", "2")}, []*swf.Decision{awsCompleteWorkflowExecution("success")}, 0, "decision 1 differs"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := compareDecisions(tc.expected, tc.actual, tc.jitter)
+
+			switch {
+			case tc.mismatch == "" && err != nil:
+				t.Errorf("unexpected mismatch: %s", err.Error())
+			case tc.mismatch != "" && err == nil:
+				t.Errorf("expected mismatch [%s], got none", tc.mismatch)
+			case tc.mismatch != "" && strings.Contains(err.Error(), tc.mismatch) == false:
+				t.Errorf("expected mismatch [%s], got [%s]", tc.mismatch, err.Error())
+			}
+		})
+	}
+}
+
+// histories saved by the aws cli use camel-cased names and timestamps in various forms
+func TestDecodeHistoryEvents(t *testing.T) {
+	raw := `[
+		{"eventId": 1, "eventType": "WorkflowExecutionStarted", "eventTimestamp": 1759334400.123,
+		 "workflowExecutionStartedEventAttributes": {"input": "{}"}},
+		{"EventId": 2, "EventType": "DecisionTaskScheduled", "EventTimestamp": "2026-10-01T12:00:00Z"}
+	]`
+
+	events, err := decodeHistoryEvents([]byte(raw))
+	if err != nil {
+		t.Fatalf("decodeHistoryEvents() failed: %s", err.Error())
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	if aws.StringValue(events[0].WorkflowExecutionStartedEventAttributes.Input) != "{}" {
+		t.Errorf("event attributes not decoded: %v", events[0])
+	}
+
+	if aws.Int64Value(events[1].EventId) != 2 || aws.StringValue(events[1].EventType) != "DecisionTaskScheduled" {
+		t.Errorf("event not decoded: %v", events[1])
+	}
+
+	if _, err := decodeHistoryEvents([]byte(`[{"eventType": "TimerFired"}]`)); err == nil {
+		t.Errorf("expected an error for an event without an id")
+	}
+}
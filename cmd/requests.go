@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"strconv"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -36,95 +35,6 @@ func (c *clientContext) reqOpenDatabase(path string) (*sql.DB, error) {
 	return sql.Open("sqlite3", dbFile)
 }
 
-func (c *clientContext) reqInProgressByDates(req *reqInfo) bool {
-	c.info("[SQL] checking for existing request in progress by timestamps")
-
-	// check if finished is set
-	if req.Finished != "" {
-		c.info("[SQL] request has a finished timestamp; not in progress")
-		return false
-	}
-
-	// check if started is more than 1 hour ago (assume S3 uploads will never take that long)
-	secs := int64(3600)
-
-	started, err := epochToInt64(req.Started)
-	if err != nil {
-		c.warn("[SQL] failure parsing start time: [%s] (%s); treating as not in progress", req.Started, err.Error())
-		return false
-	}
-
-	now := time.Now().Unix()
-
-	elapsed := now - started
-
-	c.info("[SQL] started: [%d]  now: [%d] => elapsed: [%d] > secs: [%d] ?", started, now, elapsed, secs)
-
-	if elapsed > secs {
-		c.info("[SQL] request has a stale started timestamp; not in progress")
-		return false
-	}
-
-	// somewhat recent, and not in SWF yet -- might be new/still uploading images
-	c.info("[SQL] request is somewhat recent, but not found in SWF; assuming in progress (could still be uploading to S3)")
-
-	return true
-}
-
-func (c *clientContext) reqInProgress(path string) (bool, string) {
-	c.info("[SQL] checking for existing request in progress")
-
-	zeroPct := "0%"
-
-	req, err := c.reqGetRequestInfo(path, "")
-	if err != nil {
-		c.warn("[SQL] error getting request info; not in progress (%s)", err.Error())
-		return false, zeroPct
-	}
-
-	uploaded, _ := strconv.Atoi(req.ImagesUploaded)
-	complete, _ := strconv.Atoi(req.ImagesComplete)
-	total, _ := strconv.Atoi(req.ImagesTotal)
-
-	pct := zeroPct
-	if total > 0 {
-		stepsDone := uploaded + complete
-		stepsTotal := 2 * total
-		pct = fmt.Sprintf("%d%%", (100*stepsDone)/stepsTotal)
-		c.debug("[SQL] progress: (%s + %s) / (2 * %s) => %d / %d => %s complete", req.ImagesUploaded, req.ImagesComplete, req.ImagesTotal, stepsDone, stepsTotal, pct)
-	}
-
-	if req.AWSWorkflowID == "" || req.AWSRunID == "" {
-		c.info("[SQL] no valid request info found; checking timestamps")
-
-		if c.reqInProgressByDates(req) == true {
-			return true, pct
-		}
-
-		return false, zeroPct
-	}
-
-	c.info("[SQL] found existing workflowID: [%s] / runID: [%s]", req.AWSWorkflowID, req.AWSRunID)
-
-	// check if this is an open workflow
-	open, openErr := c.awsWorkflowIsOpen(req.AWSWorkflowID, req.AWSRunID)
-	if openErr == nil && open == true {
-		c.info("[SQL] workflow execution is open; in progress")
-		return true, pct
-	}
-
-	// check if this is a closed workflow
-	closed, closedErr := c.awsWorkflowIsClosed(req.AWSWorkflowID, req.AWSRunID)
-	if closedErr == nil && closed == true {
-		c.info("[SQL] workflow execution is closed; not in progress")
-		return false, zeroPct
-	}
-
-	c.info("[SQL] workflow execution is indeterminate; checking timestamps")
-
-	return c.reqInProgressByDates(req), pct
-}
-
 func (c *clientContext) reqInitialize(path, reqid string) error {
 	c.info("[SQL] request path: [%s]", path)
 
@@ -310,7 +220,7 @@ func (c *clientContext) reqAddRecipientByType(path string, rtype int, rvalue str
 		return errors.New("failed to prepare recipient transaction")
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(rtype, rvalue)
+	_, err = stmt.Exec(rtype, sealRecipient(rvalue))
 	if err != nil {
 		c.err("[SQL] failed to execute recipient transaction: [%s]", err.Error())
 		return errors.New("failed to execute recipient transaction")
@@ -321,14 +231,24 @@ func (c *clientContext) reqAddRecipientByType(path string, rtype int, rvalue str
 }
 
 func (c *clientContext) reqAddEmail(path, value string) error {
-	return c.reqAddRecipientByType(path, 1, value)
+	return c.reqAddRecipientByType(path, recipientTypeEmail, value)
 }
 
 func (c *clientContext) reqAddCallback(path, value string) error {
-	return c.reqAddRecipientByType(path, 2, value)
+	return c.reqAddRecipientByType(path, recipientTypeCallback, value)
 }
 
 func (c *clientContext) reqGetRecipientsByType(path string, rtype int) ([]string, error) {
+	values, err := c.reqGetStoredRecipientsByType(path, rtype)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.openRecipients(values), nil
+}
+
+// the recipients as stored, which may be encrypted
+func (c *clientContext) reqGetStoredRecipientsByType(path string, rtype int) ([]string, error) {
 	// open database
 	db, err := c.reqOpenDatabase(path)
 	if err != nil {
@@ -371,10 +291,35 @@ func (c *clientContext) reqGetRecipientsByType(path string, rtype int) ([]string
 	return values, nil
 }
 
+// removes a recipient, stored in any of the given forms, returning the number removed
+func (c *clientContext) reqRemoveRecipient(path string, rtype int, values []string) (int64, error) {
+	db, err := c.reqOpenDatabase(path)
+	if err != nil {
+		c.err("[SQL] failed to open requests database when removing recipient: [%s]", err.Error())
+		return 0, errors.New("failed to open requests database")
+	}
+	defer db.Close()
+
+	var removed int64
+
+	for _, value := range values {
+		res, err := db.Exec("delete from recipients where type = ? and value = ?;", rtype, value)
+		if err != nil {
+			c.err("[SQL] failed to remove recipient: [%s]", err.Error())
+			return removed, errors.New("failed to remove recipient")
+		}
+
+		n, _ := res.RowsAffected()
+		removed += n
+	}
+
+	return removed, nil
+}
+
 func (c *clientContext) reqGetEmails(path string) ([]string, error) {
-	return c.reqGetRecipientsByType(path, 1)
+	return c.reqGetRecipientsByType(path, recipientTypeEmail)
 }
 
 func (c *clientContext) reqGetCallbacks(path string) ([]string, error) {
-	return c.reqGetRecipientsByType(path, 2)
+	return c.reqGetRecipientsByType(path, recipientTypeCallback)
 }
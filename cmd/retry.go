@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// retries of failed jobs.  a failed job keeps the results of the pages that did succeed, so a retry
+// can be limited to the missing pages; the retry then assembles the full document from both jobs
+
+type retryError struct {
+	status int
+	msg    string
+}
+
+func (e retryError) Error() string {
+	return e.msg
+}
+
+/**
+ * Submit a new workflow for just the pages a failed job is missing, optionally with a different scale or engine
+ */
+func jobRetryHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+	c.respondRetry(true)
+}
+
+// validates the retry options in the current request and responds with the queued retry
+func (c *clientContext) respondRetry(missingOnly bool) {
+	scale := c.ctx.Query("scale")
+	if scale != "" {
+		if n, err := strconv.Atoi(scale); err != nil || n < 10 || n > 100 {
+			c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid scale (expected 10-100): [%s]", scale))
+			return
+		}
+	}
+
+	engine := c.ctx.Query("engine")
+	if engine != "" && lambdaEngineAllowed(engine) == false {
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid engine (expected one of: %s): [%s]", strings.Join(lambdaEnginesAllowed(), ", "), engine))
+		return
+	}
+
+	job, err := c.jobGet(c.ctx.Param("reqid"))
+	if err != nil {
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	jc, err := c.jobRetry(job, missingOnly, scale, engine)
+	if err != nil {
+		status := http.StatusInternalServerError
+
+		var rErr retryError
+		if errors.As(err, &rErr) {
+			status = rErr.status
+		}
+
+		c.respondString(status, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	status := make(map[string]interface{})
+
+	status["reqid"] = jc.ocr.reqID
+	status["retry_of"] = job.ReqID
+	status["pages"] = len(jc.ocr.ts.Pages)
+	status["scale"] = jc.req.scale
+	status["engine"] = jc.req.engine
+
+	c.respondJSON(http.StatusOK, status)
+}
+
+// the lambda functions a retry may use: the default and final-attempt functions, and any others configured
+func lambdaEnginesAllowed() []string {
+	var engines []string
+
+	for _, engine := range append([]string{config.awsLambdaFunction.value, config.lambdaFinalEngine.value}, strings.Split(config.lambdaEngines.value, ",")...) {
+		if engine = strings.TrimSpace(engine); engine != "" {
+			engines = appendStringIfMissing(engines, engine)
+		}
+	}
+
+	return engines
+}
+
+func lambdaEngineAllowed(engine string) bool {
+	for _, allowed := range lambdaEnginesAllowed() {
+		if engine == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// queues a new job repeating a failed or canceled one, returning the new job's context
+func (c *clientContext) jobRetry(job *jobInfo, missingOnly bool, scale, engine string) (*clientContext, error) {
+	if job.State != jobStateFailed && job.State != jobStateCanceled {
+		return nil, retryError{http.StatusConflict, fmt.Sprintf("Only failed or canceled jobs can be retried: [%s]", job.State)}
+	}
+
+	if active, _ := c.jobGetActiveForPid(job.Pid); active != nil {
+		return nil, retryError{http.StatusConflict, fmt.Sprintf("PID already has an active job: [%s]", active.ReqID)}
+	}
+
+	jc, err := newJobContext(job)
+	if err != nil {
+		return nil, err
+	}
+
+	if missingOnly == true {
+		completed, err := c.jobGetCompletedPages(job.ReqID)
+		if err != nil {
+			return nil, err
+		}
+
+		// pages completed by earlier retries are carried over too
+		completed = append(completed, c.jobGetRetriedPages(job.ReqID, completed)...)
+
+		done := make(map[string]bool)
+		for _, p := range completed {
+			done[p.pid] = true
+		}
+
+		var remaining []tsGenericPidInfo
+		for _, p := range jc.ocr.ts.Pages {
+			if done[p.Pid] == false {
+				remaining = append(remaining, p)
+			}
+		}
+
+		if len(remaining) == 0 {
+			return nil, retryError{http.StatusConflict, "Job has no failed pages"}
+		}
+
+		jc.ocr.ts.Pages = remaining
+	}
+
+	// the retry gets its own request id, and keeps a reference to the original
+	jc.reqID = c.reqID
+	jc.ip = c.ip
+	jc.ocr.reqID = randomID()
+	jc.req.retryOf = job.ReqID
+
+	if scale != "" {
+		jc.req.scale = scale
+	}
+
+	if engine != "" {
+		jc.req.engine = engine
+	}
+
+	if err := jc.queueOcr(); err != nil {
+		var lErr jobLockedError
+		if errors.As(err, &lErr) {
+			return nil, retryError{http.StatusConflict, fmt.Sprintf("PID already has an active job: [%s]", lErr.reqid)}
+		}
+
+		return nil, err
+	}
+
+	c.info("[RETRY] retrying job: [%s] as [%s] (%d pages  scale: [%s]  engine: [%s])", job.ReqID, jc.ocr.reqID, len(jc.ocr.ts.Pages), jc.req.scale, jc.req.engine)
+
+	c.audit(auditEntry{Action: auditOcrRequested, Pid: job.Pid, ReqID: jc.ocr.reqID, Details: fmt.Sprintf("retry_of=%s pages=%d scale=%s engine=%s outcome=queued", job.ReqID, len(jc.ocr.ts.Pages), jc.req.scale, jc.req.engine)})
+
+	return jc, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRetryEngineAllowed(t *testing.T) {
+	c := useJobStore(t)
+
+	config.awsLambdaFunction.value = "ocr-lambda"
+	config.lambdaFinalEngine.value = "ocr-lambda-final"
+	config.lambdaEngines.value = "ocr-lambda-alt, ocr-lambda-beta"
+
+	tests := []struct {
+		engine  string
+		allowed bool
+	}{
+		{"ocr-lambda", true},
+		{"ocr-lambda-final", true},
+		{"ocr-lambda-alt", true},
+		{"ocr-lambda-beta", true},
+		{"some-other-function", false},
+		{"arn:aws:lambda:us-east-1:123456789012:function:ocr-lambda-alt", false},
+	}
+
+	for _, tc := range tests {
+		if allowed := lambdaEngineAllowed(tc.engine); allowed != tc.allowed {
+			t.Errorf("expected [%s] allowed: %v, got %v", tc.engine, tc.allowed, allowed)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.POST("/jobs/:reqid/retry", jobRetryHandler)
+
+	c.jobCreate(&jobInfo{ReqID: "r1", Pid: "uva:1", Priority: jobPriorityPatron}, &tsPidInfo{})
+
+	// a function outside the allowlist is refused before the job is looked at
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest("POST", "/jobs/r1/retry?engine=some-other-function", nil))
+
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an unknown engine, got %d: %s", http.StatusBadRequest, res.Code, res.Body.String())
+	}
+
+	// an allowed one gets as far as the job's state
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest("POST", "/jobs/r1/retry?engine=ocr-lambda-alt", nil))
+
+	if res.Code != http.StatusConflict {
+		t.Errorf("expected %d for a queued job, got %d: %s", http.StatusConflict, res.Code, res.Body.String())
+	}
+}
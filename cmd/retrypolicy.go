@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// how the decider retries failed page lambdas: how long to wait, how many attempts each kind of
+// failure gets, and what to change about the lambda request for the next attempt
+
+type lambdaFailureType string
+
+const (
+	lambdaFailureError    lambdaFailureType = "error"
+	lambdaFailureTimeout  lambdaFailureType = "timeout"
+	lambdaFailureThrottle lambdaFailureType = "throttle"
+)
+
+var lambdaFailureTypes = []lambdaFailureType{lambdaFailureError, lambdaFailureTimeout, lambdaFailureThrottle}
+
+// error types/messages reported by lambda when it is throttled
+var lambdaThrottleMarkers = []string{"TooManyRequests", "Throttl", "Rate Exceeded", "rate exceeded"}
+
+type retryPolicy interface {
+	// whether a page whose latest attempt (of the given number) failed should be tried again, and if so, after how many seconds
+	retryAfter(attempts int, failure lambdaFailureType) (bool, int)
+
+	// adjusts the lambda request for the given attempt, returning the lambda function to use ("" for unchanged)
+	adjust(attempt int, failure lambdaFailureType, req *lambdaRequest) string
+}
+
+// per-failure-type handling
+type failureHandling struct {
+	attempts   int  // maximum attempts for a page whose latest failure was of this type
+	scale      bool // whether to retry with a reduced image scale
+	multiplier int  // backoff delay multiplier
+}
+
+const (
+	retryBackoffExponential = "exponential"
+	retryBackoffLinear      = "linear"
+	retryBackoffFixed       = "fixed"
+)
+
+const (
+	retryDefaultJitter    = 30
+	retryDefaultScaleStep = 10
+	retryMinScale         = 10
+)
+
+// the retry policy built from the service configuration
+type configRetryPolicy struct {
+	backoff     string                                // backoff curve
+	seconds     int                                   // backoff base/step/fixed delay
+	jitter      int                                   // maximum random seconds added to each delay
+	handling    map[lambdaFailureType]failureHandling // per failure type
+	scales      []int                                 // scale schedule for reduced-scale retries, descending
+	finalLang   string                                // language for the final attempt, if different
+	finalEngine string                                // lambda function for the final attempt, if different
+	random      func(int) int                         // source of jitter
+}
+
+var lambdaRetryPolicy retryPolicy
+
+func initRetryPolicy() {
+	policy, err := newConfigRetryPolicy()
+	if err != nil {
+		log.Fatalf("ERROR: [RETRY] invalid lambda retry settings: [%s]", err.Error())
+	}
+
+	lambdaRetryPolicy = policy
+}
+
+func newConfigRetryPolicy() (*configRetryPolicy, error) {
+	maxAttempts, _ := strconv.Atoi(config.lambdaAttempts.value)
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	p := configRetryPolicy{
+		backoff:     retryBackoffExponential,
+		seconds:     1,
+		jitter:      config.lambdaRetryJitter.value,
+		handling:    make(map[lambdaFailureType]failureHandling),
+		finalLang:   config.lambdaFinalLang.value,
+		finalEngine: config.lambdaFinalEngine.value,
+		random:      func(n int) int { return randpool.Intn(n) },
+	}
+
+	switch {
+	case p.jitter == 0:
+		p.jitter = retryDefaultJitter
+	case p.jitter < 0:
+		p.jitter = 0
+	}
+
+	if curve := strings.TrimSpace(config.lambdaRetryBackoff.value); curve != "" {
+		parts := strings.SplitN(curve, ":", 2)
+
+		p.backoff = parts[0]
+		if p.backoff != retryBackoffExponential && p.backoff != retryBackoffLinear && p.backoff != retryBackoffFixed {
+			return nil, fmt.Errorf("unknown backoff curve: [%s]", p.backoff)
+		}
+
+		if len(parts) == 2 {
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid backoff seconds: [%s]", parts[1])
+			}
+			p.seconds = n
+		}
+	}
+
+	// every failure type gets the configured attempts by default, and timeouts retry at a reduced scale
+	for _, f := range lambdaFailureTypes {
+		p.handling[f] = failureHandling{attempts: maxAttempts, scale: f == lambdaFailureTimeout, multiplier: 1}
+	}
+
+	for _, entry := range strings.Split(config.lambdaRetryFailures.value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		f, h, err := parseFailureHandling(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		p.handling[f] = h
+	}
+
+	for _, s := range strings.Split(config.lambdaRetryScales.value, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(s)
+		if err != nil || n < retryMinScale || n > 100 {
+			return nil, fmt.Errorf("invalid scale: [%s]", s)
+		}
+
+		if len(p.scales) > 0 && n >= p.scales[len(p.scales)-1] {
+			return nil, fmt.Errorf("scale schedule must be descending: [%s]", config.lambdaRetryScales.value)
+		}
+
+		p.scales = append(p.scales, n)
+	}
+
+	return &p, nil
+}
+
+// parses "type=attempts[/scale][/xN]", e.g. "throttle=8/x4" or "error=2/scale"
+func parseFailureHandling(entry string) (lambdaFailureType, failureHandling, error) {
+	h := failureHandling{multiplier: 1}
+
+	parts := strings.SplitN(entry, "=", 2)
+	if len(parts) != 2 {
+		return "", h, fmt.Errorf("invalid failure handling: [%s]", entry)
+	}
+
+	f := lambdaFailureType(strings.TrimSpace(parts[0]))
+
+	known := false
+	for _, t := range lambdaFailureTypes {
+		if f == t {
+			known = true
+		}
+	}
+
+	if known == false {
+		return "", h, fmt.Errorf("unknown failure type: [%s]", f)
+	}
+
+	opts := strings.Split(parts[1], "/")
+
+	n, err := strconv.Atoi(strings.TrimSpace(opts[0]))
+	if err != nil || n < 1 {
+		return "", h, fmt.Errorf("invalid attempts for %s: [%s]", f, opts[0])
+	}
+
+	h.attempts = n
+
+	for _, opt := range opts[1:] {
+		opt = strings.TrimSpace(opt)
+
+		switch {
+		case opt == "scale":
+			h.scale = true
+
+		case strings.HasPrefix(opt, "x"):
+			m, err := strconv.Atoi(opt[1:])
+			if err != nil || m < 1 {
+				return "", h, fmt.Errorf("invalid delay multiplier for %s: [%s]", f, opt)
+			}
+			h.multiplier = m
+
+		default:
+			return "", h, fmt.Errorf("unknown option for %s: [%s]", f, opt)
+		}
+	}
+
+	return f, h, nil
+}
+
+func (p *configRetryPolicy) retryAfter(attempts int, failure lambdaFailureType) (bool, int) {
+	h := p.handling[failure]
+
+	if attempts >= h.attempts {
+		return false, 0
+	}
+
+	var delay int
+
+	switch p.backoff {
+	case retryBackoffLinear:
+		delay = p.seconds * attempts
+	case retryBackoffFixed:
+		delay = p.seconds
+	default:
+		delay = p.seconds * int(math.Pow(2, float64(attempts)))
+	}
+
+	delay *= h.multiplier
+
+	if p.jitter > 0 {
+		delay += p.random(p.jitter)
+	}
+
+	return true, delay
+}
+
+func (p *configRetryPolicy) adjust(attempt int, failure lambdaFailureType, req *lambdaRequest) string {
+	h := p.handling[failure]
+
+	if h.scale == true {
+		req.Scale = strconv.Itoa(p.nextScale(req.Scale))
+	}
+
+	// the last chance for this page
+	if attempt >= h.attempts {
+		if p.finalLang != "" {
+			req.Lang = p.finalLang
+		}
+
+		return p.finalEngine
+	}
+
+	return ""
+}
+
+// the next scale down from the current one: the next entry in the schedule, if any, or else one step lower
+func (p *configRetryPolicy) nextScale(current string) int {
+	scale, err := strconv.Atoi(current)
+	if err != nil {
+		scale, _ = strconv.Atoi(lambdaDefaultScale)
+	}
+
+	if len(p.scales) == 0 {
+		return maxOf(retryMinScale, scale-retryDefaultScaleStep)
+	}
+
+	for _, s := range p.scales {
+		if s < scale {
+			return s
+		}
+	}
+
+	return p.scales[len(p.scales)-1]
+}
+
+// determines the kind of failure from a failed or timed out lambda event
+func lambdaFailureFromEvent(e *swf.HistoryEvent) lambdaFailureType {
+	switch *e.EventType {
+	case "LambdaFunctionTimedOut":
+		return lambdaFailureTimeout
+
+	case "LambdaFunctionFailed":
+		a := e.LambdaFunctionFailedEventAttributes
+
+		details := lambdaFailureDetails{}
+		if a.Details != nil {
+			json.Unmarshal([]byte(*a.Details), &details)
+		}
+
+		reason := ""
+		if a.Reason != nil {
+			reason = *a.Reason
+		}
+
+		for _, m := range lambdaThrottleMarkers {
+			if strings.Contains(details.ErrorType, m) || strings.Contains(details.ErrorMessage, m) || strings.Contains(reason, m) {
+				return lambdaFailureThrottle
+			}
+		}
+	}
+
+	return lambdaFailureError
+}
+
+// the failure a retry timer was started for; timers from before failure types were recorded only distinguish timeouts
+func (p controlPayload) failureType() lambdaFailureType {
+	switch {
+	case p.Failure != "":
+		return p.Failure
+	case p.LambdaTimedOut == true:
+		return lambdaFailureTimeout
+	}
+
+	return lambdaFailureError
+}
+
+// the retry to schedule for a page whose lambda failed, based on its scheduled event
+type retryPlan struct {
+	retry   bool
+	delay   int
+	attempt int               // attempts made so far
+	failure lambdaFailureType // the latest failure
+}
+
+func planLambdaRetry(policy retryPolicy, failedEvent, scheduledEvent *swf.HistoryEvent) (retryPlan, error) {
+	lambdaPayload := controlPayload{}
+
+	if err := json.Unmarshal([]byte(*scheduledEvent.LambdaFunctionScheduledEventAttributes.Control), &lambdaPayload); err != nil {
+		return retryPlan{}, errors.New("failed to decode lambda control")
+	}
+
+	plan := retryPlan{attempt: lambdaPayload.LambdaCount, failure: lambdaFailureFromEvent(failedEvent)}
+	plan.retry, plan.delay = policy.retryAfter(plan.attempt, plan.failure)
+
+	return plan, nil
+}
+
+// builds the input, control, and lambda function for rerunning a scheduled lambda after a retry timer fires
+func retryLambdaInput(policy retryPolicy, timerPayload controlPayload, scheduledEvent *swf.HistoryEvent, function string) (string, string, string, error) {
+	a := scheduledEvent.LambdaFunctionScheduledEventAttributes
+
+	lambdaPayload := controlPayload{}
+	if err := json.Unmarshal([]byte(*a.Control), &lambdaPayload); err != nil {
+		return "", "", "", errors.New("failed to decode lambda control")
+	}
+
+	req := lambdaRequest{}
+	if err := json.Unmarshal([]byte(*a.Input), &req); err != nil {
+		return "", "", "", errors.New("failed to decode lambda input")
+	}
+
+	lambdaPayload.LambdaCount++
+
+	lang := req.Lang
+
+	// overrides are recorded, so that results produced with other settings than the job's can be told apart
+	lambdaPayload.Lang = ""
+	lambdaPayload.Engine = ""
+
+	if alt := policy.adjust(lambdaPayload.LambdaCount, timerPayload.failureType(), &req); alt != "" {
+		function = alt
+		lambdaPayload.Engine = alt
+	}
+
+	if req.Lang != lang {
+		lambdaPayload.Lang = req.Lang
+	}
+
+	input, err := json.Marshal(req)
+	if err != nil {
+		return "", "", "", errors.New("failed to encode lambda input")
+	}
+
+	control, err := json.Marshal(lambdaPayload)
+	if err != nil {
+		return "", "", "", errors.New("failed to encode lambda control")
+	}
+
+	return string(input), string(control), function, nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+)
+
+// retry settings for a test case; unset fields keep their defaults
+type retrySettings struct {
+	attempts    string
+	backoff     string
+	failures    string
+	scales      string
+	finalLang   string
+	finalEngine string
+}
+
+func useRetrySettings(t *testing.T, s retrySettings) *configRetryPolicy {
+	t.Helper()
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config.lambdaAttempts.value = s.attempts
+	if config.lambdaAttempts.value == "" {
+		config.lambdaAttempts.value = "3"
+	}
+
+	config.lambdaRetryBackoff.value = s.backoff
+	config.lambdaRetryJitter.value = -1
+	config.lambdaRetryFailures.value = s.failures
+	config.lambdaRetryScales.value = s.scales
+	config.lambdaFinalLang.value = s.finalLang
+	config.lambdaFinalEngine.value = s.finalEngine
+
+	p, err := newConfigRetryPolicy()
+	if err != nil {
+		t.Fatalf("newConfigRetryPolicy() failed: %s", err.Error())
+	}
+
+	return p
+}
+
+// synthetic swf history events
+
+func scheduledEvent(id int64, req lambdaRequest, attempt int) *swf.HistoryEvent {
+	input, _ := json.Marshal(req)
+	control, _ := json.Marshal(controlPayload{Type: controlPayloadTypeLambdaData, Pids: []string{"next"}, LambdaCount: attempt})
+
+	return &swf.HistoryEvent{
+		EventId:   aws.Int64(id),
+		EventType: aws.String("LambdaFunctionScheduled"),
+		LambdaFunctionScheduledEventAttributes: &swf.LambdaFunctionScheduledEventAttributes{
+			Input:   aws.String(string(input)),
+			Control: aws.String(string(control)),
+		},
+	}
+}
+
+func failedEvent(id, scheduledID int64, reason string, details lambdaFailureDetails) *swf.HistoryEvent {
+	d, _ := json.Marshal(details)
+
+	return &swf.HistoryEvent{
+		EventId:   aws.Int64(id),
+		EventType: aws.String("LambdaFunctionFailed"),
+		LambdaFunctionFailedEventAttributes: &swf.LambdaFunctionFailedEventAttributes{
+			ScheduledEventId: aws.Int64(scheduledID),
+			Reason:           aws.String(reason),
+			Details:          aws.String(string(d)),
+		},
+	}
+}
+
+func timedOutEvent(id, scheduledID int64) *swf.HistoryEvent {
+	return &swf.HistoryEvent{
+		EventId:   aws.Int64(id),
+		EventType: aws.String("LambdaFunctionTimedOut"),
+		LambdaFunctionTimedOutEventAttributes: &swf.LambdaFunctionTimedOutEventAttributes{
+			ScheduledEventId: aws.Int64(scheduledID),
+			TimeoutType:      aws.String("START_TO_CLOSE"),
+		},
+	}
+}
+
+// returns the lambda scheduled event that a failure event refers to, as the decider does
+func failedLambda(history []*swf.HistoryEvent, failed *swf.HistoryEvent) *swf.HistoryEvent {
+	var id int64
+
+	switch *failed.EventType {
+	case "LambdaFunctionFailed":
+		id = *failed.LambdaFunctionFailedEventAttributes.ScheduledEventId
+	case "LambdaFunctionTimedOut":
+		id = *failed.LambdaFunctionTimedOutEventAttributes.ScheduledEventId
+	}
+
+	return awsEventWithID(history, id)
+}
+
+func TestPlanLambdaRetry(t *testing.T) {
+	page := lambdaRequest{Pid: "page1", Scale: "100", Lang: "eng"}
+
+	throttled := lambdaFailureDetails{ErrorType: "TooManyRequestsException", ErrorMessage: "Rate Exceeded."}
+	crashed := lambdaFailureDetails{ErrorType: "Runtime.ExitError", ErrorMessage: "signal: killed"}
+
+	tests := []struct {
+		name     string
+		settings retrySettings
+		history  []*swf.HistoryEvent
+		retry    bool
+		delay    int
+		failure  lambdaFailureType
+	}{
+		{
+			name:    "first error retries with exponential backoff",
+			history: []*swf.HistoryEvent{scheduledEvent(5, page, 1), failedEvent(6, 5, "UnhandledError", crashed)},
+			retry:   true,
+			delay:   2,
+			failure: lambdaFailureError,
+		},
+		{
+			name:    "second timeout retries with doubled delay",
+			history: []*swf.HistoryEvent{scheduledEvent(5, page, 2), timedOutEvent(6, 5)},
+			retry:   true,
+			delay:   4,
+			failure: lambdaFailureTimeout,
+		},
+		{
+			name:    "attempts exhausted",
+			history: []*swf.HistoryEvent{scheduledEvent(5, page, 3), failedEvent(6, 5, "UnhandledError", crashed)},
+			retry:   false,
+			failure: lambdaFailureError,
+		},
+		{
+			name:     "throttling gets its own attempts and delay multiplier",
+			settings: retrySettings{failures: "throttle=8/x4"},
+			history:  []*swf.HistoryEvent{scheduledEvent(5, page, 3), failedEvent(6, 5, "UnhandledError", throttled)},
+			retry:    true,
+			delay:    32,
+			failure:  lambdaFailureThrottle,
+		},
+		{
+			name:     "throttling detected from reason alone",
+			settings: retrySettings{failures: "throttle=8"},
+			history:  []*swf.HistoryEvent{scheduledEvent(5, page, 3), failedEvent(6, 5, "Lambda.TooManyRequestsException", lambdaFailureDetails{})},
+			retry:    true,
+			delay:    8,
+			failure:  lambdaFailureThrottle,
+		},
+		{
+			name:     "errors limited separately from timeouts",
+			settings: retrySettings{failures: "error=1,timeout=5/scale"},
+			history:  []*swf.HistoryEvent{scheduledEvent(5, page, 1), failedEvent(6, 5, "UnhandledError", crashed)},
+			retry:    false,
+			failure:  lambdaFailureError,
+		},
+		{
+			name:     "timeouts allowed more attempts",
+			settings: retrySettings{failures: "error=1,timeout=5/scale"},
+			history:  []*swf.HistoryEvent{scheduledEvent(5, page, 4), timedOutEvent(6, 5)},
+			retry:    true,
+			delay:    16,
+			failure:  lambdaFailureTimeout,
+		},
+		{
+			name:     "linear backoff",
+			settings: retrySettings{backoff: "linear:10"},
+			history:  []*swf.HistoryEvent{scheduledEvent(5, page, 2), timedOutEvent(6, 5)},
+			retry:    true,
+			delay:    20,
+			failure:  lambdaFailureTimeout,
+		},
+		{
+			name:     "fixed backoff",
+			settings: retrySettings{backoff: "fixed:45"},
+			history:  []*swf.HistoryEvent{scheduledEvent(5, page, 2), failedEvent(6, 5, "UnhandledError", crashed)},
+			retry:    true,
+			delay:    45,
+			failure:  lambdaFailureError,
+		},
+		{
+			name:     "exponential backoff with base",
+			settings: retrySettings{backoff: "exponential:3"},
+			history:  []*swf.HistoryEvent{scheduledEvent(5, page, 2), failedEvent(6, 5, "UnhandledError", crashed)},
+			retry:    true,
+			delay:    12,
+			failure:  lambdaFailureError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := useRetrySettings(t, tt.settings)
+
+			failed := tt.history[len(tt.history)-1]
+
+			plan, err := planLambdaRetry(p, failed, failedLambda(tt.history, failed))
+			if err != nil {
+				t.Fatalf("planLambdaRetry() failed: %s", err.Error())
+			}
+
+			if plan.failure != tt.failure {
+				t.Errorf("failure = %s, want %s", plan.failure, tt.failure)
+			}
+
+			if plan.retry != tt.retry {
+				t.Fatalf("retry = %v, want %v", plan.retry, tt.retry)
+			}
+
+			if plan.retry == true && plan.delay != tt.delay {
+				t.Errorf("delay = %d, want %d", plan.delay, tt.delay)
+			}
+		})
+	}
+}
+
+func TestRetryLambdaInput(t *testing.T) {
+	const defaultFunction = "ocr-lambda"
+
+	tests := []struct {
+		name      string
+		settings  retrySettings
+		scale     string
+		attempt   int
+		timer     controlPayload
+		wantScale string
+		wantLang  string
+		wantFunc  string
+	}{
+		{
+			name:      "timeout reduces scale by a step",
+			scale:     "100",
+			attempt:   1,
+			timer:     controlPayload{Failure: lambdaFailureTimeout},
+			wantScale: "90",
+		},
+		{
+			name:      "scale does not go below the floor",
+			scale:     "10",
+			attempt:   1,
+			timer:     controlPayload{Failure: lambdaFailureTimeout},
+			wantScale: "10",
+		},
+		{
+			name:      "error keeps scale",
+			scale:     "100",
+			attempt:   1,
+			timer:     controlPayload{Failure: lambdaFailureError},
+			wantScale: "100",
+		},
+		{
+			name:      "timer from before failure types were recorded",
+			scale:     "80",
+			attempt:   1,
+			timer:     controlPayload{LambdaTimedOut: true},
+			wantScale: "70",
+		},
+		{
+			name:      "scale schedule",
+			settings:  retrySettings{scales: "75,50,25"},
+			scale:     "100",
+			attempt:   1,
+			timer:     controlPayload{Failure: lambdaFailureTimeout},
+			wantScale: "75",
+		},
+		{
+			name:      "scale schedule continues from current scale",
+			settings:  retrySettings{scales: "75,50,25"},
+			scale:     "50",
+			attempt:   1,
+			timer:     controlPayload{Failure: lambdaFailureTimeout},
+			wantScale: "25",
+		},
+		{
+			name:      "scale schedule stops at its last entry",
+			settings:  retrySettings{scales: "75,50,25", attempts: "10"},
+			scale:     "25",
+			attempt:   4,
+			timer:     controlPayload{Failure: lambdaFailureTimeout},
+			wantScale: "25",
+		},
+		{
+			name:      "errors can be scaled too",
+			settings:  retrySettings{failures: "error=3/scale"},
+			scale:     "100",
+			attempt:   1,
+			timer:     controlPayload{Failure: lambdaFailureError},
+			wantScale: "90",
+		},
+		{
+			name:      "final attempt switches language and engine",
+			settings:  retrySettings{finalLang: "eng+lat", finalEngine: "ocr-lambda-alt"},
+			scale:     "100",
+			attempt:   2,
+			timer:     controlPayload{Failure: lambdaFailureError},
+			wantScale: "100",
+			wantLang:  "eng+lat",
+			wantFunc:  "ocr-lambda-alt",
+		},
+		{
+			name:      "earlier attempts keep language and engine",
+			settings:  retrySettings{finalLang: "eng+lat", finalEngine: "ocr-lambda-alt"},
+			scale:     "100",
+			attempt:   1,
+			timer:     controlPayload{Failure: lambdaFailureError},
+			wantScale: "100",
+		},
+		{
+			name:      "final attempt depends on the failure type",
+			settings:  retrySettings{failures: "throttle=8", finalEngine: "ocr-lambda-alt"},
+			scale:     "100",
+			attempt:   2,
+			timer:     controlPayload{Failure: lambdaFailureThrottle},
+			wantScale: "100",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := useRetrySettings(t, tt.settings)
+
+			scheduled := scheduledEvent(5, lambdaRequest{Pid: "page1", Scale: tt.scale, Lang: "eng"}, tt.attempt)
+
+			input, control, function, err := retryLambdaInput(p, tt.timer, scheduled, defaultFunction)
+			if err != nil {
+				t.Fatalf("retryLambdaInput() failed: %s", err.Error())
+			}
+
+			req := lambdaRequest{}
+			if err := json.Unmarshal([]byte(input), &req); err != nil {
+				t.Fatalf("bad input: %s", err.Error())
+			}
+
+			payload := controlPayload{}
+			if err := json.Unmarshal([]byte(control), &payload); err != nil {
+				t.Fatalf("bad control: %s", err.Error())
+			}
+
+			wantLang := tt.wantLang
+			if wantLang == "" {
+				wantLang = "eng"
+			}
+
+			wantFunc := tt.wantFunc
+			if wantFunc == "" {
+				wantFunc = defaultFunction
+			}
+
+			if req.Scale != tt.wantScale {
+				t.Errorf("scale = %s, want %s", req.Scale, tt.wantScale)
+			}
+
+			if req.Lang != wantLang {
+				t.Errorf("lang = %s, want %s", req.Lang, wantLang)
+			}
+
+			if function != wantFunc {
+				t.Errorf("function = %s, want %s", function, wantFunc)
+			}
+
+			if req.Pid != "page1" || len(payload.Pids) != 1 || payload.Pids[0] != "next" {
+				t.Errorf("page or queue not carried over: %+v / %+v", req, payload)
+			}
+
+			if payload.LambdaCount != tt.attempt+1 {
+				t.Errorf("attempt = %d, want %d", payload.LambdaCount, tt.attempt+1)
+			}
+
+			// overrides are recorded in the control
+			if payload.Lang != tt.wantLang || payload.Engine != tt.wantFunc {
+				t.Errorf("control overrides = [%s] [%s], want [%s] [%s]", payload.Lang, payload.Engine, tt.wantLang, tt.wantFunc)
+			}
+		})
+	}
+}
+
+func TestRetrySettingsValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings retrySettings
+	}{
+		{"unknown backoff curve", retrySettings{backoff: "fibonacci"}},
+		{"bad backoff seconds", retrySettings{backoff: "fixed:soon"}},
+		{"unknown failure type", retrySettings{failures: "crash=3"}},
+		{"bad attempts", retrySettings{failures: "error=0"}},
+		{"unknown failure option", retrySettings{failures: "error=3/faster"}},
+		{"bad multiplier", retrySettings{failures: "throttle=3/x0"}},
+		{"scale out of range", retrySettings{scales: "50,5"}},
+		{"scale schedule not descending", retrySettings{scales: "50,75"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := config
+			t.Cleanup(func() { config = saved })
+
+			config.lambdaAttempts.value = "3"
+			config.lambdaRetryBackoff.value = tt.settings.backoff
+			config.lambdaRetryFailures.value = tt.settings.failures
+			config.lambdaRetryScales.value = tt.settings.scales
+
+			if _, err := newConfigRetryPolicy(); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// review of ocr results before they are posted to tracksys.  results from dry runs (and low
+// quality results, when configured) are held until staff approve or reject them, in whole or by page.
+
+// review states, for both jobs and pages
+const (
+	reviewPending  = "pending"
+	reviewApproved = "approved"
+	reviewRejected = "rejected"
+	reviewPartial  = "partial" // jobs only: some pages approved, others rejected
+)
+
+type reviewPage struct {
+	Pid     string `json:"pid"`
+	Review  string `json:"review,omitempty"`
+	Posted  bool   `json:"posted"`
+	Changed bool   `json:"changed"`
+	Diff    string `json:"diff,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func isDryRun(dryrun string) bool {
+	b, err := strconv.ParseBool(dryrun)
+	return err == nil && b == true
+}
+
+// reports whether the request carries the staff api key as a bearer token.  it is not accepted in the url,
+// where it would end up in access logs and browser history
+func staffKeyValid(ctx *gin.Context) bool {
+	if config.staffAPIKey.value == "" {
+		return false
+	}
+
+	auth := ctx.GetHeader("Authorization")
+	key := strings.TrimPrefix(auth, "Bearer ")
+
+	return key != auth && subtle.ConstantTimeCompare([]byte(key), []byte(config.staffAPIKey.value)) == 1
+}
+
+func staffAuthHandler(ctx *gin.Context) {
+	if config.staffAPIKey.value == "" {
+		ctx.String(http.StatusForbidden, "ERROR: Staff endpoints are not enabled")
+		ctx.Abort()
+		return
+	}
+
+	if staffKeyValid(ctx) == false {
+		ctx.String(http.StatusUnauthorized, "ERROR: Invalid or missing staff key")
+		ctx.Abort()
+		return
+	}
+
+	// the key is shared, so staff name themselves for the audit log
+	ctx.Set(staffUserKey, strings.TrimSpace(ctx.GetHeader("X-Staff-User")))
+}
+
+// returns the pages of a job that have results, optionally limited to a single page
+func (c *clientContext) reviewPages(reqid, pid string) ([]ocrPidInfo, error) {
+	pages, err := c.jobGetPages(reqid)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ocrPidInfo
+
+	for _, p := range pages {
+		if p.attempts == 0 && p.cached == false {
+			continue
+		}
+
+		if pid != "" && p.pid != pid {
+			continue
+		}
+
+		results = append(results, p)
+	}
+
+	return results, nil
+}
+
+/**
+ * Show what the ocr results of a job would change in tracksys
+ */
+func jobDiffHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	job, err := c.jobGet(ctx.Param("reqid"))
+	if err != nil {
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	pages, err := c.reviewPages(job.ReqID, ctx.Query("pid"))
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	if len(pages) == 0 {
+		c.respondString(http.StatusNotFound, "ERROR: No page results found")
+		return
+	}
+
+	var diffs []reviewPage
+
+	changed := 0
+
+	for _, p := range pages {
+		rp := reviewPage{Pid: p.pid, Review: p.review, Posted: p.posted}
+
+		current, txtErr := c.tsGetText(p.pid)
+		if txtErr != nil {
+			c.err("[%s] tsGetText() error: [%s]", p.pid, txtErr.Error())
+			rp.Error = txtErr.Error()
+			diffs = append(diffs, rp)
+			continue
+		}
+
+		c.versionRecordFetched(p.pid, current, job.ReqID)
+
+		rp.Diff = unifiedDiff("tracksys/"+p.pid, "ocr/"+p.pid, current, cleanOcrText(p.text))
+		rp.Changed = rp.Diff != ""
+
+		if rp.Changed == true {
+			changed++
+		}
+
+		diffs = append(diffs, rp)
+	}
+
+	status := make(map[string]interface{})
+
+	status["reqid"] = job.ReqID
+	status["pid"] = job.Pid
+	status["review"] = job.Review
+	status["pages_changed"] = changed
+	status["pages"] = diffs
+
+	c.respondJSON(http.StatusOK, status)
+}
+
+/**
+ * Approve held ocr results (all pending pages, or a single page), posting them to tracksys
+ */
+func jobApproveHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+	c.jobReview(reviewApproved)
+}
+
+/**
+ * Reject held ocr results (all pending pages, or a single page), leaving tracksys unchanged
+ */
+func jobRejectHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+	c.jobReview(reviewRejected)
+}
+
+func (c *clientContext) jobReview(decision string) {
+	job, err := c.jobGet(c.ctx.Param("reqid"))
+	if err != nil {
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	if job.Review == "" {
+		c.respondString(http.StatusConflict, "ERROR: Job is not held for review")
+		return
+	}
+
+	pid := c.ctx.Query("pid")
+
+	pages, err := c.reviewPages(job.ReqID, pid)
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	var pending []ocrPidInfo
+	for _, p := range pages {
+		if p.review == reviewPending {
+			pending = append(pending, p)
+		}
+	}
+
+	if len(pending) == 0 {
+		c.respondString(http.StatusConflict, "ERROR: No pages awaiting review")
+		return
+	}
+
+	if decision == reviewApproved && config.tsReadOnly.value == true {
+		c.info("[%s] SKIPPING TRACKSYS POST", job.Pid)
+	}
+
+	var results []reviewPage
+	var approved []ocrPidInfo
+	var rejected []ocrPidInfo
+
+	for _, p := range pending {
+		rp := reviewPage{Pid: p.pid, Review: decision}
+
+		if decision == reviewApproved && config.tsReadOnly.value == false {
+			var id int64
+			if v, err := c.versionGetForJob(p.pid, job.ReqID); err == nil {
+				id = v.ID
+			}
+
+			if err := c.versionPost(p.pid, id, p.text); err != nil {
+				c.err("[%s] Tracksys OCR posting failed: [%s]", p.pid, err.Error())
+				rp.Review = reviewPending
+				rp.Error = err.Error()
+				results = append(results, rp)
+				continue
+			}
+
+			rp.Posted = true
+		}
+
+		c.jobUpdatePageReview(job.ReqID, p.pid, rp.Review, rp.Posted)
+
+		switch rp.Review {
+		case reviewApproved:
+			approved = append(approved, p)
+		case reviewRejected:
+			rejected = append(rejected, p)
+		}
+
+		results = append(results, rp)
+	}
+
+	if len(approved) > 0 {
+		c.searchIndexResults(job.ReqID, approved)
+	}
+
+	if len(rejected) > 0 {
+		c.cacheEvictResults(job.ReqID, rejected)
+	}
+
+	review, err := c.jobUpdateReviewState(job.ReqID)
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	c.info("[%s] %d page(s) %s; job review is now: [%s]", job.Pid, len(pending), decision, review)
+
+	status := make(map[string]interface{})
+
+	status["reqid"] = job.ReqID
+	status["review"] = review
+	status["pages"] = results
+
+	c.respondJSON(http.StatusOK, status)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// a tracksys api serving the given page texts, and recording what is posted
+func useReviewTracksys(t *testing.T, texts map[string]string) map[string]string {
+	t.Helper()
+
+	var mu sync.Mutex
+	posted := make(map[string]string)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/pid/"), "/")
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case r.Method == "GET" && len(parts) == 2 && parts[1] == "text":
+			w.Write([]byte(texts[parts[0]]))
+		case r.Method == "POST" && len(parts) == 2 && parts[1] == "ocr":
+			r.ParseForm()
+			posted[parts[0]] = r.PostForm.Get("text")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	savedClient := client
+	t.Cleanup(func() { client = savedClient })
+
+	client = ts.Client()
+	config.tsAPIHost.value = ts.URL
+	config.tsReadOnly.value = false
+
+	return posted
+}
+
+// a finished job with ocr results for two pages, cached and held for review
+func createReviewJob(t *testing.T, c *clientContext) {
+	t.Helper()
+
+	c.jobCreate(&jobInfo{ReqID: "r1", Pid: "uva:1", Priority: jobPriorityPatron, DryRun: "true"}, &tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}})
+
+	c.jobSavePageCacheKey("r1", "uva:2", imageSourceArchive, "md5-2", cacheKey("md5-2", "eng", "ocr-lambda", "100"))
+	c.jobSavePageCacheKey("r1", "uva:3", imageSourceArchive, "md5-3", cacheKey("md5-3", "eng", "ocr-lambda", "100"))
+
+	pages := []ocrPidInfo{
+		{pid: "uva:2", attempts: 1, text: "new page two"},
+		{pid: "uva:3", attempts: 1, text: "new page three"},
+	}
+
+	c.jobSavePages("r1", pages)
+	c.cacheStoreResults("r1", pages)
+
+	finishTestJob(c, "r1", jobStateComplete)
+	c.jobHoldForReview("r1")
+}
+
+func reviewRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/jobs/:reqid/diff", jobDiffHandler)
+	router.POST("/jobs/:reqid/approve", jobApproveHandler)
+	router.POST("/jobs/:reqid/reject", jobRejectHandler)
+
+	return router
+}
+
+func TestJobDiff(t *testing.T) {
+	c := useJobStore(t)
+
+	useReviewTracksys(t, map[string]string{"uva:2": "old page two", "uva:3": "new page three"})
+
+	config.resultCache.value = true
+
+	createReviewJob(t, c)
+
+	res := httptest.NewRecorder()
+	reviewRouter().ServeHTTP(res, httptest.NewRequest("GET", "/jobs/r1/diff", nil))
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+
+	var status struct {
+		Review       string       `json:"review"`
+		PagesChanged int          `json:"pages_changed"`
+		Pages        []reviewPage `json:"pages"`
+	}
+
+	json.Unmarshal(res.Body.Bytes(), &status)
+
+	if status.Review != reviewPending || status.PagesChanged != 1 || len(status.Pages) != 2 {
+		t.Fatalf("unexpected diff: %s", res.Body.String())
+	}
+
+	if p := status.Pages[0]; p.Changed == false || strings.Contains(p.Diff, "-old page two") == false || strings.Contains(p.Diff, "+new page two") == false {
+		t.Errorf("expected a diff for [uva:2], got %+v", p)
+	}
+
+	if p := status.Pages[1]; p.Changed == true || p.Diff != "" {
+		t.Errorf("expected no diff for [uva:3], got %+v", p)
+	}
+
+	// a single page
+	res = httptest.NewRecorder()
+	reviewRouter().ServeHTTP(res, httptest.NewRequest("GET", "/jobs/r1/diff?pid=uva:3", nil))
+
+	json.Unmarshal(res.Body.Bytes(), &status)
+
+	if res.Code != http.StatusOK || len(status.Pages) != 1 || status.Pages[0].Pid != "uva:3" {
+		t.Errorf("expected only [uva:3], got %d: %s", res.Code, res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	reviewRouter().ServeHTTP(res, httptest.NewRequest("GET", "/jobs/r1/diff?pid=uva:9", nil))
+
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected %d for a page without results, got %d", http.StatusNotFound, res.Code)
+	}
+}
+
+func TestJobReview(t *testing.T) {
+	c := useJobStore(t)
+
+	posted := useReviewTracksys(t, map[string]string{"uva:2": "old page two", "uva:3": "old page three"})
+
+	config.resultCache.value = true
+
+	createReviewJob(t, c)
+
+	review := func(action, query string, code int, expected string) {
+		t.Helper()
+
+		res := httptest.NewRecorder()
+		reviewRouter().ServeHTTP(res, httptest.NewRequest("POST", "/jobs/r1/"+action+query, nil))
+
+		if res.Code != code {
+			t.Fatalf("expected %d from %s%s, got %d: %s", code, action, query, res.Code, res.Body.String())
+		}
+
+		if job, _ := c.jobGet("r1"); job.Review != expected {
+			t.Errorf("expected job review [%s] after %s%s, got [%s]", expected, action, query, job.Review)
+		}
+	}
+
+	// rejecting a page leaves tracksys alone, and drops its text from the cache
+	review("reject", "?pid=uva:3", http.StatusOK, reviewPending)
+
+	if _, ok := posted["uva:3"]; ok == true {
+		t.Errorf("expected nothing posted for a rejected page")
+	}
+
+	if hit, _ := c.cacheGet(cacheKey("md5-3", "eng", "ocr-lambda", "100")); hit != nil {
+		t.Errorf("expected the rejected page's result to be evicted, got [%s]", hit.text)
+	}
+
+	// approving posts the rest, which stay cached
+	review("approve", "", http.StatusOK, reviewPartial)
+
+	if posted["uva:2"] != "new page two" {
+		t.Errorf("expected [uva:2]'s text to be posted, got [%s]", posted["uva:2"])
+	}
+
+	if hit, _ := c.cacheGet(cacheKey("md5-2", "eng", "ocr-lambda", "100")); hit == nil || hit.text != "new page two" {
+		t.Errorf("expected the approved page's result to stay cached, got %+v", hit)
+	}
+
+	// nothing is left to review
+	review("reject", "", http.StatusConflict, reviewPartial)
+}
+
+func TestJobRejectKeepsNewerCache(t *testing.T) {
+	c := useJobStore(t)
+
+	useReviewTracksys(t, nil)
+
+	config.resultCache.value = true
+
+	createReviewJob(t, c)
+
+	// a later job replaced the entry with its own result
+	key := cacheKey("md5-2", "eng", "ocr-lambda", "100")
+	jobDB.Exec("update ocr_cache set text = ? where key = ?;", "later page two", key)
+
+	res := httptest.NewRecorder()
+	reviewRouter().ServeHTTP(res, httptest.NewRequest("POST", "/jobs/r1/reject", nil))
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	}
+
+	if hit, _ := c.cacheGet(key); hit == nil || hit.text != "later page two" {
+		t.Errorf("expected another job's result to stay cached, got %+v", hit)
+	}
+
+	if job, _ := c.jobGet("r1"); job.Review != reviewRejected {
+		t.Errorf("expected the job to be rejected, got [%s]", job.Review)
+	}
+}
+
+func TestStaffAuthHandler(t *testing.T) {
+	useJobStore(t)
+
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/staff", staffAuthHandler, func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+
+	tests := []struct {
+		name   string
+		key    string // configured key
+		query  string
+		header string
+		code   int
+	}{
+		{"bearer token", "secret", "", "Bearer secret", http.StatusOK},
+		{"wrong token", "secret", "", "Bearer other", http.StatusUnauthorized},
+		{"no token", "secret", "", "", http.StatusUnauthorized},
+		{"key in the query string", "secret", "?key=secret", "", http.StatusUnauthorized},
+		{"key without a scheme", "secret", "", "secret", http.StatusUnauthorized},
+		{"empty token", "secret", "", "Bearer ", http.StatusUnauthorized},
+		{"no key configured", "", "", "Bearer ", http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config.staffAPIKey.value = tc.key
+
+			req := httptest.NewRequest("GET", "/staff"+tc.query, nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+
+			if res.Code != tc.code {
+				t.Errorf("expected %d, got %d", tc.code, res.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// a full-text index of the page text the service has produced or fetched, so staff can find which
+// items mention something without going through virgo.  page text lives in an fts4 table in the
+// job store, keyed by the page's row in search_pages; item metadata used for filtering lives in
+// search_items.
+
+const (
+	searchDefaultLimit = 100
+	searchMaxLimit     = 1000
+	searchSnippetWords = 10
+	searchMarkStart    = "**"
+	searchMarkEnd      = "**"
+)
+
+type searchPageHit struct {
+	Page     string `json:"page"`
+	Position int    `json:"position"` // 1-based position of the page within its item
+	Hits     int    `json:"hits"`
+	Snippet  string `json:"snippet"`
+}
+
+type searchItemHit struct {
+	Pid        string          `json:"pid"`
+	Title      string          `json:"title,omitempty"`
+	CatalogKey string          `json:"catalog_key,omitempty"`
+	CallNumber string          `json:"call_number,omitempty"`
+	Lang       string          `json:"lang,omitempty"`
+	Hits       int             `json:"hits"`
+	Pages      []searchPageHit `json:"pages"`
+}
+
+type searchResults struct {
+	Query     string          `json:"query"`
+	Items     []searchItemHit `json:"items"`
+	Pages     int             `json:"pages"`
+	Truncated bool            `json:"truncated"` // more pages matched than the limit
+}
+
+type searchFilter struct {
+	query      string
+	catalogKey string
+	callNumber string
+	lang       string
+	limit      int
+}
+
+// returned for queries the index cannot parse, as opposed to the index failing
+type searchQueryError struct {
+	msg string
+}
+
+func (e searchQueryError) Error() string {
+	return e.msg
+}
+
+// adds or replaces the text of an item's pages, along with the item's metadata.  failed pages have
+// no text, and are left as they are
+func (c *clientContext) searchIndexItem(ts *tsPidInfo, lang string, pages []ocrPidInfo) error {
+	positions := make(map[string]int)
+	for i, p := range ts.Pages {
+		positions[p.Pid] = i + 1
+	}
+
+	tx, err := jobDB.Begin()
+	if err != nil {
+		c.err("[SEARCH] failed to begin index transaction: [%s]", err.Error())
+		return errors.New("failed to begin index transaction")
+	}
+	defer tx.Rollback()
+
+	item := "insert into search_items (pid, title, catalog_key, call_number, lang, updated) values (?, ?, ?, ?, ?, ?) on conflict (pid) do update set title = excluded.title, catalog_key = excluded.catalog_key, call_number = excluded.call_number, lang = excluded.lang, updated = excluded.updated;"
+	if _, err := tx.Exec(item, ts.Pid.Pid, ts.Pid.Title, ts.Pid.CatalogKey, ts.Pid.CallNumber, lang, fmt.Sprintf("%d", time.Now().Unix())); err != nil {
+		c.err("[SEARCH] failed to index item: [%s]", err.Error())
+		return errors.New("failed to index item")
+	}
+
+	indexed := 0
+
+	for _, p := range pages {
+		if p.failed == true {
+			continue
+		}
+
+		page := "insert into search_pages (page, pid, position) values (?, ?, ?) on conflict (page) do update set pid = excluded.pid, position = excluded.position;"
+		if _, err := tx.Exec(page, p.pid, ts.Pid.Pid, positions[p.pid]); err != nil {
+			c.err("[SEARCH] failed to index page: [%s]", err.Error())
+			return errors.New("failed to index page")
+		}
+
+		var id int64
+		if err := tx.QueryRow("select id from search_pages where page = ?;", p.pid).Scan(&id); err != nil {
+			c.err("[SEARCH] failed to retrieve indexed page: [%s]", err.Error())
+			return errors.New("failed to retrieve indexed page")
+		}
+
+		if err := searchReplaceText(tx, id, p.text); err != nil {
+			c.err("[SEARCH] failed to index page text: [%s]", err.Error())
+			return errors.New("failed to index page text")
+		}
+
+		indexed++
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.err("[SEARCH] failed to commit index transaction: [%s]", err.Error())
+		return errors.New("failed to commit index transaction")
+	}
+
+	c.info("[SEARCH] indexed %d page(s) of [%s]", indexed, ts.Pid.Pid)
+
+	return nil
+}
+
+// replaces the text indexed for a page; fts tables are updated by deleting and reinserting
+func searchReplaceText(db interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, id int64, text string) error {
+	if _, err := db.Exec("delete from search_text where docid = ?;", id); err != nil {
+		return err
+	}
+
+	_, err := db.Exec("insert into search_text (docid, text) values (?, ?);", id, cleanOcrText(text))
+
+	return err
+}
+
+// indexes a job's pages, with the item's metadata as the job saw it.  requests answered from
+// existing text have no job, and use the request's own metadata
+func (c *clientContext) searchIndexResults(reqid string, pages []ocrPidInfo) {
+	ts := c.ocr.ts
+	lang := ""
+
+	if job, err := c.jobGet(reqid); err == nil {
+		if jc, err := newJobContext(job); err == nil {
+			ts = jc.ocr.ts
+		}
+
+		_, lang = c.versionSettings(reqid)
+	}
+
+	if ts == nil {
+		c.warn("[SEARCH] no item metadata for [%s]; not indexing", reqid)
+		return
+	}
+
+	if lang == "" {
+		lang = ts.Pid.OcrLanguageHint
+	}
+
+	c.searchIndexItem(ts, lang, pages)
+}
+
+// replaces the indexed text of a page, if its item has been indexed
+func (c *clientContext) searchUpdatePage(pid, text string) error {
+	var id int64
+	if err := jobDB.QueryRow("select id from search_pages where page = ?;", pid).Scan(&id); err != nil {
+		return nil
+	}
+
+	if err := searchReplaceText(jobDB, id, text); err != nil {
+		c.err("[SEARCH] failed to update page text: [%s]", err.Error())
+		return errors.New("failed to update page text")
+	}
+
+	return nil
+}
+
+// the number of matches on a page, from fts offsets(): four numbers per match
+func searchHitCount(offsets string) int {
+	return len(strings.Fields(offsets)) / 4
+}
+
+func (c *clientContext) searchQuery(f searchFilter) (*searchResults, error) {
+	query := `select p.pid, p.page, p.position, i.title, i.catalog_key, i.call_number, i.lang,
+		offsets(search_text), snippet(search_text, ?, ?, '...', -1, ?)
+		from search_text join search_pages p on p.id = search_text.docid join search_items i on i.pid = p.pid
+		where search_text match ? and (? = '' or i.catalog_key = ?) and (? = '' or i.call_number = ?) and (? = '' or i.lang = ?)
+		order by p.pid, p.position, p.page limit ?;`
+
+	// one more than the limit shows whether there are more
+	rows, err := jobDB.Query(query, searchMarkStart, searchMarkEnd, searchSnippetWords, f.query, f.catalogKey, f.catalogKey, f.callNumber, f.callNumber, f.lang, f.lang, f.limit+1)
+	if err != nil {
+		if strings.Contains(err.Error(), "MATCH") {
+			return nil, searchQueryError{fmt.Sprintf("invalid query: [%s]", f.query)}
+		}
+
+		c.err("[SEARCH] failed to search: [%s]", err.Error())
+		return nil, errors.New("failed to search")
+	}
+	defer rows.Close()
+
+	res := searchResults{Query: f.query, Items: []searchItemHit{}}
+
+	for rows.Next() {
+		var item searchItemHit
+		var page searchPageHit
+		var offsets string
+
+		if err := rows.Scan(&item.Pid, &page.Page, &page.Position, &item.Title, &item.CatalogKey, &item.CallNumber, &item.Lang, &offsets, &page.Snippet); err != nil {
+			c.err("[SEARCH] failed to scan search result: [%s]", err.Error())
+			return nil, errors.New("failed to scan search result")
+		}
+
+		if res.Pages == f.limit {
+			res.Truncated = true
+			break
+		}
+
+		page.Hits = searchHitCount(offsets)
+		page.Snippet = strings.Join(strings.Fields(page.Snippet), " ")
+
+		// rows are ordered by item, so each item's pages are together
+		if n := len(res.Items); n == 0 || res.Items[n-1].Pid != item.Pid {
+			res.Items = append(res.Items, item)
+		}
+
+		last := &res.Items[len(res.Items)-1]
+		last.Hits += page.Hits
+		last.Pages = append(last.Pages, page)
+
+		res.Pages++
+	}
+
+	if err := rows.Err(); err != nil {
+		if strings.Contains(err.Error(), "MATCH") {
+			return nil, searchQueryError{fmt.Sprintf("invalid query: [%s]", f.query)}
+		}
+
+		c.err("[SEARCH] search query failed: [%s]", err.Error())
+		return nil, errors.New("failed to search")
+	}
+
+	return &res, nil
+}
+
+/**
+ * Search the text of indexed pages, optionally filtered by item metadata
+ */
+func searchHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	f := searchFilter{
+		query:      strings.TrimSpace(ctx.Query("q")),
+		catalogKey: ctx.Query("catalog_key"),
+		callNumber: ctx.Query("call_number"),
+		lang:       ctx.Query("lang"),
+	}
+
+	if f.query == "" {
+		c.respondString(http.StatusBadRequest, "ERROR: Missing query")
+		return
+	}
+
+	var err error
+
+	f.limit, err = strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(searchDefaultLimit)))
+	if err != nil || f.limit <= 0 || f.limit > searchMaxLimit {
+		c.respondString(http.StatusBadRequest, fmt.Sprintf("ERROR: Invalid limit (expected 1-%d): [%s]", searchMaxLimit, ctx.Query("limit")))
+		return
+	}
+
+	res, err := c.searchQuery(f)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(searchQueryError); ok == true {
+			status = http.StatusBadRequest
+		}
+
+		c.respondString(status, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	c.respondJSON(http.StatusOK, res)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	c := useJobStore(t)
+
+	items := []struct {
+		ts    tsPidInfo
+		lang  string
+		texts []string
+	}{
+		{
+			ts:    tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1", Title: "Letters", CatalogKey: "u1", CallNumber: "MSS 1"}, Pages: []tsGenericPidInfo{{Pid: "uva:2"}, {Pid: "uva:3"}}},
+			lang:  "eng",
+			texts: []string{"Dear Thomas Jefferson, I write to you", "Jefferson replied, and Jefferson again"},
+		},
+		{
+			ts:    tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:4", Title: "Lettres", CatalogKey: "u2", CallNumber: "MSS 2"}, Pages: []tsGenericPidInfo{{Pid: "uva:5"}}},
+			lang:  "fra",
+			texts: []string{"Monsieur Jefferson"},
+		},
+	}
+
+	for _, item := range items {
+		var pages []ocrPidInfo
+		for i, text := range item.texts {
+			pages = append(pages, ocrPidInfo{pid: item.ts.Pages[i].Pid, text: text})
+		}
+
+		ts := item.ts
+		if err := c.searchIndexItem(&ts, item.lang, pages); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+
+	res, err := c.searchQuery(searchFilter{query: "jefferson", limit: 10})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	if len(res.Items) != 2 || res.Pages != 3 || res.Items[0].Pid != "uva:1" || res.Items[0].Hits != 3 || len(res.Items[0].Pages) != 2 {
+		t.Fatalf("unexpected results: %+v", res)
+	}
+
+	if p := res.Items[0].Pages[1]; p.Page != "uva:3" || p.Position != 2 || p.Hits != 2 || p.Snippet != "**Jefferson** replied, and **Jefferson** again" {
+		t.Errorf("unexpected page hit: %+v", p)
+	}
+
+	// filters
+	for _, f := range []searchFilter{{catalogKey: "u2"}, {callNumber: "MSS 2"}, {lang: "fra"}} {
+		f.query = "jefferson"
+		f.limit = 10
+
+		if res, _ := c.searchQuery(f); len(res.Items) != 1 || res.Items[0].Pid != "uva:4" {
+			t.Errorf("expected only [uva:4] for %+v, got %+v", f, res)
+		}
+	}
+
+	if res, _ := c.searchQuery(searchFilter{query: "jefferson", limit: 2}); res.Pages != 2 || res.Truncated == false {
+		t.Errorf("expected 2 pages and more to come, got %+v", res)
+	}
+
+	// a correction replaces the page's text
+	c.searchUpdatePage("uva:5", "Monsieur Adams")
+
+	if res, _ := c.searchQuery(searchFilter{query: "jefferson", lang: "fra", limit: 10}); len(res.Items) != 0 {
+		t.Errorf("expected no results after the correction, got %+v", res)
+	}
+
+	if _, err := c.searchQuery(searchFilter{query: "(jefferson", limit: 10}); err == nil {
+		t.Errorf("expected an error for a malformed query")
+	} else if _, ok := err.(searchQueryError); ok == false {
+		t.Errorf("expected a query error, got %v", err)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// detailed status of a pid's ocr job: its phase, the state of each page, and an estimate of the
+// time remaining.  page states are recorded in the job store as the job progresses, so this does
+// not need tracksys or swf; tracksys is only consulted when no job is underway.
+
+// a page state change seen in a decision task
+type pageUpdate struct {
+	pid     string
+	state   string
+	attempt int    // lambda attempt scheduled, completed, or to be retried
+	details string // failure being retried
+}
+
+type pageStatus struct {
+	Pid      string `json:"pid"`
+	State    string `json:"state"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+type pageCounts struct {
+	Total     int `json:"total"`
+	Pending   int `json:"pending"`
+	Uploaded  int `json:"uploaded"` // uploaded so far, including pages since ocr'd
+	Running   int `json:"running"`
+	Retrying  int `json:"retrying"`
+	Complete  int `json:"complete"`
+	Failed    int `json:"failed"`
+	Cached    int `json:"cached"`
+	Corrected int `json:"corrected"`
+}
+
+type jobProgress struct {
+	ReqID          string       `json:"reqid"`
+	State          string       `json:"state"`
+	Phase          string       `json:"phase"`
+	PhaseStarted   string       `json:"phase_started,omitempty"`
+	Created        string       `json:"created,omitempty"`
+	Started        string       `json:"started,omitempty"`
+	ElapsedSeconds int          `json:"elapsed_seconds"` // since starting, or since being queued
+	Pages          pageCounts   `json:"pages"`
+	PageStates     []pageStatus `json:"page_states"`
+	EtaSeconds     *int         `json:"eta_seconds,omitempty"`
+	EtaBasis       string       `json:"eta_basis,omitempty"` // "observed" (this job's throughput) or "history" (recent jobs)
+}
+
+// a page's state as implied by its results, for pages saved with their results
+func (p ocrPidInfo) resultState() string {
+	switch {
+	case p.failed == true:
+		return pageStateFailed
+	case p.corrected == true:
+		return pageStateCorrected
+	case p.cached == true:
+		return pageStateCached
+	case p.attempts > 0:
+		return pageStateComplete
+	}
+
+	return pageStatePending
+}
+
+func (p ocrPidInfo) pageState() string {
+	if p.state != "" {
+		return p.state
+	}
+
+	return p.resultState()
+}
+
+// lambda attempt count from a scheduled lambda's control payload
+func lambdaControlCount(control *string) int {
+	payload := controlPayload{}
+
+	if control != nil {
+		json.Unmarshal([]byte(*control), &payload)
+	}
+
+	return payload.LambdaCount
+}
+
+// pages completed by the lambda results in a decision task, and scheduled, retried, or given up
+// on by its decisions
+func decisionPageUpdates(info decisionInfo, res deciderResult) []pageUpdate {
+	// language detection samples are followed by the full run, which tracks its own pages
+	if info.req.Sample == true {
+		return nil
+	}
+
+	var updates []pageUpdate
+
+	for _, e := range info.recentEvents {
+		if *e.EventType != "LambdaFunctionCompleted" {
+			continue
+		}
+
+		o := awsEventWithID(info.allEvents, *e.LambdaFunctionCompletedEventAttributes.ScheduledEventId)
+		if o == nil {
+			continue
+		}
+
+		a := o.LambdaFunctionScheduledEventAttributes
+
+		updates = append(updates, pageUpdate{pid: lambdaInputPid(a.Input), state: pageStateComplete, attempt: lambdaControlCount(a.Control)})
+	}
+
+	for _, d := range res.decisions {
+		switch *d.DecisionType {
+		case "ScheduleLambdaFunction":
+			a := d.ScheduleLambdaFunctionDecisionAttributes
+
+			updates = append(updates, pageUpdate{pid: lambdaInputPid(a.Input), state: pageStateRunning, attempt: lambdaControlCount(a.Control)})
+
+		case "StartTimer":
+			payload := controlPayload{}
+			if a := d.StartTimerDecisionAttributes; a.Control == nil || json.Unmarshal([]byte(*a.Control), &payload) != nil {
+				continue
+			}
+
+			if payload.Type != controlPayloadTypeTimerLambdaRetry {
+				continue
+			}
+
+			id, _ := strconv.ParseInt(payload.OrigEventID, 10, 64)
+
+			o := awsEventWithID(info.allEvents, id)
+			if o == nil {
+				continue
+			}
+
+			a := o.LambdaFunctionScheduledEventAttributes
+
+			updates = append(updates, pageUpdate{pid: lambdaInputPid(a.Input), state: pageStateRetrying, attempt: lambdaControlCount(a.Control), details: string(payload.failureType())})
+
+		case "RecordMarker":
+			if a := d.RecordMarkerDecisionAttributes; *a.MarkerName == markerPageFailed && a.Details != nil {
+				updates = append(updates, pageUpdate{pid: *a.Details, state: pageStateFailed})
+			}
+		}
+	}
+
+	// pages without a pid could not be tracked anyway
+	var valid []pageUpdate
+	for _, u := range updates {
+		if u.pid != "" {
+			valid = append(valid, u)
+		}
+	}
+
+	return valid
+}
+
+// the page pid in a lambda's input
+func lambdaInputPid(input *string) string {
+	req := lambdaRequest{}
+
+	if input != nil {
+		json.Unmarshal([]byte(*input), &req)
+	}
+
+	return req.Pid
+}
+
+func epochSecondsSince(epoch string, now time.Time) int {
+	e, err := epochToInt64(epoch)
+	if err != nil || e <= 0 {
+		return 0
+	}
+
+	return maxOf(0, int(now.Unix()-e))
+}
+
+// the detailed progress of a queued or running job
+func (c *clientContext) jobProgressDetails(job *jobInfo) jobProgress {
+	now := time.Now()
+
+	p := jobProgress{
+		ReqID:        job.ReqID,
+		State:        job.State,
+		Phase:        job.Phase,
+		PhaseStarted: job.PhaseStarted,
+		Created:      job.Created,
+		Started:      job.Started,
+		PageStates:   []pageStatus{},
+	}
+
+	if job.Started != "" {
+		p.ElapsedSeconds = epochSecondsSince(job.Started, now)
+	} else {
+		p.ElapsedSeconds = epochSecondsSince(job.Created, now)
+	}
+
+	// every page of the job, in order, whether or not it has a row in the job store yet
+	ts := tsPidInfo{}
+	json.Unmarshal([]byte(job.tsInfo), &ts)
+
+	saved := make(map[string]ocrPidInfo)
+	if pages, err := c.jobGetPages(job.ReqID); err == nil {
+		for _, page := range pages {
+			saved[page.pid] = page
+		}
+	}
+
+	for _, tp := range ts.Pages {
+		page, ok := saved[tp.Pid]
+		if ok == false {
+			page = ocrPidInfo{pid: tp.Pid}
+		}
+
+		state := page.pageState()
+
+		p.PageStates = append(p.PageStates, pageStatus{Pid: tp.Pid, State: state, Attempts: maxOf(page.attempts, page.attempt)})
+
+		switch state {
+		case pageStatePending:
+			p.Pages.Pending++
+		case pageStateUploaded:
+			p.Pages.Uploaded++
+		case pageStateRunning:
+			p.Pages.Running++
+		case pageStateRetrying:
+			p.Pages.Retrying++
+		case pageStateComplete:
+			p.Pages.Complete++
+		case pageStateFailed:
+			p.Pages.Failed++
+		case pageStateCached:
+			p.Pages.Cached++
+		case pageStateCorrected:
+			p.Pages.Corrected++
+		}
+	}
+
+	p.Pages.Total = len(ts.Pages)
+
+	// pages past uploading were uploaded too, unless the job went straight to ocr without uploads
+	if config.disableUploads.value == false {
+		p.Pages.Uploaded += p.Pages.Running + p.Pages.Retrying + p.Pages.Complete + p.Pages.Failed
+	}
+
+	if eta, basis, ok := c.jobEstimateRemaining(job.Phase, p.Pages, epochSecondsSince(job.PhaseStarted, now)); ok == true {
+		p.EtaSeconds = &eta
+		p.EtaBasis = basis
+	}
+
+	return p
+}
+
+// pages needing ocr, as opposed to those satisfied by the result cache or corrections
+func (pc pageCounts) ocrTotal() int {
+	return pc.Total - pc.Cached - pc.Corrected
+}
+
+// the old progress measure: images uploaded plus pages ocr'd, out of twice the pages needing ocr
+func (pc pageCounts) percent() string {
+	if pc.ocrTotal() <= 0 {
+		return "0%"
+	}
+
+	return fmt.Sprintf("%d%%", (100*(pc.Uploaded+pc.Complete+pc.Failed))/(2*pc.ocrTotal()))
+}
+
+// seconds until a running job is expected to finish, from its own page throughput once pages have
+// been ocr'd, or else from recent jobs
+func (c *clientContext) jobEstimateRemaining(phase string, pc pageCounts, phaseSeconds int) (int, string, bool) {
+	ocrTotal := pc.ocrTotal()
+	done := pc.Complete + pc.Failed
+
+	pageSecs, attempts, _ := c.estimatePageSeconds()
+
+	switch phase {
+	case jobPhaseOcr:
+		if done > 0 && phaseSeconds > 0 {
+			return (ocrTotal - done) * phaseSeconds / done, "observed", true
+		}
+
+		return estimateOcrSeconds(ocrTotal-done, pageSecs*attempts), "history", true
+
+	case jobPhaseUploading:
+		upload := 0
+		if pc.Uploaded > 0 && phaseSeconds > 0 {
+			upload = (ocrTotal - pc.Uploaded) * phaseSeconds / pc.Uploaded
+		}
+
+		return upload + estimateOcrSeconds(ocrTotal, pageSecs*attempts), "history", true
+
+	case jobPhaseStarting, jobPhaseLanguage:
+		return estimateOcrSeconds(ocrTotal, pageSecs*attempts), "history", true
+
+	case jobPhaseFinalizing:
+		return 0, "observed", true
+	}
+
+	return 0, "", false
+}
+
+// Handle a request for /ocr/:pid/status
+func ocrStatusHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	job, err := c.jobGetActiveForPid(c.req.pid)
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	status := make(map[string]interface{})
+
+	// no job underway: tracksys tells an idle pid from an unknown one
+	if job == nil {
+		ts, tsErr := c.tsGetMetadataPidInfo()
+
+		if tsErr != nil {
+			c.err("Tracksys API error: [%s]", tsErr.Error())
+
+			if isTsNotFound(tsErr) == true {
+				c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: Unknown PID: [%s]", tsErr.Error()))
+				return
+			}
+
+			c.respondString(http.StatusBadGateway, fmt.Sprintf("ERROR: Could not retrieve PID info: [%s]", tsErr.Error()))
+			return
+		}
+
+		c.info("no request in progress")
+
+		status["status"] = "idle"
+		status["has_ocr"] = ts.Pid.HasOcr
+		status["has_transcription"] = ts.Pid.HasTranscription
+		status["is_ocr_candidate"] = ts.isOcrable
+
+		if last, _ := c.jobGetLatestForPid(c.req.pid); last != nil {
+			status["last_job"] = map[string]string{"reqid": last.ReqID, "state": last.State, "finished": last.Finished}
+		}
+
+		c.respondJSON(http.StatusOK, status)
+		return
+	}
+
+	// the pid info saved with the job stands in for tracksys
+	ts := tsPidInfo{}
+	json.Unmarshal([]byte(job.tsInfo), &ts)
+
+	details := c.jobProgressDetails(job)
+
+	status["status"] = job.State
+	status["has_ocr"] = ts.Pid.HasOcr
+	status["has_transcription"] = ts.Pid.HasTranscription
+	status["is_ocr_candidate"] = tsIsOcrable(ts.Pid)
+	status["reqid"] = job.ReqID
+	status["cache_hits"] = job.CacheHits
+	status["cache_misses"] = job.CacheMisses
+	status["progress"] = details
+
+	if job.State == jobStateQueued {
+		pos, _ := c.jobQueuePosition(job.ReqID)
+		c.info("request queued: position %d", pos)
+		status["ocr_progress"] = "0%"
+		status["queue_position"] = pos
+		status["queue_priority"] = job.Priority
+	} else {
+		pct := details.Pages.percent()
+		c.info("request in progress: %s (phase: %s)", pct, job.Phase)
+		status["ocr_progress"] = pct
+	}
+
+	c.respondJSON(http.StatusOK, status)
+}
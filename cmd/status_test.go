@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useJobStore(t *testing.T) *clientContext {
+	t.Helper()
+
+	saved := config
+	savedDB := jobDB
+
+	t.Cleanup(func() {
+		jobDB.Close()
+		jobDB = savedDB
+		config = saved
+	})
+
+	config.storageDir.value = t.TempDir()
+
+	// handlers name each request with it
+	if randomSource == nil {
+		randomSource = rand.New(rand.NewSource(1))
+	}
+
+	initJobStore()
+
+	return newBackgroundContext()
+}
+
+// finishes a job as if it had run
+func finishTestJob(c *clientContext, reqid, state string) {
+	jobDB.Exec("update jobs set state = ? where req_id = ?;", jobStateRunning, reqid)
+	c.jobFinish(reqid, state)
+}
+
+func pageUpdatesString(updates []pageUpdate) string {
+	var s []string
+	for _, u := range updates {
+		s = append(s, fmt.Sprintf("%s:%s:%d:%s", u.pid, u.state, u.attempt, u.details))
+	}
+
+	return strings.Join(s, " ")
+}
+
+func TestDecisionPageUpdates(t *testing.T) {
+	tests := []struct {
+		file    string
+		updates string
+	}{
+		{"01-workflow-started.json", ""},
+		{"02-queue-timer-fired.json", "uva:2:running:1:"},
+		{"03-lambda-timed-out.json", "uva:2:retrying:1:timeout"},
+		{"04-retry-timer-fired.json", "uva:2:running:2:"},
+		{"06-partial-give-up.json", "uva:2:failed:0: uva:4:running:1:"},
+		{"07-last-lambda-completed.json", "uva:2:complete:1:"},
+		{"09-adaptive-fast-completion.json", "uva:2:complete:1: uva:4:running:1: uva:5:running:1:"},
+		{"10-adaptive-throttled.json", "uva:2:retrying:1:throttle"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.file, func(t *testing.T) {
+			rec, err := readDecisionRecord(filepath.Join("testdata", "replay", tc.file))
+			if err != nil {
+				t.Fatalf("%s", err.Error())
+			}
+
+			info, res, _, err := replayDecisionRecord(rec, t.Logf)
+			if err != nil {
+				t.Fatalf("%s", err.Error())
+			}
+
+			if got := pageUpdatesString(decisionPageUpdates(info, res)); got != tc.updates {
+				t.Errorf("expected updates [%s], got [%s]", tc.updates, got)
+			}
+		})
+	}
+}
+
+func TestJobProgressDetails(t *testing.T) {
+	c := useJobStore(t)
+
+	ts := tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}}
+	for i := 2; i <= 7; i++ {
+		ts.Pages = append(ts.Pages, tsGenericPidInfo{Pid: fmt.Sprintf("uva:%d", i)})
+	}
+
+	if err := c.jobCreate(&jobInfo{ReqID: "r1", Pid: "uva:1", Priority: jobPriorityPatron}, &ts); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	if job, _ := c.jobClaimNext(); job == nil || job.Phase != jobPhaseStarting {
+		t.Fatalf("expected to claim the job in the starting phase, got %+v", job)
+	}
+
+	// uva:7 was never uploaded
+	for _, pid := range []string{"uva:2", "uva:3", "uva:4", "uva:5"} {
+		c.jobSavePageSource("r1", pid, "archive", "", false)
+	}
+
+	c.jobSaveCorrectedPages("r1", []ocrPidInfo{{pid: "uva:6", text: "corrected"}})
+
+	c.jobUpdatePhase("r1", jobPhaseOcr)
+
+	c.jobUpdatePageStates("r1", []pageUpdate{
+		{pid: "uva:2", state: pageStateRunning, attempt: 1},
+		{pid: "uva:3", state: pageStateRunning, attempt: 1},
+		{pid: "uva:4", state: pageStateRunning, attempt: 1},
+	})
+
+	c.jobUpdatePageStates("r1", []pageUpdate{
+		{pid: "uva:2", state: pageStateComplete, attempt: 1},
+		{pid: "uva:3", state: pageStateRetrying, attempt: 1},
+	})
+
+	c.jobUpdatePageStates("r1", []pageUpdate{
+		{pid: "uva:3", state: pageStateRunning, attempt: 2},
+	})
+
+	job, err := c.jobGetActiveForPid("uva:1")
+	if err != nil || job == nil {
+		t.Fatalf("expected an active job")
+	}
+
+	p := c.jobProgressDetails(job)
+
+	if p.Phase != jobPhaseOcr || p.State != jobStateRunning {
+		t.Errorf("unexpected state/phase: %s/%s", p.State, p.Phase)
+	}
+
+	expected := pageCounts{Total: 6, Pending: 1, Uploaded: 4, Running: 2, Complete: 1, Corrected: 1}
+	if p.Pages != expected {
+		t.Errorf("expected counts %+v, got %+v", expected, p.Pages)
+	}
+
+	var states []string
+	for _, s := range p.PageStates {
+		states = append(states, fmt.Sprintf("%s:%s:%d", s.Pid, s.State, s.Attempts))
+	}
+
+	if got := strings.Join(states, " "); got != "uva:2:complete:1 uva:3:running:2 uva:4:running:1 uva:5:uploaded:0 uva:6:corrected:0 uva:7:pending:0" {
+		t.Errorf("unexpected page states: [%s]", got)
+	}
+
+	// nothing observed in this phase yet, so the estimate comes from history
+	if p.EtaSeconds == nil || *p.EtaSeconds <= 0 || p.EtaBasis != "history" {
+		t.Errorf("expected a history-based estimate, got %v (%s)", p.EtaSeconds, p.EtaBasis)
+	}
+
+	if pct := p.Pages.percent(); pct != "50%" {
+		t.Errorf("expected 50%% progress, got %s", pct)
+	}
+
+	// results saved at the end of the job replace the progress states
+	c.jobSavePages("r1", []ocrPidInfo{{pid: "uva:3", attempts: 2, text: "text"}, {pid: "uva:4", failed: true}})
+
+	pages, _ := c.jobGetPages("r1")
+	for _, page := range pages {
+		if page.pid == "uva:3" && page.pageState() != pageStateComplete || page.pid == "uva:4" && page.pageState() != pageStateFailed {
+			t.Errorf("unexpected final state for [%s]: %s", page.pid, page.pageState())
+		}
+	}
+
+	// progress states are not mistaken for results when a failed job is retried
+	finishTestJob(c, "r1", jobStateFailed)
+
+	completed, _ := c.jobGetCompletedPages("r1")
+	if len(completed) != 2 {
+		t.Errorf("expected 2 completed pages (uva:3, uva:6), got %d", len(completed))
+	}
+}
+
+func TestJobEstimateRemaining(t *testing.T) {
+	c := useJobStore(t)
+
+	pc := pageCounts{Total: 12, Cached: 2, Uploaded: 10, Complete: 3, Failed: 1, Running: 6}
+
+	if eta, basis, ok := c.jobEstimateRemaining(jobPhaseOcr, pc, 40); ok == false || eta != 60 || basis != "observed" {
+		t.Errorf("expected 60 observed seconds, got %d (%s, %v)", eta, basis, ok)
+	}
+
+	if _, _, ok := c.jobEstimateRemaining(jobPhaseQueued, pc, 40); ok == true {
+		t.Errorf("expected no estimate for a queued job")
+	}
+}
+
+func TestJobFinishAfterCancel(t *testing.T) {
+	c := useJobStore(t)
+
+	c.jobCreate(&jobInfo{ReqID: "r1", Pid: "uva:1", Priority: jobPriorityPatron}, &tsPidInfo{Pid: tsGenericPidInfo{Pid: "uva:1"}})
+	c.jobClaimNext()
+
+	// staff cancel the job while its final decision task is being handled
+	c.jobCancel("r1")
+
+	c.processOcrFailure(ocrResultsInfo{pid: "uva:1", reqid: "r1", workDir: t.TempDir(), details: "late failure"})
+
+	if job, _ := c.jobGet("r1"); job.State != jobStateCanceled {
+		t.Errorf("expected the job to stay canceled, got [%s]", job.State)
+	}
+
+	if finished, err := c.jobFinish("r1", jobStateComplete); err != nil || finished == true {
+		t.Errorf("expected a canceled job not to be finished (%v)", err)
+	}
+
+	// requests answered from existing text have no job, and finish as before
+	if finished, err := c.jobFinish("no-job", jobStateComplete); err != nil || finished == false {
+		t.Errorf("expected a request without a job to finish (%v)", err)
+	}
+}
@@ -28,7 +28,9 @@ type tsGenericPidInfo struct {
 	HasTranscription bool   `json:"has_transcription,omitempty"`
 	CatalogKey       string `json:"catalog_key,omitempty"`
 	CallNumber       string `json:"call_number,omitempty"`
-	imageSource      string
+	MD5              string `json:"md5,omitempty"`
+	imageSource      string // location of the page image
+	imageSourceName  string // which image source the location belongs to
 	remoteName       string
 }
 
@@ -39,6 +41,21 @@ type tsPidInfo struct {
 	isOcrable bool
 }
 
+// returned when tracksys has no such pid (or not one that can be ocr'd as a whole), as opposed to
+// tracksys being unreachable
+type tsNotFoundError struct {
+	msg string
+}
+
+func (e tsNotFoundError) Error() string {
+	return e.msg
+}
+
+func isTsNotFound(err error) bool {
+	_, ok := err.(tsNotFoundError)
+	return ok
+}
+
 func getTsURL(api string, pid string, params map[string]string) string {
 	url := fmt.Sprintf("%s%s/%s", config.tsAPIHost.value, api, pid)
 
@@ -110,6 +127,10 @@ func (c *clientContext) tsGetPidInfo() (*tsPidInfo, error) {
 
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusNotFound {
+		return nil, tsNotFoundError{fmt.Sprintf("pid not found: [%s]", c.req.pid)}
+	}
+
 	// parse json from body
 
 	var ts tsPidInfo
@@ -145,7 +166,7 @@ func (c *clientContext) tsGetPidInfo() (*tsPidInfo, error) {
 		return &ts, nil
 	}
 
-	return nil, fmt.Errorf("unhandled PID type: [%s]", ts.Pid.Type)
+	return nil, tsNotFoundError{fmt.Sprintf("unhandled PID type: [%s]", ts.Pid.Type)}
 }
 
 func (c *clientContext) tsGetMetadataPidInfo() (*tsPidInfo, error) {
@@ -156,30 +177,29 @@ func (c *clientContext) tsGetMetadataPidInfo() (*tsPidInfo, error) {
 	}
 
 	if strings.Contains(ts.Pid.Type, "metadata") == false {
-		return nil, fmt.Errorf("pid is not a metadata type: [%s]", ts.Pid.Type)
+		return nil, tsNotFoundError{fmt.Sprintf("pid is not a metadata type: [%s]", ts.Pid.Type)}
 	}
 
 	// ensure there are pages to process
 	if len(ts.Pages) == 0 {
-		return nil, errors.New("metadata pid does not have any pages")
+		return nil, tsNotFoundError{"metadata pid does not have any pages"}
 	}
 
-	// check if this is ocr-able: FIXME (DCMD-634)
-	ts.isOcrable = false
-	if ts.Pid.OcrCandidate == true {
-		if ts.Pid.TextSource == "" || ts.Pid.TextSource == "ocr" {
-			ts.isOcrable = true
-		}
-	} else {
-		// fallback for tracksysdev until it has the new API
-		if ts.Pid.OcrHint == "Regular Font" || ts.Pid.OcrHint == "Modern Font" {
-			ts.isOcrable = true
-		}
-	}
+	ts.isOcrable = tsIsOcrable(ts.Pid)
 
 	return ts, nil
 }
 
+// check if this is ocr-able: FIXME (DCMD-634)
+func tsIsOcrable(pid tsGenericPidInfo) bool {
+	if pid.OcrCandidate == true {
+		return pid.TextSource == "" || pid.TextSource == "ocr"
+	}
+
+	// fallback for tracksysdev until it has the new API
+	return pid.OcrHint == "Regular Font" || pid.OcrHint == "Modern Font"
+}
+
 func (c *clientContext) tsGetText(pid string) (string, error) {
 	url := fmt.Sprintf("%s/api/pid/%s/text", config.tsAPIHost.value, pid)
 	req, reqErr := http.NewRequest("GET", url, nil)
@@ -196,6 +216,11 @@ func (c *clientContext) tsGetText(pid string) (string, error) {
 
 	defer res.Body.Close()
 
+	// an error page is not the page's text
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to retrieve fulltext (status: %s)", res.Status)
+	}
+
 	// read text from body
 
 	text, textErr := ioutil.ReadAll(res.Body)
@@ -254,17 +279,19 @@ func (c *clientContext) tsPostText(pid, text string) error {
 	return nil
 }
 
-func (c *clientContext) tsJobStatusCallback(apiURL, status, message, started, finished string) error {
+func (c *clientContext) tsJobStatusCallback(apiURL, status, message, started, finished string, failedPages []string) error {
 	jobstatus := struct {
-		Status   string `json:"status,omitempty"`
-		Message  string `json:"message,omitempty"`
-		Started  string `json:"started,omitempty"`
-		Finished string `json:"finished,omitempty"`
+		Status      string   `json:"status,omitempty"`
+		Message     string   `json:"message,omitempty"`
+		Started     string   `json:"started,omitempty"`
+		Finished    string   `json:"finished,omitempty"`
+		FailedPages []string `json:"failed_pages,omitempty"`
 	}{
-		Status:   status,
-		Message:  message,
-		Started:  started,
-		Finished: finished,
+		Status:      status,
+		Message:     message,
+		Started:     started,
+		Finished:    finished,
+		FailedPages: failedPages,
 	}
 
 	output, jsonErr := json.Marshal(jobstatus)
@@ -21,8 +21,25 @@ var gitCommit string
 // structures
 
 type ocrPidInfo struct {
-	pid  string // page pid
-	text string
+	pid        string // page pid
+	text       string
+	confidence *float64 // mean word confidence, if reported by the lambda
+	words      int      // word count, if reported by the lambda
+	attempts   int      // number of lambda attempts needed
+	scale      string   // image scale used for the successful attempt
+	source     string   // image source the page was read from
+	md5        string   // checksum of the page image as read from the source
+	verified   bool     // whether the checksum matched the one from tracksys
+	cached     bool     // whether the text came from the result cache
+	corrected  bool     // whether the text is a manual correction, rather than ocr
+	review     string   // review state, if held for review
+	posted     bool     // whether the text was posted to tracksys after review
+	failed     bool     // whether ocr was given up on for this page (partial success)
+	lang       string   // language used, if the final attempt overrode the job's
+	engine     string   // lambda function used, if the final attempt overrode the job's
+	duration   float64  // seconds the successful lambda attempt ran for, if known
+	state      string   // progress through the job (see page states)
+	attempt    int      // lambda attempt currently underway, while the job is running
 }
 
 type ocrResultsInfo struct {
@@ -49,6 +66,9 @@ type healthCheckStatus struct {
 	Message string `json:"message,omitempty"`
 }
 
+// stands in for the text of pages that were given up on (partial success)
+const ocrUnavailableText = "[OCR unavailable for this page]"
+
 // globals
 
 var randpool *rand.Rand
@@ -100,8 +120,24 @@ func getS3Filename(reqID, remoteFile string) string {
 }
 
 func getIIIFUrl(pid string) string {
-	url := strings.Replace(config.iiifURLTemplate.value, "{PID}", pid, -1)
-	return url
+	region := config.iiifRegion.value
+	if region == "" {
+		region = "full"
+	}
+
+	size := config.iiifSize.value
+	if size == "" {
+		size = "full"
+	}
+
+	format := config.iiifFormat.value
+	if format == "" {
+		format = "jpg"
+	}
+
+	r := strings.NewReplacer("{PID}", pid, "{REGION}", region, "{SIZE}", size, "{FORMAT}", format)
+
+	return r.Replace(config.iiifURLTemplate.value)
 }
 
 func (c *clientContext) writeFileWithContents(filename, contents string) error {
@@ -136,17 +172,26 @@ func appendStringIfMissing(slice []string, str string) []string {
 	return append(slice, str)
 }
 
-func (c *clientContext) processEmails(workdir, subject, body, attachment string) {
-	if emails, err := c.reqGetEmails(workdir); err == nil {
-		for _, e := range emails {
-			c.emailResults(e, subject, body, attachment)
-		}
-	} else {
+// emails everyone waiting on a request, publishing a progress event for each email sent
+func (c *clientContext) processEmails(pid, workdir, reqid, subject, body, attachment string) {
+	emails, err := c.reqGetEmails(workdir)
+	if err != nil {
 		c.err("error retrieving email addresses: [%s]", err.Error())
+		return
+	}
+
+	sent := 0
+	for _, e := range emails {
+		if c.emailResults(e, subject, body, attachment) == nil {
+			c.audit(auditEntry{Action: auditEmailSent, Pid: pid, ReqID: reqid, Target: e, Details: subject})
+			sent++
+			publishProgress(pid, reqid, eventEmailSent, progressEvent{Done: sent, Total: len(emails)})
+		}
 	}
 }
 
-func (c *clientContext) processCallbacks(workdir, reqid, status, message string) {
+// posts job status to every callback for a request, publishing a progress event for each one delivered
+func (c *clientContext) processCallbacks(pid, workdir, reqid, status, message string, failed []string) {
 	req, reqErr := c.reqGetRequestInfo(workdir, reqid)
 	if reqErr != nil {
 		c.warn("could not get times; making some up.  error: [%s]", reqErr.Error())
@@ -159,22 +204,36 @@ func (c *clientContext) processCallbacks(workdir, reqid, status, message string)
 		req.Finished = tsTimestamp(fmt.Sprintf("%d", now))
 	}
 
-	if callbacks, err := c.reqGetCallbacks(workdir); err == nil {
-		for _, cb := range callbacks {
-			c.tsJobStatusCallback(cb, status, message, req.Started, req.Finished)
-		}
-	} else {
+	callbacks, err := c.reqGetCallbacks(workdir)
+	if err != nil {
 		c.err("error retrieving callbacks: [%s]", err.Error())
+		return
+	}
+
+	delivered := 0
+	for _, cb := range callbacks {
+		if c.tsJobStatusCallback(cb, status, message, req.Started, req.Finished, failed) == nil {
+			c.audit(auditEntry{Action: auditCallbackDelivered, Pid: pid, ReqID: reqid, Target: cb, Details: status})
+			delivered++
+			publishProgress(pid, reqid, eventCallbackDelivered, progressEvent{Done: delivered, Total: len(callbacks), Details: status})
+		}
 	}
 }
 
 func (c *clientContext) getVirgoURL(res ocrResultsInfo) string {
+	catalogKey := ""
+	if req, reqErr := c.reqGetRequestInfo(res.workDir, res.reqid); reqErr == nil {
+		catalogKey = req.CatalogKey
+	}
+	return virgoURL(res.pid, catalogKey)
+}
+
+func virgoURL(pid, catalogKey string) string {
 	v4url := "https://search.lib.virginia.edu"
-	req, reqErr := c.reqGetRequestInfo(res.workDir, res.reqid)
-	if reqErr != nil || req.CatalogKey == "" {
-		v4url += fmt.Sprintf("/?q=keyword:{%s}", res.pid)
+	if catalogKey == "" {
+		v4url += fmt.Sprintf("/?q=keyword:{%s}", pid)
 	} else {
-		v4url += fmt.Sprintf("/items/%s", req.CatalogKey)
+		v4url += fmt.Sprintf("/items/%s", catalogKey)
 	}
 	return v4url
 }
@@ -189,17 +248,56 @@ func ocrFormatPageText(text string, i int, total int) string {
 	return pageText
 }
 
-func ocrFormatDocument(pages []string) string {
+func ocrFormatDocument(pages []ocrPidInfo) string {
 	doc := ""
 
 	for i, page := range pages {
-		pageText := ocrFormatPageText(page, i+1, len(pages))
+		text := page.text
+		if page.failed == true {
+			text = ocrUnavailableText
+		}
+
+		pageText := ocrFormatPageText(text, i+1, len(pages))
 		doc += "\n" + pageText + "\n"
 	}
 
 	return doc
 }
 
+// describes the pages that were given up on, by position in the document
+func ocrFailedPages(pages []ocrPidInfo) []string {
+	var failed []string
+
+	for i, page := range pages {
+		if page.failed == true {
+			failed = append(failed, fmt.Sprintf("page %d of %d (%s)", i+1, len(pages), page.pid))
+		}
+	}
+
+	return failed
+}
+
+// whether a request (or, by default, the service) allows delivering a document with some pages missing
+func partialSuccessEnabled(partial string) bool {
+	if b, err := strconv.ParseBool(partial); err == nil {
+		return b
+	}
+
+	return config.partialSuccess.value
+}
+
+// names the results attachment after the call number, if there is one
+func ocrFileName(pid, callNumber string) string {
+	ocrBaseName := pid
+	if callNumber != "" {
+		ocrBaseName = callNumber
+	}
+
+	ocrBaseName = strings.ReplaceAll(ocrBaseName, "/", "∕")
+
+	return fmt.Sprintf("%s.txt", ocrBaseName)
+}
+
 func ocrEmailBody(message string) string {
 	body := fmt.Sprintf(`Hello,
 
@@ -216,38 +314,99 @@ University of Virginia Library`, message, config.emailAddress.value)
 	return body
 }
 
+// returns the subject and body of the email sent for a completed request, listing any pages without ocr
+func ocrSuccessEmail(url string, failed []string) (string, string) {
+	subject := "Your OCR request is ready to view"
+
+	message := "The OCR document you requested is attached."
+	message += "\n\n"
+
+	if len(failed) > 0 {
+		message += fmt.Sprintf("OCR could not be generated for %d page(s), which are marked \"%s\" in the document:", len(failed), ocrUnavailableText)
+		message += "\n\n"
+		for _, f := range failed {
+			message += "  * " + f + "\n"
+		}
+		message += "\n"
+	}
+
+	message += "The file is also now discoverable in Virgo, along with citation and rights information: " + url
+	message += "\n\n"
+	message += "Please note that it is your responsibility to determine appropriate rights and usage for Library material."
+
+	return subject, ocrEmailBody(message)
+}
+
+// returns the subject and body of the email sent for a failed request
+func ocrFailureEmail(url string) (string, string) {
+	subject := "Your OCR request cannot be completed"
+
+	message := "Unfortunately, the OCR document you requested has failed to generate. This may be a result of a technical issue or a problem with the original document."
+	message += "\n\n"
+	message += url
+
+	return subject, ocrEmailBody(message)
+}
+
 func (c *clientContext) processOcrSuccess(res ocrResultsInfo) {
 	c.info("[%s] processing and posting successful OCR", res.pid)
 
+	c.jobUpdatePhase(res.reqid, jobPhaseFinalizing)
+	publishProgress(res.pid, res.reqid, eventFinalizing, progressEvent{Total: len(res.pages)})
+
 	if config.tsReadOnly.value == true {
 		c.info("[%s] SKIPPING TRACKSYS POST", res.pid)
 	}
 
 	c.reqUpdateFinished(res.workDir, res.reqid)
 
-	var pages []string
-	for _, p := range res.pages {
-		pages = append(pages, p.text)
+	// keep newly generated page results, and check their quality before they overwrite anything
+	versions := make(map[string]int64)
+	hold := false
 
-		// post to tracksys?
+	if res.overwrite == true {
+		c.jobSavePages(res.reqid, res.pages)
 
-		if config.tsReadOnly.value == false && res.overwrite == true {
-			if err := c.tsPostText(p.pid, p.text); err != nil {
-				c.err("[%s] Tracksys OCR posting failed: [%s]", res.pid, err.Error())
+		// corrected pages are already in tracksys, and are not ocr; failed pages have no text at all
+		var results []ocrPidInfo
+		for _, p := range res.pages {
+			if p.corrected == false && p.failed == false {
+				results = append(results, p)
 			}
 		}
-	}
 
-	ocrBaseName := res.pid
-	req, reqErr := c.reqGetRequestInfo(res.workDir, res.reqid)
-	if reqErr == nil && req.CallNumber != "" {
-		ocrBaseName = req.CallNumber
+		versions = c.versionAddResults(res.reqid, results)
+
+		report := newQualityReport(results)
+		c.jobUpdateQuality(res.reqid, report.quality())
+
+		if report.LowQuality == true {
+			c.warn("[%s] low quality OCR: %d of %d pages below confidence threshold %d", res.pid, len(report.LowConfidence), report.Pages, report.Threshold)
+
+			if config.qualityReview.value == true {
+				c.info("[%s] holding low quality OCR for review; not posting to Tracksys", res.pid)
+				hold = true
+			}
+		}
+
+		if job, err := c.jobGet(res.reqid); err == nil && isDryRun(job.DryRun) == true {
+			c.info("[%s] dry run; holding OCR for review; not posting to Tracksys", res.pid)
+			hold = true
+		}
+
+		if hold == true {
+			c.jobHoldForReview(res.reqid)
+			res.overwrite = false
+		}
 	}
 
-	ocrBaseName = strings.ReplaceAll(ocrBaseName, "/", "∕")
+	callNumber := ""
+	if req, reqErr := c.reqGetRequestInfo(res.workDir, res.reqid); reqErr == nil {
+		callNumber = req.CallNumber
+	}
 
-	ocrText := ocrFormatDocument(pages)
-	ocrFile := fmt.Sprintf("%s/%s.txt", res.workDir, ocrBaseName)
+	ocrText := ocrFormatDocument(res.pages)
+	ocrFile := fmt.Sprintf("%s/%s", res.workDir, ocrFileName(res.pid, callNumber))
 
 	// save to all file
 	if err := c.writeFileWithContents(ocrFile, ocrText); err != nil {
@@ -257,39 +416,70 @@ func (c *clientContext) processOcrSuccess(res ocrResultsInfo) {
 		return
 	}
 
-	subject := "Your OCR request is ready to view"
+	// a job canceled while its results were on their way is left canceled, and nothing is posted or sent
+	if finished, err := c.jobFinish(res.reqid, jobStateComplete); err == nil && finished == false {
+		c.info("[%s] job [%s] was stopped; not posting or notifying", res.pid, res.reqid)
+		return
+	}
 
-	message := "The OCR document you requested is attached."
-	message += "\n\n"
-	message += "The file is also now discoverable in Virgo, along with citation and rights information: " + c.getVirgoURL(res)
-	message += "\n\n"
-	message += "Please note that it is your responsibility to determine appropriate rights and usage for Library material."
+	// held text is indexed if and when it is approved
+	if hold == false {
+		c.searchIndexResults(res.reqid, res.pages)
+	}
+
+	for _, p := range res.pages {
+		// post to tracksys?
 
-	body := ocrEmailBody(message)
+		if config.tsReadOnly.value == false && res.overwrite == true && p.corrected == false && p.failed == false {
+			if err := c.versionPost(p.pid, versions[p.pid], p.text); err != nil {
+				c.err("[%s] Tracksys OCR posting failed: [%s]", res.pid, err.Error())
+			}
+		}
+	}
+
+	failed := ocrFailedPages(res.pages)
+
+	message := "OCR completed successfully"
+	if len(failed) > 0 {
+		c.warn("[%s] delivering partial OCR; %d page(s) unavailable", res.pid, len(failed))
+		message = fmt.Sprintf("OCR completed with %d page(s) unavailable", len(failed))
+	}
+
+	subject, body := ocrSuccessEmail(c.getVirgoURL(res), failed)
 
-	c.processEmails(res.workDir, subject, body, ocrFile)
-	c.processCallbacks(res.workDir, res.reqid, "success", "OCR completed successfully")
+	c.processEmails(res.pid, res.workDir, res.reqid, subject, body, ocrFile)
+	c.processCallbacks(res.pid, res.workDir, res.reqid, "success", message, failed)
 
 	os.RemoveAll(res.workDir)
+
+	c.jobLockRelease(res.reqid)
+
+	publishProgress(res.pid, res.reqid, eventJobComplete, progressEvent{Done: len(res.pages) - len(failed), Total: len(res.pages), Details: message})
 }
 
 func (c *clientContext) processOcrFailure(res ocrResultsInfo) {
 	c.info("[%s] processing failed OCR", res.pid)
 
-	c.reqUpdateFinished(res.workDir, res.reqid)
+	c.jobUpdatePhase(res.reqid, jobPhaseFinalizing)
+	publishProgress(res.pid, res.reqid, eventFinalizing, progressEvent{Details: res.details})
 
-	subject := "Your OCR request cannot be completed"
+	c.reqUpdateFinished(res.workDir, res.reqid)
 
-	message := "Unfortunately, the OCR document you requested has failed to generate. This may be a result of a technical issue or a problem with the original document."
-	message += "\n\n"
-	message += c.getVirgoURL(res)
+	if finished, err := c.jobFinish(res.reqid, jobStateFailed); err == nil && finished == false {
+		c.info("[%s] job [%s] was stopped; not notifying", res.pid, res.reqid)
+		return
+	}
 
-	body := ocrEmailBody(message)
+	subject, body := ocrFailureEmail(c.getVirgoURL(res))
 
-	c.processEmails(res.workDir, subject, body, "")
-	c.processCallbacks(res.workDir, res.reqid, "fail", res.details)
+	c.processEmails(res.pid, res.workDir, res.reqid, subject, body, "")
+	c.processCallbacks(res.pid, res.workDir, res.reqid, "fail", res.details, nil)
 
 	os.RemoveAll(res.workDir)
+
+	c.jobLockRelease(res.reqid)
+
+	publishProgress(res.pid, res.reqid, eventJobFailed, progressEvent{Details: res.details})
 }
 
 func maxOf(ints ...int) int {
@@ -304,6 +494,26 @@ func maxOf(ints ...int) int {
 	return max
 }
 
+func maxOfFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func minOf(ints ...int) int {
+	min := ints[0]
+
+	for _, n := range ints {
+		if n < min {
+			min = n
+		}
+	}
+
+	return min
+}
+
 func countsToString(m map[string]int) string {
 	b := new(bytes.Buffer)
 
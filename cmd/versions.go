@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// history of every text the service has produced or fetched for each page, so that
+// text replaced in tracksys can be seen and restored later
+
+// version sources
+const (
+	versionSourceLambda   = "lambda"
+	versionSourceCache    = "cache"
+	versionSourceTracksys = "tracksys"
+)
+
+type textVersion struct {
+	ID      int64  `json:"id"`
+	Pid     string `json:"pid"`
+	ReqID   string `json:"reqid,omitempty"`
+	Source  string `json:"source"`
+	Engine  string `json:"engine,omitempty"`
+	Lang    string `json:"lang,omitempty"`
+	Created string `json:"created"`
+	Posted  string `json:"posted,omitempty"`
+	Length  int    `json:"length"`
+	Snippet string `json:"snippet,omitempty"`
+	Text    string `json:"text,omitempty"`
+}
+
+const versionColumns = "id, pid, req_id, source, engine, lang, created, posted, text"
+
+func scanVersion(row interface{ Scan(...interface{}) error }) (*textVersion, error) {
+	var v textVersion
+
+	if err := row.Scan(&v.ID, &v.Pid, &v.ReqID, &v.Source, &v.Engine, &v.Lang, &v.Created, &v.Posted, &v.Text); err != nil {
+		return nil, err
+	}
+
+	v.Length = len(v.Text)
+
+	return &v, nil
+}
+
+func (c *clientContext) versionAdd(v textVersion) (int64, error) {
+	query := "insert into text_versions (pid, req_id, source, engine, lang, created, posted, text) values (?, ?, ?, ?, ?, ?, '', ?);"
+	res, err := jobDB.Exec(query, v.Pid, v.ReqID, v.Source, v.Engine, v.Lang, fmt.Sprintf("%d", time.Now().Unix()), v.Text)
+	if err != nil {
+		c.err("[VERSION] failed to add text version: [%s]", err.Error())
+		return 0, errors.New("failed to add text version")
+	}
+
+	return res.LastInsertId()
+}
+
+// records text fetched from tracksys, in case it is about to be replaced, unless it is already in the history
+func (c *clientContext) versionRecordFetched(pid, text, reqid string) {
+	if text == "" {
+		return
+	}
+
+	versions, err := c.versionGetAll(pid)
+	if err != nil {
+		return
+	}
+
+	clean := cleanOcrText(text)
+	for _, v := range versions {
+		if cleanOcrText(v.Text) == clean {
+			return
+		}
+	}
+
+	c.versionAdd(textVersion{Pid: pid, ReqID: reqid, Source: versionSourceTracksys, Text: text})
+}
+
+// records newly generated page results for a job, returning pid => version id
+func (c *clientContext) versionAddResults(reqid string, pages []ocrPidInfo) map[string]int64 {
+	engine, lang := c.versionSettings(reqid)
+
+	ids := make(map[string]int64)
+
+	for _, p := range pages {
+		source := versionSourceLambda
+		if p.cached == true {
+			source = versionSourceCache
+		}
+
+		// record the settings a final attempt actually used
+		v := textVersion{Pid: p.pid, ReqID: reqid, Source: source, Engine: engine, Lang: lang, Text: p.text}
+		if p.engine != "" {
+			v.Engine = p.engine
+		}
+		if p.lang != "" {
+			v.Lang = p.lang
+		}
+
+		if id, err := c.versionAdd(v); err == nil {
+			ids[p.pid] = id
+		}
+	}
+
+	return ids
+}
+
+// the engine and language settings a job ran with
+func (c *clientContext) versionSettings(reqid string) (string, string) {
+	job, err := c.jobGet(reqid)
+	if err != nil {
+		return "", ""
+	}
+
+	jc, err := newJobContext(job)
+	if err != nil {
+		return "", ""
+	}
+
+	lang := job.Lang
+	if lang == "" {
+		lang = job.DetectedLang
+	}
+	if lang == "" {
+		lang = jc.ocr.ts.Pid.OcrLanguageHint
+	}
+
+	return ocrEngineVersion(job.Engine, jc.ocr.ts.Pid.OcrHint), lang
+}
+
+// posts a version to tracksys, first saving whatever text it replaces
+func (c *clientContext) versionPost(pid string, id int64, text string) error {
+	if current, err := c.tsGetText(pid); err == nil {
+		c.versionRecordFetched(pid, current, "")
+	}
+
+	if err := c.tsPostText(pid, text); err != nil {
+		return err
+	}
+
+	e := auditEntry{Action: auditTracksysPost, Page: pid, Details: fmt.Sprintf("%d characters", len(text))}
+	if v, err := c.versionGet(pid, id); err == nil {
+		e.ReqID = v.ReqID
+		e.Details = fmt.Sprintf("version %d (source: %s  %d characters)", v.ID, v.Source, len(text))
+	}
+
+	c.audit(e)
+
+	if id > 0 {
+		if _, err := jobDB.Exec("update text_versions set posted = ? where id = ?;", fmt.Sprintf("%d", time.Now().Unix()), id); err != nil {
+			c.err("[VERSION] failed to mark version as posted: [%s]", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (c *clientContext) versionGet(pid string, id int64) (*textVersion, error) {
+	row := jobDB.QueryRow(fmt.Sprintf("select %s from text_versions where pid = ? and id = ?;", versionColumns), pid, id)
+
+	v, err := scanVersion(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			c.err("[VERSION] failed to retrieve version: [%s]", err.Error())
+		}
+		return nil, fmt.Errorf("failed to retrieve version: [%d]", id)
+	}
+
+	return v, nil
+}
+
+// the version recorded for a page by a particular job
+func (c *clientContext) versionGetForJob(pid, reqid string) (*textVersion, error) {
+	row := jobDB.QueryRow(fmt.Sprintf("select %s from text_versions where pid = ? and req_id = ? and source in (?, ?) order by id desc limit 1;", versionColumns), pid, reqid, versionSourceLambda, versionSourceCache)
+
+	v, err := scanVersion(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			c.err("[VERSION] failed to retrieve job version: [%s]", err.Error())
+		}
+		return nil, fmt.Errorf("failed to retrieve version for job: [%s]", reqid)
+	}
+
+	return v, nil
+}
+
+// the version most recently posted to tracksys, which is normally the page's current text there
+func (c *clientContext) versionGetPosted(pid string) (*textVersion, error) {
+	row := jobDB.QueryRow(fmt.Sprintf("select %s from text_versions where pid = ? and posted != '' order by cast(posted as integer) desc, id desc limit 1;", versionColumns), pid)
+
+	v, err := scanVersion(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			c.err("[VERSION] failed to retrieve posted version: [%s]", err.Error())
+		}
+		return nil, fmt.Errorf("no posted version: [%s]", pid)
+	}
+
+	return v, nil
+}
+
+func (c *clientContext) versionGetAll(pid string) ([]textVersion, error) {
+	rows, err := jobDB.Query(fmt.Sprintf("select %s from text_versions where pid = ? order by id desc;", versionColumns), pid)
+	if err != nil {
+		c.err("[VERSION] failed to retrieve versions: [%s]", err.Error())
+		return nil, errors.New("failed to retrieve versions")
+	}
+	defer rows.Close()
+
+	var versions []textVersion
+
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			c.err("[VERSION] failed to scan version: [%s]", err.Error())
+			return nil, errors.New("failed to scan version")
+		}
+
+		versions = append(versions, *v)
+	}
+
+	if err := rows.Err(); err != nil {
+		c.err("[VERSION] select query failed: [%s]", err.Error())
+		return nil, errors.New("failed to select versions")
+	}
+
+	return versions, nil
+}
+
+/**
+ * List the text versions of a page, newest first
+ */
+func pageVersionsHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	versions, err := c.versionGetAll(c.req.pid)
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	for i := range versions {
+		versions[i].Snippet = textSnippet(versions[i].Text)
+		versions[i].Text = ""
+	}
+
+	status := make(map[string]interface{})
+
+	status["pid"] = c.req.pid
+	status["versions"] = versions
+
+	c.respondJSON(http.StatusOK, status)
+}
+
+func (c *clientContext) versionFromRequest() (*textVersion, error) {
+	id, err := strconv.ParseInt(c.ctx.Param("id"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version: [%s]", c.ctx.Param("id"))
+	}
+
+	return c.versionGet(c.req.pid, id)
+}
+
+/**
+ * Return a single text version of a page, including its text
+ */
+func pageVersionHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	v, err := c.versionFromRequest()
+	if err != nil {
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	c.respondJSON(http.StatusOK, v)
+}
+
+/**
+ * Re-post an older text version of a page to tracksys
+ */
+func pageVersionRestoreHandler(ctx *gin.Context) {
+	c := newClientContext(ctx)
+
+	v, err := c.versionFromRequest()
+	if err != nil {
+		c.respondString(http.StatusNotFound, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	if config.tsReadOnly.value == true {
+		c.info("[%s] SKIPPING TRACKSYS POST", v.Pid)
+		c.respondString(http.StatusConflict, "ERROR: Tracksys is read-only")
+		return
+	}
+
+	if err := c.versionPost(v.Pid, v.ID, v.Text); err != nil {
+		c.err("[%s] Tracksys OCR posting failed: [%s]", v.Pid, err.Error())
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	// the restored text is now the page's text: a restored correction becomes the page's correction,
+	// and anything else replaces it, so later ocr runs neither skip the page nor reuse the old text
+	if v.Source == versionSourceManual {
+		err = c.correctionSave(v.Pid, v.ID)
+	} else {
+		err = c.correctionDelete(v.Pid)
+	}
+
+	if err != nil {
+		c.respondString(http.StatusInternalServerError, fmt.Sprintf("ERROR: %s", err.Error()))
+		return
+	}
+
+	c.searchUpdatePage(v.Pid, v.Text)
+
+	c.info("[%s] restored text version %d (source: [%s]  created: [%s])", v.Pid, v.ID, v.Source, v.Created)
+
+	c.audit(auditEntry{Action: auditPageRestored, Page: v.Pid, ReqID: v.ReqID, Details: fmt.Sprintf("version %d (source: %s)", v.ID, v.Source)})
+
+	c.respondString(http.StatusOK, "OK")
+}
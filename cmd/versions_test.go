@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestVersionRestoreCorrection(t *testing.T) {
+	c := useJobStore(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	savedClient := client
+	t.Cleanup(func() { client = savedClient })
+
+	client = ts.Client()
+	config.tsAPIHost.value = ts.URL
+	config.tsReadOnly.value = false
+
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.POST("/pages/:pid/versions/:id/restore", pageVersionRestoreHandler)
+
+	restore := func(id int64) {
+		t.Helper()
+
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest("POST", fmt.Sprintf("/pages/uva:2/versions/%d/restore", id), nil))
+
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected %d restoring version %d, got %d: %s", http.StatusOK, id, res.Code, res.Body.String())
+		}
+	}
+
+	ocr, _ := c.versionAdd(textVersion{Pid: "uva:2", Source: versionSourceLambda, Text: "ocr text"})
+	first, _ := c.versionAdd(textVersion{Pid: "uva:2", Source: versionSourceManual, Text: "first correction"})
+	second, _ := c.versionAdd(textVersion{Pid: "uva:2", Source: versionSourceManual, Text: "second correction"})
+
+	c.correctionSave("uva:2", second)
+
+	// restoring an earlier correction makes it the page's correction
+	restore(first)
+
+	if v, err := c.correctionGet("uva:2"); err != nil || v == nil || v.ID != first {
+		t.Errorf("expected version %d to be the correction, got %+v (%v)", first, v, err)
+	}
+
+	// restoring ocr text removes the correction, so later runs ocr the page again
+	restore(ocr)
+
+	if v, err := c.correctionGet("uva:2"); err != nil || v != nil {
+		t.Errorf("expected no correction, got %+v (%v)", v, err)
+	}
+}